@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"golang.org/x/net/context"
+)
+
+// Total preview bytes kept in memory
+const attachmentPreviewCacheMaxBytes = 10 * 1024 * 1024
+
+// A single preview bigger than this is not worth caching
+const attachmentPreviewCacheMaxAssetBytes = 2 * 1024 * 1024
+
+// How many attachment messages we remember preview asset metadata for
+const attachmentAssetNoteLimit = 4096
+
+type previewCacheEntry struct {
+	key   string
+	asset chat1.Asset
+	data  []byte
+}
+
+// attachmentPreviewCache keeps recently used attachment previews in memory so
+// opening a conversation does not refetch them from S3 every time. Asset
+// metadata is noted as attachment messages flow through Push/Pull, which lets
+// callers look up by conversation and message ID alone; the bytes are added
+// when a preview download completes. Entries are evicted least recently used
+// first once the cache exceeds its size cap.
+type attachmentPreviewCache struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+
+	lru    *list.List
+	tab    map[string]*list.Element
+	assets map[string]chat1.Asset
+	size   int64
+}
+
+func newAttachmentPreviewCache(g *libkb.GlobalContext) *attachmentPreviewCache {
+	return &attachmentPreviewCache{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "AttachmentPreviewCache", false),
+		lru:          list.New(),
+		tab:          make(map[string]*list.Element),
+		assets:       make(map[string]chat1.Asset),
+	}
+}
+
+func (c *attachmentPreviewCache) msgKey(convID chat1.ConversationID, msgID chat1.MessageID) string {
+	return fmt.Sprintf("%s:%d", convID, msgID)
+}
+
+func (c *attachmentPreviewCache) dataKey(convID chat1.ConversationID, msgID chat1.MessageID,
+	asset chat1.Asset) string {
+	return fmt.Sprintf("%s:%d:%x", convID, msgID, asset.EncHash)
+}
+
+func previewAsset(msg chat1.MessageUnboxed) (res chat1.Asset, ok bool) {
+	if !msg.IsValid() {
+		return res, false
+	}
+	body := msg.Valid().MessageBody
+	switch msg.GetMessageType() {
+	case chat1.MessageType_ATTACHMENT:
+		att := body.Attachment()
+		if att.Preview != nil {
+			return *att.Preview, true
+		}
+		if len(att.Previews) > 0 {
+			return att.Previews[0], true
+		}
+	case chat1.MessageType_ATTACHMENTUPLOADED:
+		uploaded := body.Attachmentuploaded()
+		if len(uploaded.Previews) > 0 {
+			return uploaded.Previews[0], true
+		}
+	}
+	return res, false
+}
+
+// note records the preview asset of an attachment message so later lookups
+// can go by message ID alone.
+func (c *attachmentPreviewCache) note(ctx context.Context, convID chat1.ConversationID,
+	msg chat1.MessageUnboxed) {
+	asset, ok := previewAsset(msg)
+	if !ok {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.assets) >= attachmentAssetNoteLimit {
+		// Coarse reset; the map refills as messages flow through
+		c.assets = make(map[string]chat1.Asset)
+	}
+	c.assets[c.msgKey(convID, msg.GetMessageID())] = asset
+}
+
+func (c *attachmentPreviewCache) noteAll(ctx context.Context, convID chat1.ConversationID,
+	msgs []chat1.MessageUnboxed) {
+	for _, msg := range msgs {
+		c.note(ctx, convID, msg)
+	}
+}
+
+// get returns cached preview bytes for an attachment message, if any.
+func (c *attachmentPreviewCache) get(ctx context.Context, convID chat1.ConversationID,
+	msgID chat1.MessageID) ([]byte, chat1.Asset, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	asset, ok := c.assets[c.msgKey(convID, msgID)]
+	if !ok {
+		return nil, chat1.Asset{}, false
+	}
+	el, ok := c.tab[c.dataKey(convID, msgID, asset)]
+	if !ok {
+		return nil, chat1.Asset{}, false
+	}
+	c.lru.MoveToFront(el)
+	ent := el.Value.(previewCacheEntry)
+	return ent.data, ent.asset, true
+}
+
+// put adds downloaded preview bytes, evicting least recently used entries to
+// stay under the size cap.
+func (c *attachmentPreviewCache) put(ctx context.Context, convID chat1.ConversationID,
+	msgID chat1.MessageID, asset chat1.Asset, data []byte) {
+	if len(data) == 0 || len(data) > attachmentPreviewCacheMaxAssetBytes {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	c.assets[c.msgKey(convID, msgID)] = asset
+	key := c.dataKey(convID, msgID, asset)
+	if el, ok := c.tab[key]; ok {
+		c.size -= int64(len(el.Value.(previewCacheEntry).data))
+		c.lru.Remove(el)
+	}
+	c.tab[key] = c.lru.PushFront(previewCacheEntry{key: key, asset: asset, data: data})
+	c.size += int64(len(data))
+	for c.size > attachmentPreviewCacheMaxBytes {
+		back := c.lru.Back()
+		if back == nil {
+			break
+		}
+		ent := back.Value.(previewCacheEntry)
+		c.Debug(ctx, "put: evicting: %s (%d bytes)", ent.key, len(ent.data))
+		c.size -= int64(len(ent.data))
+		c.lru.Remove(back)
+		delete(c.tab, ent.key)
+	}
+}
@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// How many missing messages we fetch per remote call
+const backfillChunkSize = 50
+
+// Pause between chunks so a big hole doesn't hog the connection
+const backfillChunkDelay = time.Second
+
+// Backfiller repairs holes in cached conversation history in the background.
+// Push records a hole whenever a message lands that is not continuous with
+// local storage; the backfiller drains the hole map by fetching the missing
+// ranges through GetMessages, which merges them back into storage. Once a
+// conversation is repaired we tell the UI its thread is stale so it can
+// re-render from the now contiguous cache.
+type Backfiller struct {
+	libkb.Contextified
+	utils.DebugLabeler
+	sync.Mutex
+
+	source *HybridConversationSource
+
+	// Conversations with a repair in flight, to keep runs single-flight
+	active map[string]bool
+}
+
+func newBackfiller(g *libkb.GlobalContext, source *HybridConversationSource) *Backfiller {
+	return &Backfiller{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Backfiller", false),
+		source:       source,
+		active:       make(map[string]bool),
+	}
+}
+
+// Queue kicks off a background repair of the given conversation, unless one
+// is already in flight.
+func (b *Backfiller) Queue(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID) {
+	b.Lock()
+	defer b.Unlock()
+	if b.active[convID.String()] {
+		return
+	}
+	b.active[convID.String()] = true
+	b.Debug(ctx, "Queue: convID: %s uid: %s", convID, uid)
+	go b.run(convID, uid)
+}
+
+// Deepen pages a conversation's history into local storage until depth
+// messages are cached or the conversation runs out, unless a deepening is
+// already in flight. Used to make pinned conversations usable offline.
+func (b *Backfiller) Deepen(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	depth int) {
+	b.Lock()
+	defer b.Unlock()
+	key := "deep:" + convID.String()
+	if b.active[key] {
+		return
+	}
+	b.active[key] = true
+	b.Debug(ctx, "Deepen: convID: %s uid: %s depth: %d", convID, uid, depth)
+	go b.runDeepen(convID, uid, depth)
+}
+
+func (b *Backfiller) finish(key string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.active, key)
+}
+
+func (b *Backfiller) runDeepen(convID chat1.ConversationID, uid gregor1.UID, depth int) {
+	defer b.finish("deep:" + convID.String())
+
+	// Run as a prefetch so a concurrent prefetcher run isn't canceled by our
+	// own Pulls
+	ctx := prefetchCtx(context.Background())
+	fetched := 0
+	pagination := &chat1.Pagination{Num: backfillChunkSize}
+	for fetched < depth {
+		thread, _, err := b.source.Pull(ctx, convID, uid, nil, pagination)
+		if err != nil {
+			b.Debug(ctx, "runDeepen: pull failed: convID: %s err: %s", convID, err.Error())
+			return
+		}
+		fetched += len(thread.Messages)
+		if thread.Pagination == nil || thread.Pagination.Last || len(thread.Messages) == 0 {
+			break
+		}
+		pagination = &chat1.Pagination{Num: backfillChunkSize, Next: thread.Pagination.Next}
+		time.Sleep(backfillChunkDelay)
+	}
+	b.Debug(ctx, "runDeepen: convID: %s paged %d messages", convID, fetched)
+}
+
+func (b *Backfiller) run(convID chat1.ConversationID, uid gregor1.UID) {
+	defer b.finish(convID.String())
+
+	ctx := context.Background()
+	holes := b.source.storage.Holes(ctx, convID, uid)
+	if len(holes) == 0 {
+		return
+	}
+	b.Debug(ctx, "run: convID: %s holes: %d", convID, len(holes))
+
+	filled := false
+	for _, hole := range holes {
+		for start := hole.Start; start <= hole.End; start += backfillChunkSize {
+			end := start + backfillChunkSize - 1
+			if end > hole.End {
+				end = hole.End
+			}
+			var msgIDs []chat1.MessageID
+			for id := start; id <= end; id++ {
+				msgIDs = append(msgIDs, id)
+			}
+			if _, err := b.source.GetMessages(ctx, convID, uid, msgIDs, nil); err != nil {
+				b.Debug(ctx, "run: fetch failed: convID: %s range: %d-%d err: %s", convID, start,
+					end, err.Error())
+				return
+			}
+			filled = true
+			if end < hole.End {
+				time.Sleep(backfillChunkDelay)
+			}
+		}
+	}
+
+	if filled {
+		b.Debug(ctx, "run: convID: %s repaired, notifying", convID)
+		b.G().NotifyRouter.HandleChatThreadsStale(ctx, keybase1.UID(uid.String()),
+			[]chat1.ConversationID{convID})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
@@ -37,9 +38,11 @@ func init() {
 type Boxer struct {
 	utils.DebugLabeler
 
-	tlf    keybase1.TlfInterface
-	hashV1 func(data []byte) chat1.Hash
-	sign   func(msg []byte, kp libkb.NaclSigningKeyPair, prefix libkb.SignaturePrefix) (chat1.SignatureInfo, error) // replaceable for testing
+	tlf        keybase1.TlfInterface
+	hashV1     func(data []byte) chat1.Hash
+	sign       func(msg []byte, kp libkb.NaclSigningKeyPair, prefix libkb.SignaturePrefix) (chat1.SignatureInfo, error) // replaceable for testing
+	senderKeys *senderKeyCache
+	tlfKeys    *cryptKeyCache
 	libkb.Contextified
 }
 
@@ -49,10 +52,43 @@ func NewBoxer(g *libkb.GlobalContext, tlf keybase1.TlfInterface) *Boxer {
 		tlf:          tlf,
 		hashV1:       hashSha256V1,
 		sign:         sign,
+		senderKeys:   newSenderKeyCache(),
+		tlfKeys:      newCryptKeyCache(),
 		Contextified: libkb.NewContextified(g),
 	}
 }
 
+// HandleUserChanged drops cached sender key validity for a user when their
+// sigchain changes, so new revocations are honored on the next check.
+func (b *Boxer) HandleUserChanged(uid keybase1.UID) error {
+	b.senderKeys.invalidate(uid)
+	return nil
+}
+
+// InvalidateTLFKeys drops the cached crypt keys for a TLF, called when a
+// finalize or resolve update changes who holds its keys.
+func (b *Boxer) InvalidateTLFKeys(tlfName string) {
+	b.tlfKeys.invalidate(tlfName)
+}
+
+// findCryptKeys looks up crypt keys for a TLF, preferring the boxer's
+// long-lived cache over the per-request KeyFinder so repeated pulls across
+// conversations of the same TLF don't re-derive the same keys. Only the
+// unbox path may use this: a cache hit skips the KeyFinder entirely, and
+// with it the identify that sends rely on to surface track breaks.
+func (b *Boxer) findCryptKeys(ctx context.Context, tlfName string,
+	tlfPublic bool) (keybase1.GetTLFCryptKeysRes, error) {
+	if keys, ok := b.tlfKeys.get(tlfName, tlfPublic); ok {
+		return keys, nil
+	}
+	keys, err := CtxKeyFinder(ctx).Find(ctx, b.tlf, tlfName, tlfPublic)
+	if err != nil {
+		return keybase1.GetTLFCryptKeysRes{}, err
+	}
+	b.tlfKeys.put(tlfName, tlfPublic, keys)
+	return keys, nil
+}
+
 func (b *Boxer) log() logger.Logger {
 	return b.G().GetLog()
 }
@@ -76,7 +112,7 @@ func (b *Boxer) makeErrorMessage(msg chat1.MessageBoxed, err UnboxingError) chat
 func (b *Boxer) UnboxMessage(ctx context.Context, boxed chat1.MessageBoxed, finalizeInfo *chat1.ConversationFinalizeInfo) (chat1.MessageUnboxed, UnboxingError) {
 	tlfName := boxed.ClientHeader.TLFNameExpanded(finalizeInfo)
 	tlfPublic := boxed.ClientHeader.TlfPublic
-	keys, err := CtxKeyFinder(ctx).Find(ctx, b.tlf, tlfName, tlfPublic)
+	keys, err := b.findCryptKeys(ctx, tlfName, tlfPublic)
 	if err != nil {
 		// transient error. Rekey errors come through here
 		return chat1.MessageUnboxed{}, NewTransientUnboxingError(err)
@@ -350,16 +386,56 @@ func (b *Boxer) getSenderInfoLocal(ctx context.Context, clientHeader chat1.Messa
 	return b.getUsernameAndDevice(ctx, uid, did)
 }
 
+// UnboxMessages unboxes a batch of messages on a bounded pool of workers,
+// preserving input order in the result. Worker count comes from
+// Env.GetChatUnboxWorkers.
 func (b *Boxer) UnboxMessages(ctx context.Context, boxed []chat1.MessageBoxed, finalizeInfo *chat1.ConversationFinalizeInfo) (unboxed []chat1.MessageUnboxed, err error) {
-	for _, msg := range boxed {
-		decmsg, err := b.UnboxMessage(ctx, msg, finalizeInfo)
-		if err != nil {
-			return unboxed, err
+	if len(boxed) == 0 {
+		return nil, nil
+	}
+
+	workers := b.G().Env.GetChatUnboxWorkers()
+	if workers > len(boxed) {
+		workers = len(boxed)
+	}
+	if workers <= 1 {
+		for _, msg := range boxed {
+			decmsg, err := b.UnboxMessage(ctx, msg, finalizeInfo)
+			if err != nil {
+				return unboxed, err
+			}
+			unboxed = append(unboxed, decmsg)
 		}
-		unboxed = append(unboxed, decmsg)
+		return unboxed, nil
+	}
+
+	// Workers pull indices off a channel and write results into place, so
+	// the output lines up with the input no matter who finishes first
+	res := make([]chat1.MessageUnboxed, len(boxed))
+	errs := make([]UnboxingError, len(boxed))
+	indexCh := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexCh {
+				res[index], errs[index] = b.UnboxMessage(ctx, boxed[index], finalizeInfo)
+			}
+		}()
+	}
+	for index := range boxed {
+		indexCh <- index
 	}
+	close(indexCh)
+	wg.Wait()
 
-	return unboxed, nil
+	for _, ierr := range errs {
+		if ierr != nil {
+			return nil, ierr
+		}
+	}
+	return res, nil
 }
 
 // Can return (nil, nil) if there is no saved merkle root.
@@ -388,6 +464,9 @@ func (b *Boxer) BoxMessage(ctx context.Context, msg chat1.MessagePlaintext, sign
 		return nil, NewBoxingError("blank TLF name given", true)
 	}
 
+	// Always hit the KeyFinder here rather than the long-lived key cache:
+	// sends must run identify every time so track breaks surface to the
+	// sender.
 	cres, err := CtxKeyFinder(ctx).Find(ctx, b.tlf, tlfName, msg.ClientHeader.TlfPublic)
 	if err != nil {
 		return nil, NewBoxingCryptKeysError(err)
@@ -632,9 +711,20 @@ func (b *Boxer) ValidSenderKey(ctx context.Context, sender gregor1.UID, key []by
 		return false, false, nil, NewTransientUnboxingError(fmt.Errorf("no CachedUserLoader available in context"))
 	}
 
-	found, revokedAt, deleted, err := cachedUserLoader.CheckKIDForUID(ctx, kbSender, kid)
-	if err != nil {
-		return false, false, nil, NewTransientUnboxingError(err)
+	var revokedAt *keybase1.KeybaseTime
+	var deleted bool
+	if cres, ok := b.senderKeys.get(kbSender, kid); ok {
+		found, revokedAt, deleted = cres.found, cres.revokedAt, cres.deleted
+	} else {
+		found, revokedAt, deleted, err = cachedUserLoader.CheckKIDForUID(ctx, kbSender, kid)
+		if err != nil {
+			return false, false, nil, NewTransientUnboxingError(err)
+		}
+		b.senderKeys.put(kbSender, kid, senderKeyRes{
+			found:     found,
+			revokedAt: revokedAt,
+			deleted:   deleted,
+		})
 	}
 	if !found {
 		return false, false, nil, nil
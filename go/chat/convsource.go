@@ -3,6 +3,9 @@ package chat
 import (
 	"errors"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/keybase/client/go/chat/storage"
 	"github.com/keybase/client/go/chat/utils"
@@ -17,6 +20,12 @@ type baseConversationSource struct {
 	utils.DebugLabeler
 
 	getSecretUI func() libkb.SecretUI
+	previews    *attachmentPreviewCache
+	pins        *storage.Pins
+	convPins    *storage.ConvPins
+	readMarks   *storage.ReadMarks
+	receipts    *storage.Receipts
+	processors  []threadProcessor
 }
 
 func newBaseConversationSource(g *libkb.GlobalContext, getSecretUI func() libkb.SecretUI) *baseConversationSource {
@@ -24,33 +33,93 @@ func newBaseConversationSource(g *libkb.GlobalContext, getSecretUI func() libkb.
 		Contextified: libkb.NewContextified(g),
 		DebugLabeler: utils.NewDebugLabeler(g, "baseConversationSource", false),
 		getSecretUI:  getSecretUI,
+		previews:     newAttachmentPreviewCache(g),
+		pins:         storage.NewPins(g),
+		convPins:     storage.NewConvPins(g),
+		readMarks:    storage.NewReadMarks(g),
+		receipts:     storage.NewReceipts(g),
+		processors:   newThreadProcessors(g),
 	}
 }
 
+// Pin adds a message to the pinned set for a conversation.
+func (s *baseConversationSource) Pin(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgID chat1.MessageID) error {
+	return s.pins.Pin(ctx, convID, uid, msgID)
+}
+
+// Unpin removes a message from the pinned set for a conversation.
+func (s *baseConversationSource) Unpin(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgID chat1.MessageID) error {
+	return s.pins.Unpin(ctx, convID, uid, msgID)
+}
+
+// SetConvPinned marks or unmarks a conversation as kept offline.
+func (s *baseConversationSource) SetConvPinned(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, pinned bool) error {
+	return s.convPins.Set(ctx, uid, convID, pinned)
+}
+
+// ListPinnedConvs returns the conversations the user has pinned for offline
+// use.
+func (s *baseConversationSource) ListPinnedConvs(ctx context.Context,
+	uid gregor1.UID) []chat1.ConversationID {
+	return s.convPins.List(ctx, uid)
+}
+
+// AttachmentPreviewCached returns preview bytes for an attachment message if
+// the preview cache has them.
+func (s *baseConversationSource) AttachmentPreviewCached(ctx context.Context,
+	convID chat1.ConversationID, msgID chat1.MessageID) ([]byte, chat1.Asset, bool) {
+	return s.previews.get(ctx, convID, msgID)
+}
+
+// CacheAttachmentPreview stores downloaded preview bytes for later lookups.
+func (s *baseConversationSource) CacheAttachmentPreview(ctx context.Context,
+	convID chat1.ConversationID, msgID chat1.MessageID, asset chat1.Asset, data []byte) {
+	s.previews.put(ctx, convID, msgID, asset, data)
+}
+
 func (s *baseConversationSource) postProcessThread(ctx context.Context, uid gregor1.UID,
 	convID chat1.ConversationID, thread *chat1.ThreadView, q *chat1.GetThreadQuery,
 	finalizeInfo *chat1.ConversationFinalizeInfo) (err error) {
 
-	// Sanity check the prev pointers in this thread.
-	// TODO: We'll do this against what's in the cache once that's ready,
-	//       rather than only checking the messages we just fetched against
-	//       each other.
+	// Sanity check the prev pointers in this thread. This checks the fetched
+	// page against itself; the hybrid source additionally verifies pointers
+	// against cached history.
 	_, err = CheckPrevPointersAndGetUnpreved(thread)
 	if err != nil {
 		return err
 	}
 
-	// Resolve supersedes
+	// Collapse message relationships (supersedes, reactions, ...) with the
+	// registered thread processors
 	if q == nil || !q.DisableResolveSupersedes {
-		transform := newSupersedesTransform(s.G())
-		if thread.Messages, err = transform.run(ctx, convID, uid, thread.Messages, finalizeInfo); err != nil {
-			return err
+		for _, proc := range s.processors {
+			if thread.Messages, err = proc.run(ctx, convID, uid, thread.Messages, finalizeInfo); err != nil {
+				s.Debug(ctx, "postProcessThread: processor %s failed: %s", proc.name(), err.Error())
+				return err
+			}
 		}
 	}
 
 	// Run type filter if it exists
 	thread.Messages = utils.FilterByType(thread.Messages, q)
 
+	// Hide ephemeral messages that have expired; the purger tombstones them
+	// in storage in the background
+	thread.Messages = utils.FilterExpired(thread.Messages)
+
+	// Note attachment previews so the frontend can find them in the cache
+	s.previews.noteAll(ctx, convID, thread.Messages)
+
+	// Attach pin state so the frontend knows what is pinned without another
+	// call
+	thread.PinnedMessages = s.pins.List(ctx, convID, uid)
+
+	// Stamp delivery state onto the user's own messages for receipt display
+	s.decorateReceipts(ctx, convID, uid, thread)
+
 	// Fetch outbox and tack onto the result
 	outbox := storage.NewOutbox(s.G(), uid, s.getSecretUI)
 	if err = outbox.SprinkleIntoThread(ctx, convID, thread); err != nil {
@@ -62,6 +131,25 @@ func (s *baseConversationSource) postProcessThread(ctx context.Context, uid greg
 	return nil
 }
 
+// decorateReceipts stamps delivery state onto messages the user sent: a valid
+// message from the server has by definition been delivered, and the receipts
+// store says how far the conversation is known to have been read.
+func (s *baseConversationSource) decorateReceipts(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, thread *chat1.ThreadView) {
+	readMsgID := s.receipts.ReadMsgID(ctx, convID, uid)
+	for index, msg := range thread.Messages {
+		if !msg.IsValid() || !msg.Valid().ClientHeader.Sender.Eq(uid) {
+			continue
+		}
+		mvalid := msg.Valid()
+		mvalid.DeliveryStatus = chat1.MessageDeliveryStatus_DELIVERED
+		if msg.GetMessageID() <= readMsgID {
+			mvalid.DeliveryStatus = chat1.MessageDeliveryStatus_READ
+		}
+		thread.Messages[index] = chat1.NewMessageUnboxedWithValid(mvalid)
+	}
+}
+
 func (s *baseConversationSource) TransformSupersedes(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID, msgs []chat1.MessageUnboxed, finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error) {
 	transform := newSupersedesTransform(s.G())
 	return transform.run(ctx, convID, uid, msgs, finalizeInfo)
@@ -71,8 +159,9 @@ type RemoteConversationSource struct {
 	*baseConversationSource
 
 	libkb.Contextified
-	ri    func() chat1.RemoteInterface
-	boxer *Boxer
+	ri      func() chat1.RemoteInterface
+	boxer   *Boxer
+	threads *recentThreadCache
 }
 
 func NewRemoteConversationSource(g *libkb.GlobalContext, b *Boxer, ri func() chat1.RemoteInterface,
@@ -80,8 +169,9 @@ func NewRemoteConversationSource(g *libkb.GlobalContext, b *Boxer, ri func() cha
 	return &RemoteConversationSource{
 		Contextified:           libkb.NewContextified(g),
 		baseConversationSource: newBaseConversationSource(g, si),
-		ri:    ri,
-		boxer: b,
+		ri:      ri,
+		boxer:   b,
+		threads: newRecentThreadCache(g),
 	}
 }
 
@@ -106,7 +196,7 @@ func (s *RemoteConversationSource) Pull(ctx context.Context, convID chat1.Conver
 	conv, ratelim, err := utils.GetRemoteConv(ctx, s.G(), uid, convID)
 	rl = append(rl, ratelim)
 	if err != nil {
-		return chat1.ThreadView{}, rl, err
+		return chat1.ThreadView{}, rl, classifyConvSourceError(err)
 	}
 
 	rarg := chat1.GetThreadRemoteArg{
@@ -117,7 +207,7 @@ func (s *RemoteConversationSource) Pull(ctx context.Context, convID chat1.Conver
 	boxed, err := s.ri().GetThreadRemote(ctx, rarg)
 	rl = append(rl, boxed.RateLimit)
 	if err != nil {
-		return chat1.ThreadView{}, rl, err
+		return chat1.ThreadView{}, rl, classifyConvSourceError(err)
 	}
 
 	thread, err := s.boxer.UnboxThread(ctx, boxed.Thread, convID, conv.Metadata.FinalizeInfo)
@@ -130,15 +220,57 @@ func (s *RemoteConversationSource) Pull(ctx context.Context, convID chat1.Conver
 		return chat1.ThreadView{}, nil, err
 	}
 
+	// Remember first pages so PullLocalOnly has something to serve offline,
+	// unless this is an incognito pull
+	if (query == nil || !query.NoCache) &&
+		(pagination == nil || (len(pagination.Next) == 0 && len(pagination.Previous) == 0)) {
+		s.threads.put(ctx, uid, convID, thread)
+	}
+
 	return thread, rl, nil
 }
 
+// PullStream on this source just runs a normal Pull, there is no cache to
+// stream ahead of the network.
+func (s *RemoteConversationSource) PullStream(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, query *chat1.GetThreadQuery, pagination *chat1.Pagination,
+	deliver func(thread chat1.ThreadView, final bool)) ([]*chat1.RateLimit, error) {
+
+	thread, rl, err := s.Pull(ctx, convID, uid, query, pagination)
+	if err != nil {
+		return rl, err
+	}
+	deliver(thread, true)
+	return rl, nil
+}
+
+// PullLocalOnly serves the last pulled first page of a conversation from the
+// in-memory recent thread cache; anything beyond that is a miss, since this
+// source keeps no persistent storage.
 func (s *RemoteConversationSource) PullLocalOnly(ctx context.Context, convID chat1.ConversationID,
 	uid gregor1.UID, query *chat1.GetThreadQuery, pagination *chat1.Pagination) (chat1.ThreadView, error) {
-	return chat1.ThreadView{}, storage.MissError{Msg: "PullLocalOnly is unimplemented for RemoteConversationSource"}
+
+	if convID.IsNil() {
+		return chat1.ThreadView{}, errors.New("RemoteConversationSource.PullLocalOnly called with empty convID")
+	}
+	if pagination != nil && (len(pagination.Next) > 0 || len(pagination.Previous) > 0) {
+		return chat1.ThreadView{}, storage.MissError{Msg: "thread cache only holds first pages"}
+	}
+	thread, ok := s.threads.get(ctx, uid, convID)
+	if !ok {
+		return chat1.ThreadView{}, storage.MissError{Msg: "no recently pulled thread for conversation"}
+	}
+	s.Debug(ctx, "PullLocalOnly: thread cache hit: convID: %s uid: %s", convID, uid)
+
+	// The cached page was post processed at Pull time; just re-apply the
+	// caller's filters
+	thread.Messages = utils.FilterByType(thread.Messages, query)
+	thread.Messages = utils.FilterExpired(thread.Messages)
+	return thread, nil
 }
 
 func (s *RemoteConversationSource) Clear(convID chat1.ConversationID, uid gregor1.UID) error {
+	s.threads.clearConv(uid, convID)
 	return nil
 }
 
@@ -149,6 +281,9 @@ func (s *RemoteConversationSource) GetMessages(ctx context.Context, convID chat1
 		ConversationID: convID,
 		MessageIDs:     msgIDs,
 	})
+	if err != nil {
+		return nil, classifyConvSourceError(err)
+	}
 
 	msgs, err := s.boxer.UnboxMessages(ctx, rres.Msgs, finalizeInfo)
 	if err != nil {
@@ -164,19 +299,83 @@ func (s *RemoteConversationSource) GetMessagesWithRemotes(ctx context.Context,
 	return s.boxer.UnboxMessages(ctx, msgs, finalizeInfo)
 }
 
+// ListPinned returns the pinned messages for a conversation, resolving the
+// stored IDs through GetMessages.
+func (s *RemoteConversationSource) ListPinned(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) ([]chat1.MessageUnboxed, error) {
+	ids := s.pins.List(ctx, convID, uid)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return s.GetMessages(ctx, convID, uid, ids, nil)
+}
+
+// PreloadConversations warms the recent thread cache with the first pages of
+// the given conversations, so PullLocalOnly can serve them afterwards.
+func (s *RemoteConversationSource) PreloadConversations(ctx context.Context, uid gregor1.UID,
+	convIDs []chat1.ConversationID, depth int) (rl []*chat1.RateLimit, err error) {
+	if depth <= 0 {
+		depth = preloadDefaultDepth
+	}
+	for _, convID := range convIDs {
+		if err := ctx.Err(); err != nil {
+			return rl, err
+		}
+		_, rls, perr := s.Pull(ctx, convID, uid, nil, &chat1.Pagination{Num: depth})
+		if perr != nil {
+			s.Debug(ctx, "PreloadConversations: pull failed: convID: %s err: %s", convID,
+				perr.Error())
+			continue
+		}
+		rl = append(rl, rls...)
+	}
+	return rl, nil
+}
+
+func (s *RemoteConversationSource) Search(ctx context.Context, uid gregor1.UID, query string,
+	opts chat1.SearchLocalOptions) ([]chat1.SearchLocalHit, error) {
+	// Search runs over local storage, which this source doesn't keep
+	return nil, errors.New("search requires local conversation storage")
+}
+
+func (s *RemoteConversationSource) ClearCache(ctx context.Context, uid gregor1.UID,
+	opts chat1.ClearCacheLocalOpts) (chat1.ClearCacheLocalRes, error) {
+	// Only the in-memory recent threads are cached by this source
+	if opts.ConvID != nil {
+		s.threads.clearConv(uid, *opts.ConvID)
+	} else {
+		s.threads.clearAll()
+	}
+	return chat1.ClearCacheLocalRes{}, nil
+}
+
+func (s *RemoteConversationSource) CacheStats() chat1.CacheStatsLocalRes {
+	// Nothing is cached by this source
+	return chat1.CacheStatsLocalRes{}
+}
+
+func (s *RemoteConversationSource) InvalidateTLFCryptKeys(tlfName string) {
+	s.boxer.InvalidateTLFKeys(tlfName)
+}
+
 type HybridConversationSource struct {
 	libkb.Contextified
 	utils.DebugLabeler
 	*baseConversationSource
 
-	ri      func() chat1.RemoteInterface
-	boxer   *Boxer
-	storage *storage.Storage
+	ri         func() chat1.RemoteInterface
+	boxer      *Boxer
+	storage    *storage.Storage
+	prefetcher *Prefetcher
+	backfiller *Backfiller
+	purger     *Purger
+	stats      *sourceStats
+	marker     *readMarker
 }
 
 func NewHybridConversationSource(g *libkb.GlobalContext, b *Boxer, storage *storage.Storage,
 	ri func() chat1.RemoteInterface, si func() libkb.SecretUI) *HybridConversationSource {
-	return &HybridConversationSource{
+	s := &HybridConversationSource{
 		Contextified:           libkb.NewContextified(g),
 		DebugLabeler:           utils.NewDebugLabeler(g, "HybridConversationSource", false),
 		baseConversationSource: newBaseConversationSource(g, si),
@@ -184,6 +383,35 @@ func NewHybridConversationSource(g *libkb.GlobalContext, b *Boxer, storage *stor
 		boxer:   b,
 		storage: storage,
 	}
+	s.prefetcher = newPrefetcher(g, s, si)
+	s.backfiller = newBackfiller(g, s)
+	s.purger = newPurger(g, s, si)
+	s.stats = newSourceStats()
+	s.marker = newReadMarker(g, ri, s.readMarks)
+	return s
+}
+
+// mergeMessages writes messages into local storage, tracking merge counters
+// on success.
+func (s *HybridConversationSource) mergeMessages(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgs []chat1.MessageUnboxed) storage.Error {
+	if err := s.storage.Merge(ctx, convID, uid, msgs); err != nil {
+		return err
+	}
+	s.stats.recordMerge(len(msgs))
+	return nil
+}
+
+// CacheStats reports cache hit/miss and merge counters since the service
+// started.
+func (s *HybridConversationSource) CacheStats() chat1.CacheStatsLocalRes {
+	res := s.stats.export()
+	res.MergeConflicts = s.storage.MergeConflicts()
+	return res
+}
+
+func (s *HybridConversationSource) InvalidateTLFCryptKeys(tlfName string) {
+	s.boxer.InvalidateTLFKeys(tlfName)
 }
 
 func (s *HybridConversationSource) Push(ctx context.Context, convID chat1.ConversationID,
@@ -223,13 +451,128 @@ func (s *HybridConversationSource) Push(ctx context.Context, convID chat1.Conver
 		})
 	}
 
-	if err = s.storage.Merge(ctx, convID, uid, []chat1.MessageUnboxed{decmsg}); err != nil {
+	if err = s.mergeMessages(ctx, convID, uid, []chat1.MessageUnboxed{decmsg}); err != nil {
 		return decmsg, continuousUpdate, err
 	}
 
+	s.previews.note(ctx, convID, decmsg)
+
+	if !continuousUpdate {
+		// Record the gap we just created and get it repaired in the background,
+		// so local reads become contiguous without a full thread fetch
+		if herr := s.storage.AddHole(ctx, convID, uid, maxMsgID+1, msg.GetMessageID()-1); herr != nil {
+			s.Debug(ctx, "Push: failed to record hole: %s", herr.Error())
+		}
+		s.backfiller.Queue(ctx, convID, uid)
+	}
+
 	return decmsg, continuousUpdate, nil
 }
 
+// postProcessThread runs the shared thread post processing, then checks the
+// page's prev pointers against messages already in local storage.
+func (s *HybridConversationSource) postProcessThread(ctx context.Context, uid gregor1.UID,
+	convID chat1.ConversationID, thread *chat1.ThreadView, q *chat1.GetThreadQuery,
+	finalizeInfo *chat1.ConversationFinalizeInfo) error {
+	if err := s.baseConversationSource.postProcessThread(ctx, uid, convID, thread, q,
+		finalizeInfo); err != nil {
+		return err
+	}
+	return s.checkPrevsAgainstCache(ctx, convID, uid, thread)
+}
+
+// checkPrevsAgainstCache verifies prev pointers that refer to messages
+// outside the fetched page against copies already held in local storage. A
+// hash mismatch means the server handed us a different header for a message
+// than the one we saw before, so it is surfaced as a consistency error
+// rather than papered over.
+func (s *HybridConversationSource) checkPrevsAgainstCache(ctx context.Context,
+	convID chat1.ConversationID, uid gregor1.UID, thread *chat1.ThreadView) error {
+
+	inPage := make(map[chat1.MessageID]bool)
+	for _, msg := range thread.Messages {
+		if msg.IsValid() {
+			inPage[msg.GetMessageID()] = true
+		}
+	}
+	prevs := make(map[chat1.MessageID]chat1.Hash)
+	var external []chat1.MessageID
+	for _, msg := range thread.Messages {
+		if !msg.IsValid() {
+			continue
+		}
+		for _, prev := range msg.Valid().ClientHeader.Prev {
+			if inPage[prev.Id] || prevs[prev.Id] != nil {
+				continue
+			}
+			prevs[prev.Id] = prev.Hash
+			external = append(external, prev.Id)
+		}
+	}
+	if len(external) == 0 {
+		return nil
+	}
+
+	cached, err := s.storage.FetchMessages(ctx, convID, uid, external)
+	if err != nil {
+		// Verification is best effort over what the cache holds; a read
+		// error here is not evidence of tampering
+		s.Debug(ctx, "checkPrevsAgainstCache: failed to read cache: %s", err.Error())
+		return nil
+	}
+	for index, msg := range cached {
+		if msg == nil || !msg.IsValid() {
+			continue
+		}
+		id := external[index]
+		if !msg.Valid().HeaderHash.Eq(prevs[id]) {
+			s.Debug(ctx, "checkPrevsAgainstCache: hash mismatch against cache: convID: %s id: %d",
+				convID, id)
+			return NewChatThreadConsistencyError(IncorrectHash,
+				"Thread has hash %s for cached message ID %d, but the cache has %s",
+				prevs[id].String(), id, msg.Valid().HeaderHash.String())
+		}
+	}
+	return nil
+}
+
+// addPlaceholders inserts placeholder entries for message IDs known to be
+// missing from local storage that fall inside the returned page, so callers
+// can render the gaps and request backfill explicitly. Only used on cached
+// results; a remote fetch returns the real messages for any holes it covers.
+func (s *HybridConversationSource) addPlaceholders(ctx context.Context,
+	convID chat1.ConversationID, uid gregor1.UID, thread *chat1.ThreadView) {
+
+	if len(thread.Messages) == 0 {
+		return
+	}
+	holes := s.storage.Holes(ctx, convID, uid)
+	if len(holes) == 0 {
+		return
+	}
+
+	// Messages are sorted by ID descending
+	maxID := thread.Messages[0].GetMessageID()
+	minID := thread.Messages[len(thread.Messages)-1].GetMessageID()
+	added := 0
+	for _, hole := range holes {
+		for id := hole.Start; id <= hole.End; id++ {
+			if id < minID || id > maxID {
+				continue
+			}
+			thread.Messages = append(thread.Messages,
+				chat1.NewMessageUnboxedWithPlaceholder(chat1.MessageUnboxedPlaceholder{
+					MessageID: id,
+				}))
+			added++
+		}
+	}
+	if added > 0 {
+		sort.Sort(ByMsgID(thread.Messages))
+		s.Debug(ctx, "addPlaceholders: convID: %s added %d placeholders", convID, added)
+	}
+}
+
 func (s *HybridConversationSource) identifyTLF(ctx context.Context, convID chat1.ConversationID,
 	uid gregor1.UID, msgs []chat1.MessageUnboxed, finalizeInfo *chat1.ConversationFinalizeInfo) error {
 
@@ -262,16 +605,27 @@ func (s *HybridConversationSource) Pull(ctx context.Context, convID chat1.Conver
 		return chat1.ThreadView{}, rl, errors.New("HybridConversationSource.Pull called with empty convID")
 	}
 
+	// A foreground fetch takes priority over any background warming
+	if !isPrefetchCtx(ctx) {
+		s.prefetcher.Cancel()
+	}
+
 	// Get conversation metadata
 	conv, ratelim, err := utils.GetRemoteConv(ctx, s.G(), uid, convID)
 	rl = append(rl, ratelim)
 
-	// Post process thread before returning
+	// Post process thread before returning. Cached pages additionally get
+	// placeholders for any known holes they span; the transforms above only
+	// ever see real messages.
+	cacheHit := false
 	defer func() {
 		if err == nil {
 			err = s.postProcessThread(ctx, uid, convID, &thread, query,
 				conv.Metadata.FinalizeInfo)
 		}
+		if err == nil && cacheHit {
+			s.addPlaceholders(ctx, convID, uid, &thread)
+		}
 	}()
 
 	if err == nil {
@@ -280,6 +634,8 @@ func (s *HybridConversationSource) Pull(ctx context.Context, convID chat1.Conver
 		if err == nil {
 			// If found, then return the stuff
 			s.Debug(ctx, "Pull: cache hit: convID: %s uid: %s", convID, uid)
+			s.stats.recordHit()
+			cacheHit = true
 
 			// Identify this TLF by running crypt keys
 			if ierr := s.identifyTLF(ctx, convID, uid, thread.Messages, conv.Metadata.FinalizeInfo); ierr != nil {
@@ -294,22 +650,21 @@ func (s *HybridConversationSource) Pull(ctx context.Context, convID chat1.Conver
 			}
 			thread.Messages = updatedMessages
 
-			// Before returning the stuff, send remote request to mark as read if
-			// requested.
+			// Before returning the stuff, mark as read if requested. Only the
+			// local state is touched here; the read receipt RPC is debounced
+			// and retried off this path, and can never fail the read.
 			if query != nil && query.MarkAsRead && len(thread.Messages) > 0 {
 				readMsgID := thread.Messages[0].GetMessageID()
-				res, err := s.ri().MarkAsRead(ctx, chat1.MarkAsReadArg{
-					ConversationID: convID,
-					MsgID:          readMsgID,
-				})
-				if err != nil {
-					return chat1.ThreadView{}, nil, err
+
+				// Record the read position locally first, so unread state
+				// clears immediately whatever the server does
+				if merr := s.readMarks.Mark(ctx, convID, uid, readMsgID, false); merr != nil {
+					s.Debug(ctx, "Pull: failed to record local read mark: %s", merr.Error())
 				}
-				if _, err = s.G().InboxSource.ReadMessage(ctx, uid, 0, convID, readMsgID); err != nil {
-					return chat1.ThreadView{}, nil, err
+				if _, merr := s.G().InboxSource.ReadMessage(ctx, uid, 0, convID, readMsgID); merr != nil {
+					s.Debug(ctx, "Pull: failed to mark inbox read: %s", merr.Error())
 				}
-
-				rl = append(rl, res.RateLimit)
+				s.marker.MarkAsRead(ctx, convID, uid, readMsgID)
 			}
 
 			return thread, rl, nil
@@ -328,23 +683,163 @@ func (s *HybridConversationSource) Pull(ctx context.Context, convID chat1.Conver
 	boxed, err := s.ri().GetThreadRemote(ctx, rarg)
 	rl = append(rl, boxed.RateLimit)
 	if err != nil {
-		return chat1.ThreadView{}, rl, err
+		return chat1.ThreadView{}, rl, classifyConvSourceError(err)
 	}
 
 	// Unbox
+	s.stats.recordMiss()
+	unboxStart := time.Now()
 	thread, err = s.boxer.UnboxThread(ctx, boxed.Thread, convID, conv.Metadata.FinalizeInfo)
 	if err != nil {
 		return chat1.ThreadView{}, rl, err
 	}
+	s.stats.recordUnbox(len(thread.Messages), time.Since(unboxStart))
 
-	// Store locally (just warn on error, don't abort the whole thing)
-	if err = s.storage.Merge(ctx, convID, uid, thread.Messages); err != nil {
-		s.Debug(ctx, "Pull: unable to commit thread locally: convID: %s uid: %s", convID, uid)
+	// Store locally (just warn on error, don't abort the whole thing). An
+	// incognito pull leaves no trace of the conversation on this device.
+	if query == nil || !query.NoCache {
+		if err = s.mergeMessages(ctx, convID, uid, thread.Messages); err != nil {
+			s.Debug(ctx, "Pull: unable to commit thread locally: convID: %s uid: %s", convID, uid)
+		}
+	} else {
+		s.Debug(ctx, "Pull: noCache set, skipping local commit: convID: %s", convID)
 	}
 
 	return thread, rl, nil
 }
 
+// pullStreamPageSize is how many messages each streamed remote page carries
+const pullStreamPageSize = 50
+
+// PullStream fetches a thread like Pull, but hands out batches as they become
+// available: first whatever the cache holds, then the remote thread one page
+// at a time. The last call to deliver carries the complete, post-processed
+// thread and final set to true.
+func (s *HybridConversationSource) PullStream(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, query *chat1.GetThreadQuery, pagination *chat1.Pagination,
+	deliver func(thread chat1.ThreadView, final bool)) (rl []*chat1.RateLimit, err error) {
+
+	if convID.IsNil() {
+		return nil, errors.New("HybridConversationSource.PullStream called with empty convID")
+	}
+	if deliver == nil {
+		return nil, errors.New("HybridConversationSource.PullStream called without a deliver callback")
+	}
+
+	// A foreground fetch takes priority over any background warming
+	if !isPrefetchCtx(ctx) {
+		s.prefetcher.Cancel()
+	}
+
+	// Get conversation metadata
+	conv, ratelim, err := utils.GetRemoteConv(ctx, s.G(), uid, convID)
+	rl = append(rl, ratelim)
+	if err != nil {
+		return rl, err
+	}
+
+	// On a cache hit everything arrives in a single final batch
+	thread, err := s.storage.Fetch(ctx, conv, uid, query, pagination)
+	if err == nil {
+		s.Debug(ctx, "PullStream: cache hit: convID: %s uid: %s", convID, uid)
+		s.stats.recordHit()
+		if err = s.postProcessThread(ctx, uid, convID, &thread, query, conv.Metadata.FinalizeInfo); err != nil {
+			return rl, err
+		}
+		s.addPlaceholders(ctx, convID, uid, &thread)
+		deliver(thread, true)
+		return rl, nil
+	}
+
+	// Show whatever the cache does have while the network catches up
+	partialHit := false
+	if ltv, lerr := s.storage.FetchUpToLocalMaxMsgID(ctx, convID, uid, query, pagination); lerr == nil && len(ltv.Messages) > 0 {
+		if perr := s.postProcessThread(ctx, uid, convID, &ltv, query, conv.Metadata.FinalizeInfo); perr == nil {
+			partialHit = true
+			deliver(ltv, false)
+		}
+	}
+	if partialHit {
+		s.stats.recordPartial()
+	} else {
+		s.stats.recordMiss()
+	}
+
+	// Page through the remote thread, delivering progress after each page
+	num := pullStreamPageSize
+	if pagination != nil && pagination.Num > 0 && pagination.Num < num {
+		num = pagination.Num
+	}
+	var remaining int
+	if pagination != nil {
+		remaining = pagination.Num
+	}
+	pagePag := &chat1.Pagination{Num: num}
+	if pagination != nil {
+		pagePag.Next = pagination.Next
+		pagePag.Previous = pagination.Previous
+	}
+
+	thread = chat1.ThreadView{}
+	for {
+		boxed, err := s.ri().GetThreadRemote(ctx, chat1.GetThreadRemoteArg{
+			ConversationID: convID,
+			Query:          query,
+			Pagination:     pagePag,
+		})
+		rl = append(rl, boxed.RateLimit)
+		if err != nil {
+			return rl, classifyConvSourceError(err)
+		}
+		unboxStart := time.Now()
+		page, err := s.boxer.UnboxThread(ctx, boxed.Thread, convID, conv.Metadata.FinalizeInfo)
+		if err != nil {
+			return rl, err
+		}
+		s.stats.recordUnbox(len(page.Messages), time.Since(unboxStart))
+		thread.Messages = append(thread.Messages, page.Messages...)
+		thread.Pagination = page.Pagination
+
+		last := page.Pagination == nil || page.Pagination.Last || len(page.Messages) == 0
+		if remaining > 0 && len(thread.Messages) >= remaining {
+			last = true
+		}
+		if last {
+			break
+		}
+
+		// Intermediate batch: post-process a copy so the final pass starts
+		// from the raw messages
+		partial := chat1.ThreadView{
+			Messages:   append([]chat1.MessageUnboxed(nil), thread.Messages...),
+			Pagination: page.Pagination,
+		}
+		if perr := s.postProcessThread(ctx, uid, convID, &partial, query, conv.Metadata.FinalizeInfo); perr == nil {
+			deliver(partial, false)
+		}
+		pagePag = &chat1.Pagination{Num: num, Next: page.Pagination.Next}
+	}
+	if remaining > 0 && len(thread.Messages) > remaining {
+		thread.Messages = thread.Messages[:remaining]
+	}
+
+	// Store locally (just warn on error, don't abort the whole thing). An
+	// incognito pull leaves no trace of the conversation on this device.
+	if query == nil || !query.NoCache {
+		if merr := s.mergeMessages(ctx, convID, uid, thread.Messages); merr != nil {
+			s.Debug(ctx, "PullStream: unable to commit thread locally: convID: %s uid: %s", convID, uid)
+		}
+	} else {
+		s.Debug(ctx, "PullStream: noCache set, skipping local commit: convID: %s", convID)
+	}
+
+	if err = s.postProcessThread(ctx, uid, convID, &thread, query, conv.Metadata.FinalizeInfo); err != nil {
+		return rl, err
+	}
+	deliver(thread, true)
+	return rl, nil
+}
+
 func (s *HybridConversationSource) updateMessages(ctx context.Context, messages []chat1.MessageUnboxed) ([]chat1.MessageUnboxed, error) {
 	updatedMessages := make([]chat1.MessageUnboxed, 0, len(messages))
 	for _, m := range messages {
@@ -398,6 +893,10 @@ func (s *HybridConversationSource) PullLocalOnly(ctx context.Context, convID cha
 	tv, err := s.storage.FetchUpToLocalMaxMsgID(ctx, convID, uid, query, pagination)
 	if err != nil {
 		s.Debug(ctx, "PullLocalOnly: failed to fetch local messages: %s", err.Error())
+		if _, ok := err.(storage.MissError); ok {
+			// A miss might just be a hole, get it repaired for next time
+			s.backfiller.Queue(ctx, convID, uid)
+		}
 		return chat1.ThreadView{}, err
 	}
 
@@ -415,6 +914,139 @@ func (s *HybridConversationSource) Clear(convID chat1.ConversationID, uid gregor
 	return s.storage.MaybeNuke(true, nil, convID, uid)
 }
 
+// preloadDefaultDepth is how many recent messages PreloadConversations pulls
+// per conversation when the caller doesn't say
+const preloadDefaultDepth = 50
+
+// PreloadConversations warms local storage for the given conversations in one
+// coordinated pass, instead of the dozens of independent Pulls a GUI inbox
+// open would otherwise issue. Conversations already cached are served by the
+// Pull cache hit path and cost no remote calls; the rest share one rate limit
+// budget, with the pass backing off when the server reports it running low.
+func (s *HybridConversationSource) PreloadConversations(ctx context.Context, uid gregor1.UID,
+	convIDs []chat1.ConversationID, depth int) (rl []*chat1.RateLimit, err error) {
+
+	if depth <= 0 {
+		depth = preloadDefaultDepth
+	}
+	s.Debug(ctx, "PreloadConversations: convs: %d depth: %d", len(convIDs), depth)
+
+	// The preload takes the prefetcher's place; individual Pulls below should
+	// not re-cancel it mid-pass
+	s.prefetcher.Cancel()
+	ctx = prefetchCtx(ctx)
+
+	for index, convID := range convIDs {
+		if err := ctx.Err(); err != nil {
+			return rl, err
+		}
+		_, rls, perr := s.Pull(ctx, convID, uid, nil, &chat1.Pagination{Num: depth})
+		if perr != nil {
+			s.Debug(ctx, "PreloadConversations: pull failed: convID: %s err: %s", convID,
+				perr.Error())
+			continue
+		}
+		rl = append(rl, rls...)
+		if nearRateLimit(rls) && index < len(convIDs)-1 {
+			s.Debug(ctx, "PreloadConversations: near a rate limit, backing off")
+			time.Sleep(prefetchThrottleDelay)
+		}
+	}
+	return rl, nil
+}
+
+// searchDefaultMaxHits caps search results when the caller doesn't say
+const searchDefaultMaxHits = 50
+
+// Search runs the query against the local message index, either for one
+// conversation or across every conversation in the local inbox. No remote
+// calls are made, so it works offline.
+func (s *HybridConversationSource) Search(ctx context.Context, uid gregor1.UID, query string,
+	opts chat1.SearchLocalOptions) (hits []chat1.SearchLocalHit, err error) {
+
+	limit := opts.MaxHits
+	if limit <= 0 {
+		limit = searchDefaultMaxHits
+	}
+
+	var convIDs []chat1.ConversationID
+	if opts.ConvID != nil {
+		convIDs = append(convIDs, *opts.ConvID)
+	} else {
+		ibox := storage.NewInbox(s.G(), uid, s.getSecretUI)
+		_, convs, cerr := ibox.ReadAll(ctx)
+		if cerr != nil {
+			return nil, cerr
+		}
+		for _, conv := range convs {
+			convIDs = append(convIDs, conv.GetConvID())
+		}
+	}
+
+	for _, convID := range convIDs {
+		if len(hits) >= limit {
+			break
+		}
+		msgs, serr := s.storage.Search(ctx, convID, uid, query, limit-len(hits))
+		if serr != nil {
+			s.Debug(ctx, "Search: error searching convID: %s err: %s", convID, serr.Error())
+			continue
+		}
+		for _, msg := range msgs {
+			hits = append(hits, chat1.SearchLocalHit{
+				ConvID: convID,
+				Msg:    msg,
+			})
+		}
+	}
+	return hits, nil
+}
+
+// ClearCache purges cached conversations matching the given options: a
+// single conversation, every conversation of a TLF, those idle longer than
+// the given age, or everything when no filter is set. Granularity is the
+// whole conversation; anything cleared just repages from the server on next
+// use.
+func (s *HybridConversationSource) ClearCache(ctx context.Context, uid gregor1.UID,
+	opts chat1.ClearCacheLocalOpts) (res chat1.ClearCacheLocalRes, err error) {
+
+	ibox := storage.NewInbox(s.G(), uid, s.getSecretUI)
+	_, convs, err := ibox.ReadAll(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	var cutoff gregor1.Time
+	if opts.OlderThanSeconds > 0 {
+		cutoff = gregor1.ToTime(time.Now().Add(-time.Duration(opts.OlderThanSeconds) * time.Second))
+	}
+	for _, conv := range convs {
+		convID := conv.GetConvID()
+		if opts.ConvID != nil && !opts.ConvID.Eq(convID) {
+			continue
+		}
+		if len(opts.TlfName) > 0 && !strings.EqualFold(opts.TlfName, convTlfName(conv)) {
+			continue
+		}
+		if cutoff > 0 && (conv.ReaderInfo == nil || conv.ReaderInfo.Mtime >= cutoff) {
+			continue
+		}
+		if freed := s.storage.ClearConvCache(ctx, convID, uid); freed > 0 {
+			s.Debug(ctx, "ClearCache: cleared: convID: %s bytes: %d", convID, freed)
+			res.BytesReclaimed += freed
+			res.ConvsCleared++
+		}
+	}
+	return res, nil
+}
+
+func convTlfName(conv chat1.Conversation) string {
+	if len(conv.MaxMsgs) == 0 {
+		return ""
+	}
+	return conv.MaxMsgs[0].ClientHeader.TlfName
+}
+
 type ByMsgID []chat1.MessageUnboxed
 
 func (m ByMsgID) Len() int           { return len(m) }
@@ -443,29 +1075,13 @@ func (s *HybridConversationSource) GetMessages(ctx context.Context, convID chat1
 	s.Debug(ctx, "GetMessages: convID: %s uid: %s total msgs: %d remote: %d", convID, uid, len(msgIDs),
 		len(remoteMsgs))
 	if len(remoteMsgs) > 0 {
-		rmsgs, err := s.ri().GetMessagesRemote(ctx, chat1.GetMessagesRemoteArg{
-			ConversationID: convID,
-			MessageIDs:     remoteMsgs,
-		})
+		rmsgsUnboxed, err := s.fetchRemoteMessages(ctx, convID, uid, remoteMsgs, finalizeInfo)
 		if err != nil {
 			return nil, err
 		}
-
-		// Unbox all the remote messages
-		rmsgsUnboxed, err := s.boxer.UnboxMessages(ctx, rmsgs.Msgs, finalizeInfo)
-		if err != nil {
-			return nil, err
-		}
-
-		sort.Sort(ByMsgID(rmsgsUnboxed))
 		for _, rmsg := range rmsgsUnboxed {
 			rmsgsTab[rmsg.GetMessageID()] = rmsg
 		}
-
-		// Write out messages
-		if err := s.storage.Merge(ctx, convID, uid, rmsgsUnboxed); err != nil {
-			return nil, err
-		}
 	}
 
 	// Form final result
@@ -487,6 +1103,93 @@ func (s *HybridConversationSource) GetMessages(ctx context.Context, convID chat1
 	return res, nil
 }
 
+// fetchRemoteChunkWorkers bounds how many remote message chunks are in
+// flight at once
+const fetchRemoteChunkWorkers = 3
+
+// fetchRemoteMessages pulls the given message IDs from the server in chunks
+// of Env.GetChatFetchBatchSize, fetching chunks on a bounded pool of workers.
+// Each chunk is unboxed and merged into storage as it lands, so partial
+// progress survives a failure partway through a large request.
+func (s *HybridConversationSource) fetchRemoteMessages(ctx context.Context,
+	convID chat1.ConversationID, uid gregor1.UID, msgIDs []chat1.MessageID,
+	finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error) {
+
+	batch := s.G().Env.GetChatFetchBatchSize()
+	if batch <= 0 {
+		batch = len(msgIDs)
+	}
+	var chunks [][]chat1.MessageID
+	for start := 0; start < len(msgIDs); start += batch {
+		end := start + batch
+		if end > len(msgIDs) {
+			end = len(msgIDs)
+		}
+		chunks = append(chunks, msgIDs[start:end])
+	}
+	s.Debug(ctx, "fetchRemoteMessages: convID: %s msgs: %d chunks: %d", convID, len(msgIDs),
+		len(chunks))
+
+	fetchChunk := func(ids []chat1.MessageID) ([]chat1.MessageUnboxed, error) {
+		rmsgs, err := s.ri().GetMessagesRemote(ctx, chat1.GetMessagesRemoteArg{
+			ConversationID: convID,
+			MessageIDs:     ids,
+		})
+		if err != nil {
+			return nil, classifyConvSourceError(err)
+		}
+		unboxStart := time.Now()
+		unboxed, err := s.boxer.UnboxMessages(ctx, rmsgs.Msgs, finalizeInfo)
+		if err != nil {
+			return nil, err
+		}
+		s.stats.recordUnbox(len(unboxed), time.Since(unboxStart))
+		sort.Sort(ByMsgID(unboxed))
+		if err := s.mergeMessages(ctx, convID, uid, unboxed); err != nil {
+			return nil, err
+		}
+		return unboxed, nil
+	}
+
+	if len(chunks) == 1 {
+		return fetchChunk(chunks[0])
+	}
+
+	// Workers pull chunk indices off a channel and write results into place,
+	// mirroring the unbox worker pool
+	workers := fetchRemoteChunkWorkers
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+	chunkRes := make([][]chat1.MessageUnboxed, len(chunks))
+	errs := make([]error, len(chunks))
+	indexCh := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexCh {
+				chunkRes[index], errs[index] = fetchChunk(chunks[index])
+			}
+		}()
+	}
+	for index := range chunks {
+		indexCh <- index
+	}
+	close(indexCh)
+	wg.Wait()
+
+	var res []chat1.MessageUnboxed
+	for index, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, chunkRes[index]...)
+	}
+	return res, nil
+}
+
 func (s *HybridConversationSource) GetMessagesWithRemotes(ctx context.Context,
 	convID chat1.ConversationID, uid gregor1.UID, msgs []chat1.MessageBoxed,
 	finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error) {
@@ -525,7 +1228,7 @@ func (s *HybridConversationSource) GetMessagesWithRemotes(ctx context.Context,
 		}
 	}
 	if len(merges) > 0 {
-		if err = s.storage.Merge(ctx, convID, uid, merges); err != nil {
+		if err = s.mergeMessages(ctx, convID, uid, merges); err != nil {
 			return res, err
 		}
 	}
@@ -539,9 +1242,73 @@ func (s *HybridConversationSource) GetMessagesWithRemotes(ctx context.Context,
 	return res, nil
 }
 
+// ExportSnapshot packages the cached messages of every conversation in the
+// local inbox into a snapshot sealed with key, so a freshly provisioned
+// device can warm its cache without redownloading history. The key should be
+// agreed over the provisioning channel to the destination device.
+func (s *HybridConversationSource) ExportSnapshot(ctx context.Context, uid gregor1.UID,
+	key [32]byte) ([]byte, error) {
+	ibox := storage.NewInbox(s.G(), uid, s.getSecretUI)
+	_, convs, err := ibox.ReadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var convIDs []chat1.ConversationID
+	for _, conv := range convs {
+		convIDs = append(convIDs, conv.GetConvID())
+	}
+	return s.storage.ExportSnapshot(ctx, uid, convIDs, key)
+}
+
+// ImportSnapshot validates a snapshot exported by another device and merges
+// it into local storage.
+func (s *HybridConversationSource) ImportSnapshot(ctx context.Context, uid gregor1.UID,
+	data []byte, key [32]byte) error {
+	convs, msgs, err := s.storage.ImportSnapshot(ctx, uid, data, key)
+	if err != nil {
+		return err
+	}
+	s.Debug(ctx, "ImportSnapshot: merged: convs: %d msgs: %d", convs, msgs)
+	return nil
+}
+
+// SetConvPinned marks or unmarks a conversation as kept offline. The pinned
+// set exempts the conversation from cache eviction and puts it at the front of
+// background prefetch; pinning additionally kicks off a background backfill of
+// its history to the configured depth.
+func (s *HybridConversationSource) SetConvPinned(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, pinned bool) error {
+	if err := s.convPins.Set(ctx, uid, convID, pinned); err != nil {
+		return err
+	}
+	if pinned {
+		s.backfiller.Deepen(ctx, convID, uid, s.G().Env.GetChatPinnedBackfillDepth())
+	}
+	return nil
+}
+
+// ListPinned returns the pinned messages for a conversation, resolving the
+// stored IDs through GetMessages so uncached pins come down from the server.
+func (s *HybridConversationSource) ListPinned(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) ([]chat1.MessageUnboxed, error) {
+	ids := s.pins.List(ctx, convID, uid)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return s.GetMessages(ctx, convID, uid, ids, nil)
+}
+
 func NewConversationSource(g *libkb.GlobalContext, typ string, boxer *Boxer, storage *storage.Storage,
 	ri func() chat1.RemoteInterface, si func() libkb.SecretUI) libkb.ConversationSource {
-	if typ == "hybrid" {
+	switch typ {
+	case "hybrid":
+		return NewHybridConversationSource(g, boxer, storage, ri, si)
+	case "hybridsql":
+		if !storage.SQLEngineAvailable() {
+			g.Log.Warning("hybridsql conversation source requested but this build has no SQLite driver; using hybrid")
+			return NewHybridConversationSource(g, boxer, storage, ri, si)
+		}
+		storage.UseSQLEngine()
 		return NewHybridConversationSource(g, boxer, storage, ri, si)
 	}
 	return NewRemoteConversationSource(g, boxer, ri, si)
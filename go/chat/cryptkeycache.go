@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// cryptKeyCache memoizes TLF crypt key lookups across conversations. The
+// per-request KeyFinder only helps within a single Pull; conversations of the
+// same TLF otherwise re-derive identical keys on every fetch, so the Boxer
+// keeps this longer-lived cache. Entries live until the TLF is explicitly
+// invalidated by a finalize or resolve update, which are the events that
+// change a TLF's key holders.
+type cryptKeyCache struct {
+	sync.Mutex
+	keys map[string]keybase1.GetTLFCryptKeysRes
+}
+
+func newCryptKeyCache() *cryptKeyCache {
+	return &cryptKeyCache{
+		keys: make(map[string]keybase1.GetTLFCryptKeysRes),
+	}
+}
+
+func (c *cryptKeyCache) key(tlfName string, tlfPublic bool) string {
+	return fmt.Sprintf("%s|%v", tlfName, tlfPublic)
+}
+
+func (c *cryptKeyCache) get(tlfName string, tlfPublic bool) (keybase1.GetTLFCryptKeysRes, bool) {
+	c.Lock()
+	defer c.Unlock()
+	res, ok := c.keys[c.key(tlfName, tlfPublic)]
+	return res, ok
+}
+
+func (c *cryptKeyCache) put(tlfName string, tlfPublic bool, keys keybase1.GetTLFCryptKeysRes) {
+	c.Lock()
+	defer c.Unlock()
+	c.keys[c.key(tlfName, tlfPublic)] = keys
+}
+
+// invalidate drops all entries for a TLF, including finalized variants of the
+// name, forcing fresh key derivation on the next lookup.
+func (c *cryptKeyCache) invalidate(tlfName string) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.keys {
+		if strings.HasPrefix(key, tlfName) {
+			delete(c.keys, key)
+		}
+	}
+}
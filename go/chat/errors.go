@@ -2,9 +2,13 @@ package chat
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/chat1"
+	"golang.org/x/net/context"
 )
 
 type UnboxingError interface {
@@ -59,6 +63,106 @@ func (e TransientUnboxingError) ExportType() chat1.MessageUnboxedErrorType {
 
 //=============================================================================
 
+// ConvSourceError classifies failures coming out of ConversationSource
+// methods so callers can tell retriable conditions from permanent ones
+// without poking at raw remote errors.
+type ConvSourceError interface {
+	error
+	Inner() error
+	IsRetriable() bool
+	RetryAfter() time.Duration
+}
+
+// OfflineError means the remote could not be reached at all. Retrying is
+// pointless until connectivity returns.
+type OfflineError struct{ inner error }
+
+func NewOfflineError(inner error) OfflineError { return OfflineError{inner} }
+
+func (e OfflineError) Error() string {
+	return fmt.Sprintf("chat source offline: %s", e.inner.Error())
+}
+
+func (e OfflineError) Inner() error              { return e.inner }
+func (e OfflineError) IsRetriable() bool         { return false }
+func (e OfflineError) RetryAfter() time.Duration { return 0 }
+
+// RateLimitedError means the server turned the request away for quota
+// reasons; Retry says how long to back off before trying again.
+type RateLimitedError struct {
+	inner error
+	Retry time.Duration
+}
+
+func NewRateLimitedError(inner error, retry time.Duration) RateLimitedError {
+	return RateLimitedError{inner: inner, Retry: retry}
+}
+
+func (e RateLimitedError) Error() string {
+	return fmt.Sprintf("chat source rate limited: retry after: %v: %s", e.Retry, e.inner.Error())
+}
+
+func (e RateLimitedError) Inner() error              { return e.inner }
+func (e RateLimitedError) IsRetriable() bool         { return true }
+func (e RateLimitedError) RetryAfter() time.Duration { return e.Retry }
+
+// TransientNetworkError covers timeouts and dropped connections where an
+// immediate retry has a decent chance of succeeding.
+type TransientNetworkError struct{ inner error }
+
+func NewTransientNetworkError(inner error) TransientNetworkError {
+	return TransientNetworkError{inner}
+}
+
+func (e TransientNetworkError) Error() string {
+	return fmt.Sprintf("chat source transient network error: %s", e.inner.Error())
+}
+
+func (e TransientNetworkError) Inner() error              { return e.inner }
+func (e TransientNetworkError) IsRetriable() bool         { return true }
+func (e TransientNetworkError) RetryAfter() time.Duration { return 0 }
+
+// PermanentConvSourceError is everything else; retrying will not help.
+type PermanentConvSourceError struct{ inner error }
+
+func NewPermanentConvSourceError(inner error) PermanentConvSourceError {
+	return PermanentConvSourceError{inner}
+}
+
+func (e PermanentConvSourceError) Error() string {
+	return fmt.Sprintf("chat source permanent error: %s", e.inner.Error())
+}
+
+func (e PermanentConvSourceError) Inner() error              { return e.inner }
+func (e PermanentConvSourceError) IsRetriable() bool         { return false }
+func (e PermanentConvSourceError) RetryAfter() time.Duration { return 0 }
+
+// classifyConvSourceError wraps a raw remote error into the taxonomy above.
+// Errors that are already classified pass through untouched.
+func classifyConvSourceError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err := err.(type) {
+	case ConvSourceError:
+		return err
+	case libkb.APINetError:
+		return NewOfflineError(err)
+	case net.Error:
+		if err.Timeout() || err.Temporary() {
+			return NewTransientNetworkError(err)
+		}
+		return NewOfflineError(err)
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded:
+		return NewTransientNetworkError(err)
+	}
+	return NewPermanentConvSourceError(err)
+}
+
+//=============================================================================
+
 type ConsistencyErrorCode int
 
 const (
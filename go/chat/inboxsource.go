@@ -375,6 +375,16 @@ func (s *RemoteInboxSource) SetStatus(ctx context.Context, uid gregor1.UID, vers
 	return nil, nil
 }
 
+func (s *RemoteInboxSource) MembersUpdate(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
+	convID chat1.ConversationID, joined []gregor1.UID, left []gregor1.UID) (*chat1.ConversationLocal, error) {
+	return nil, nil
+}
+
+func (s *RemoteInboxSource) UpdateConversation(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
+	conv chat1.Conversation) (*chat1.ConversationLocal, error) {
+	return nil, nil
+}
+
 func (s *RemoteInboxSource) TlfFinalize(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
 	convIDs []chat1.ConversationID, finalizeInfo chat1.ConversationFinalizeInfo) ([]chat1.ConversationLocal, error) {
 	// Notify rest of system about reset
@@ -622,6 +632,35 @@ func (s *HybridInboxSource) SetStatus(ctx context.Context, uid gregor1.UID, vers
 	return conv, nil
 }
 
+func (s *HybridInboxSource) MembersUpdate(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
+	convID chat1.ConversationID, joined []gregor1.UID, left []gregor1.UID) (conv *chat1.ConversationLocal, err error) {
+	defer s.Trace(ctx, func() error { return err }, "MembersUpdate")()
+	if cerr := storage.NewInbox(s.G(), uid, s.getSecretUI).MembersUpdate(ctx, vers, convID, joined, left); cerr != nil {
+		err = s.handleInboxError(cerr, uid)
+		return nil, err
+	}
+	if conv, err = s.getConvLocal(ctx, uid, convID); err != nil {
+		s.Debug(ctx, "MembersUpdate: unable to load conversation: convID: %s err: %s", convID, err.Error())
+		return nil, nil
+	}
+	return conv, nil
+}
+
+func (s *HybridInboxSource) UpdateConversation(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
+	conv chat1.Conversation) (res *chat1.ConversationLocal, err error) {
+	defer s.Trace(ctx, func() error { return err }, "UpdateConversation")()
+	if cerr := storage.NewInbox(s.G(), uid, s.getSecretUI).UpdateConversation(ctx, vers, conv); cerr != nil {
+		err = s.handleInboxError(cerr, uid)
+		return nil, err
+	}
+	if res, err = s.getConvLocal(ctx, uid, conv.GetConvID()); err != nil {
+		s.Debug(ctx, "UpdateConversation: unable to load conversation: convID: %s err: %s",
+			conv.GetConvID(), err.Error())
+		return nil, nil
+	}
+	return res, nil
+}
+
 func (s *HybridInboxSource) TlfFinalize(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
 	convIDs []chat1.ConversationID, finalizeInfo chat1.ConversationFinalizeInfo) (convs []chat1.ConversationLocal, err error) {
 	defer s.Trace(ctx, func() error { return err }, "TlfFinalize")()
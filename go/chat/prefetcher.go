@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/storage"
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+// How many of the most recently active conversations get warmed after a
+// reconnect sync
+const prefetchConvLimit = 10
+
+// How many messages we pull per conversation
+const prefetchPageSize = 50
+
+// Pause between conversations, and the longer pause taken when the server
+// reports we are close to a rate limit
+const prefetchConvDelay = 500 * time.Millisecond
+const prefetchThrottleDelay = 5 * time.Second
+
+type prefetchKey int
+
+var prefKey prefetchKey
+
+func prefetchCtx(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prefKey, true)
+}
+
+func isPrefetchCtx(ctx context.Context) bool {
+	val, _ := ctx.Value(prefKey).(bool)
+	return val
+}
+
+// Prefetcher warms HybridConversationSource storage after a reconnect sync by
+// pre-Pulling the most recently active conversations, so threads render from
+// cache when the user opens them. Runs are single-flight, back off when the
+// server reports a tight rate limit, and are canceled outright by foreground
+// Pull activity.
+type Prefetcher struct {
+	libkb.Contextified
+	utils.DebugLabeler
+	sync.Mutex
+
+	source      *HybridConversationSource
+	getSecretUI func() libkb.SecretUI
+
+	// Non-nil while a run is in flight; closing it cancels the run
+	cancelCh chan struct{}
+}
+
+func newPrefetcher(g *libkb.GlobalContext, source *HybridConversationSource,
+	si func() libkb.SecretUI) *Prefetcher {
+	return &Prefetcher{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Prefetcher", false),
+		source:       source,
+		getSecretUI:  si,
+	}
+}
+
+// Start kicks off a background run for the given user, replacing any run
+// already in flight.
+func (p *Prefetcher) Start(ctx context.Context, uid gregor1.UID) {
+	p.Lock()
+	if p.cancelCh != nil {
+		close(p.cancelCh)
+	}
+	ch := make(chan struct{})
+	p.cancelCh = ch
+	p.Unlock()
+
+	p.Debug(ctx, "Start: uid: %s", uid)
+	go p.run(uid, ch)
+}
+
+// Cancel stops any background run. Foreground Pulls call this so the user
+// never competes with the prefetcher for bandwidth or rate limit budget.
+func (p *Prefetcher) Cancel() {
+	p.Lock()
+	if p.cancelCh != nil {
+		close(p.cancelCh)
+		p.cancelCh = nil
+	}
+	p.Unlock()
+}
+
+func (p *Prefetcher) finish(ch chan struct{}) {
+	p.Lock()
+	if p.cancelCh == ch {
+		p.cancelCh = nil
+	}
+	p.Unlock()
+}
+
+func (p *Prefetcher) canceled(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+type convsByRecentActivity []chat1.Conversation
+
+func (c convsByRecentActivity) Len() int      { return len(c) }
+func (c convsByRecentActivity) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c convsByRecentActivity) Less(i, j int) bool {
+	return convMtime(c[i]) > convMtime(c[j])
+}
+
+func convMtime(conv chat1.Conversation) gregor1.Time {
+	if conv.ReaderInfo == nil {
+		return 0
+	}
+	return conv.ReaderInfo.Mtime
+}
+
+// rank returns the conversations worth warming: pinned conversations first,
+// then the most recently active, each group ordered by recent activity. Pinned
+// conversations are always included and do not count against the limit. It
+// reads only local inbox storage, which the syncer has just freshened.
+func (p *Prefetcher) rank(ctx context.Context, uid gregor1.UID) ([]chat1.Conversation, error) {
+	ibox := storage.NewInbox(p.G(), uid, p.getSecretUI)
+	_, convs, cerr := ibox.ReadAll(ctx)
+	if cerr != nil {
+		return nil, cerr
+	}
+	pinnedSet := storage.NewConvPins(p.G()).PinnedMap(ctx, uid)
+	var pinned, rest []chat1.Conversation
+	for _, conv := range convs {
+		if pinnedSet[conv.GetConvID().String()] {
+			pinned = append(pinned, conv)
+		} else {
+			rest = append(rest, conv)
+		}
+	}
+	sort.Sort(convsByRecentActivity(pinned))
+	sort.Sort(convsByRecentActivity(rest))
+	if len(rest) > prefetchConvLimit {
+		rest = rest[:prefetchConvLimit]
+	}
+	return append(pinned, rest...), nil
+}
+
+func (p *Prefetcher) run(uid gregor1.UID, ch chan struct{}) {
+	defer p.finish(ch)
+
+	ctx := prefetchCtx(context.Background())
+	convs, err := p.rank(ctx, uid)
+	if err != nil {
+		p.Debug(ctx, "run: unable to rank conversations: %s", err.Error())
+		return
+	}
+
+	p.Debug(ctx, "run: warming %d conversations", len(convs))
+	for _, conv := range convs {
+		if p.canceled(ch) {
+			p.Debug(ctx, "run: canceled")
+			return
+		}
+
+		delay := prefetchConvDelay
+		_, rls, err := p.source.Pull(ctx, conv.GetConvID(), uid, nil, &chat1.Pagination{
+			Num: prefetchPageSize,
+		})
+		if err != nil {
+			p.Debug(ctx, "run: pull failed: convID: %s err: %s", conv.GetConvID(), err.Error())
+		}
+		if nearRateLimit(rls) {
+			p.Debug(ctx, "run: near a rate limit, backing off")
+			delay = prefetchThrottleDelay
+		}
+
+		select {
+		case <-ch:
+			p.Debug(ctx, "run: canceled")
+			return
+		case <-time.After(delay):
+		}
+	}
+	p.Debug(ctx, "run: complete")
+}
+
+// nearRateLimit is true if any reported rate limit has under a fifth of its
+// call budget left in the current window.
+func nearRateLimit(rls []*chat1.RateLimit) bool {
+	for _, rl := range rls {
+		if rl == nil || rl.MaxCalls <= 0 {
+			continue
+		}
+		if rl.CallsRemaining*5 < rl.MaxCalls {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/storage"
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// How often we sweep local storage for expired ephemeral messages
+const purgeInterval = time.Minute
+
+// Purger sweeps HybridConversationSource storage in the background, deleting
+// the bodies of ephemeral messages whose expiry time has passed. Reads filter
+// expired messages out on their own; the purger makes sure the plaintext does
+// not outlive its expiry on disk, and tells the UI to refresh when something
+// visible explodes.
+type Purger struct {
+	libkb.Contextified
+	utils.DebugLabeler
+	sync.Mutex
+
+	source      *HybridConversationSource
+	getSecretUI func() libkb.SecretUI
+
+	// Non-nil while the loop is running; closing it stops the loop
+	stopCh chan struct{}
+	uid    gregor1.UID
+}
+
+func newPurger(g *libkb.GlobalContext, source *HybridConversationSource,
+	si func() libkb.SecretUI) *Purger {
+	return &Purger{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Purger", false),
+		source:       source,
+		getSecretUI:  si,
+	}
+}
+
+// Start begins the background sweep loop for the given user. Safe to call on
+// every reconnect; a loop already running for the same user is left alone.
+func (p *Purger) Start(ctx context.Context, uid gregor1.UID) {
+	p.Lock()
+	if p.stopCh != nil && p.uid.Eq(uid) {
+		p.Unlock()
+		return
+	}
+	if p.stopCh != nil {
+		close(p.stopCh)
+	}
+	ch := make(chan struct{})
+	p.stopCh = ch
+	p.uid = uid
+	p.Unlock()
+
+	p.Debug(ctx, "Start: uid: %s", uid)
+	go p.loop(uid, ch)
+}
+
+// Stop halts the background loop.
+func (p *Purger) Stop(ctx context.Context) {
+	p.Lock()
+	if p.stopCh != nil {
+		close(p.stopCh)
+		p.stopCh = nil
+	}
+	p.Unlock()
+}
+
+func (p *Purger) loop(uid gregor1.UID, ch chan struct{}) {
+	for {
+		select {
+		case <-ch:
+			return
+		case <-time.After(purgeInterval):
+			p.purge(uid)
+		}
+	}
+}
+
+func (p *Purger) purge(uid gregor1.UID) {
+	ctx := context.Background()
+
+	ibox := storage.NewInbox(p.G(), uid, p.getSecretUI)
+	_, convs, cerr := ibox.ReadAll(ctx)
+	if cerr != nil {
+		p.Debug(ctx, "purge: unable to read inbox: %s", cerr.Error())
+		return
+	}
+
+	var stale []chat1.ConversationID
+	for _, conv := range convs {
+		purged, err := p.source.storage.PurgeExpired(ctx, conv.GetConvID(), uid)
+		if err != nil {
+			p.Debug(ctx, "purge: convID: %s error: %s", conv.GetConvID(), err.Error())
+			continue
+		}
+		if len(purged) > 0 {
+			p.Debug(ctx, "purge: convID: %s purged: %d", conv.GetConvID(), len(purged))
+			stale = append(stale, conv.GetConvID())
+		}
+	}
+
+	// Something visible just exploded, tell the UI to refresh those threads
+	if len(stale) > 0 {
+		p.G().NotifyRouter.HandleChatThreadsStale(ctx, keybase1.UID(uid.String()), stale)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/keybase/client/go/badges"
 	"github.com/keybase/client/go/chat/pager"
+	"github.com/keybase/client/go/chat/storage"
 	"github.com/keybase/client/go/chat/utils"
 	"github.com/keybase/client/go/gregor"
 	"github.com/keybase/client/go/libkb"
@@ -18,11 +21,217 @@ import (
 	"github.com/keybase/go-codec/codec"
 )
 
+// How long repeated identical typing updates for the same conversation and
+// typer are suppressed before we forward another one
+const typingDebounceWindow = 5 * time.Second
+
+type typingEntry struct {
+	typing bool
+	at     time.Time
+}
+
+// chatPayloadHandle is shared by all chat payload decoders rather than
+// allocating a fresh handle per message.
+var chatPayloadHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// PayloadInvalidError is returned when a chat.activity payload fails strict
+// validation before it is applied.
+type PayloadInvalidError struct {
+	Action string
+	Reason string
+}
+
+func (e PayloadInvalidError) Error() string {
+	return fmt.Sprintf("invalid %s payload: %s", e.Action, e.Reason)
+}
+
+// Bounds for the in-memory buffer of payloads that failed to apply to local
+// storage (e.g. disk full, locked DB) and are awaiting a retry
+const pushRetryInterval = 15 * time.Second
+const pushRetryAttempts = 3
+const pushRetryBufferLimit = 100
+
+// failedPush is one newMessage payload local storage rejected.
+type failedPush struct {
+	uid       gregor1.UID
+	convID    chat1.ConversationID
+	vers      chat1.InboxVers
+	msg       chat1.MessageBoxed
+	journalID uint64
+	attempts  int
+}
+
+// convJob is one decoded chat.activity payload waiting to be applied to a
+// conversation.
+type convJob struct {
+	vers chat1.InboxVers
+	run  func()
+}
+
+// convSerializer applies chat.activity payloads for a single conversation one
+// at a time and in inboxVers order, so payloads replayed after a reconnect
+// can't interleave with live ones.
+type convSerializer struct {
+	sync.Mutex
+	queues map[string]*convQueue
+}
+
+type convQueue struct {
+	jobs    []convJob
+	running bool
+}
+
+func newConvSerializer() *convSerializer {
+	return &convSerializer{queues: make(map[string]*convQueue)}
+}
+
+// enqueue adds a job for the conversation, keeping its queue sorted by
+// inboxVers, and starts a worker for the conversation if none is running.
+func (s *convSerializer) enqueue(convID string, vers chat1.InboxVers, run func()) {
+	s.Lock()
+	defer s.Unlock()
+	q, ok := s.queues[convID]
+	if !ok {
+		q = &convQueue{}
+		s.queues[convID] = q
+	}
+	idx := len(q.jobs)
+	for i, j := range q.jobs {
+		if vers < j.vers {
+			idx = i
+			break
+		}
+	}
+	q.jobs = append(q.jobs, convJob{})
+	copy(q.jobs[idx+1:], q.jobs[idx:])
+	q.jobs[idx] = convJob{vers: vers, run: run}
+	if !q.running {
+		q.running = true
+		go s.drain(q)
+	}
+}
+
+func (s *convSerializer) drain(q *convQueue) {
+	for {
+		s.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			s.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		s.Unlock()
+		job.run()
+	}
+}
+
+// badgeCoalesceWindow is how long unread updates are buffered before being
+// pushed to the badger, so a burst of activity becomes one badge push per
+// conversation.
+const badgeCoalesceWindow = 250 * time.Millisecond
+
+type badgeUpdate struct {
+	update chat1.UnreadUpdate
+	vers   chat1.InboxVers
+}
+
+// badgePipeline funnels UnreadUpdates from all chat.activity cases into the
+// badger. Updates are applied in InboxVers order, stale versions are dropped,
+// and bursts within badgeCoalesceWindow collapse to the latest update per
+// conversation.
+type badgePipeline struct {
+	sync.Mutex
+	appliedVers chat1.InboxVers
+	pending     []badgeUpdate
+	flushing    bool
+}
+
+func (b *badgePipeline) push(badger *badges.Badger, update *chat1.UnreadUpdate, vers chat1.InboxVers) {
+	if badger == nil || update == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if vers < b.appliedVers {
+		return
+	}
+	idx := len(b.pending)
+	for i, u := range b.pending {
+		if vers < u.vers {
+			idx = i
+			break
+		}
+	}
+	b.pending = append(b.pending, badgeUpdate{})
+	copy(b.pending[idx+1:], b.pending[idx:])
+	b.pending[idx] = badgeUpdate{update: *update, vers: vers}
+	if !b.flushing {
+		b.flushing = true
+		go b.flush(badger)
+	}
+}
+
+func (b *badgePipeline) flush(badger *badges.Badger) {
+	time.Sleep(badgeCoalesceWindow)
+
+	b.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.flushing = false
+	if len(pending) > 0 {
+		b.appliedVers = pending[len(pending)-1].vers
+	}
+	b.Unlock()
+
+	// Only the newest update per conversation matters; push those in
+	// InboxVers order.
+	latest := make(map[string]int)
+	for i, u := range pending {
+		latest[u.update.ConvID.String()] = i
+	}
+	for i, u := range pending {
+		if latest[u.update.ConvID.String()] != i {
+			continue
+		}
+		badger.PushChatUpdate(u.update, u.vers)
+	}
+}
+
 type PushHandler struct {
 	libkb.Contextified
 	utils.DebugLabeler
 
 	identNotifier *IdentifyNotifier
+
+	// Last forwarded typing state per conversation and typer, for debouncing
+	typingMu sync.Mutex
+	typing   map[string]typingEntry
+
+	// Per-conversation ordered application of chat.activity payloads
+	convQueues *convSerializer
+
+	// Highest inboxVers seen per uid, for spotting gaps in the update stream
+	inboxVersMu   sync.Mutex
+	lastInboxVers map[string]chat1.InboxVers
+
+	// Payloads local storage rejected, awaiting retry
+	retryMu      sync.Mutex
+	retryBuf     []failedPush
+	retryRunning bool
+
+	// Count of payloads rejected by strict validation
+	rejectedMu       sync.Mutex
+	rejectedPayloads int
+
+	// Ordered, coalesced application of UnreadUpdates to the badger
+	badgeUpdates badgePipeline
+
+	// Journal of in-flight newMessage applies, replayed after a crash
+	applyJournal *storage.ApplyJournal
+
+	// Read watermarks for delivery receipts
+	receipts *storage.Receipts
 }
 
 func NewPushHandler(g *libkb.GlobalContext) *PushHandler {
@@ -30,7 +239,101 @@ func NewPushHandler(g *libkb.GlobalContext) *PushHandler {
 		Contextified:  libkb.NewContextified(g),
 		DebugLabeler:  utils.NewDebugLabeler(g, "PushHandler", false),
 		identNotifier: NewIdentifyNotifier(g),
+		typing:        make(map[string]typingEntry),
+		convQueues:    newConvSerializer(),
+		lastInboxVers: make(map[string]chat1.InboxVers),
+		applyJournal:  storage.NewApplyJournal(g),
+		receipts:      storage.NewReceipts(g),
+	}
+}
+
+// RegisterOOBMHandlers registers this push handler's out-of-band systems with
+// the given registrar, so the service side doesn't need a hardcoded list of
+// chat systems. badger is looked up at dispatch time since it attaches after
+// startup.
+func (g *PushHandler) RegisterOOBMHandlers(
+	register func(system string, f func(ctx context.Context, obm gregor.OutOfBandMessage) error),
+	badger func() *badges.Badger) {
+	register("chat.activity", func(ctx context.Context, obm gregor.OutOfBandMessage) error {
+		return g.Activity(ctx, obm, badger())
+	})
+	register("chat.tlffinalize", g.TlfFinalize)
+	register("chat.tlfresolve", g.TlfResolve)
+	register("chat.typing", g.Typing)
+	register("chat.membersUpdate", g.MembersUpdate)
+}
+
+// Typing handles a chat.typing out-of-band message: decode the typing
+// update, debounce repeats per conversation and typer, and forward the rest
+// to the UIs through the NotifyRouter.
+func (g *PushHandler) Typing(ctx context.Context, m gregor.OutOfBandMessage) error {
+	if m.Body() == nil {
+		return errors.New("gregor handler for chat.typing: nil message body")
+	}
+
+	var update chat1.TypingUpdate
+	reader := bytes.NewReader(m.Body().Bytes())
+	dec := codec.NewDecoder(reader, chatPayloadHandle)
+	if err := dec.Decode(&update); err != nil {
+		return err
+	}
+
+	typer := keybase1.UID(update.Uid.String())
+	key := update.ConvID.String() + ":" + typer.String()
+	now := time.Now()
+
+	g.typingMu.Lock()
+	prev, seen := g.typing[key]
+	if seen && prev.typing == update.Typing && now.Sub(prev.at) < typingDebounceWindow {
+		g.typingMu.Unlock()
+		g.Debug(ctx, "typing: debounced repeat update for conv %s", update.ConvID)
+		return nil
+	}
+	g.typing[key] = typingEntry{typing: update.Typing, at: now}
+	g.typingMu.Unlock()
+
+	uid := keybase1.UID(m.UID().String())
+	g.G().NotifyRouter.HandleChatTypingUpdate(context.Background(), uid, update.ConvID,
+		typer, update.Typing)
+	return nil
+}
+
+// MembersUpdate handles a chat.membersUpdate out-of-band message: apply the
+// membership change to the local inbox entry and tell the UIs who joined and
+// who left.
+func (g *PushHandler) MembersUpdate(ctx context.Context, m gregor.OutOfBandMessage) error {
+	if m.Body() == nil {
+		return errors.New("gregor handler for chat.membersUpdate: nil message body")
 	}
+
+	g.Debug(ctx, "members update received")
+
+	var update chat1.MembersUpdatePayload
+	reader := bytes.NewReader(m.Body().Bytes())
+	dec := codec.NewDecoder(reader, chatPayloadHandle)
+	if err := dec.Decode(&update); err != nil {
+		return err
+	}
+
+	// Update inbox
+	if _, err := g.G().InboxSource.MembersUpdate(ctx, m.UID().Bytes(), update.InboxVers,
+		update.ConvID, update.Joined, update.Left); err != nil {
+		g.Debug(ctx, "members update: unable to update inbox: %s", err.Error())
+	}
+
+	joined := make([]keybase1.UID, len(update.Joined))
+	for i, u := range update.Joined {
+		joined[i] = keybase1.UID(u.String())
+	}
+	left := make([]keybase1.UID, len(update.Left))
+	for i, u := range update.Left {
+		left[i] = keybase1.UID(u.String())
+	}
+
+	uid := keybase1.UID(m.UID().String())
+	g.G().NotifyRouter.HandleChatMembersUpdate(context.Background(), uid, update.ConvID, joined, left)
+
+	return nil
 }
 
 func (g *PushHandler) TlfFinalize(ctx context.Context, m gregor.OutOfBandMessage) error {
@@ -42,7 +345,7 @@ func (g *PushHandler) TlfFinalize(ctx context.Context, m gregor.OutOfBandMessage
 
 	var update chat1.TLFFinalizeUpdate
 	reader := bytes.NewReader(m.Body().Bytes())
-	dec := codec.NewDecoder(reader, &codec.MsgpackHandle{WriteExt: true})
+	dec := codec.NewDecoder(reader, chatPayloadHandle)
 	err := dec.Decode(&update)
 	if err != nil {
 		return err
@@ -57,6 +360,8 @@ func (g *PushHandler) TlfFinalize(ctx context.Context, m gregor.OutOfBandMessage
 	convMap := make(map[string]chat1.ConversationLocal)
 	for _, conv := range convs {
 		convMap[conv.GetConvID().String()] = conv
+		// The key holders for this TLF just changed, drop any cached keys
+		g.G().ConvSource.InvalidateTLFCryptKeys(conv.Info.TlfName)
 	}
 
 	// Send notify for each conversation ID
@@ -85,7 +390,7 @@ func (g *PushHandler) TlfResolve(ctx context.Context, m gregor.OutOfBandMessage)
 
 	var update chat1.TLFResolveUpdate
 	reader := bytes.NewReader(m.Body().Bytes())
-	dec := codec.NewDecoder(reader, &codec.MsgpackHandle{WriteExt: true})
+	dec := codec.NewDecoder(reader, chatPayloadHandle)
 	err := dec.Decode(&update)
 	if err != nil {
 		return err
@@ -111,11 +416,176 @@ func (g *PushHandler) TlfResolve(ctx context.Context, m gregor.OutOfBandMessage)
 		NewTLFName: updateConv.Info.TlfName,
 	}
 
+	// Resolution can change the TLF membership, drop any cached keys
+	g.G().ConvSource.InvalidateTLFCryptKeys(updateConv.Info.TlfName)
+
 	g.G().NotifyRouter.HandleChatTLFResolve(context.Background(), keybase1.UID(uid), update.ConvID, resolveInfo)
 
 	return nil
 }
 
+// validateActivityPayload enforces the fields every versioned chat.activity
+// payload must carry before we touch local storage with it.
+func (g *PushHandler) validateActivityPayload(ctx context.Context, action string,
+	convID chat1.ConversationID, vers chat1.InboxVers) error {
+	var reason string
+	switch {
+	case len(convID) == 0:
+		reason = "empty convID"
+	case vers == 0:
+		reason = "zero inboxVers"
+	default:
+		return nil
+	}
+
+	g.rejectedMu.Lock()
+	g.rejectedPayloads++
+	g.rejectedMu.Unlock()
+
+	err := PayloadInvalidError{Action: action, Reason: reason}
+	g.Debug(ctx, "chat activity: rejecting payload: %s", err.Error())
+	return err
+}
+
+// RejectedPayloadCount returns how many payloads strict validation has
+// rejected since startup.
+func (g *PushHandler) RejectedPayloadCount() int {
+	g.rejectedMu.Lock()
+	defer g.rejectedMu.Unlock()
+	return g.rejectedPayloads
+}
+
+// bufferFailedPush queues a payload that local storage rejected so it can be
+// retried off the push path. If the buffer is full the conversation is marked
+// stale right away instead.
+func (g *PushHandler) bufferFailedPush(ctx context.Context, p failedPush) {
+	g.retryMu.Lock()
+	if len(g.retryBuf) >= pushRetryBufferLimit {
+		g.retryMu.Unlock()
+		g.Debug(ctx, "push retry: buffer full, marking %s stale", p.convID)
+		g.G().NotifyRouter.HandleChatThreadsStale(context.Background(), keybase1.UID(p.uid.String()),
+			[]chat1.ConversationID{p.convID})
+		return
+	}
+	g.retryBuf = append(g.retryBuf, p)
+	if !g.retryRunning {
+		g.retryRunning = true
+		go g.pushRetryLoop()
+	}
+	g.retryMu.Unlock()
+}
+
+// pushRetryLoop reapplies buffered payloads until they stick or run out of
+// attempts, and exits once the buffer drains.
+func (g *PushHandler) pushRetryLoop() {
+	for {
+		time.Sleep(pushRetryInterval)
+		g.retryMu.Lock()
+		if len(g.retryBuf) == 0 {
+			g.retryRunning = false
+			g.retryMu.Unlock()
+			return
+		}
+		pending := g.retryBuf
+		g.retryBuf = nil
+		g.retryMu.Unlock()
+
+		ctx := context.Background()
+		for _, p := range pending {
+			p.attempts++
+			if err := g.applyPush(ctx, p); err == nil {
+				g.Debug(ctx, "push retry: applied buffered payload: convID: %s", p.convID)
+				g.commitApply(ctx, p.uid, p.journalID)
+				continue
+			}
+			if p.attempts >= pushRetryAttempts {
+				// Give up; the frontend reloading the thread will recover
+				g.Debug(ctx, "push retry: giving up on convID %s after %d attempts, marking stale",
+					p.convID, p.attempts)
+				g.commitApply(ctx, p.uid, p.journalID)
+				g.G().NotifyRouter.HandleChatThreadsStale(context.Background(),
+					keybase1.UID(p.uid.String()), []chat1.ConversationID{p.convID})
+				continue
+			}
+			g.retryMu.Lock()
+			g.retryBuf = append(g.retryBuf, p)
+			g.retryMu.Unlock()
+		}
+	}
+}
+
+// applyPush reapplies one buffered payload to local storage.
+func (g *PushHandler) applyPush(ctx context.Context, p failedPush) error {
+	if _, _, err := g.G().ConvSource.Push(ctx, p.convID, p.uid, p.msg); err != nil {
+		return err
+	}
+	if _, err := g.G().InboxSource.NewMessage(ctx, p.uid, p.vers, p.convID, p.msg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// commitApply clears a journal entry once its apply has fully landed (or has
+// been given up on).
+func (g *PushHandler) commitApply(ctx context.Context, uid gregor1.UID, jid uint64) {
+	if jid == 0 {
+		return
+	}
+	if err := g.applyJournal.Commit(ctx, uid, jid); err != nil {
+		g.Debug(ctx, "unable to commit apply journal entry %d: %s", jid, err.Error())
+	}
+}
+
+// ReplayPendingApplies reapplies journaled newMessage payloads that never
+// committed, picking up applies a crash cut short. Entries that still fail
+// are dropped with a stale-thread notification, so the frontend reloads the
+// conversation from the server instead.
+func (g *PushHandler) ReplayPendingApplies(ctx context.Context, uid gregor1.UID) {
+	pending := g.applyJournal.Pending(ctx, uid)
+	if len(pending) == 0 {
+		return
+	}
+	g.Debug(ctx, "ReplayPendingApplies: replaying %d incomplete applies", len(pending))
+	for _, e := range pending {
+		err := g.applyPush(ctx, failedPush{
+			uid:    uid,
+			convID: e.ConvID,
+			vers:   e.Vers,
+			msg:    e.Msg,
+		})
+		if err != nil {
+			g.Debug(ctx, "ReplayPendingApplies: replay failed: convID: %s err: %s", e.ConvID,
+				err.Error())
+			g.G().NotifyRouter.HandleChatThreadsStale(context.Background(),
+				keybase1.UID(uid.String()), []chat1.ConversationID{e.ConvID})
+		}
+		g.commitApply(ctx, uid, e.ID)
+	}
+}
+
+// checkInboxVersGap watches the inboxVers stamps flowing through
+// chat.activity. A skipped version means we missed updates somewhere; rather
+// than silently diverge, refetch the inbox and tell the UI it is stale.
+func (g *PushHandler) checkInboxVersGap(ctx context.Context, uid gregor.UID, vers chat1.InboxVers) {
+	g.inboxVersMu.Lock()
+	key := uid.String()
+	last, seen := g.lastInboxVers[key]
+	if vers > last {
+		g.lastInboxVers[key] = vers
+	}
+	g.inboxVersMu.Unlock()
+
+	if !seen || vers <= last+1 {
+		return
+	}
+
+	g.Debug(ctx, "inboxVers gap: ours: %d update: %d; resyncing inbox", last, vers)
+	if _, _, err := g.G().InboxSource.Read(ctx, uid.Bytes(), nil, nil, nil); err != nil {
+		g.Debug(ctx, "inboxVers gap: unable to resync inbox: %s", err.Error())
+	}
+	g.G().NotifyRouter.HandleChatInboxStale(context.Background(), keybase1.UID(uid.String()))
+}
+
 func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, badger *badges.Badger) error {
 	if m.Body() == nil {
 		return errors.New("gregor handler for chat.activity: nil message body")
@@ -124,7 +594,7 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 	var activity chat1.ChatActivity
 	var gm chat1.GenericPayload
 	reader := bytes.NewReader(m.Body().Bytes())
-	dec := codec.NewDecoder(reader, &codec.MsgpackHandle{WriteExt: true})
+	dec := codec.NewDecoder(reader, chatPayloadHandle)
 	err := dec.Decode(&gm)
 	if err != nil {
 		return err
@@ -146,6 +616,10 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 			return err
 		}
 
+		if verr := g.validateActivityPayload(ctx, action, nm.ConvID, nm.InboxVers); verr != nil {
+			return verr
+		}
+
 		g.Debug(ctx, "chat activity: newMessage: convID: %s sender: %s",
 			nm.ConvID, nm.Message.ClientHeader.Sender)
 		if nm.Message.ClientHeader.OutboxID != nil {
@@ -155,53 +629,80 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 			g.Debug(ctx, "chat activity: newMessage: outboxID is empty")
 		}
 		uid := m.UID().Bytes()
+		g.checkInboxVersGap(ctx, m.UID(), nm.InboxVers)
+
+		g.convQueues.enqueue(nm.ConvID.String(), nm.InboxVers, func() {
+			var activity chat1.ChatActivity
+			var conv *chat1.ConversationLocal
+			var err error
+
+			// Journal the payload before touching storage, so a crash between
+			// the message merge and the inbox bump leaves a record to replay
+			jid, jerr := g.applyJournal.Begin(ctx, gregor1.UID(uid), nm.ConvID, nm.InboxVers,
+				nm.Message)
+			if jerr != nil {
+				g.Debug(ctx, "chat activity: unable to journal apply: %s", jerr.Error())
+			}
 
-		var conv *chat1.ConversationLocal
-		decmsg, appended, pushErr := g.G().ConvSource.Push(ctx, nm.ConvID, gregor1.UID(uid), nm.Message)
-		if err != nil {
-			g.Debug(ctx, "chat activity: unable to push message: %s", err.Error())
-		}
-		if conv, err = g.G().InboxSource.NewMessage(ctx, uid, nm.InboxVers, nm.ConvID, nm.Message); err != nil {
-			g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
-		}
-
-		// If we have no error on this message, then notify the frontend
-		if pushErr == nil {
-			// Make a pagination object so client can use it in GetThreadLocal
-			pmsgs := []pager.Message{nm.Message}
-			pager := pager.NewThreadPager()
-			page, err := pager.MakePage(pmsgs, 1)
-			if err != nil {
-				g.Debug(ctx, "chat activity: error making page: %s", err.Error())
+			decmsg, appended, pushErr := g.G().ConvSource.Push(ctx, nm.ConvID, gregor1.UID(uid), nm.Message)
+			if pushErr != nil {
+				g.Debug(ctx, "chat activity: unable to push message: %s", pushErr.Error())
+			}
+			if conv, err = g.G().InboxSource.NewMessage(ctx, uid, nm.InboxVers, nm.ConvID, nm.Message); err != nil {
+				g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
+			}
+			if pushErr != nil || err != nil {
+				// Local storage rejected the payload (disk full, locked DB,
+				// ...); hold on to it and try again shortly
+				g.bufferFailedPush(ctx, failedPush{
+					uid:       gregor1.UID(uid),
+					convID:    nm.ConvID,
+					vers:      nm.InboxVers,
+					msg:       nm.Message,
+					journalID: jid,
+				})
+			} else {
+				g.commitApply(ctx, gregor1.UID(uid), jid)
 			}
-			activity = chat1.NewChatActivityWithIncomingMessage(chat1.IncomingMessage{
-				Message:    decmsg,
-				ConvID:     nm.ConvID,
-				Conv:       conv,
-				Pagination: page,
-			})
-		}
 
-		// If this message was not "appended", meaning there is a hole between what we have in cache,
-		// and this message, then we send out a notification that this thread should be considered
-		// stale.
-		// We also get here if we had an error unboxing the messages, it could be a temporal thing
-		// so the frontend should reload.
-		if !appended || pushErr != nil {
-			if !appended {
-				g.Debug(ctx, "chat activity: newMessage: non-append message, alerting")
+			// If we have no error on this message, then notify the frontend
+			if pushErr == nil {
+				// Make a pagination object so client can use it in GetThreadLocal
+				pmsgs := []pager.Message{nm.Message}
+				pager := pager.NewThreadPager()
+				page, err := pager.MakePage(pmsgs, 1)
+				if err != nil {
+					g.Debug(ctx, "chat activity: error making page: %s", err.Error())
+				}
+				activity = chat1.NewChatActivityWithIncomingMessage(chat1.IncomingMessage{
+					Message:    decmsg,
+					ConvID:     nm.ConvID,
+					Conv:       conv,
+					Pagination: page,
+				})
 			}
-			if pushErr != nil {
-				g.Debug(ctx, "chat activity: newMessage: push error, alerting")
+
+			// If this message was not "appended", meaning there is a hole between what we have in cache,
+			// and this message, then we send out a notification that this thread should be considered
+			// stale.
+			// We also get here if we had an error unboxing the messages, it could be a temporal thing
+			// so the frontend should reload.
+			if !appended || pushErr != nil {
+				if !appended {
+					g.Debug(ctx, "chat activity: newMessage: non-append message, alerting")
+				}
+				if pushErr != nil {
+					g.Debug(ctx, "chat activity: newMessage: push error, alerting")
+				}
+				kuid := keybase1.UID(m.UID().String())
+				g.G().NotifyRouter.HandleChatThreadsStale(context.Background(), kuid,
+					[]chat1.ConversationID{nm.ConvID})
 			}
-			kuid := keybase1.UID(m.UID().String())
-			g.G().NotifyRouter.HandleChatThreadsStale(context.Background(), kuid,
-				[]chat1.ConversationID{nm.ConvID})
-		}
 
-		if badger != nil && nm.UnreadUpdate != nil {
-			badger.PushChatUpdate(*nm.UnreadUpdate, nm.InboxVers)
-		}
+			g.badgeUpdates.push(badger, nm.UnreadUpdate, nm.InboxVers)
+			g.notifyNewChatActivity(ctx, m.UID(), &activity)
+		})
+		return nil
 	case "readMessage":
 		var nm chat1.ReadMessagePayload
 		err = dec.Decode(&nm)
@@ -209,24 +710,37 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 			g.Debug(ctx, "chat activity: error decoding: %s", err.Error())
 			return err
 		}
+		if verr := g.validateActivityPayload(ctx, action, nm.ConvID, nm.InboxVers); verr != nil {
+			return verr
+		}
+
 		g.Debug(ctx, "chat activity: readMessage: convID: %s msgID: %d",
 			nm.ConvID, nm.MsgID)
 
-		var conv *chat1.ConversationLocal
 		uid := m.UID().Bytes()
-		if conv, err = g.G().InboxSource.ReadMessage(ctx, uid, nm.InboxVers, nm.ConvID, nm.MsgID); err != nil {
-			g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
-		}
+		g.checkInboxVersGap(ctx, m.UID(), nm.InboxVers)
+		g.convQueues.enqueue(nm.ConvID.String(), nm.InboxVers, func() {
+			var conv *chat1.ConversationLocal
+			conv, err := g.G().InboxSource.ReadMessage(ctx, uid, nm.InboxVers, nm.ConvID, nm.MsgID)
+			if err != nil {
+				g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
+			}
 
-		activity = chat1.NewChatActivityWithReadMessage(chat1.ReadMessageInfo{
-			MsgID:  nm.MsgID,
-			ConvID: nm.ConvID,
-			Conv:   conv,
-		})
+			// Advance the read watermark for delivery receipts
+			if rerr := g.receipts.MarkRead(ctx, nm.ConvID, gregor1.UID(uid), nm.MsgID); rerr != nil {
+				g.Debug(ctx, "chat activity: unable to record read receipt: %s", rerr.Error())
+			}
 
-		if badger != nil && nm.UnreadUpdate != nil {
-			badger.PushChatUpdate(*nm.UnreadUpdate, nm.InboxVers)
-		}
+			activity := chat1.NewChatActivityWithReadMessage(chat1.ReadMessageInfo{
+				MsgID:  nm.MsgID,
+				ConvID: nm.ConvID,
+				Conv:   conv,
+			})
+
+			g.badgeUpdates.push(badger, nm.UnreadUpdate, nm.InboxVers)
+			g.notifyNewChatActivity(ctx, m.UID(), &activity)
+		})
+		return nil
 	case "setStatus":
 		var nm chat1.SetStatusPayload
 		err = dec.Decode(&nm)
@@ -234,23 +748,31 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 			g.Debug(ctx, "chat activity: error decoding: %s", err.Error())
 			return err
 		}
+		if verr := g.validateActivityPayload(ctx, action, nm.ConvID, nm.InboxVers); verr != nil {
+			return verr
+		}
+
 		g.Debug(ctx, "chat activity: setStatus: convID: %s status: %d",
 			nm.ConvID, nm.Status)
 
-		var conv *chat1.ConversationLocal
 		uid := m.UID().Bytes()
-		if conv, err = g.G().InboxSource.SetStatus(ctx, uid, nm.InboxVers, nm.ConvID, nm.Status); err != nil {
-			g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
-		}
-		activity = chat1.NewChatActivityWithSetStatus(chat1.SetStatusInfo{
-			ConvID: nm.ConvID,
-			Status: nm.Status,
-			Conv:   conv,
-		})
+		g.checkInboxVersGap(ctx, m.UID(), nm.InboxVers)
+		g.convQueues.enqueue(nm.ConvID.String(), nm.InboxVers, func() {
+			var conv *chat1.ConversationLocal
+			conv, err := g.G().InboxSource.SetStatus(ctx, uid, nm.InboxVers, nm.ConvID, nm.Status)
+			if err != nil {
+				g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
+			}
+			activity := chat1.NewChatActivityWithSetStatus(chat1.SetStatusInfo{
+				ConvID: nm.ConvID,
+				Status: nm.Status,
+				Conv:   conv,
+			})
 
-		if badger != nil && nm.UnreadUpdate != nil {
-			badger.PushChatUpdate(*nm.UnreadUpdate, nm.InboxVers)
-		}
+			g.badgeUpdates.push(badger, nm.UnreadUpdate, nm.InboxVers)
+			g.notifyNewChatActivity(ctx, m.UID(), &activity)
+		})
+		return nil
 	case "newConversation":
 		var nm chat1.NewConversationPayload
 		err = dec.Decode(&nm)
@@ -258,9 +780,14 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 			g.Debug(ctx, "chat activity: error decoding: %s", err.Error())
 			return err
 		}
+		if verr := g.validateActivityPayload(ctx, action, nm.ConvID, nm.InboxVers); verr != nil {
+			return verr
+		}
+
 		g.Debug(ctx, "chat activity: newConversation: convID: %s ", nm.ConvID)
 
 		uid := m.UID().Bytes()
+		g.checkInboxVersGap(ctx, m.UID(), nm.InboxVers)
 
 		// We need to get this conversation and then localize it
 		var inbox chat1.Inbox
@@ -283,9 +810,52 @@ func (g *PushHandler) Activity(ctx context.Context, m gregor.OutOfBandMessage, b
 			Conv: inbox.Convs[0],
 		})
 
-		if badger != nil && nm.UnreadUpdate != nil {
-			badger.PushChatUpdate(*nm.UnreadUpdate, nm.InboxVers)
+		g.badgeUpdates.push(badger, nm.UnreadUpdate, nm.InboxVers)
+	case "updateConversation":
+		var nm chat1.UpdateConversationPayload
+		err = dec.Decode(&nm)
+		if err != nil {
+			g.Debug(ctx, "chat activity: error decoding: %s", err.Error())
+			return err
 		}
+		if verr := g.validateActivityPayload(ctx, action, nm.ConvID, nm.InboxVers); verr != nil {
+			return verr
+		}
+
+		g.Debug(ctx, "chat activity: updateConversation: convID: %s", nm.ConvID)
+
+		uid := m.UID().Bytes()
+		g.checkInboxVersGap(ctx, m.UID(), nm.InboxVers)
+
+		g.convQueues.enqueue(nm.ConvID.String(), nm.InboxVers, func() {
+			// Refetch the conversation so we pick up whatever metadata changed
+			inbox, _, err := g.G().InboxSource.ReadNoCache(ctx, uid, nil, &chat1.GetInboxLocalQuery{
+				ConvID: &nm.ConvID,
+			}, nil)
+			if err != nil {
+				g.Debug(ctx, "chat activity: unable to read conversation: %s", err.Error())
+				return
+			}
+			if len(inbox.ConvsUnverified) != 1 {
+				g.Debug(ctx, "chat activity: unable to find conversation")
+				return
+			}
+
+			conv, err := g.G().InboxSource.UpdateConversation(ctx, uid, nm.InboxVers,
+				inbox.ConvsUnverified[0])
+			if err != nil {
+				g.Debug(ctx, "chat activity: unable to update inbox: %s", err.Error())
+			}
+
+			activity := chat1.NewChatActivityWithUpdateConversation(chat1.UpdateConversationInfo{
+				ConvID: nm.ConvID,
+				Conv:   conv,
+			})
+
+			g.badgeUpdates.push(badger, nm.UnreadUpdate, nm.InboxVers)
+			g.notifyNewChatActivity(ctx, m.UID(), &activity)
+		})
+		return nil
 	default:
 		return fmt.Errorf("unhandled chat.activity action %q", action)
 	}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+)
+
+// reactionTransform aggregates reaction messages in a thread page onto their
+// target messages and drops the reaction messages themselves from the view,
+// so the frontend renders reactions on their targets instead of as thread
+// entries. Reactions whose target lives outside the page are already folded
+// into the storage derived view at merge time; this pass covers pages served
+// straight from the server.
+type reactionTransform struct {
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func newReactionTransform(g *libkb.GlobalContext) *reactionTransform {
+	return &reactionTransform{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "reactionTransform", false),
+	}
+}
+
+func init() {
+	registerThreadProcessor(func(g *libkb.GlobalContext) threadProcessor {
+		return newReactionTransform(g)
+	})
+}
+
+func (t *reactionTransform) name() string {
+	return "reactions"
+}
+
+// addReaction records a reaction in an emoji to usernames map, ignoring
+// duplicate reactions by the same sender.
+func addReaction(reactions map[string][]string, emoji string, sender string) map[string][]string {
+	if reactions == nil {
+		reactions = make(map[string][]string)
+	}
+	for _, existing := range reactions[emoji] {
+		if existing == sender {
+			return reactions
+		}
+	}
+	reactions[emoji] = append(reactions[emoji], sender)
+	return reactions
+}
+
+func (t *reactionTransform) run(ctx context.Context,
+	convID chat1.ConversationID, uid gregor1.UID, originalMsgs []chat1.MessageUnboxed,
+	finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error) {
+
+	// Aggregate the reaction messages in the page by target
+	reactions := make(map[chat1.MessageID]map[string][]string)
+	for _, msg := range originalMsgs {
+		if !msg.IsValid() || msg.GetMessageType() != chat1.MessageType_REACTION {
+			continue
+		}
+		body := msg.Valid().MessageBody.Reaction()
+		reactions[body.MessageID] = addReaction(reactions[body.MessageID], body.Body,
+			msg.Valid().SenderUsername)
+	}
+
+	// Attach the aggregation to target messages and drop the reaction
+	// messages from the view
+	var newMsgs []chat1.MessageUnboxed
+	for _, msg := range originalMsgs {
+		if msg.IsValid() && msg.GetMessageType() == chat1.MessageType_REACTION {
+			continue
+		}
+		if rmap, ok := reactions[msg.GetMessageID()]; ok && msg.IsValid() {
+			mvalid := msg.Valid()
+			for emoji, senders := range rmap {
+				for _, sender := range senders {
+					mvalid.Reactions = addReaction(mvalid.Reactions, emoji, sender)
+				}
+			}
+			t.Debug(ctx, "run: aggregated reactions: convID: %s target: %d emojis: %d", convID,
+				msg.GetMessageID(), len(rmap))
+			msg = chat1.NewMessageUnboxedWithValid(mvalid)
+		}
+		newMsgs = append(newMsgs, msg)
+	}
+	return newMsgs, nil
+}
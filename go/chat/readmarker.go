@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/storage"
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+// How long we wait for further reads of a conversation before sending the
+// read receipt, so scrolling through a thread produces one RPC, not many
+const markAsReadDebounce = time.Second
+
+// How long to wait before retrying a failed MarkAsRead
+const markAsReadRetryInterval = 15 * time.Second
+
+// After this many failed attempts we stop retrying and leave the unsynced
+// read mark for the connect time replay to pick up
+const markAsReadMaxRetries = 4
+
+type readMarkerEntry struct {
+	convID  chat1.ConversationID
+	uid     gregor1.UID
+	msgID   chat1.MessageID
+	retries int
+	timer   *time.Timer
+}
+
+// readMarker sends MarkAsRead receipts to the server off the Pull path.
+// Reads are debounced per conversation and failures are retried in the
+// background, so a read receipt RPC never slows down or fails a local read.
+// The local read mark is recorded by the caller before anything is handed
+// here; this type only deals with syncing it to the server.
+type readMarker struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+
+	ri        func() chat1.RemoteInterface
+	readMarks *storage.ReadMarks
+	pending   map[string]*readMarkerEntry
+}
+
+func newReadMarker(g *libkb.GlobalContext, ri func() chat1.RemoteInterface,
+	readMarks *storage.ReadMarks) *readMarker {
+	return &readMarker{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "ReadMarker", false),
+		ri:           ri,
+		readMarks:    readMarks,
+		pending:      map[string]*readMarkerEntry{},
+	}
+}
+
+func (m *readMarker) key(convID chat1.ConversationID, uid gregor1.UID) string {
+	return fmt.Sprintf("%s:%s", uid, convID)
+}
+
+// MarkAsRead queues a read receipt for a conversation. Successive calls for
+// the same conversation within the debounce window collapse into one RPC
+// carrying the highest message ID seen.
+func (m *readMarker) MarkAsRead(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgID chat1.MessageID) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := m.key(convID, uid)
+	if ent, ok := m.pending[key]; ok {
+		if msgID > ent.msgID {
+			ent.msgID = msgID
+		}
+		ent.retries = 0
+		ent.timer.Reset(markAsReadDebounce)
+		return
+	}
+	ent := &readMarkerEntry{
+		convID: convID,
+		uid:    uid,
+		msgID:  msgID,
+	}
+	ent.timer = time.AfterFunc(markAsReadDebounce, func() { m.flush(key) })
+	m.pending[key] = ent
+}
+
+func (m *readMarker) flush(key string) {
+	ctx := context.Background()
+
+	m.Lock()
+	ent, ok := m.pending[key]
+	if !ok {
+		m.Unlock()
+		return
+	}
+	convID := ent.convID
+	uid := ent.uid
+	msgID := ent.msgID
+	m.Unlock()
+
+	_, err := m.ri().MarkAsRead(ctx, chat1.MarkAsReadArg{
+		ConversationID: convID,
+		MsgID:          msgID,
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	ent, ok = m.pending[key]
+	if !ok {
+		return
+	}
+	if err != nil {
+		ent.retries++
+		if ent.retries > markAsReadMaxRetries {
+			// Give up; the unsynced read mark gets replayed on reconnect
+			m.Debug(ctx, "flush: giving up on %s after %d attempts: %s", key, ent.retries,
+				err.Error())
+			delete(m.pending, key)
+			return
+		}
+		m.Debug(ctx, "flush: MarkAsRead failed for %s (attempt %d), retrying: %s", key,
+			ent.retries, err.Error())
+		ent.timer = time.AfterFunc(markAsReadRetryInterval, func() { m.flush(key) })
+		return
+	}
+
+	if merr := m.readMarks.Mark(ctx, convID, uid, msgID, true); merr != nil {
+		m.Debug(ctx, "flush: failed to sync local read mark: %s", merr.Error())
+	}
+	if ent.msgID > msgID {
+		// More reads arrived while the RPC was in flight, go around again
+		ent.retries = 0
+		ent.timer = time.AfterFunc(markAsReadDebounce, func() { m.flush(key) })
+		return
+	}
+	delete(m.pending, key)
+}
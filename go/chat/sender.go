@@ -413,7 +413,10 @@ func (d DelivererSecretUI) GetPassphrase(pinentry keybase1.GUIEntryArg, terminal
 	return keybase1.GetPassphraseRes{}, fmt.Errorf("no secret UI available")
 }
 
-const deliverMaxAttempts = 5
+// Failed attempts back off exponentially from the base, capped at the max, so
+// a flaky connection doesn't spin on the same message
+const deliverBaseBackoff = 2 * time.Second
+const deliverMaxBackoff = time.Minute
 
 type DelivererInfoError interface {
 	IsImmediateFail() (chat1.OutboxErrorType, bool)
@@ -427,6 +430,7 @@ type Deliverer struct {
 	sender        Sender
 	outbox        *storage.Outbox
 	storage       *storage.Storage
+	receipts      *storage.Receipts
 	identNotifier *IdentifyNotifier
 	shutdownCh    chan chan struct{}
 	msgSentCh     chan struct{}
@@ -434,6 +438,12 @@ type Deliverer struct {
 	delivering    bool
 	connected     bool
 	clock         clockwork.Clock
+
+	// Time of the last send attempt per outbox ID, for backoff
+	attemptTimes map[string]time.Time
+	// Fingerprint of the last delivery status notification, so we only tell
+	// the UI about changes
+	lastStatusReport string
 }
 
 func NewDeliverer(g *libkb.GlobalContext, sender Sender) *Deliverer {
@@ -445,8 +455,10 @@ func NewDeliverer(g *libkb.GlobalContext, sender Sender) *Deliverer {
 		reconnectCh:   make(chan struct{}, 100),
 		sender:        sender,
 		storage:       storage.New(g, func() libkb.SecretUI { return DelivererSecretUI{} }),
+		receipts:      storage.NewReceipts(g),
 		identNotifier: NewIdentifyNotifier(g),
 		clock:         clockwork.NewRealClock(),
+		attemptTimes:  make(map[string]time.Time),
 	}
 
 	g.PushShutdownHook(func() error {
@@ -467,6 +479,8 @@ func (s *Deliverer) Start(ctx context.Context, uid gregor1.UID) {
 		return DelivererSecretUI{}
 	})
 	s.outbox.SetClock(s.clock)
+	s.attemptTimes = make(map[string]time.Time)
+	s.lastStatusReport = ""
 
 	s.delivering = true
 	go s.deliverLoop()
@@ -507,6 +521,11 @@ func (s *Deliverer) SetClock(clock clockwork.Clock) {
 func (s *Deliverer) Connected(ctx context.Context) {
 	s.connected = true
 
+	// Forget backoff state so everything queued while offline goes out now
+	s.Lock()
+	s.attemptTimes = make(map[string]time.Time)
+	s.Unlock()
+
 	// Wake up deliver loop on reconnect
 	s.Debug(ctx, "reconnected: forcing deliver loop run")
 	s.reconnectCh <- struct{}{}
@@ -535,12 +554,11 @@ func (s *Deliverer) Queue(ctx context.Context, convID chat1.ConversationID, msg
 	return obr, nil
 }
 
+// doNotRetryFailure determines if a send error is permanent. Offline is not a
+// failure condition anymore: messages just wait in the outbox until we
+// reconnect.
 func (s *Deliverer) doNotRetryFailure(obr chat1.OutboxRecord, err error) (chat1.OutboxErrorType, bool) {
 
-	if !s.connected {
-		return chat1.OutboxErrorType_OFFLINE, true
-	}
-
 	// Check for an identify error
 	if berr, ok := err.(DelivererInfoError); ok {
 		if typ, ok := berr.IsImmediateFail(); ok {
@@ -549,7 +567,7 @@ func (s *Deliverer) doNotRetryFailure(obr chat1.OutboxRecord, err error) (chat1.
 	}
 
 	// Check attempts otherwise
-	if obr.State.Sending() > deliverMaxAttempts {
+	if obr.State.Sending() > s.G().Env.GetChatOutboxMaxAttempts() {
 		return chat1.OutboxErrorType_MISC, true
 	}
 
@@ -573,6 +591,69 @@ func (s *Deliverer) failMessage(ctx context.Context, obr chat1.OutboxRecord,
 	return nil
 }
 
+// attemptReady determines if enough time has passed since the last failed
+// attempt to try a record again.
+func (s *Deliverer) attemptReady(obr chat1.OutboxRecord) bool {
+	attempts := obr.State.Sending()
+	if attempts == 0 {
+		return true
+	}
+	s.Lock()
+	last, ok := s.attemptTimes[obr.OutboxID.String()]
+	s.Unlock()
+	if !ok {
+		return true
+	}
+	backoff := deliverBaseBackoff * time.Duration(1<<uint(attempts-1))
+	if backoff > deliverMaxBackoff {
+		backoff = deliverMaxBackoff
+	}
+	return s.clock.Now().Sub(last) >= backoff
+}
+
+func (s *Deliverer) recordAttempt(obr chat1.OutboxRecord) {
+	s.Lock()
+	s.attemptTimes[obr.OutboxID.String()] = s.clock.Now()
+	s.Unlock()
+}
+
+func (s *Deliverer) clearAttempt(obr chat1.OutboxRecord) {
+	s.Lock()
+	delete(s.attemptTimes, obr.OutboxID.String())
+	s.Unlock()
+}
+
+// notifyDeliveryStatus tells the UI what is still waiting in the outbox, so it
+// can render per-message delivery state. Quiet if nothing changed since the
+// last report.
+func (s *Deliverer) notifyDeliveryStatus(ctx context.Context) {
+	obrs, err := s.outbox.PullAllConversations(ctx, false, false)
+	if err != nil {
+		if _, ok := err.(storage.MissError); !ok {
+			s.Debug(ctx, "notifyDeliveryStatus: unable to pull outbox: err: %s", err.Error())
+		}
+		obrs = nil
+	}
+
+	var fp string
+	for _, obr := range obrs {
+		fp += fmt.Sprintf("%s:%d;", obr.OutboxID, obr.State.Sending())
+	}
+	s.Lock()
+	changed := fp != s.lastStatusReport
+	s.lastStatusReport = fp
+	s.Unlock()
+	if !changed {
+		return
+	}
+
+	act := chat1.NewChatActivityWithDeliveryStatus(chat1.DeliveryStatusInfo{
+		OutboxRecords: obrs,
+	})
+	s.G().NotifyRouter.HandleNewChatActivity(context.Background(),
+		keybase1.UID(s.outbox.GetUID().String()), &act)
+}
+
 func (s *Deliverer) deliverLoop() {
 	bgctx := context.Background()
 	s.Debug(bgctx, "starting non blocking sender deliver loop: uid: %s duration: %v",
@@ -591,8 +672,23 @@ func (s *Deliverer) deliverLoop() {
 		case <-s.G().Clock().After(s.G().Env.GetChatDelivererInterval()):
 		}
 
+		// Move anything stuck past the age or attempt limits into the
+		// terminal failed state, and let the UI know about the casualties
+		if failed, ferr := s.outbox.GC(bgctx, s.G().Env.GetChatOutboxMaxAge(),
+			s.G().Env.GetChatOutboxMaxAttempts()); ferr != nil {
+			s.Debug(bgctx, "unable to gc outbox: uid: %s err: %s", s.outbox.GetUID(), ferr.Error())
+		} else if len(failed) > 0 {
+			s.Debug(bgctx, "gc failed %d stuck outbox records: uid: %s", len(failed),
+				s.outbox.GetUID())
+			act := chat1.NewChatActivityWithFailedMessage(chat1.FailedMessageInfo{
+				OutboxRecords: failed,
+			})
+			s.G().NotifyRouter.HandleNewChatActivity(context.Background(),
+				keybase1.UID(s.outbox.GetUID().String()), &act)
+		}
+
 		// Fetch outbox
-		obrs, err := s.outbox.PullAllConversations(bgctx, false, true)
+		obrs, err := s.outbox.PullAllConversations(bgctx, false, false)
 		if err != nil {
 			if _, ok := err.(storage.MissError); !ok {
 				s.Debug(bgctx, "unable to pull outbox: uid: %s err: %s", s.outbox.GetUID(),
@@ -600,6 +696,17 @@ func (s *Deliverer) deliverLoop() {
 			}
 			continue
 		}
+
+		// If we are offline, leave everything queued. It all goes out when the
+		// reconnect signal hits.
+		if !s.connected {
+			if len(obrs) > 0 {
+				s.Debug(bgctx, "offline: leaving %d messages queued: uid: %s", len(obrs),
+					s.outbox.GetUID())
+			}
+			s.notifyDeliveryStatus(bgctx)
+			continue
+		}
 		if len(obrs) > 0 {
 			s.Debug(bgctx, "flushing %d items from the outbox: uid: %s", len(obrs), s.outbox.GetUID())
 		}
@@ -608,37 +715,52 @@ func (s *Deliverer) deliverLoop() {
 		var breaks []keybase1.TLFIdentifyFailure
 		for _, obr := range obrs {
 
+			// Respect the backoff schedule for records that have failed before
+			if !s.attemptReady(obr) {
+				continue
+			}
+
 			bctx := Context(context.Background(), obr.IdentifyBehavior, &breaks, s.identNotifier)
-			if !s.connected {
-				err = errors.New("disconnected from chat server")
-			} else {
-				_, _, _, err = s.sender.Send(bctx, obr.ConvID, obr.Msg, 0)
+			s.recordAttempt(obr)
+			_, msgID, _, err := s.sender.Send(bctx, obr.ConvID, obr.Msg, 0)
+			if err == nil {
+				s.clearAttempt(obr)
+				// Record the server ack for delivery receipts
+				if rerr := s.receipts.MarkDelivered(bgctx, obr.ConvID, s.outbox.GetUID(),
+					msgID); rerr != nil {
+					s.Debug(bgctx, "unable to record delivery receipt: %s", rerr.Error())
+				}
+				if err := s.outbox.RemoveMessage(bgctx, obr.OutboxID); err != nil {
+					s.Debug(bgctx, "unable to remove sent message from outbox: uid: %s err: %s",
+						s.outbox.GetUID(), err.Error())
+				}
+				continue
 			}
-			if err != nil {
-				s.Debug(bgctx, "failed to send msg: uid: %s convID: %s err: %s attempts: %d",
-					s.outbox.GetUID(), obr.ConvID, err.Error(), obr.State.Sending())
-
-				// Process failure. If we determine that the message is unrecoverable, then bail out.
-				if errTyp, ok := s.doNotRetryFailure(obr, err); ok {
-					// Record failure if we hit this case, and put the rest of this loop in a
-					// mode where all other entries also fail.
-					s.Debug(bgctx, "failure condition reached, marking all as errors and notifying: errTyp: %v attempts: %d", errTyp, obr.State.Sending())
-
-					if err := s.failMessage(bgctx, obr, chat1.OutboxStateError{
-						Message: err.Error(),
-						Typ:     errTyp,
-					}); err != nil {
-						s.Debug(bgctx, "unable to fail message: err: %s", err.Error())
-					}
-
-				} else {
-					if err = s.outbox.RecordFailedAttempt(bgctx, obr); err != nil {
-						s.Debug(bgctx, "unable to record failed attempt on outbox: uid %s err: %s",
-							s.outbox.GetUID(), err.Error())
-					}
+			s.Debug(bgctx, "failed to send msg: uid: %s convID: %s err: %s attempts: %d",
+				s.outbox.GetUID(), obr.ConvID, err.Error(), obr.State.Sending())
+
+			// Process failure. If we determine that the message is unrecoverable, then bail out.
+			if errTyp, ok := s.doNotRetryFailure(obr, err); ok {
+				// Record failure if we hit this case, and put the rest of this loop in a
+				// mode where all other entries also fail.
+				s.Debug(bgctx, "failure condition reached, marking all as errors and notifying: errTyp: %v attempts: %d", errTyp, obr.State.Sending())
+
+				s.clearAttempt(obr)
+				if err := s.failMessage(bgctx, obr, chat1.OutboxStateError{
+					Message: err.Error(),
+					Typ:     errTyp,
+				}); err != nil {
+					s.Debug(bgctx, "unable to fail message: err: %s", err.Error())
+				}
+
+			} else {
+				if err = s.outbox.RecordFailedAttempt(bgctx, obr); err != nil {
+					s.Debug(bgctx, "unable to record failed attempt on outbox: uid %s err: %s",
+						s.outbox.GetUID(), err.Error())
 				}
 			}
 		}
+		s.notifyDeliveryStatus(bgctx)
 	}
 }
 
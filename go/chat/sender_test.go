@@ -44,6 +44,10 @@ func (n *chatListener) KeyfamilyChanged(uid keybase1.UID)
 func (n *chatListener) PGPKeyInSecretStoreFile()                                     {}
 func (n *chatListener) BadgeState(badgeState keybase1.BadgeState)                    {}
 func (n *chatListener) ReachabilityChanged(r keybase1.Reachability)                  {}
+func (n *chatListener) GregorThrottled(throttled bool)                               {}
+func (n *chatListener) GregorConnectFatal(reason string)                             {}
+func (n *chatListener) GregorHandlerQuarantined(name string)                         {}
+func (n *chatListener) GenericGregorEvent(system string, body string)                {}
 func (n *chatListener) ChatIdentifyUpdate(update keybase1.CanonicalTLFNameAndIDWithBreaks) {
 	n.identifyUpdate <- update
 }
@@ -53,6 +57,13 @@ func (n *chatListener) ChatTLFResolve(uid keybase1.UID, convID chat1.Conversatio
 }
 func (n *chatListener) ChatInboxStale(uid keybase1.UID)                                {}
 func (n *chatListener) ChatThreadsStale(uid keybase1.UID, cids []chat1.ConversationID) {}
+func (n *chatListener) ChatTypingUpdate(uid keybase1.UID, convID chat1.ConversationID, typer keybase1.UID, typing bool) {
+}
+func (n *chatListener) ChatMembersUpdate(uid keybase1.UID, convID chat1.ConversationID, joined []keybase1.UID, left []keybase1.UID) {
+}
+func (n *chatListener) ChatMessageConflict(uid keybase1.UID, convID chat1.ConversationID, msgID chat1.MessageID) {
+}
+func (n *chatListener) ChatCompactionProgress(uid keybase1.UID, done int, total int) {}
 func (n *chatListener) NewChatActivity(uid keybase1.UID, activity chat1.ChatActivity) {
 	n.Lock()
 	defer n.Unlock()
@@ -370,8 +381,11 @@ func TestFailingSender(t *testing.T) {
 		require.NoError(t, err)
 		obids = append(obids, obid)
 	}
-	for i := 0; i < deliverMaxAttempts; i++ {
+	for i := 0; i < libkb.ChatOutboxMaxAttempts+2; i++ {
+		// Advance past the retry backoff so every forced run attempts a send
+		world.Fc.Advance(deliverMaxBackoff)
 		tc.G.MessageDeliverer.ForceDeliverLoop(context.TODO())
+		time.Sleep(100 * time.Millisecond)
 	}
 
 	var recvd []chat1.OutboxID
@@ -429,50 +443,23 @@ func TestDisconnectedFailure(t *testing.T) {
 		cl.Advance(time.Millisecond)
 	}
 
-	var allrecvd []chat1.OutboxID
-	var recvd []chat1.OutboxID
-	appendUnique := func(a []chat1.OutboxID, r []chat1.OutboxID) (res []chat1.OutboxID) {
-		m := make(map[string]bool)
-		for _, i := range a {
-			m[hex.EncodeToString(i)] = true
-			res = append(res, i)
-		}
-		for _, i := range r {
-			if !m[hex.EncodeToString(i)] {
-				res = append(res, i)
-			}
-		}
-		return res
+	// Nothing fails while we are offline, the messages just wait in the outbox
+	select {
+	case <-listener.failing:
+		require.Fail(t, "no failed messages expected while offline")
+	case <-time.After(time.Second):
 	}
-	for {
-		select {
-		case recvd = <-listener.failing:
-			allrecvd = appendUnique(allrecvd, recvd)
-			if len(allrecvd) >= len(obids) {
-				break
-			}
-			continue
-		case <-time.After(20 * time.Second):
-			require.Fail(t, "timeout in failing loop")
-			break
-		}
-		break
+	f := func() libkb.SecretUI {
+		return &libkb.TestSecretUI{Passphrase: u.Passphrase}
 	}
-
-	require.Equal(t, len(obids), len(allrecvd), "invalid length")
-	require.Equal(t, obids, allrecvd, "list mismatch")
+	outbox := storage.NewOutbox(tc.G, u.User.GetUID().ToBytes(), f)
+	obrs, err := outbox.PullAllConversations(context.TODO(), false, false)
+	require.NoError(t, err)
+	require.Equal(t, len(obids), len(obrs), "wrong number of queued messages")
 
 	t.Logf("reconnecting and checking for successes")
 	<-tc.G.MessageDeliverer.Stop(context.TODO())
-	<-tc.G.MessageDeliverer.Stop(context.TODO())
 	tc.G.MessageDeliverer.(*Deliverer).SetSender(baseSender)
-	f := func() libkb.SecretUI {
-		return &libkb.TestSecretUI{Passphrase: u.Passphrase}
-	}
-	outbox := storage.NewOutbox(tc.G, u.User.GetUID().ToBytes(), f)
-	for _, obid := range obids {
-		require.NoError(t, outbox.RetryMessage(context.TODO(), obid))
-	}
 	tc.G.MessageDeliverer.Connected(context.TODO())
 	tc.G.MessageDeliverer.Start(context.TODO(), u.User.GetUID().ToBytes())
 
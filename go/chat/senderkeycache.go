@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+type senderKeyRes struct {
+	found     bool
+	revokedAt *keybase1.KeybaseTime
+	deleted   bool
+}
+
+// senderKeyCache memoizes the sigchain lookups behind Boxer.ValidSenderKey.
+// Revocation checks run for every valid message on a Pull cache hit, and the
+// answer for a (sender, key) pair only changes when the sender's sigchain
+// does, so entries live until HandleUserChanged invalidates that user.
+// Whether a key was valid at a particular message ctime is computed from the
+// cached revocation time, so no per-ctime state is kept.
+type senderKeyCache struct {
+	sync.Mutex
+	res map[string]senderKeyRes
+}
+
+func newSenderKeyCache() *senderKeyCache {
+	return &senderKeyCache{
+		res: make(map[string]senderKeyRes),
+	}
+}
+
+func (c *senderKeyCache) key(uid keybase1.UID, kid keybase1.KID) string {
+	return fmt.Sprintf("%s:%s", uid, kid)
+}
+
+func (c *senderKeyCache) get(uid keybase1.UID, kid keybase1.KID) (senderKeyRes, bool) {
+	c.Lock()
+	defer c.Unlock()
+	res, ok := c.res[c.key(uid, kid)]
+	return res, ok
+}
+
+func (c *senderKeyCache) put(uid keybase1.UID, kid keybase1.KID, res senderKeyRes) {
+	c.Lock()
+	defer c.Unlock()
+	c.res[c.key(uid, kid)] = res
+}
+
+// invalidate drops all entries for a user, forcing fresh sigchain checks.
+func (c *senderKeyCache) invalidate(uid keybase1.UID) {
+	c.Lock()
+	defer c.Unlock()
+	prefix := uid.String() + ":"
+	for key := range c.res {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			delete(c.res, key)
+		}
+	}
+}
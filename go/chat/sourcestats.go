@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/chat1"
+)
+
+// sourceStats tracks cache effectiveness counters for the hybrid
+// conversation source: how often Pull is served from storage, how much gets
+// merged in, and how long unboxing takes. All methods are safe for
+// concurrent use.
+type sourceStats struct {
+	sync.Mutex
+
+	pullHits     int64
+	pullPartials int64
+	pullMisses   int64
+	mergeBatches int64
+	mergedMsgs   int64
+	unboxBatches int64
+	unboxMsgs    int64
+	unboxDur     time.Duration
+}
+
+func newSourceStats() *sourceStats {
+	return &sourceStats{}
+}
+
+func (s *sourceStats) recordHit() {
+	s.Lock()
+	defer s.Unlock()
+	s.pullHits++
+}
+
+func (s *sourceStats) recordPartial() {
+	s.Lock()
+	defer s.Unlock()
+	s.pullPartials++
+}
+
+func (s *sourceStats) recordMiss() {
+	s.Lock()
+	defer s.Unlock()
+	s.pullMisses++
+}
+
+func (s *sourceStats) recordMerge(numMsgs int) {
+	s.Lock()
+	defer s.Unlock()
+	s.mergeBatches++
+	s.mergedMsgs += int64(numMsgs)
+}
+
+func (s *sourceStats) recordUnbox(numMsgs int, dur time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.unboxBatches++
+	s.unboxMsgs += int64(numMsgs)
+	s.unboxDur += dur
+}
+
+func (s *sourceStats) export() chat1.CacheStatsLocalRes {
+	s.Lock()
+	defer s.Unlock()
+	return chat1.CacheStatsLocalRes{
+		PullCacheHits:       s.pullHits,
+		PullCachePartials:   s.pullPartials,
+		PullCacheMisses:     s.pullMisses,
+		MergeBatches:        s.mergeBatches,
+		MergedMessages:      s.mergedMsgs,
+		UnboxBatches:        s.unboxBatches,
+		UnboxedMessages:     s.unboxMsgs,
+		UnboxLatencyTotalMs: int64(s.unboxDur / time.Millisecond),
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const applyJournalVersion = 1
+
+// How many pending applies we keep per uid; beyond this the oldest entries
+// are dropped, since the stale-thread notification path recovers them anyway
+const applyJournalLimit = 200
+
+// ApplyEntry is one journaled newMessage apply: the payload is written here
+// before conversation storage and the inbox are touched, and removed once
+// both writes succeed. Entries left behind by a crash are replayed later.
+type ApplyEntry struct {
+	ID     uint64               `codec:"I"`
+	ConvID chat1.ConversationID `codec:"C"`
+	Vers   chat1.InboxVers      `codec:"V"`
+	Msg    chat1.MessageBoxed   `codec:"M"`
+}
+
+type diskApplyJournal struct {
+	Version int          `codec:"V"`
+	NextID  uint64       `codec:"N"`
+	Entries []ApplyEntry `codec:"E"`
+}
+
+func makeApplyJournalKey(uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatApplyJournal,
+		Key: fmt.Sprintf("aj:%s", uid),
+	}
+}
+
+// ApplyJournal persists newMessage payloads across the two-step apply into
+// conversation storage and the inbox, so a crash between the steps leaves a
+// record to replay instead of silently inconsistent state.
+type ApplyJournal struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func NewApplyJournal(g *libkb.GlobalContext) *ApplyJournal {
+	return &ApplyJournal{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "ApplyJournal", false),
+	}
+}
+
+func (j *ApplyJournal) readLocked(ctx context.Context, uid gregor1.UID) diskApplyJournal {
+	fresh := diskApplyJournal{Version: applyJournalVersion, NextID: 1}
+	raw, found, err := j.G().LocalChatDb.GetRaw(makeApplyJournalKey(uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskApplyJournal
+	if err := decode(raw, &d); err != nil {
+		j.Debug(ctx, "readLocked: failed to decode journal, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != applyJournalVersion {
+		return fresh
+	}
+	return d
+}
+
+func (j *ApplyJournal) writeLocked(uid gregor1.UID, d diskApplyJournal) error {
+	// An empty journal is still written out, keeping NextID monotonic
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return j.G().LocalChatDb.PutRaw(makeApplyJournalKey(uid), dat)
+}
+
+// Begin records a payload about to be applied and returns the entry ID to
+// pass to Commit once both writes have succeeded.
+func (j *ApplyJournal) Begin(ctx context.Context, uid gregor1.UID, convID chat1.ConversationID,
+	vers chat1.InboxVers, msg chat1.MessageBoxed) (uint64, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	d := j.readLocked(ctx, uid)
+	id := d.NextID
+	d.NextID++
+	d.Entries = append(d.Entries, ApplyEntry{
+		ID:     id,
+		ConvID: convID,
+		Vers:   vers,
+		Msg:    msg,
+	})
+	if len(d.Entries) > applyJournalLimit {
+		d.Entries = d.Entries[len(d.Entries)-applyJournalLimit:]
+	}
+	return id, j.writeLocked(uid, d)
+}
+
+// Commit removes a journal entry after its apply has fully landed.
+func (j *ApplyJournal) Commit(ctx context.Context, uid gregor1.UID, id uint64) error {
+	j.Lock()
+	defer j.Unlock()
+
+	d := j.readLocked(ctx, uid)
+	var res []ApplyEntry
+	for _, e := range d.Entries {
+		if e.ID != id {
+			res = append(res, e)
+		}
+	}
+	if len(res) == len(d.Entries) {
+		return nil
+	}
+	d.Entries = res
+	return j.writeLocked(uid, d)
+}
+
+// Pending returns the journaled applies that never committed, oldest first.
+func (j *ApplyJournal) Pending(ctx context.Context, uid gregor1.UID) []ApplyEntry {
+	j.Lock()
+	defer j.Unlock()
+	return j.readLocked(ctx, uid).Entries
+}
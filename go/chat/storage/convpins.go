@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const convPinsVersion = 1
+
+type diskConvPins struct {
+	Version int                    `codec:"V"`
+	IDs     []chat1.ConversationID `codec:"P"`
+}
+
+func makeConvPinsKey(uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatConvPins,
+		Key: fmt.Sprintf("cp:%s", uid),
+	}
+}
+
+// ConvPins persists the set of conversations the user wants kept offline.
+// Pinned conversations are exempt from cache eviction, warmed first by the
+// prefetcher, and have their history backfilled to the configured depth.
+type ConvPins struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func NewConvPins(g *libkb.GlobalContext) *ConvPins {
+	return &ConvPins{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "ConvPins", false),
+	}
+}
+
+func (p *ConvPins) readLocked(ctx context.Context, uid gregor1.UID) diskConvPins {
+	fresh := diskConvPins{Version: convPinsVersion}
+	raw, found, err := p.G().LocalChatDb.GetRaw(makeConvPinsKey(uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskConvPins
+	if err := decode(raw, &d); err != nil {
+		p.Debug(ctx, "readLocked: failed to decode conv pins, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != convPinsVersion {
+		return fresh
+	}
+	return d
+}
+
+func (p *ConvPins) writeLocked(uid gregor1.UID, d diskConvPins) error {
+	if len(d.IDs) == 0 {
+		return p.G().LocalChatDb.Delete(makeConvPinsKey(uid))
+	}
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return p.G().LocalChatDb.PutRaw(makeConvPinsKey(uid), dat)
+}
+
+// Set adds or removes a conversation from the pinned set.
+func (p *ConvPins) Set(ctx context.Context, uid gregor1.UID, convID chat1.ConversationID,
+	pinned bool) error {
+	p.Lock()
+	defer p.Unlock()
+
+	d := p.readLocked(ctx, uid)
+	var res []chat1.ConversationID
+	for _, id := range d.IDs {
+		if !id.Eq(convID) {
+			res = append(res, id)
+		}
+	}
+	if pinned {
+		res = append(res, convID)
+	}
+	if len(res) == len(d.IDs) && !pinned {
+		return nil
+	}
+	d.IDs = res
+	return p.writeLocked(uid, d)
+}
+
+// List returns the pinned conversations for a user.
+func (p *ConvPins) List(ctx context.Context, uid gregor1.UID) []chat1.ConversationID {
+	p.Lock()
+	defer p.Unlock()
+	return p.readLocked(ctx, uid).IDs
+}
+
+// PinnedMap returns the pinned set keyed by conversation ID string, for quick
+// membership checks.
+func (p *ConvPins) PinnedMap(ctx context.Context, uid gregor1.UID) map[string]bool {
+	p.Lock()
+	defer p.Unlock()
+
+	res := make(map[string]bool)
+	for _, id := range p.readLocked(ctx, uid).IDs {
+		res[id.String()] = true
+	}
+	return res
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const derivedViewVersion = 2
+
+type diskDerivedView struct {
+	Version   int                                      `codec:"V"`
+	Deleted   map[chat1.MessageID]bool                 `codec:"D"`
+	Msgs      map[chat1.MessageID]chat1.MessageUnboxed `codec:"M"`
+	Reactions map[chat1.MessageID]map[string][]string  `codec:"R"`
+}
+
+func makeDerivedViewKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatDerived,
+		Key: fmt.Sprintf("dv:%s:%s", uid, convID),
+	}
+}
+
+// derivedView holds the final form of superseded messages, computed
+// incrementally as superseders are merged. The block store keeps the original
+// bodies of edited messages; thread reads overlay this view so they don't
+// have to run the supersedes transform for ranges we have already processed.
+// Derived entries carry the same supersededBy pointers as their stored
+// counterparts, so readers still see the supersede relationship on the final
+// form. Reaction messages aggregate here as well, as emoji to reacting
+// usernames per target message.
+type derivedView struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+	*baseBox
+}
+
+func newDerivedView(g *libkb.GlobalContext, getSecretUI func() libkb.SecretUI) *derivedView {
+	return &derivedView{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "DerivedView", false),
+		baseBox:      newBaseBox(g, getSecretUI),
+	}
+}
+
+func (d *derivedView) readLocked(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) diskDerivedView {
+	fresh := diskDerivedView{
+		Version:   derivedViewVersion,
+		Deleted:   make(map[chat1.MessageID]bool),
+		Msgs:      make(map[chat1.MessageID]chat1.MessageUnboxed),
+		Reactions: make(map[chat1.MessageID]map[string][]string),
+	}
+	var dv diskDerivedView
+	found, err := d.readDiskBox(makeDerivedViewKey(convID, uid), &dv)
+	if err != nil || !found {
+		if err != nil {
+			d.Debug(ctx, "readLocked: failed to read derived view, resetting: %s", err.Error())
+		}
+		return fresh
+	}
+	if dv.Version != derivedViewVersion || dv.Deleted == nil || dv.Msgs == nil ||
+		dv.Reactions == nil {
+		return fresh
+	}
+	return dv
+}
+
+func (d *derivedView) transformEdit(target chat1.MessageUnboxed,
+	super chat1.MessageUnboxed) chat1.MessageUnboxed {
+	mvalid := target.Valid()
+	mvalid.ClientHeader.MessageType = chat1.MessageType_TEXT
+	mvalid.ServerHeader.SupersededBy = super.GetMessageID()
+	mvalid.MessageBody = chat1.NewMessageBodyWithText(chat1.MessageText{
+		Body: super.Valid().MessageBody.Edit().Body,
+	})
+	return chat1.NewMessageUnboxedWithValid(mvalid)
+}
+
+func (d *derivedView) transformAttachment(target chat1.MessageUnboxed,
+	super chat1.MessageUnboxed) chat1.MessageUnboxed {
+	uploaded := super.Valid().MessageBody.Attachmentuploaded()
+	attachment := chat1.MessageAttachment{
+		Object:   uploaded.Object,
+		Previews: uploaded.Previews,
+		Metadata: uploaded.Metadata,
+		Uploaded: true,
+	}
+	if len(uploaded.Previews) > 0 {
+		attachment.Preview = &uploaded.Previews[0]
+	}
+	mvalid := target.Valid()
+	mvalid.ClientHeader.MessageType = chat1.MessageType_ATTACHMENT
+	mvalid.ServerHeader.SupersededBy = super.GetMessageID()
+	mvalid.MessageBody = chat1.NewMessageBodyWithAttachment(attachment)
+	return chat1.NewMessageUnboxedWithValid(mvalid)
+}
+
+// apply records the effect of a superseder on its target message.
+func (d *derivedView) apply(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	target chat1.MessageUnboxed, super chat1.MessageUnboxed) error {
+	d.Lock()
+	defer d.Unlock()
+
+	dv := d.readLocked(ctx, convID, uid)
+	targetID := target.GetMessageID()
+	switch super.GetMessageType() {
+	case chat1.MessageType_DELETE:
+		dv.Deleted[targetID] = true
+		delete(dv.Msgs, targetID)
+		delete(dv.Reactions, targetID)
+	case chat1.MessageType_EDIT:
+		dv.Msgs[targetID] = d.transformEdit(target, super)
+	case chat1.MessageType_ATTACHMENTUPLOADED:
+		dv.Msgs[targetID] = d.transformAttachment(target, super)
+	case chat1.MessageType_REACTION:
+		if dv.Deleted[targetID] {
+			return nil
+		}
+		emoji := super.Valid().MessageBody.Reaction().Body
+		sender := super.Valid().SenderUsername
+		if dv.Reactions[targetID] == nil {
+			dv.Reactions[targetID] = make(map[string][]string)
+		}
+		for _, existing := range dv.Reactions[targetID][emoji] {
+			if existing == sender {
+				return nil
+			}
+		}
+		dv.Reactions[targetID][emoji] = append(dv.Reactions[targetID][emoji], sender)
+	default:
+		return nil
+	}
+	d.Debug(ctx, "apply: convID: %s target: %d superseder: %d type: %v", convID, targetID,
+		super.GetMessageID(), super.GetMessageType())
+	return d.writeDiskBox(makeDerivedViewKey(convID, uid), dv)
+}
+
+// overlay substitutes derived final forms into a list of raw messages.
+// Deleted messages pass through in their stored form, which already has the
+// body emptied, so the shape of the list is stable across deletes.
+func (d *derivedView) overlay(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	msgs []chat1.MessageUnboxed) []chat1.MessageUnboxed {
+	d.Lock()
+	defer d.Unlock()
+
+	dv := d.readLocked(ctx, convID, uid)
+	if len(dv.Msgs) == 0 && len(dv.Reactions) == 0 {
+		return msgs
+	}
+	res := make([]chat1.MessageUnboxed, 0, len(msgs))
+	for _, msg := range msgs {
+		msgID := msg.GetMessageID()
+		if dmsg, ok := dv.Msgs[msgID]; ok {
+			msg = dmsg
+		}
+		if rmap, ok := dv.Reactions[msgID]; ok && msg.IsValid() {
+			mvalid := msg.Valid()
+			mvalid.Reactions = rmap
+			msg = chat1.NewMessageUnboxedWithValid(mvalid)
+		}
+		res = append(res, msg)
+	}
+	return res
+}
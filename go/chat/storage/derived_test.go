@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeReaction(id chat1.MessageID, target chat1.MessageID, emoji string, sender string) chat1.MessageUnboxed {
+	msg := chat1.MessageUnboxedValid{
+		ServerHeader: chat1.MessageServerHeader{
+			MessageID: id,
+		},
+		ClientHeader: chat1.MessageClientHeader{
+			MessageType: chat1.MessageType_REACTION,
+			Supersedes:  target,
+		},
+		SenderUsername: sender,
+		MessageBody: chat1.NewMessageBodyWithReaction(chat1.MessageReaction{
+			MessageID: target,
+			Body:      emoji,
+		}),
+	}
+	return chat1.NewMessageUnboxedWithValid(msg)
+}
+
+func TestDerivedViewEdit(t *testing.T) {
+	_, storage, uid := setupStorageTest(t, "derived edit")
+
+	msgs := makeMsgRange(10)
+	conv := makeConversation(msgs[0].GetMessageID())
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, msgs))
+
+	edit := makeEdit(chat1.MessageID(11), 6)
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid,
+		[]chat1.MessageUnboxed{edit}))
+
+	conv.ReaderInfo.MaxMsgid = 11
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 11, len(res.Messages), "wrong amount of messages")
+
+	edited := res.Messages[len(res.Messages)-6]
+	require.Equal(t, chat1.MessageID(6), edited.GetMessageID(), "MessageID incorrect")
+	require.Equal(t, chat1.MessageType_TEXT, edited.GetMessageType(), "edited message should read as text")
+	require.Equal(t, "edit", edited.Valid().MessageBody.Text().Body, "edited body not served")
+	require.Equal(t, chat1.MessageID(11), edited.Valid().ServerHeader.SupersededBy,
+		"supersededBy incorrect")
+}
+
+func TestDerivedViewDelete(t *testing.T) {
+	_, storage, uid := setupStorageTest(t, "derived delete")
+
+	msgs := makeMsgRange(10)
+	conv := makeConversation(msgs[0].GetMessageID())
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, msgs))
+
+	edit := makeEdit(chat1.MessageID(11), 6)
+	supersedingDelete := makeDelete(chat1.MessageID(12), 6, []chat1.MessageID{11})
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid,
+		[]chat1.MessageUnboxed{edit}))
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid,
+		[]chat1.MessageUnboxed{supersedingDelete}))
+
+	conv.ReaderInfo.MaxMsgid = 12
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 12, len(res.Messages), "deleted messages should stay in the thread")
+
+	deleted := res.Messages[len(res.Messages)-6].Valid()
+	require.Equal(t, chat1.MessageID(6), deleted.ServerHeader.MessageID, "MessageID incorrect")
+	require.Equal(t, chat1.MessageID(12), deleted.ServerHeader.SupersededBy, "supersededBy incorrect")
+	deletedBodyType, berr := deleted.MessageBody.MessageType()
+	require.NoError(t, berr)
+	require.Equal(t, chat1.MessageType_NONE, deletedBodyType, "expected the body to be deleted")
+
+	// A reaction landing after the delete should be screened out
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid,
+		[]chat1.MessageUnboxed{makeReaction(chat1.MessageID(13), 6, ":+1:", "alice")}))
+	conv.ReaderInfo.MaxMsgid = 13
+	res, err = storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	deleted = res.Messages[len(res.Messages)-6].Valid()
+	require.Len(t, deleted.Reactions, 0, "reaction on deleted message should be dropped")
+}
+
+func TestDerivedViewReactions(t *testing.T) {
+	_, storage, uid := setupStorageTest(t, "derived reactions")
+
+	msgs := makeMsgRange(10)
+	conv := makeConversation(msgs[0].GetMessageID())
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, msgs))
+
+	reactions := []chat1.MessageUnboxed{
+		makeReaction(chat1.MessageID(14), 3, ":-1:", "alice"),
+		makeReaction(chat1.MessageID(13), 3, ":+1:", "alice"),
+		makeReaction(chat1.MessageID(12), 3, ":+1:", "bob"),
+		makeReaction(chat1.MessageID(11), 3, ":+1:", "alice"),
+	}
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, reactions))
+
+	conv.ReaderInfo.MaxMsgid = 14
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+
+	target := res.Messages[len(res.Messages)-3].Valid()
+	require.Equal(t, chat1.MessageID(3), target.ServerHeader.MessageID, "MessageID incorrect")
+	require.Equal(t, []string{"alice", "bob"}, target.Reactions[":+1:"],
+		"duplicate sender should only count once")
+	require.Equal(t, []string{"alice"}, target.Reactions[":-1:"], "wrong senders")
+	require.Equal(t, chat1.MessageID(0), target.ServerHeader.SupersededBy,
+		"reactions should not supersede their target")
+	require.Equal(t, "junk text", target.MessageBody.Text().Body, "target body should be untouched")
+}
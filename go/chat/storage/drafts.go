@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+)
+
+const draftsVersion = 1
+
+type diskDraft struct {
+	Version int             `codec:"V"`
+	Draft   chat1.DraftInfo `codec:"D"`
+}
+
+// Drafts persists unsent message drafts per conversation, encrypted at rest
+// like the rest of chat storage, so the GUI can restore them across restarts.
+type Drafts struct {
+	sync.Mutex
+	libkb.Contextified
+	*baseBox
+	utils.DebugLabeler
+
+	uid gregor1.UID
+}
+
+func NewDrafts(g *libkb.GlobalContext, uid gregor1.UID, getSecretUI func() libkb.SecretUI) *Drafts {
+	return &Drafts{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Drafts", false),
+		baseBox:      newBaseBox(g, getSecretUI),
+		uid:          uid,
+	}
+}
+
+func (d *Drafts) dbKey(convID chat1.ConversationID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatDrafts,
+		Key: fmt.Sprintf("dr:%s:%s", d.uid, convID),
+	}
+}
+
+// Save stores the draft for a conversation, stamping its modification time.
+func (d *Drafts) Save(ctx context.Context, convID chat1.ConversationID, draft chat1.DraftInfo) Error {
+	d.Lock()
+	defer d.Unlock()
+
+	draft.Mtime = gregor1.ToTime(time.Now())
+	if err := d.writeDiskBox(d.dbKey(convID), diskDraft{
+		Version: draftsVersion,
+		Draft:   draft,
+	}); err != nil {
+		return NewInternalError(d.DebugLabeler, "failure to write draft: %s", err.Error())
+	}
+	return nil
+}
+
+// Get returns the stored draft for a conversation, or nil if there is none.
+func (d *Drafts) Get(ctx context.Context, convID chat1.ConversationID) (*chat1.DraftInfo, Error) {
+	d.Lock()
+	defer d.Unlock()
+
+	var disk diskDraft
+	found, err := d.readDiskBox(d.dbKey(convID), &disk)
+	if err != nil {
+		return nil, NewInternalError(d.DebugLabeler, "failure to read draft: %s", err.Error())
+	}
+	if !found {
+		return nil, nil
+	}
+	if disk.Version != draftsVersion {
+		d.Debug(ctx, "Get: on disk version not equal to program version, clearing: disk: %d program: %d",
+			disk.Version, draftsVersion)
+		if cerr := d.clearLocked(convID); cerr != nil {
+			return nil, cerr
+		}
+		return nil, nil
+	}
+	return &disk.Draft, nil
+}
+
+// Clear removes the stored draft for a conversation.
+func (d *Drafts) Clear(ctx context.Context, convID chat1.ConversationID) Error {
+	d.Lock()
+	defer d.Unlock()
+	return d.clearLocked(convID)
+}
+
+func (d *Drafts) clearLocked(convID chat1.ConversationID) Error {
+	if err := d.G().LocalChatDb.Delete(d.dbKey(convID)); err != nil {
+		return NewInternalError(d.DebugLabeler, "error clearing draft: convID: %s err: %s", convID,
+			err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const cacheTrackerVersion = 1
+
+// How long after the last access a conversation is considered in use and
+// exempt from eviction
+const evictRecentWindow = 30 * time.Minute
+
+// Minimum time between eviction passes
+const evictCheckInterval = time.Minute
+
+// Access time writes are throttled to this granularity to keep Fetch cheap
+const accessUpdateGranularity = time.Minute
+
+type convCacheEntry struct {
+	ConvID     chat1.ConversationID `codec:"C"`
+	Size       int64                `codec:"S"`
+	LastAccess gregor1.Time         `codec:"A"`
+}
+
+type diskCacheTracker struct {
+	Version int                       `codec:"V"`
+	Convs   map[string]convCacheEntry `codec:"C"`
+}
+
+// EvictStats describes what cache eviction has done since the service
+// started.
+type EvictStats struct {
+	ConvsEvicted int
+	BytesFreed   int64
+	LastRun      time.Time
+}
+
+// cacheTracker accounts for the disk footprint of cached conversations, and
+// evicts whole conversations least recently used first once the configured
+// budgets are exceeded. Pinned (favorited) and recently accessed
+// conversations are left alone.
+type cacheTracker struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+
+	getSecretUI func() libkb.SecretUI
+	blocks      *blockEngine
+	msgids      *msgIDTracker
+	index       *Index
+	convPins    *ConvPins
+	lastCheck   time.Time
+	stats       EvictStats
+}
+
+func newCacheTracker(g *libkb.GlobalContext, getSecretUI func() libkb.SecretUI,
+	index *Index) *cacheTracker {
+	return &cacheTracker{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "CacheTracker", false),
+		getSecretUI:  getSecretUI,
+		blocks:       newBlockEngine(g),
+		msgids:       newMsgIDTracker(g),
+		index:        index,
+		convPins:     NewConvPins(g),
+	}
+}
+
+func (c *cacheTracker) dbKey(uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatCacheTracker,
+		Key: fmt.Sprintf("ct:%s", uid),
+	}
+}
+
+func (c *cacheTracker) readLocked(ctx context.Context, uid gregor1.UID) diskCacheTracker {
+	fresh := diskCacheTracker{
+		Version: cacheTrackerVersion,
+		Convs:   make(map[string]convCacheEntry),
+	}
+	raw, found, err := c.G().LocalChatDb.GetRaw(c.dbKey(uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskCacheTracker
+	if err := decode(raw, &d); err != nil {
+		c.Debug(ctx, "readLocked: failed to decode tracker, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != cacheTrackerVersion || d.Convs == nil {
+		return fresh
+	}
+	return d
+}
+
+func (c *cacheTracker) writeLocked(uid gregor1.UID, d diskCacheTracker) error {
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return c.G().LocalChatDb.PutRaw(c.dbKey(uid), dat)
+}
+
+// convDiskSize sums the raw block payloads of a conversation. No decryption
+// is needed, the on-disk lengths are what the budget is about.
+func (c *cacheTracker) convDiskSize(convID chat1.ConversationID, uid gregor1.UID) int64 {
+	raw, found, err := c.G().LocalChatDb.GetRaw(makeBlockIndexKey(convID, uid))
+	if err != nil || !found {
+		return 0
+	}
+	var bi blockIndex
+	if err := decode(raw, &bi); err != nil {
+		return 0
+	}
+	size := int64(len(raw))
+	for i := 0; i <= bi.MaxBlock; i++ {
+		braw, found, err := c.G().LocalChatDb.GetRaw(c.blocks.makeBlockKey(convID, uid, i))
+		if err != nil || !found {
+			continue
+		}
+		size += int64(len(braw))
+	}
+	return size
+}
+
+// recordAccess notes that a conversation was read from the cache. Writes are
+// throttled since Fetch is a hot path.
+func (c *cacheTracker) recordAccess(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) {
+	c.Lock()
+	defer c.Unlock()
+
+	d := c.readLocked(ctx, uid)
+	ent := d.Convs[convID.String()]
+	now := time.Now()
+	if gregor1.FromTime(ent.LastAccess).Add(accessUpdateGranularity).After(now) {
+		return
+	}
+	ent.ConvID = convID
+	ent.LastAccess = gregor1.ToTime(now)
+	d.Convs[convID.String()] = ent
+	if err := c.writeLocked(uid, d); err != nil {
+		c.Debug(ctx, "recordAccess: failed to write tracker: %s", err.Error())
+	}
+}
+
+// recordConvSize refreshes the accounted size of a conversation after a
+// write.
+func (c *cacheTracker) recordConvSize(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) {
+	c.Lock()
+	defer c.Unlock()
+
+	d := c.readLocked(ctx, uid)
+	ent := d.Convs[convID.String()]
+	ent.ConvID = convID
+	ent.Size = c.convDiskSize(convID, uid)
+	if ent.LastAccess == 0 {
+		// Merged but never fetched, start the clock now
+		ent.LastAccess = gregor1.ToTime(time.Now())
+	}
+	d.Convs[convID.String()] = ent
+	if err := c.writeLocked(uid, d); err != nil {
+		c.Debug(ctx, "recordConvSize: failed to write tracker: %s", err.Error())
+	}
+}
+
+// pinnedConvs returns the conversations the user has favorited or explicitly
+// pinned for offline use, which we never evict.
+func (c *cacheTracker) pinnedConvs(ctx context.Context, uid gregor1.UID) map[string]bool {
+	res := c.convPins.PinnedMap(ctx, uid)
+	ibox := NewInbox(c.G(), uid, c.getSecretUI)
+	_, convs, err := ibox.ReadAll(ctx)
+	if err != nil {
+		c.Debug(ctx, "pinnedConvs: unable to read inbox: %s", err.Error())
+		return res
+	}
+	for _, conv := range convs {
+		if conv.Metadata.Status == chat1.ConversationStatus_FAVORITE {
+			res[conv.GetConvID().String()] = true
+		}
+	}
+	return res
+}
+
+type byLastAccess []convCacheEntry
+
+func (b byLastAccess) Len() int           { return len(b) }
+func (b byLastAccess) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastAccess) Less(i, j int) bool { return b[i].LastAccess < b[j].LastAccess }
+
+// check runs an eviction pass if one hasn't happened recently. It is called
+// with the Storage lock held, so the database is quiet.
+func (c *cacheTracker) check(ctx context.Context, uid gregor1.UID) {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.lastCheck) < evictCheckInterval {
+		return
+	}
+	c.lastCheck = time.Now()
+
+	globalMax := int64(c.G().Env.GetChatCacheMaxBytes())
+	convMax := int64(c.G().Env.GetChatConvCacheMaxBytes())
+	d := c.readLocked(ctx, uid)
+
+	var total int64
+	for _, ent := range d.Convs {
+		total += ent.Size
+	}
+	pinned := c.pinnedConvs(ctx, uid)
+	now := time.Now()
+	evictable := func(ent convCacheEntry) bool {
+		if pinned[ent.ConvID.String()] {
+			return false
+		}
+		return now.Sub(gregor1.FromTime(ent.LastAccess)) >= evictRecentWindow
+	}
+
+	// A single conversation over its own budget goes entirely: it gets
+	// repaged from the server on next use
+	evicted := false
+	for key, ent := range d.Convs {
+		if ent.Size > convMax && evictable(ent) {
+			total -= ent.Size
+			c.evictLocked(ctx, &d, key, uid)
+			evicted = true
+		}
+	}
+
+	// Then work off the global budget, least recently used first
+	if total > globalMax {
+		var ents []convCacheEntry
+		for _, ent := range d.Convs {
+			if evictable(ent) {
+				ents = append(ents, ent)
+			}
+		}
+		sort.Sort(byLastAccess(ents))
+		for _, ent := range ents {
+			if total <= globalMax {
+				break
+			}
+			total -= ent.Size
+			c.evictLocked(ctx, &d, ent.ConvID.String(), uid)
+			evicted = true
+		}
+	}
+
+	if evicted {
+		c.stats.LastRun = time.Now()
+		if err := c.writeLocked(uid, d); err != nil {
+			c.Debug(ctx, "check: failed to write tracker: %s", err.Error())
+		}
+		c.Debug(ctx, "check: eviction stats: convs: %d bytes: %d", c.stats.ConvsEvicted,
+			c.stats.BytesFreed)
+	}
+}
+
+// evictLocked drops all blocks of a conversation from the cache, along with
+// its block index, max message ID and search index.
+func (c *cacheTracker) evictLocked(ctx context.Context, d *diskCacheTracker, key string,
+	uid gregor1.UID) {
+	ent, ok := d.Convs[key]
+	if !ok {
+		return
+	}
+	c.Debug(ctx, "evictLocked: convID: %s size: %d lastAccess: %s", ent.ConvID, ent.Size,
+		gregor1.FromTime(ent.LastAccess))
+
+	raw, found, err := c.G().LocalChatDb.GetRaw(makeBlockIndexKey(ent.ConvID, uid))
+	if err == nil && found {
+		var bi blockIndex
+		if err := decode(raw, &bi); err == nil {
+			for i := 0; i <= bi.MaxBlock; i++ {
+				if err := c.G().LocalChatDb.Delete(c.blocks.makeBlockKey(ent.ConvID, uid, i)); err != nil {
+					c.Debug(ctx, "evictLocked: failed to delete block: %d err: %s", i, err.Error())
+				}
+			}
+		}
+	}
+	if err := c.G().LocalChatDb.Delete(makeBlockIndexKey(ent.ConvID, uid)); err != nil {
+		c.Debug(ctx, "evictLocked: failed to delete block index: %s", err.Error())
+	}
+	if err := c.G().LocalChatDb.Delete(c.msgids.makeMaxMsgIDKey(ent.ConvID, uid)); err != nil {
+		c.Debug(ctx, "evictLocked: failed to delete max msgID: %s", err.Error())
+	}
+	if err := c.index.Clear(ent.ConvID, uid); err != nil {
+		c.Debug(ctx, "evictLocked: failed to clear search index: %s", err.Error())
+	}
+	if err := c.G().LocalChatDb.Delete(makeHoleMapKey(ent.ConvID, uid)); err != nil {
+		c.Debug(ctx, "evictLocked: failed to delete hole map: %s", err.Error())
+	}
+	if err := c.G().LocalChatDb.Delete(makeDerivedViewKey(ent.ConvID, uid)); err != nil {
+		c.Debug(ctx, "evictLocked: failed to delete derived view: %s", err.Error())
+	}
+
+	c.stats.ConvsEvicted++
+	c.stats.BytesFreed += ent.Size
+	delete(d.Convs, key)
+}
+
+// clearConv drops one conversation from the cache on user request, returning
+// the bytes reclaimed.
+func (c *cacheTracker) clearConv(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	d := c.readLocked(ctx, uid)
+	key := convID.String()
+	ent, ok := d.Convs[key]
+	if !ok {
+		// Not tracked yet, measure directly so the caller still gets a number
+		ent = convCacheEntry{ConvID: convID, Size: c.convDiskSize(convID, uid)}
+		d.Convs[key] = ent
+	}
+	size := ent.Size
+	c.evictLocked(ctx, &d, key, uid)
+	if err := c.writeLocked(uid, d); err != nil {
+		c.Debug(ctx, "clearConv: failed to write tracker: %s", err.Error())
+	}
+	return size
+}
+
+// Stats reports what eviction has done since the service started.
+func (c *cacheTracker) Stats() EvictStats {
+	c.Lock()
+	defer c.Unlock()
+	return c.stats
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const holeMapVersion = 1
+
+// Hole is a range of message IDs known to be missing from local storage.
+type Hole struct {
+	Start chat1.MessageID `codec:"S"`
+	End   chat1.MessageID `codec:"E"`
+}
+
+type diskHoleMap struct {
+	Version int    `codec:"V"`
+	Holes   []Hole `codec:"H"`
+}
+
+func makeHoleMapKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatHoles,
+		Key: fmt.Sprintf("ho:%s:%s", uid, convID),
+	}
+}
+
+// holeTracker records gaps in cached conversation history, created when a
+// push lands a message that is not continuous with what we have. The
+// backfiller reads the map to know which ranges to repair, and Merge knocks
+// ranges out as the missing messages arrive.
+type holeTracker struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func newHoleTracker(g *libkb.GlobalContext) *holeTracker {
+	return &holeTracker{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "HoleTracker", false),
+	}
+}
+
+func (h *holeTracker) readLocked(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) diskHoleMap {
+	fresh := diskHoleMap{Version: holeMapVersion}
+	raw, found, err := h.G().LocalChatDb.GetRaw(makeHoleMapKey(convID, uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskHoleMap
+	if err := decode(raw, &d); err != nil {
+		h.Debug(ctx, "readLocked: failed to decode hole map, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != holeMapVersion {
+		return fresh
+	}
+	return d
+}
+
+func (h *holeTracker) writeLocked(convID chat1.ConversationID, uid gregor1.UID,
+	d diskHoleMap) error {
+	if len(d.Holes) == 0 {
+		return h.G().LocalChatDb.Delete(makeHoleMapKey(convID, uid))
+	}
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return h.G().LocalChatDb.PutRaw(makeHoleMapKey(convID, uid), dat)
+}
+
+type holesByStart []Hole
+
+func (h holesByStart) Len() int           { return len(h) }
+func (h holesByStart) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h holesByStart) Less(i, j int) bool { return h[i].Start < h[j].Start }
+
+// add records a missing range, coalescing with any ranges it touches.
+func (h *holeTracker) add(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	start, end chat1.MessageID) error {
+	if start > end {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	d := h.readLocked(ctx, convID, uid)
+	d.Holes = append(d.Holes, Hole{Start: start, End: end})
+	sort.Sort(holesByStart(d.Holes))
+	var res []Hole
+	for _, hole := range d.Holes {
+		if len(res) > 0 && hole.Start <= res[len(res)-1].End+1 {
+			if hole.End > res[len(res)-1].End {
+				res[len(res)-1].End = hole.End
+			}
+		} else {
+			res = append(res, hole)
+		}
+	}
+	d.Holes = res
+	h.Debug(ctx, "add: convID: %s range: %d-%d total holes: %d", convID, start, end, len(d.Holes))
+	return h.writeLocked(convID, uid, d)
+}
+
+// removeMsgs knocks merged messages out of the hole map, splitting ranges as
+// needed.
+func (h *holeTracker) removeMsgs(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgs []chat1.MessageUnboxed) error {
+	h.Lock()
+	defer h.Unlock()
+
+	d := h.readLocked(ctx, convID, uid)
+	if len(d.Holes) == 0 {
+		return nil
+	}
+	ids := make(map[chat1.MessageID]bool)
+	for _, msg := range msgs {
+		ids[msg.GetMessageID()] = true
+	}
+
+	var res []Hole
+	changed := false
+	for _, hole := range d.Holes {
+		start := hole.Start
+		for id := hole.Start; id <= hole.End; id++ {
+			if ids[id] {
+				changed = true
+				if id > start {
+					res = append(res, Hole{Start: start, End: id - 1})
+				}
+				start = id + 1
+			}
+		}
+		if start <= hole.End {
+			res = append(res, Hole{Start: start, End: hole.End})
+		}
+	}
+	if !changed {
+		return nil
+	}
+	d.Holes = res
+	return h.writeLocked(convID, uid, d)
+}
+
+// list returns the currently known holes, lowest range first.
+func (h *holeTracker) list(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) []Hole {
+	h.Lock()
+	defer h.Unlock()
+	return h.readLocked(ctx, convID, uid).Holes
+}
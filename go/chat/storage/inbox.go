@@ -728,6 +728,102 @@ func (i *Inbox) SetStatus(ctx context.Context, vers chat1.InboxVers, convID chat
 	return nil
 }
 
+// UpdateConversation replaces a conversation's stored entry with a freshly
+// fetched copy, covering metadata changes (name, topic, notification
+// settings) that have no dedicated update message.
+func (i *Inbox) UpdateConversation(ctx context.Context, vers chat1.InboxVers, conv chat1.Conversation) (err Error) {
+	i.Lock()
+	defer i.Unlock()
+	defer i.maybeNukeFn(func() Error { return err }, i.dbKey())
+
+	i.Debug(ctx, "UpdateConversation: vers: %d convID: %s", vers, conv.GetConvID())
+	ibox, err := i.readDiskInbox(ctx)
+	if err != nil {
+		if _, ok := err.(MissError); ok {
+			return nil
+		}
+		return err
+	}
+
+	// Check inbox versions, make sure it makes sense (clear otherwise)
+	var cont bool
+	if vers, cont, err = i.handleVersion(ctx, ibox.InboxVersion, vers); !cont {
+		return err
+	}
+
+	// Find conversation
+	_, existing := i.getConv(conv.GetConvID(), ibox.Conversations)
+	if existing == nil {
+		i.Debug(ctx, "UpdateConversation: no conversation found: convID: %s, clearing", conv.GetConvID())
+		return i.clear()
+	}
+
+	*existing = conv
+
+	// Write out to disk
+	ibox.InboxVersion = vers
+	if err := i.writeDiskInbox(ibox); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (i *Inbox) MembersUpdate(ctx context.Context, vers chat1.InboxVers, convID chat1.ConversationID,
+	joined []gregor1.UID, left []gregor1.UID) (err Error) {
+	i.Lock()
+	defer i.Unlock()
+	defer i.maybeNukeFn(func() Error { return err }, i.dbKey())
+
+	i.Debug(ctx, "MembersUpdate: vers: %d convID: %s joined: %d left: %d", vers, convID,
+		len(joined), len(left))
+	ibox, err := i.readDiskInbox(ctx)
+	if err != nil {
+		if _, ok := err.(MissError); ok {
+			return nil
+		}
+		return err
+	}
+
+	// Check inbox versions, make sure it makes sense (clear otherwise)
+	var cont bool
+	if vers, cont, err = i.handleVersion(ctx, ibox.InboxVersion, vers); !cont {
+		return err
+	}
+
+	// Find conversation
+	_, conv := i.getConv(convID, ibox.Conversations)
+	if conv == nil {
+		i.Debug(ctx, "MembersUpdate: no conversation found: convID: %s, clearing", convID)
+		return i.clear()
+	}
+
+	// Rebuild the active list with joiners at the front and leavers dropped
+	gone := make(map[string]bool)
+	for _, uid := range left {
+		gone[uid.String()] = true
+	}
+	seen := make(map[string]bool)
+	var activeList []gregor1.UID
+	for _, uid := range append(joined, conv.Metadata.ActiveList...) {
+		if gone[uid.String()] || seen[uid.String()] {
+			continue
+		}
+		seen[uid.String()] = true
+		activeList = append(activeList, uid)
+	}
+	conv.Metadata.ActiveList = activeList
+	conv.ReaderInfo.Mtime = gregor1.ToTime(time.Now())
+
+	// Write out to disk
+	ibox.InboxVersion = vers
+	if err := i.writeDiskInbox(ibox); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (i *Inbox) TlfFinalize(ctx context.Context, vers chat1.InboxVers, convIDs []chat1.ConversationID,
 	finalizeInfo chat1.ConversationFinalizeInfo) (err Error) {
 	i.Lock()
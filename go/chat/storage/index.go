@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const indexVersion = 1
+
+// Token length bounds, so a pathological conversation can't balloon the
+// index with noise or huge blobs
+const indexMinTokenLen = 3
+const indexMaxTokenLen = 32
+
+type indexDiskData struct {
+	Version int                          `codec:"V"`
+	Tokens  map[string][]chat1.MessageID `codec:"T"`
+}
+
+// Index maintains a per-conversation token index over message text. It is
+// kept current as messages are merged into storage, so chat history is
+// searchable offline without remote calls.
+type Index struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+	*baseBox
+}
+
+func NewIndex(g *libkb.GlobalContext, getSecretUI func() libkb.SecretUI) *Index {
+	return &Index{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Index", false),
+		baseBox:      newBaseBox(g, getSecretUI),
+	}
+}
+
+func (idx *Index) dbKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatIndex,
+		Key: fmt.Sprintf("idx:%s:%s", uid, convID),
+	}
+}
+
+// tokenize splits message text into the lowercased tokens we index,
+// deduplicated and bounded in length.
+func tokenize(text string) []string {
+	raw := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]bool)
+	var res []string
+	for _, tok := range raw {
+		if len(tok) < indexMinTokenLen || len(tok) > indexMaxTokenLen || seen[tok] {
+			continue
+		}
+		seen[tok] = true
+		res = append(res, tok)
+	}
+	return res
+}
+
+// searchableText returns the text we index for a message, if any.
+func searchableText(msg chat1.MessageUnboxed) string {
+	if !msg.IsValid() {
+		return ""
+	}
+	body := msg.Valid().MessageBody
+	typ, err := body.MessageType()
+	if err != nil {
+		return ""
+	}
+	switch typ {
+	case chat1.MessageType_TEXT:
+		return body.Text().Body
+	case chat1.MessageType_EDIT:
+		return body.Edit().Body
+	}
+	return ""
+}
+
+// Add indexes the text of the given messages for the conversation.
+func (idx *Index) Add(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	msgs []chat1.MessageUnboxed) error {
+	idx.Lock()
+	defer idx.Unlock()
+
+	var data indexDiskData
+	found, err := idx.readDiskBox(idx.dbKey(convID, uid), &data)
+	if err != nil {
+		return err
+	}
+	if !found || data.Tokens == nil {
+		data = indexDiskData{Version: indexVersion, Tokens: make(map[string][]chat1.MessageID)}
+	}
+
+	dirty := false
+	for _, msg := range msgs {
+		text := searchableText(msg)
+		if text == "" {
+			continue
+		}
+		msgID := msg.GetMessageID()
+		for _, tok := range tokenize(text) {
+			ids := data.Tokens[tok]
+			dup := false
+			for _, id := range ids {
+				if id == msgID {
+					dup = true
+					break
+				}
+			}
+			if dup {
+				continue
+			}
+			data.Tokens[tok] = append(ids, msgID)
+			dirty = true
+		}
+	}
+	if !dirty {
+		return nil
+	}
+	return idx.writeDiskBox(idx.dbKey(convID, uid), data)
+}
+
+type msgIDsDesc []chat1.MessageID
+
+func (m msgIDsDesc) Len() int           { return len(m) }
+func (m msgIDsDesc) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m msgIDsDesc) Less(i, j int) bool { return m[i] > m[j] }
+
+// Search returns the IDs of messages containing every token of the query,
+// newest first, up to limit.
+func (idx *Index) Search(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	query string, limit int) ([]chat1.MessageID, error) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	var data indexDiskData
+	found, err := idx.readDiskBox(idx.dbKey(convID, uid), &data)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	counts := make(map[chat1.MessageID]int)
+	for _, tok := range tokens {
+		for _, id := range data.Tokens[tok] {
+			counts[id]++
+		}
+	}
+	var hits []chat1.MessageID
+	for id, count := range counts {
+		if count == len(tokens) {
+			hits = append(hits, id)
+		}
+	}
+	sort.Sort(msgIDsDesc(hits))
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// Clear drops the conversation's index.
+func (idx *Index) Clear(convID chat1.ConversationID, uid gregor1.UID) error {
+	idx.Lock()
+	defer idx.Unlock()
+	return idx.G().LocalChatDb.Delete(idx.dbKey(convID, uid))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"sort"
 
@@ -169,7 +170,7 @@ func (o *Outbox) PullAllConversations(ctx context.Context, includeErrors bool, r
 			o.Debug(ctx, "PullAllConversations: unknown state item: skipping: err: %s", err.Error())
 			continue
 		}
-		if state == chat1.OutboxStateType_ERROR {
+		if state == chat1.OutboxStateType_ERROR || state == chat1.OutboxStateType_FAILED {
 			if includeErrors {
 				res = append(res, obr)
 			} else {
@@ -287,6 +288,101 @@ func (o *Outbox) MarkAsError(ctx context.Context, obr chat1.OutboxRecord, errRec
 	return nil
 }
 
+// GC moves records that have been stuck for longer than maxAge, or retried
+// more than maxAttempts times, into the terminal failed state. Failed records
+// stay in the outbox so the UI can offer retry or delete, but the deliverer
+// no longer touches them. Returns the records newly failed.
+func (o *Outbox) GC(ctx context.Context, maxAge time.Duration, maxAttempts int) ([]chat1.OutboxRecord, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	// Read outbox for the user
+	obox, err := o.readDiskOutbox(ctx)
+	if err != nil {
+		if _, ok := err.(MissError); ok {
+			return nil, nil
+		}
+		return nil, o.maybeNuke(err, o.dbKey())
+	}
+
+	now := o.clock.Now()
+	var failed, recs []chat1.OutboxRecord
+	for _, obr := range obox.Records {
+		state, serr := obr.State.State()
+		if serr != nil {
+			o.Debug(ctx, "GC: dropping record with unknown state: err: %s", serr.Error())
+			continue
+		}
+		expired := now.Sub(obr.Ctime.Time()) > maxAge
+		switch state {
+		case chat1.OutboxStateType_SENDING:
+			if expired || obr.State.Sending() > maxAttempts {
+				obr.State = chat1.NewOutboxStateWithFailed(chat1.OutboxStateError{
+					Message: "message failed to send",
+					Typ:     chat1.OutboxErrorType_MISC,
+				})
+				failed = append(failed, obr)
+			}
+		case chat1.OutboxStateType_ERROR:
+			if expired {
+				obr.State = chat1.NewOutboxStateWithFailed(obr.State.Error())
+				failed = append(failed, obr)
+			}
+		}
+		recs = append(recs, obr)
+	}
+	if len(failed) == 0 {
+		return nil, nil
+	}
+
+	// Write out box
+	obox.Records = recs
+	if err := o.writeDiskBox(o.dbKey(), obox); err != nil {
+		return nil, o.maybeNuke(NewInternalError(o.DebugLabeler,
+			"error writing outbox: err: %s", err.Error()), o.dbKey())
+	}
+
+	return failed, nil
+}
+
+// PurgeFailed removes all records in the terminal failed state, returning how
+// many were dropped.
+func (o *Outbox) PurgeFailed(ctx context.Context) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	// Read outbox for the user
+	obox, err := o.readDiskOutbox(ctx)
+	if err != nil {
+		if _, ok := err.(MissError); ok {
+			return 0, nil
+		}
+		return 0, o.maybeNuke(err, o.dbKey())
+	}
+
+	var recs []chat1.OutboxRecord
+	purged := 0
+	for _, obr := range obox.Records {
+		if state, serr := obr.State.State(); serr == nil && state == chat1.OutboxStateType_FAILED {
+			purged++
+			continue
+		}
+		recs = append(recs, obr)
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+
+	// Write out box
+	obox.Records = recs
+	if err := o.writeDiskBox(o.dbKey(), obox); err != nil {
+		return 0, o.maybeNuke(NewInternalError(o.DebugLabeler,
+			"error writing outbox: err: %s", err.Error()), o.dbKey())
+	}
+
+	return purged, nil
+}
+
 func (o *Outbox) RetryMessage(ctx context.Context, obid chat1.OutboxID) error {
 	o.Lock()
 	defer o.Unlock()
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const pinsVersion = 1
+
+// How many messages can be pinned in a single conversation
+const pinsMaxPerConv = 100
+
+type diskPins struct {
+	Version int               `codec:"V"`
+	IDs     []chat1.MessageID `codec:"P"`
+}
+
+func makePinsKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatPins,
+		Key: fmt.Sprintf("pi:%s:%s", uid, convID),
+	}
+}
+
+// Pins persists the set of pinned message IDs per conversation. Only the IDs
+// are stored; callers resolve them to messages through the conversation
+// source.
+type Pins struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func NewPins(g *libkb.GlobalContext) *Pins {
+	return &Pins{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Pins", false),
+	}
+}
+
+func (p *Pins) readLocked(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) diskPins {
+	fresh := diskPins{Version: pinsVersion}
+	raw, found, err := p.G().LocalChatDb.GetRaw(makePinsKey(convID, uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskPins
+	if err := decode(raw, &d); err != nil {
+		p.Debug(ctx, "readLocked: failed to decode pins, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != pinsVersion {
+		return fresh
+	}
+	return d
+}
+
+func (p *Pins) writeLocked(convID chat1.ConversationID, uid gregor1.UID, d diskPins) error {
+	if len(d.IDs) == 0 {
+		return p.G().LocalChatDb.Delete(makePinsKey(convID, uid))
+	}
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return p.G().LocalChatDb.PutRaw(makePinsKey(convID, uid), dat)
+}
+
+// Pin adds a message to the pinned set for a conversation.
+func (p *Pins) Pin(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	msgID chat1.MessageID) error {
+	p.Lock()
+	defer p.Unlock()
+
+	d := p.readLocked(ctx, convID, uid)
+	for _, id := range d.IDs {
+		if id == msgID {
+			return nil
+		}
+	}
+	if len(d.IDs) >= pinsMaxPerConv {
+		return MiscError{Msg: fmt.Sprintf("too many pinned messages: max: %d", pinsMaxPerConv)}
+	}
+	d.IDs = append(d.IDs, msgID)
+	p.Debug(ctx, "Pin: convID: %s msgID: %d total: %d", convID, msgID, len(d.IDs))
+	return p.writeLocked(convID, uid, d)
+}
+
+// Unpin removes a message from the pinned set for a conversation.
+func (p *Pins) Unpin(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	msgID chat1.MessageID) error {
+	p.Lock()
+	defer p.Unlock()
+
+	d := p.readLocked(ctx, convID, uid)
+	var res []chat1.MessageID
+	for _, id := range d.IDs {
+		if id != msgID {
+			res = append(res, id)
+		}
+	}
+	if len(res) == len(d.IDs) {
+		return nil
+	}
+	d.IDs = res
+	p.Debug(ctx, "Unpin: convID: %s msgID: %d total: %d", convID, msgID, len(d.IDs))
+	return p.writeLocked(convID, uid, d)
+}
+
+// List returns the pinned message IDs for a conversation, oldest pin first.
+func (p *Pins) List(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) []chat1.MessageID {
+	p.Lock()
+	defer p.Unlock()
+	return p.readLocked(ctx, convID, uid).IDs
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const quarantineVersion = 1
+
+// QuarantineEntry captures both versions of a message that arrived twice
+// with the same ID but different contents. The stored version stays live in
+// the cache; the conflicting pair is kept here for inspection.
+type QuarantineEntry struct {
+	MsgID    chat1.MessageID      `codec:"M"`
+	Stored   chat1.MessageUnboxed `codec:"S"`
+	Incoming chat1.MessageUnboxed `codec:"I"`
+	Ctime    gregor1.Time         `codec:"C"`
+}
+
+type diskQuarantine struct {
+	Version int               `codec:"V"`
+	Entries []QuarantineEntry `codec:"E"`
+}
+
+func makeQuarantineKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatQuarantine,
+		Key: fmt.Sprintf("qu:%s:%s", uid, convID),
+	}
+}
+
+// Quarantine holds message versions that conflicted on merge: the server (or
+// something in between) presented a message ID we already had, with different
+// contents. Merge refuses to overwrite in that case and records both versions
+// here so the anomaly can be examined instead of silently disappearing.
+type Quarantine struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func NewQuarantine(g *libkb.GlobalContext) *Quarantine {
+	return &Quarantine{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Quarantine", false),
+	}
+}
+
+func (q *Quarantine) readLocked(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) diskQuarantine {
+	fresh := diskQuarantine{
+		Version: quarantineVersion,
+	}
+	raw, found, err := q.G().LocalChatDb.GetRaw(makeQuarantineKey(convID, uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskQuarantine
+	if err := decode(raw, &d); err != nil {
+		q.Debug(ctx, "readLocked: failed to decode quarantine, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != quarantineVersion {
+		return fresh
+	}
+	return d
+}
+
+func (q *Quarantine) writeLocked(convID chat1.ConversationID, uid gregor1.UID,
+	d diskQuarantine) error {
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return q.G().LocalChatDb.PutRaw(makeQuarantineKey(convID, uid), dat)
+}
+
+// Record stores a conflicting pair of message versions for the given ID.
+func (q *Quarantine) Record(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, stored chat1.MessageUnboxed, incoming chat1.MessageUnboxed) error {
+	q.Lock()
+	defer q.Unlock()
+
+	d := q.readLocked(ctx, convID, uid)
+	d.Entries = append(d.Entries, QuarantineEntry{
+		MsgID:    incoming.GetMessageID(),
+		Stored:   stored,
+		Incoming: incoming,
+		Ctime:    gregor1.ToTime(time.Now()),
+	})
+	return q.writeLocked(convID, uid, d)
+}
+
+// List returns all quarantined conflicts for the conversation.
+func (q *Quarantine) List(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) []QuarantineEntry {
+	q.Lock()
+	defer q.Unlock()
+	return q.readLocked(ctx, convID, uid).Entries
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeTextWithHeaderHash(id chat1.MessageID, text string, hash []byte) chat1.MessageUnboxed {
+	mvalid := makeText(id, text).Valid()
+	mvalid.HeaderHash = chat1.Hash(hash)
+	return chat1.NewMessageUnboxedWithValid(mvalid)
+}
+
+func TestStorageQuarantine(t *testing.T) {
+	tc, storage, uid := setupStorageTest(t, "quarantine")
+
+	msgs := []chat1.MessageUnboxed{
+		makeTextWithHeaderHash(chat1.MessageID(3), "three", randBytes(32)),
+		makeTextWithHeaderHash(chat1.MessageID(2), "two", randBytes(32)),
+		makeTextWithHeaderHash(chat1.MessageID(1), "one", randBytes(32)),
+	}
+	conv := makeConversation(msgs[0].GetMessageID())
+	convID := conv.Metadata.ConversationID
+
+	require.NoError(t, storage.Merge(context.TODO(), convID, uid, msgs))
+
+	// Replaying identical contents is not a conflict
+	require.NoError(t, storage.Merge(context.TODO(), convID, uid, msgs))
+	require.Equal(t, int64(0), storage.MergeConflicts(), "identical replay should not conflict")
+
+	// Same ID, different contents: the stored version wins and the pair is
+	// quarantined
+	imposter := makeTextWithHeaderHash(chat1.MessageID(2), "imposter", randBytes(32))
+	require.NoError(t, storage.Merge(context.TODO(), convID, uid,
+		[]chat1.MessageUnboxed{imposter}))
+	require.Equal(t, int64(1), storage.MergeConflicts(), "conflict not counted")
+
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, len(msgs), len(res.Messages), "wrong amount of messages")
+	require.Equal(t, "two", res.Messages[1].Valid().MessageBody.Text().Body,
+		"stored version should survive the conflict")
+
+	entries := NewQuarantine(tc.G).List(context.TODO(), convID, uid)
+	require.Len(t, entries, 1, "wrong amount of quarantine entries")
+	require.Equal(t, chat1.MessageID(2), entries[0].MsgID, "wrong message quarantined")
+	require.Equal(t, "two", entries[0].Stored.Valid().MessageBody.Text().Body,
+		"stored version not recorded")
+	require.Equal(t, "imposter", entries[0].Incoming.Valid().MessageBody.Text().Body,
+		"incoming version not recorded")
+}
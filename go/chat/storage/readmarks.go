@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const readMarksVersion = 1
+
+type diskReadMark struct {
+	MsgID  chat1.MessageID `codec:"M"`
+	Synced bool            `codec:"S"`
+}
+
+type diskReadMarks struct {
+	Version int                     `codec:"V"`
+	Marks   map[string]diskReadMark `codec:"M"`
+}
+
+func makeReadMarksKey(uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatReadMarks,
+		Key: fmt.Sprintf("rm:%s", uid),
+	}
+}
+
+// ReadMarks persists a local read watermark per conversation, so reading a
+// thread while offline still clears unread state immediately. Marks start out
+// unsynced and are flipped to synced once the server has acked a MarkAsRead
+// for them.
+type ReadMarks struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func NewReadMarks(g *libkb.GlobalContext) *ReadMarks {
+	return &ReadMarks{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "ReadMarks", false),
+	}
+}
+
+func (r *ReadMarks) readLocked(ctx context.Context, uid gregor1.UID) diskReadMarks {
+	fresh := diskReadMarks{Version: readMarksVersion, Marks: make(map[string]diskReadMark)}
+	raw, found, err := r.G().LocalChatDb.GetRaw(makeReadMarksKey(uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskReadMarks
+	if err := decode(raw, &d); err != nil {
+		r.Debug(ctx, "readLocked: failed to decode read marks, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != readMarksVersion || d.Marks == nil {
+		return fresh
+	}
+	return d
+}
+
+func (r *ReadMarks) writeLocked(uid gregor1.UID, d diskReadMarks) error {
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return r.G().LocalChatDb.PutRaw(makeReadMarksKey(uid), dat)
+}
+
+// Mark advances the local read watermark for a conversation. It never moves
+// the watermark backwards; marking an already covered message with synced set
+// just records the server ack.
+func (r *ReadMarks) Mark(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	msgID chat1.MessageID, synced bool) error {
+	r.Lock()
+	defer r.Unlock()
+
+	d := r.readLocked(ctx, uid)
+	cur, ok := d.Marks[convID.String()]
+	if ok && cur.MsgID > msgID {
+		return nil
+	}
+	if ok && cur.MsgID == msgID {
+		synced = synced || cur.Synced
+	}
+	d.Marks[convID.String()] = diskReadMark{MsgID: msgID, Synced: synced}
+	r.Debug(ctx, "Mark: convID: %s msgID: %d synced: %v", convID, msgID, synced)
+	return r.writeLocked(uid, d)
+}
+
+// Get returns the local read watermark for a conversation, or zero if none
+// has been recorded.
+func (r *ReadMarks) Get(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) chat1.MessageID {
+	r.Lock()
+	defer r.Unlock()
+	return r.readLocked(ctx, uid).Marks[convID.String()].MsgID
+}
+
+// Unsynced returns the watermarks the server has not acked yet, keyed by
+// conversation.
+func (r *ReadMarks) Unsynced(ctx context.Context, uid gregor1.UID) map[string]chat1.MessageID {
+	r.Lock()
+	defer r.Unlock()
+
+	res := make(map[string]chat1.MessageID)
+	for key, mark := range r.readLocked(ctx, uid).Marks {
+		if !mark.Synced {
+			res[key] = mark.MsgID
+		}
+	}
+	return res
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestReadMarks(t *testing.T) {
+	tc, _, uid := setupStorageTest(t, "readmarks")
+
+	marks := NewReadMarks(tc.G)
+	conv1 := makeConvID()
+	conv2 := makeConvID()
+	ctx := context.TODO()
+
+	require.Equal(t, chat1.MessageID(0), marks.Get(ctx, conv1, uid))
+
+	// A local mark starts out unsynced
+	require.NoError(t, marks.Mark(ctx, conv1, uid, chat1.MessageID(5), false))
+	require.Equal(t, chat1.MessageID(5), marks.Get(ctx, conv1, uid))
+	unsynced := marks.Unsynced(ctx, uid)
+	require.Equal(t, chat1.MessageID(5), unsynced[conv1.String()], "mark should be unsynced")
+
+	// A stale replay neither moves the watermark backwards nor syncs it
+	require.NoError(t, marks.Mark(ctx, conv1, uid, chat1.MessageID(3), true))
+	require.Equal(t, chat1.MessageID(5), marks.Get(ctx, conv1, uid),
+		"watermark should not move backwards")
+	require.Len(t, marks.Unsynced(ctx, uid), 1, "stale ack should not sync the mark")
+
+	// A server ack at the same ID flips the mark to synced
+	require.NoError(t, marks.Mark(ctx, conv1, uid, chat1.MessageID(5), true))
+	require.Equal(t, chat1.MessageID(5), marks.Get(ctx, conv1, uid))
+	require.Len(t, marks.Unsynced(ctx, uid), 0, "acked mark should be synced")
+
+	// Replaying the same ID unsynced does not undo the ack
+	require.NoError(t, marks.Mark(ctx, conv1, uid, chat1.MessageID(5), false))
+	require.Len(t, marks.Unsynced(ctx, uid), 0, "replay should not unsync the mark")
+
+	// Marks are per conversation
+	require.NoError(t, marks.Mark(ctx, conv2, uid, chat1.MessageID(2), false))
+	require.Equal(t, chat1.MessageID(5), marks.Get(ctx, conv1, uid))
+	require.Equal(t, chat1.MessageID(2), marks.Get(ctx, conv2, uid))
+	require.Equal(t, chat1.MessageID(2), marks.Unsynced(ctx, uid)[conv2.String()],
+		"new conversation mark should be unsynced")
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+const receiptsVersion = 1
+
+type diskReceipts struct {
+	Version   int                              `codec:"V"`
+	Delivered map[chat1.MessageID]gregor1.Time `codec:"D"`
+	ReadMsgID chat1.MessageID                  `codec:"R"`
+}
+
+func makeReceiptsKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatReceipts,
+		Key: fmt.Sprintf("re:%s:%s", uid, convID),
+	}
+}
+
+// Receipts tracks per-message delivery state for a conversation: when the
+// server acked messages we sent, and how far the conversation is known to
+// have been read. The deliverer records acks as outbox records go out, and
+// the push handler advances the read watermark from readMessage payloads.
+// Thread reads stamp this state onto messages for receipt display.
+type Receipts struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+}
+
+func NewReceipts(g *libkb.GlobalContext) *Receipts {
+	return &Receipts{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "Receipts", false),
+	}
+}
+
+func (r *Receipts) readLocked(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) diskReceipts {
+	fresh := diskReceipts{
+		Version:   receiptsVersion,
+		Delivered: make(map[chat1.MessageID]gregor1.Time),
+	}
+	raw, found, err := r.G().LocalChatDb.GetRaw(makeReceiptsKey(convID, uid))
+	if err != nil || !found {
+		return fresh
+	}
+	var d diskReceipts
+	if err := decode(raw, &d); err != nil {
+		r.Debug(ctx, "readLocked: failed to decode receipts, resetting: %s", err.Error())
+		return fresh
+	}
+	if d.Version != receiptsVersion || d.Delivered == nil {
+		return fresh
+	}
+	return d
+}
+
+func (r *Receipts) writeLocked(convID chat1.ConversationID, uid gregor1.UID,
+	d diskReceipts) error {
+	dat, err := encode(d)
+	if err != nil {
+		return err
+	}
+	return r.G().LocalChatDb.PutRaw(makeReceiptsKey(convID, uid), dat)
+}
+
+// MarkDelivered records the server ack for a message we sent.
+func (r *Receipts) MarkDelivered(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgID chat1.MessageID) error {
+	r.Lock()
+	defer r.Unlock()
+
+	d := r.readLocked(ctx, convID, uid)
+	if _, ok := d.Delivered[msgID]; ok {
+		return nil
+	}
+	d.Delivered[msgID] = gregor1.ToTime(time.Now())
+	return r.writeLocked(convID, uid, d)
+}
+
+// MarkRead advances the read watermark of a conversation. The watermark only
+// ever moves forward.
+func (r *Receipts) MarkRead(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgID chat1.MessageID) error {
+	r.Lock()
+	defer r.Unlock()
+
+	d := r.readLocked(ctx, convID, uid)
+	if msgID <= d.ReadMsgID {
+		return nil
+	}
+	d.ReadMsgID = msgID
+	return r.writeLocked(convID, uid, d)
+}
+
+// ReadMsgID returns the highest message ID known to have been read in a
+// conversation.
+func (r *Receipts) ReadMsgID(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) chat1.MessageID {
+	r.Lock()
+	defer r.Unlock()
+	return r.readLocked(ctx, convID, uid).ReadMsgID
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestReceipts(t *testing.T) {
+	tc, _, uid := setupStorageTest(t, "receipts")
+
+	receipts := NewReceipts(tc.G)
+	convID := makeConvID()
+	ctx := context.TODO()
+
+	// Delivery acks are idempotent: the first timestamp sticks
+	require.NoError(t, receipts.MarkDelivered(ctx, convID, uid, chat1.MessageID(4)))
+	first := receipts.readLocked(ctx, convID, uid).Delivered[chat1.MessageID(4)]
+	require.NoError(t, receipts.MarkDelivered(ctx, convID, uid, chat1.MessageID(4)))
+	require.Equal(t, first, receipts.readLocked(ctx, convID, uid).Delivered[chat1.MessageID(4)],
+		"redelivery should not move the ack time")
+	require.Len(t, receipts.readLocked(ctx, convID, uid).Delivered, 1,
+		"wrong amount of delivery acks")
+
+	// The read watermark only ever moves forward
+	require.Equal(t, chat1.MessageID(0), receipts.ReadMsgID(ctx, convID, uid))
+	require.NoError(t, receipts.MarkRead(ctx, convID, uid, chat1.MessageID(5)))
+	require.Equal(t, chat1.MessageID(5), receipts.ReadMsgID(ctx, convID, uid))
+	require.NoError(t, receipts.MarkRead(ctx, convID, uid, chat1.MessageID(3)))
+	require.Equal(t, chat1.MessageID(5), receipts.ReadMsgID(ctx, convID, uid),
+		"watermark should not move backwards")
+	require.NoError(t, receipts.MarkRead(ctx, convID, uid, chat1.MessageID(8)))
+	require.Equal(t, chat1.MessageID(8), receipts.ReadMsgID(ctx, convID, uid))
+
+	// Receipts are per conversation
+	require.Equal(t, chat1.MessageID(0), receipts.ReadMsgID(ctx, makeConvID(), uid))
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/context"
+)
+
+const snapshotVersion = 1
+
+// snapshotConv is one conversation's cached messages inside an exported
+// snapshot.
+type snapshotConv struct {
+	ConvID   chat1.ConversationID   `codec:"C"`
+	MaxMsgID chat1.MessageID        `codec:"X"`
+	Msgs     []chat1.MessageUnboxed `codec:"M"`
+}
+
+type snapshot struct {
+	Version int            `codec:"V"`
+	UID     gregor1.UID    `codec:"U"`
+	Ctime   gregor1.Time   `codec:"T"`
+	Convs   []snapshotConv `codec:"C"`
+}
+
+type boxedSnapshot struct {
+	V int
+	N [24]byte
+	E []byte
+}
+
+// ExportSnapshot packages every message cached for the given conversations
+// into a snapshot sealed with the provided key. The key is expected to be
+// agreed over the provisioning channel to the destination device, so the
+// snapshot is never readable under this device's storage key alone.
+func (s *Storage) ExportSnapshot(ctx context.Context, uid gregor1.UID,
+	convIDs []chat1.ConversationID, key [32]byte) ([]byte, error) {
+	// All public functions get locks to make access to the database single threaded.
+	// They should never be called from private functons.
+	s.Lock()
+	defer s.Unlock()
+
+	// Fetch secret key
+	dkey, ierr := getSecretBoxKey(s.G(), s.getSecretUI)
+	if ierr != nil {
+		return nil, MiscError{Msg: "unable to get secret key: " + ierr.Error()}
+	}
+
+	snap := snapshot{
+		Version: snapshotVersion,
+		UID:     uid,
+		Ctime:   gregor1.ToTime(time.Now()),
+	}
+	for _, convID := range convIDs {
+		var err Error
+		ctx, err = s.engine.init(ctx, dkey, convID, uid)
+		if err != nil {
+			return nil, err
+		}
+		maxMsgID, err := s.idtracker.getMaxMessageID(ctx, convID, uid)
+		if err != nil {
+			// Nothing cached for this conversation
+			if _, ok := err.(MissError); ok {
+				continue
+			}
+			return nil, err
+		}
+		rc := newSimpleResultCollector(-1)
+		if err = s.engine.readMessages(ctx, rc, convID, uid, maxMsgID); err != nil {
+			if _, ok := err.(MissError); ok {
+				continue
+			}
+			return nil, err
+		}
+		snap.Convs = append(snap.Convs, snapshotConv{
+			ConvID:   convID,
+			MaxMsgID: maxMsgID,
+			Msgs:     rc.result(),
+		})
+	}
+	s.Debug(ctx, "ExportSnapshot: uid: %s convs: %d", uid, len(snap.Convs))
+
+	dat, derr := encode(snap)
+	if derr != nil {
+		return nil, derr
+	}
+	nonce, derr := libkb.RandBytes(24)
+	if derr != nil {
+		return nil, derr
+	}
+	var fnonce [24]byte
+	copy(fnonce[:], nonce)
+	boxed := boxedSnapshot{
+		V: snapshotVersion,
+		N: fnonce,
+		E: secretbox.Seal(nil, dat, &fnonce, &key),
+	}
+	return encode(boxed)
+}
+
+// OpenSnapshot unseals and validates a snapshot produced by ExportSnapshot,
+// returning the conversations it carries. The snapshot must belong to the
+// given uid.
+func openSnapshot(uid gregor1.UID, data []byte, key [32]byte) ([]snapshotConv, error) {
+	var boxed boxedSnapshot
+	if err := decode(data, &boxed); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %s", err.Error())
+	}
+	if boxed.V > snapshotVersion {
+		return nil, fmt.Errorf("bad snapshot version: %d current: %d", boxed.V, snapshotVersion)
+	}
+	pt, ok := secretbox.Open(nil, boxed.E, &boxed.N, &key)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt snapshot")
+	}
+	var snap snapshot
+	if err := decode(pt, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot contents: %s", err.Error())
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("bad snapshot contents version: %d current: %d", snap.Version,
+			snapshotVersion)
+	}
+	if !snap.UID.Eq(uid) {
+		return nil, fmt.Errorf("snapshot uid mismatch: %s != %s", snap.UID, uid)
+	}
+	return snap.Convs, nil
+}
+
+// validateSnapshotConv sanity checks one conversation from a snapshot before
+// it is merged: message IDs must be unique, nonzero, and no higher than the
+// advertised max.
+func validateSnapshotConv(conv snapshotConv) error {
+	seen := make(map[chat1.MessageID]bool)
+	for _, msg := range conv.Msgs {
+		id := msg.GetMessageID()
+		if id == 0 {
+			return fmt.Errorf("snapshot conv %s has a message with no ID", conv.ConvID)
+		}
+		if id > conv.MaxMsgID {
+			return fmt.Errorf("snapshot conv %s message ID %d above max %d", conv.ConvID, id,
+				conv.MaxMsgID)
+		}
+		if seen[id] {
+			return fmt.Errorf("snapshot conv %s has duplicate message ID %d", conv.ConvID, id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// ImportSnapshot unseals a snapshot exported by another device and merges
+// its conversations into local storage. It returns how many conversations
+// and messages were merged.
+func (s *Storage) ImportSnapshot(ctx context.Context, uid gregor1.UID, data []byte,
+	key [32]byte) (convs, msgs int, err error) {
+
+	sconvs, err := openSnapshot(uid, data, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, conv := range sconvs {
+		if verr := validateSnapshotConv(conv); verr != nil {
+			return convs, msgs, verr
+		}
+	}
+	for _, conv := range sconvs {
+		if len(conv.Msgs) == 0 {
+			continue
+		}
+		if merr := s.Merge(ctx, conv.ConvID, uid, conv.Msgs); merr != nil {
+			return convs, msgs, merr
+		}
+		convs++
+		msgs += len(conv.Msgs)
+	}
+	s.Debug(ctx, "ImportSnapshot: uid: %s convs: %d msgs: %d", uid, convs, msgs)
+	return convs, msgs, nil
+}
@@ -3,12 +3,14 @@ package storage
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/chat/pager"
 	"github.com/keybase/client/go/chat/utils"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/chat1"
 	"github.com/keybase/client/go/protocol/gregor1"
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 	"golang.org/x/net/context"
 )
@@ -30,6 +32,12 @@ type Storage struct {
 	getSecretUI func() libkb.SecretUI
 	engine      storageEngine
 	idtracker   *msgIDTracker
+	index       *Index
+	tracker     *cacheTracker
+	holes       *holeTracker
+	derived     *derivedView
+	quarantine  *Quarantine
+	conflicts   int64
 }
 
 type storageEngine interface {
@@ -42,11 +50,17 @@ type storageEngine interface {
 }
 
 func New(g *libkb.GlobalContext, getSecretUI func() libkb.SecretUI) *Storage {
+	index := NewIndex(g, getSecretUI)
 	return &Storage{
 		Contextified: libkb.NewContextified(g),
 		getSecretUI:  getSecretUI,
 		engine:       newBlockEngine(g),
 		idtracker:    newMsgIDTracker(g),
+		index:        index,
+		tracker:      newCacheTracker(g, getSecretUI, index),
+		holes:        newHoleTracker(g),
+		derived:      newDerivedView(g, getSecretUI),
+		quarantine:   NewQuarantine(g),
 		DebugLabeler: utils.NewDebugLabeler(g, "Storage", false),
 	}
 }
@@ -55,6 +69,21 @@ func (s *Storage) setEngine(engine storageEngine) {
 	s.engine = engine
 }
 
+// SQLEngineAvailable reports whether this build links the SQLite driver the
+// SQL engine needs. Only builds with the chatsqlite tag do.
+func (s *Storage) SQLEngineAvailable() bool {
+	return sqlEngineAvailable
+}
+
+// UseSQLEngine swaps the block engine for the SQLite-backed one, keeping the
+// block engine around so existing conversations migrate on first touch. It
+// only has an effect when SQLEngineAvailable.
+func (s *Storage) UseSQLEngine() {
+	s.Lock()
+	defer s.Unlock()
+	s.setEngine(newSQLEngine(s.G(), s.engine))
+}
+
 func makeBlockIndexKey(convID chat1.ConversationID, uid gregor1.UID) libkb.DbKey {
 	return libkb.DbKey{
 		Typ: libkb.DBChatBlockIndex,
@@ -215,6 +244,13 @@ func (s *Storage) Merge(ctx context.Context, convID chat1.ConversationID, uid gr
 		return err
 	}
 
+	// Refuse to overwrite messages we already have with different contents.
+	// A well-behaved server never reuses a message ID, so a mismatch here is
+	// an anomaly worth keeping evidence of.
+	if msgs, err = s.screenConflicts(ctx, convID, uid, msgs); err != nil {
+		return s.MaybeNuke(false, err, convID, uid)
+	}
+
 	// Write out new data into blocks
 	if err = s.engine.writeMessages(ctx, convID, uid, msgs); err != nil {
 		return s.MaybeNuke(false, err, convID, uid)
@@ -232,9 +268,76 @@ func (s *Storage) Merge(ctx context.Context, convID chat1.ConversationID, uid gr
 		}
 	}
 
+	// Keep the search index current. A failure here only degrades search, so
+	// don't fail the whole merge over it.
+	if ierr := s.index.Add(ctx, convID, uid, msgs); ierr != nil {
+		s.Debug(ctx, "Merge: failed to index messages: %s", ierr.Error())
+	}
+
+	// Knock out any holes these messages fill
+	if herr := s.holes.removeMsgs(ctx, convID, uid, msgs); herr != nil {
+		s.Debug(ctx, "Merge: failed to update hole map: %s", herr.Error())
+	}
+
+	// Keep cache accounting current and enforce the cache budget
+	s.tracker.recordConvSize(ctx, convID, uid)
+	s.tracker.check(ctx, uid)
+
 	return nil
 }
 
+// screenConflicts compares incoming messages against what is already stored
+// under the same IDs. On a content mismatch the stored version wins: the
+// incoming one is dropped from the write set, both versions are quarantined,
+// and a security warning goes out to the UIs.
+func (s *Storage) screenConflicts(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID, msgs []chat1.MessageUnboxed) (res []chat1.MessageUnboxed, err Error) {
+
+	for _, msg := range msgs {
+		if !msg.IsValid() {
+			res = append(res, msg)
+			continue
+		}
+		msgID := msg.GetMessageID()
+		rc := newSimpleResultCollector(1)
+		if err = s.engine.readMessages(ctx, rc, convID, uid, msgID); err != nil {
+			if _, ok := err.(MissError); ok {
+				res = append(res, msg)
+				continue
+			}
+			return nil, err
+		}
+		stored := rc.result()
+		if len(stored) == 0 || !stored[0].IsValid() {
+			res = append(res, msg)
+			continue
+		}
+		if stored[0].Valid().HeaderHash.Eq(msg.Valid().HeaderHash) {
+			// Same contents, rewriting is harmless
+			res = append(res, msg)
+			continue
+		}
+		s.Debug(ctx, "screenConflicts: content mismatch on id: %d, keeping stored version",
+			msgID)
+		s.conflicts++
+		if qerr := s.quarantine.Record(ctx, convID, uid, stored[0], msg); qerr != nil {
+			s.Debug(ctx, "screenConflicts: failed to quarantine id: %d: %s", msgID,
+				qerr.Error())
+		}
+		s.G().NotifyRouter.HandleChatMessageConflict(ctx, keybase1.UID(uid.String()),
+			convID, msgID)
+	}
+	return res, nil
+}
+
+// MergeConflicts reports how many content conflicts Merge has refused since
+// the service started.
+func (s *Storage) MergeConflicts() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.conflicts
+}
+
 func (s *Storage) updateAllSupersededBy(ctx context.Context, convID chat1.ConversationID,
 	uid gregor1.UID, msgs []chat1.MessageUnboxed) Error {
 
@@ -278,15 +381,26 @@ func (s *Storage) updateAllSupersededBy(ctx context.Context, convID chat1.Conver
 			superMsg := superMsgs[0]
 			if superMsg.IsValid() {
 				s.Debug(ctx, "updateSupersededBy: writing: id: %d superseded: %d", msgid, superID)
-				mvalid := superMsg.Valid()
-				mvalid.ServerHeader.SupersededBy = msgid
-				if msg.GetMessageType() == chat1.MessageType_DELETE {
-					var emptyBody chat1.MessageBody
-					mvalid.MessageBody = emptyBody
+				// Reactions accumulate on their target rather than replacing
+				// it, so they leave the stored message alone and only touch
+				// the derived view
+				if msg.GetMessageType() != chat1.MessageType_REACTION {
+					mvalid := superMsg.Valid()
+					mvalid.ServerHeader.SupersededBy = msgid
+					if msg.GetMessageType() == chat1.MessageType_DELETE {
+						var emptyBody chat1.MessageBody
+						mvalid.MessageBody = emptyBody
+					}
+					superMsgs[0] = chat1.NewMessageUnboxedWithValid(mvalid)
+					if err = s.engine.writeMessages(ctx, convID, uid, superMsgs); err != nil {
+						return err
+					}
 				}
-				superMsgs[0] = chat1.NewMessageUnboxedWithValid(mvalid)
-				if err = s.engine.writeMessages(ctx, convID, uid, superMsgs); err != nil {
-					return err
+				// Record the final form in the derived view so reads skip
+				// the supersedes transform for this message
+				if derr := s.derived.apply(ctx, convID, uid, superMsg, msg); derr != nil {
+					s.Debug(ctx, "updateSupersededBy: failed to update derived view: %s",
+						derr.Error())
 				}
 			} else {
 				s.Debug(ctx, "updateSupersededBy: skipping id: %d, it is stored as an error",
@@ -367,7 +481,8 @@ func (s *Storage) fetchUpToMsgIDLocked(ctx context.Context, convID chat1.Convers
 	if tres.Pagination, ierr = pager.NewThreadPager().MakePage(pmsgs, num); ierr != nil {
 		return chat1.ThreadView{}, NewInternalError(s.DebugLabeler, "Fetch: failed to encode pager: %s", ierr.Error())
 	}
-	tres.Messages = res
+	// Substitute derived final forms into the result
+	tres.Messages = s.derived.overlay(ctx, convID, uid, res)
 
 	s.Debug(ctx, "Fetch: cache hit: num: %d", len(res))
 	return tres, nil
@@ -386,7 +501,11 @@ func (s *Storage) FetchUpToLocalMaxMsgID(ctx context.Context, convID chat1.Conve
 	}
 	s.Debug(ctx, "FetchUpToLocalMaxMsgID: using max msgID: %d", maxMsgID)
 
-	return s.fetchUpToMsgIDLocked(ctx, convID, uid, maxMsgID, query, pagination)
+	tres, err := s.fetchUpToMsgIDLocked(ctx, convID, uid, maxMsgID, query, pagination)
+	if err == nil {
+		s.tracker.recordAccess(ctx, convID, uid)
+	}
+	return tres, err
 }
 
 func (s *Storage) Fetch(ctx context.Context, conv chat1.Conversation,
@@ -396,7 +515,103 @@ func (s *Storage) Fetch(ctx context.Context, conv chat1.Conversation,
 	s.Lock()
 	defer s.Unlock()
 
-	return s.fetchUpToMsgIDLocked(ctx, conv.Metadata.ConversationID, uid, conv.ReaderInfo.MaxMsgid, query, pagination)
+	tres, err := s.fetchUpToMsgIDLocked(ctx, conv.Metadata.ConversationID, uid, conv.ReaderInfo.MaxMsgid, query, pagination)
+	if err == nil {
+		s.tracker.recordAccess(ctx, conv.Metadata.ConversationID, uid)
+	}
+	return tres, err
+}
+
+// EvictStats reports what cache eviction has done since the service started.
+func (s *Storage) EvictStats() EvictStats {
+	return s.tracker.Stats()
+}
+
+// ClearConvCache removes all cached data for a conversation and returns how
+// many bytes that reclaimed.
+func (s *Storage) ClearConvCache(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) int64 {
+	// All public functions get locks to make access to the database single threaded.
+	// They should never be called from private functons.
+	s.Lock()
+	defer s.Unlock()
+	return s.tracker.clearConv(ctx, convID, uid)
+}
+
+// PurgeExpired deletes the bodies of expired ephemeral messages in a
+// conversation, leaving tombstones behind, and returns the IDs it purged.
+// Already purged messages are skipped, so repeated calls are cheap.
+func (s *Storage) PurgeExpired(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) ([]chat1.MessageID, Error) {
+	// All public functions get locks to make access to the database single threaded.
+	// They should never be called from private functons.
+	s.Lock()
+	defer s.Unlock()
+
+	// Fetch secret key
+	key, ierr := getSecretBoxKey(s.G(), s.getSecretUI)
+	if ierr != nil {
+		return nil, MiscError{Msg: "unable to get secret key: " + ierr.Error()}
+	}
+
+	var err Error
+	ctx, err = s.engine.init(ctx, key, convID, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	maxMsgID, err := s.idtracker.getMaxMessageID(ctx, convID, uid)
+	if err != nil {
+		// Nothing cached for this conversation, nothing to purge
+		if _, ok := err.(MissError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rc := newSimpleResultCollector(-1)
+	if err = s.engine.readMessages(ctx, rc, convID, uid, maxMsgID); err != nil {
+		return nil, s.MaybeNuke(false, err, convID, uid)
+	}
+
+	now := time.Now()
+	var purged []chat1.MessageID
+	var tombstones []chat1.MessageUnboxed
+	for _, msg := range rc.result() {
+		if !utils.IsExpired(msg, now) {
+			continue
+		}
+		mvalid := msg.Valid()
+		// An empty body means a previous pass (or a delete) already got it
+		if typ, _ := mvalid.MessageBody.MessageType(); typ == chat1.MessageType_NONE {
+			continue
+		}
+		var emptyBody chat1.MessageBody
+		mvalid.MessageBody = emptyBody
+		tombstones = append(tombstones, chat1.NewMessageUnboxedWithValid(mvalid))
+		purged = append(purged, msg.GetMessageID())
+	}
+	if len(tombstones) > 0 {
+		s.Debug(ctx, "PurgeExpired: convID: %s purging %d messages", convID, len(tombstones))
+		if err = s.engine.writeMessages(ctx, convID, uid, tombstones); err != nil {
+			return nil, s.MaybeNuke(false, err, convID, uid)
+		}
+	}
+	return purged, nil
+}
+
+// AddHole records a range of message IDs known to be missing locally, so the
+// backfiller can repair it.
+func (s *Storage) AddHole(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	start, end chat1.MessageID) error {
+	return s.holes.add(ctx, convID, uid, start, end)
+}
+
+// Holes returns the ranges of message IDs missing from local storage, lowest
+// range first.
+func (s *Storage) Holes(ctx context.Context, convID chat1.ConversationID,
+	uid gregor1.UID) []Hole {
+	return s.holes.list(ctx, convID, uid)
 }
 
 func (s *Storage) FetchMessages(ctx context.Context, convID chat1.ConversationID,
@@ -434,3 +649,31 @@ func (s *Storage) FetchMessages(ctx context.Context, convID chat1.ConversationID
 
 	return res, nil
 }
+
+// Search returns locally stored messages matching every token of the query,
+// newest first. Only the token index and local blocks are consulted, so it
+// works offline.
+func (s *Storage) Search(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	query string, limit int) ([]chat1.MessageUnboxed, error) {
+
+	ids, err := s.index.Search(ctx, convID, uid, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	msgs, err := s.FetchMessages(ctx, convID, uid, ids)
+	if err != nil {
+		return nil, err
+	}
+	var res []chat1.MessageUnboxed
+	for _, msg := range msgs {
+		// An indexed message can be missing if the conversation cache was
+		// cleared out from under the index
+		if msg != nil {
+			res = append(res, *msg)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,307 @@
+// +build chatsqlite
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	_ "github.com/keybase/client/go/sqlite3" // registers the "sqlite3" driver
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/context"
+)
+
+// Builds with the chatsqlite tag link the system SQLite library through the
+// sqlite3 package above, so the SQL engine is usable.
+const sqlEngineAvailable = true
+
+// sqlEngine is an alternate storage engine backed by SQLite, selected with
+// the "hybridsql" conv source type. Messages are sealed individually with the
+// local storage key and stored one row each, indexed by conversation, message
+// ID, type and ctime, which makes range queries and deletion-by-age plain
+// SQL. The engine only exists in builds with the chatsqlite tag, which link
+// the sqlite3 driver; other builds refuse "hybridsql" at conv source
+// selection. Conversations still living in the block store are migrated over
+// the first time they are touched.
+type sqlEngine struct {
+	libkb.Contextified
+	utils.DebugLabeler
+	sync.Mutex
+
+	db       *sql.DB
+	fallback storageEngine
+	msgids   *msgIDTracker
+
+	// Conversations already checked against the block store this run
+	migrated map[string]bool
+}
+
+type sekey string
+
+var seskkey sekey = "sesk"
+
+const sqlEngineSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	conv_id TEXT NOT NULL,
+	uid TEXT NOT NULL,
+	msg_id INTEGER NOT NULL,
+	msg_type INTEGER NOT NULL,
+	ctime INTEGER NOT NULL,
+	data BLOB NOT NULL,
+	PRIMARY KEY (conv_id, uid, msg_id)
+);
+CREATE INDEX IF NOT EXISTS messages_type ON messages (conv_id, uid, msg_type);
+CREATE INDEX IF NOT EXISTS messages_ctime ON messages (conv_id, uid, ctime);
+`
+
+func newSQLEngine(g *libkb.GlobalContext, fallback storageEngine) storageEngine {
+	return &sqlEngine{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "SQLEngine", true),
+		fallback:     fallback,
+		msgids:       newMsgIDTracker(g),
+		migrated:     make(map[string]bool),
+	}
+}
+
+func (se *sqlEngine) getDB(ctx context.Context) (*sql.DB, Error) {
+	se.Lock()
+	defer se.Unlock()
+	if se.db != nil {
+		return se.db, nil
+	}
+	path := filepath.Join(se.G().Env.GetDataDir(), "chat.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, NewInternalError(se.DebugLabeler, "getDB: failed to open: %s", err.Error())
+	}
+	if _, err = db.Exec(sqlEngineSchema); err != nil {
+		db.Close()
+		return nil, NewInternalError(se.DebugLabeler, "getDB: failed to create schema: %s", err.Error())
+	}
+	se.Debug(ctx, "getDB: opened: %s", path)
+	se.db = db
+	return se.db, nil
+}
+
+func (se *sqlEngine) init(ctx context.Context, key [32]byte, convID chat1.ConversationID,
+	uid gregor1.UID) (context.Context, Error) {
+
+	ctx = context.WithValue(ctx, seskkey, key)
+	if _, err := se.getDB(ctx); err != nil {
+		return ctx, err
+	}
+	if err := se.maybeMigrate(ctx, key, convID, uid); err != nil {
+		return ctx, err
+	}
+	return ctx, nil
+}
+
+func (se *sqlEngine) fetchSecretKey(ctx context.Context) (key [32]byte, err Error) {
+	var ok bool
+	val := ctx.Value(seskkey)
+	if key, ok = val.([32]byte); !ok {
+		return key, MiscError{Msg: "secret key not in context"}
+	}
+	return key, nil
+}
+
+// maybeMigrate copies a conversation out of the block store the first time
+// the SQL engine sees it with no rows of its own.
+func (se *sqlEngine) maybeMigrate(ctx context.Context, key [32]byte, convID chat1.ConversationID,
+	uid gregor1.UID) Error {
+
+	se.Lock()
+	mkey := fmt.Sprintf("%s:%s", uid, convID)
+	if se.migrated[mkey] {
+		se.Unlock()
+		return nil
+	}
+	se.migrated[mkey] = true
+	se.Unlock()
+
+	db, err := se.getDB(ctx)
+	if err != nil {
+		return err
+	}
+	var count int
+	if qerr := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE conv_id = ? AND uid = ?`,
+		convID.String(), uid.String()).Scan(&count); qerr != nil {
+		return NewInternalError(se.DebugLabeler, "maybeMigrate: failed to count: %s", qerr.Error())
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// Anything in the block store?
+	maxID, merr := se.msgids.getMaxMessageID(ctx, convID, uid)
+	if merr != nil {
+		if _, ok := merr.(MissError); ok {
+			return nil
+		}
+		return merr
+	}
+
+	fctx, ferr := se.fallback.init(ctx, key, convID, uid)
+	if ferr != nil {
+		return ferr
+	}
+	rc := newSimpleResultCollector(-1)
+	if ferr = se.fallback.readMessages(fctx, rc, convID, uid, maxID); ferr != nil {
+		se.Debug(ctx, "maybeMigrate: failed to read block store: convID: %s err: %s", convID,
+			ferr.Error())
+		return nil
+	}
+	msgs := rc.result()
+	if len(msgs) == 0 {
+		return nil
+	}
+	se.Debug(ctx, "maybeMigrate: migrating: convID: %s msgs: %d", convID, len(msgs))
+	return se.writeMessages(ctx, convID, uid, msgs)
+}
+
+func (se *sqlEngine) sealMessage(ctx context.Context, msg chat1.MessageUnboxed) ([]byte, Error) {
+	dat, err := encode(msg)
+	if err != nil {
+		return nil, NewInternalError(se.DebugLabeler, "sealMessage: failed to encode: %s", err.Error())
+	}
+	key, cerr := se.fetchSecretKey(ctx)
+	if cerr != nil {
+		return nil, cerr
+	}
+	nonce, err := libkb.RandBytes(24)
+	if err != nil {
+		return nil, MiscError{Msg: fmt.Sprintf("sealMessage: failure to generate nonce: %s", err.Error())}
+	}
+	var fnonce [24]byte
+	copy(fnonce[:], nonce)
+	sealed := secretbox.Seal(nil, dat, &fnonce, &key)
+	payload, err := encode(boxedBlock{
+		V: cryptoVersion,
+		N: fnonce,
+		E: sealed,
+	})
+	if err != nil {
+		return nil, NewInternalError(se.DebugLabeler, "sealMessage: failed to encode: %s", err.Error())
+	}
+	return payload, nil
+}
+
+func (se *sqlEngine) openMessage(ctx context.Context, dat []byte) (res chat1.MessageUnboxed, err Error) {
+	var b boxedBlock
+	if derr := decode(dat, &b); derr != nil {
+		return res, NewInternalError(se.DebugLabeler, "openMessage: failed to decode: %s", derr.Error())
+	}
+	if b.V > cryptoVersion {
+		return res, NewInternalError(se.DebugLabeler, "openMessage: bad crypto version: %d current: %d",
+			b.V, cryptoVersion)
+	}
+	key, cerr := se.fetchSecretKey(ctx)
+	if cerr != nil {
+		return res, cerr
+	}
+	pt, ok := secretbox.Open(nil, b.E, &b.N, &key)
+	if !ok {
+		return res, NewInternalError(se.DebugLabeler, "openMessage: failed to decrypt")
+	}
+	if derr := decode(pt, &res); derr != nil {
+		return res, NewInternalError(se.DebugLabeler, "openMessage: failed to decode: %s", derr.Error())
+	}
+	return res, nil
+}
+
+func (se *sqlEngine) writeMessages(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+	msgs []chat1.MessageUnboxed) Error {
+
+	db, err := se.getDB(ctx)
+	if err != nil {
+		return err
+	}
+	tx, terr := db.Begin()
+	if terr != nil {
+		return NewInternalError(se.DebugLabeler, "writeMessages: failed to start tx: %s", terr.Error())
+	}
+	for _, msg := range msgs {
+		payload, err := se.sealMessage(ctx, msg)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		var ctime gregor1.Time
+		if msg.IsValid() {
+			ctime = msg.Valid().ServerHeader.Ctime
+		}
+		if _, terr = tx.Exec(`INSERT OR REPLACE INTO messages
+			(conv_id, uid, msg_id, msg_type, ctime, data) VALUES (?, ?, ?, ?, ?, ?)`,
+			convID.String(), uid.String(), int64(msg.GetMessageID()),
+			int64(msg.GetMessageType()), int64(ctime), payload); terr != nil {
+			tx.Rollback()
+			return NewInternalError(se.DebugLabeler, "writeMessages: failed to insert: %s", terr.Error())
+		}
+	}
+	if terr = tx.Commit(); terr != nil {
+		return NewInternalError(se.DebugLabeler, "writeMessages: failed to commit: %s", terr.Error())
+	}
+	return nil
+}
+
+func (se *sqlEngine) readMessages(ctx context.Context, res resultCollector,
+	convID chat1.ConversationID, uid gregor1.UID, maxID chat1.MessageID) (err Error) {
+
+	// Run all errors through resultCollector
+	defer func() {
+		if err != nil {
+			err = res.error(err)
+		}
+	}()
+
+	db, err := se.getDB(ctx)
+	if err != nil {
+		return err
+	}
+	rows, qerr := db.Query(`SELECT msg_id, data FROM messages
+		WHERE conv_id = ? AND uid = ? AND msg_id <= ? AND msg_id >= 1
+		ORDER BY msg_id DESC`, convID.String(), uid.String(), int64(maxID))
+	if qerr != nil {
+		return NewInternalError(se.DebugLabeler, "readMessages: failed to query: %s", qerr.Error())
+	}
+	defer rows.Close()
+
+	// Walk down from maxID; any gap is a cache miss, same as the block engine
+	expected := maxID
+	for rows.Next() {
+		if res.done() {
+			return nil
+		}
+		var msgID int64
+		var dat []byte
+		if qerr = rows.Scan(&msgID, &dat); qerr != nil {
+			return NewInternalError(se.DebugLabeler, "readMessages: failed to scan: %s", qerr.Error())
+		}
+		if chat1.MessageID(msgID) != expected {
+			se.Debug(ctx, "readMessages: gap: expected: %d got: %d", expected, msgID)
+			return MissError{}
+		}
+		msg, err := se.openMessage(ctx, dat)
+		if err != nil {
+			return err
+		}
+		se.Debug(ctx, "readMessages: adding msg_id: %d", msg.GetMessageID())
+		res.push(msg)
+		expected--
+	}
+	if qerr = rows.Err(); qerr != nil {
+		return NewInternalError(se.DebugLabeler, "readMessages: failed to read rows: %s", qerr.Error())
+	}
+	if !res.done() && expected >= 1 {
+		se.Debug(ctx, "readMessages: ran out of rows: expected: %d", expected)
+		return MissError{}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !chatsqlite
+
+package storage
+
+import (
+	"github.com/keybase/client/go/libkb"
+)
+
+// Without the chatsqlite build tag no SQLite driver is linked in, so the SQL
+// engine is unavailable. newSQLEngine hands back the engine it was asked to
+// replace; conv source selection checks SQLEngineAvailable and refuses
+// "hybridsql" before it gets here.
+const sqlEngineAvailable = false
+
+func newSQLEngine(g *libkb.GlobalContext, fallback storageEngine) storageEngine {
+	return fallback
+}
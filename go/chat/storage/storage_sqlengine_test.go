@@ -0,0 +1,70 @@
+// +build chatsqlite
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSQLEngineBasic(t *testing.T) {
+	_, storage, uid := setupStorageTest(t, "sql basic")
+	storage.UseSQLEngine()
+
+	msgs := makeMsgRange(10)
+	conv := makeConversation(msgs[0].GetMessageID())
+
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, msgs))
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, len(msgs), len(res.Messages), "wrong amount of messages")
+	for i := 0; i < len(res.Messages); i++ {
+		require.Equal(t, msgs[i].GetMessageID(), res.Messages[i].GetMessageID(), "msg mismatch")
+	}
+}
+
+func TestSQLEngineMigration(t *testing.T) {
+	_, storage, uid := setupStorageTest(t, "sql migration")
+
+	// Land a conversation in the block store first
+	msgs := makeMsgRange(10)
+	conv := makeConversation(msgs[0].GetMessageID())
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, msgs))
+
+	// The SQL engine picks the conversation up from the block store the
+	// first time it is touched
+	storage.UseSQLEngine()
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, len(msgs), len(res.Messages), "wrong amount of messages")
+	for i := 0; i < len(res.Messages); i++ {
+		require.Equal(t, msgs[i].GetMessageID(), res.Messages[i].GetMessageID(), "msg mismatch")
+	}
+}
+
+func TestSQLEngineSupersedes(t *testing.T) {
+	_, storage, uid := setupStorageTest(t, "sql supersedes")
+	storage.UseSQLEngine()
+
+	msgs := makeMsgRange(10)
+	conv := makeConversation(msgs[0].GetMessageID())
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid, msgs))
+
+	supersededMsg := msgs[5]
+	editMsg := makeEdit(chat1.MessageID(11), supersededMsg.GetMessageID())
+	require.NoError(t, storage.Merge(context.TODO(), conv.Metadata.ConversationID, uid,
+		[]chat1.MessageUnboxed{editMsg}))
+
+	conv = makeConversation(editMsg.GetMessageID())
+	res, err := storage.Fetch(context.TODO(), conv, uid, nil, nil)
+	require.NoError(t, err)
+	for _, msg := range res.Messages {
+		if msg.GetMessageID() == supersededMsg.GetMessageID() {
+			require.Equal(t, editMsg.GetMessageID(), msg.Valid().ServerHeader.SupersededBy,
+				"superseded pointer not set")
+		}
+	}
+}
@@ -21,6 +21,16 @@ func newSupersedesTransform(g *libkb.GlobalContext) *supersedesTransform {
 	}
 }
 
+func init() {
+	registerThreadProcessor(func(g *libkb.GlobalContext) threadProcessor {
+		return newSupersedesTransform(g)
+	})
+}
+
+func (t *supersedesTransform) name() string {
+	return "supersedes"
+}
+
 func (t *supersedesTransform) transformEdit(msg chat1.MessageUnboxed, superMsg chat1.MessageUnboxed) *chat1.MessageUnboxed {
 	clientHeader := msg.Valid().ClientHeader
 	clientHeader.MessageType = chat1.MessageType_TEXT
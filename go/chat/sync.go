@@ -58,6 +58,36 @@ func (s *Syncer) Connected(ctx context.Context, cli chat1.RemoteInterface, uid g
 	// Let the Deliverer know that we are back online
 	s.G().MessageDeliverer.Connected(ctx)
 
+	// Replay read positions recorded while offline, so the server unread
+	// state catches up to what the user actually read
+	readMarks := storage.NewReadMarks(s.G())
+	for key, msgID := range readMarks.Unsynced(ctx, uid) {
+		convID, cerr := chat1.MakeConvID(key)
+		if cerr != nil {
+			s.Debug(ctx, "Connected: invalid convID in read marks: %s", cerr.Error())
+			continue
+		}
+		if _, merr := cli.MarkAsRead(ctx, chat1.MarkAsReadArg{
+			ConversationID: convID,
+			MsgID:          msgID,
+		}); merr != nil {
+			s.Debug(ctx, "Connected: failed to replay read mark: convID: %s err: %s", convID,
+				merr.Error())
+			continue
+		}
+		if merr := readMarks.Mark(ctx, convID, uid, msgID, true); merr != nil {
+			s.Debug(ctx, "Connected: failed to sync read mark: convID: %s err: %s", convID,
+				merr.Error())
+		}
+	}
+
+	// Warm the most recently active conversations in the background, so
+	// threads render from cache when the user opens them
+	if hcs, ok := s.G().ConvSource.(*HybridConversationSource); ok {
+		hcs.prefetcher.Start(ctx, uid)
+		hcs.purger.Start(ctx, uid)
+	}
+
 	return nil
 }
 
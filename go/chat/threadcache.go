@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"golang.org/x/net/context"
+)
+
+// How many conversations the remote source remembers threads for
+const recentThreadCacheSize = 10
+
+type recentThreadEntry struct {
+	key    string
+	thread chat1.ThreadView
+}
+
+// recentThreadCache keeps the most recently pulled first page of a handful of
+// conversations in memory, so PullLocalOnly can serve recently viewed threads
+// on a source that keeps no persistent storage. Entries are snapshots of the
+// last Pull: they go stale as new messages arrive and are evicted least
+// recently used first.
+type recentThreadCache struct {
+	sync.Mutex
+	libkb.Contextified
+	utils.DebugLabeler
+
+	lru *list.List
+	tab map[string]*list.Element
+}
+
+func newRecentThreadCache(g *libkb.GlobalContext) *recentThreadCache {
+	return &recentThreadCache{
+		Contextified: libkb.NewContextified(g),
+		DebugLabeler: utils.NewDebugLabeler(g, "RecentThreadCache", false),
+		lru:          list.New(),
+		tab:          make(map[string]*list.Element),
+	}
+}
+
+func (c *recentThreadCache) key(uid gregor1.UID, convID chat1.ConversationID) string {
+	return fmt.Sprintf("%s:%s", uid, convID)
+}
+
+// put stores the latest pulled page for a conversation, evicting the least
+// recently used conversation once over the cap.
+func (c *recentThreadCache) put(ctx context.Context, uid gregor1.UID, convID chat1.ConversationID,
+	thread chat1.ThreadView) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := c.key(uid, convID)
+	if el, ok := c.tab[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.tab[key] = c.lru.PushFront(recentThreadEntry{key: key, thread: thread})
+	for c.lru.Len() > recentThreadCacheSize {
+		back := c.lru.Back()
+		if back == nil {
+			break
+		}
+		ent := back.Value.(recentThreadEntry)
+		c.Debug(ctx, "put: evicting: %s", ent.key)
+		c.lru.Remove(back)
+		delete(c.tab, ent.key)
+	}
+}
+
+// get returns the cached page for a conversation, if any.
+func (c *recentThreadCache) get(ctx context.Context, uid gregor1.UID,
+	convID chat1.ConversationID) (chat1.ThreadView, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.tab[c.key(uid, convID)]
+	if !ok {
+		return chat1.ThreadView{}, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(recentThreadEntry).thread, true
+}
+
+// clearConv drops the cached page for a single conversation.
+func (c *recentThreadCache) clearConv(uid gregor1.UID, convID chat1.ConversationID) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := c.key(uid, convID)
+	if el, ok := c.tab[key]; ok {
+		c.lru.Remove(el)
+		delete(c.tab, key)
+	}
+}
+
+// clearAll drops every cached page.
+func (c *recentThreadCache) clearAll() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lru = list.New()
+	c.tab = make(map[string]*list.Element)
+}
@@ -0,0 +1,37 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+)
+
+// threadProcessor collapses one kind of message relationship (supersedes,
+// reactions, ...) across a fetched page. Processors run in registration order
+// during postProcessThread; each sees the output of the one before it.
+type threadProcessor interface {
+	// name identifies the processor in debug logs
+	name() string
+	// run returns the page with the processor's relationship applied
+	run(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+		msgs []chat1.MessageUnboxed, finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error)
+}
+
+// threadProcessorFactories is the package level registry. A message
+// relationship registers a factory from its own file (usually in init), and
+// every conversation source constructed afterwards applies it; convsource
+// itself never needs to know about individual relationships.
+var threadProcessorFactories []func(g *libkb.GlobalContext) threadProcessor
+
+func registerThreadProcessor(f func(g *libkb.GlobalContext) threadProcessor) {
+	threadProcessorFactories = append(threadProcessorFactories, f)
+}
+
+func newThreadProcessors(g *libkb.GlobalContext) (res []threadProcessor) {
+	for _, f := range threadProcessorFactories {
+		res = append(res, f(g))
+	}
+	return res
+}
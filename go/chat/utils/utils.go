@@ -364,7 +364,30 @@ func GetSupersedes(msg chat1.MessageUnboxed) ([]chat1.MessageID, error) {
 		return msg.Valid().MessageBody.Delete().MessageIDs, nil
 	case chat1.MessageType_ATTACHMENTUPLOADED:
 		return []chat1.MessageID{msg.Valid().MessageBody.Attachmentuploaded().MessageID}, nil
+	case chat1.MessageType_REACTION:
+		return []chat1.MessageID{msg.Valid().MessageBody.Reaction().MessageID}, nil
 	default:
 		return nil, nil
 	}
 }
+
+// IsExpired is true for an ephemeral message whose expiry time has passed.
+func IsExpired(msg chat1.MessageUnboxed, now time.Time) bool {
+	if !msg.IsValid() {
+		return false
+	}
+	etime := msg.Valid().ClientHeader.Etime
+	return etime != nil && *etime > 0 && *etime <= gregor1.ToTime(now)
+}
+
+// FilterExpired removes expired ephemeral messages from a list.
+func FilterExpired(msgs []chat1.MessageUnboxed) (res []chat1.MessageUnboxed) {
+	now := time.Now()
+	for _, msg := range msgs {
+		if IsExpired(msg, now) {
+			continue
+		}
+		res = append(res, msg)
+	}
+	return res
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/keybase/cli"
+	"github.com/keybase/client/go/libcmdline"
+	"github.com/keybase/client/go/libkb"
+)
+
+type CmdChatCompact struct {
+	libkb.Contextified
+}
+
+func newCmdChatCompact(cl *libcmdline.CommandLine, g *libkb.GlobalContext) cli.Command {
+	return cli.Command{
+		Name:  "compact",
+		Usage: "Compact local chat storage to reclaim disk space.",
+		Action: func(c *cli.Context) {
+			cmd := &CmdChatCompact{Contextified: libkb.NewContextified(g)}
+			cl.ChooseCommand(cmd, "compact", c)
+		},
+	}
+}
+
+func (c *CmdChatCompact) ParseArgv(ctx *cli.Context) error {
+	if len(ctx.Args()) > 0 {
+		return fmt.Errorf("compact takes no arguments")
+	}
+	return nil
+}
+
+func (c *CmdChatCompact) Run() error {
+	chatClient, err := GetChatLocalClient(c.G())
+	if err != nil {
+		return err
+	}
+
+	res, err := chatClient.CompactChatStorageLocal(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	ui := c.G().UI.GetTerminalUI()
+	ui.Printf("Compacted chat storage: %s before, %s after\n",
+		humanize.Bytes(uint64(res.BytesBefore)), humanize.Bytes(uint64(res.BytesAfter)))
+	return nil
+}
+
+func (c *CmdChatCompact) GetUsage() libkb.Usage {
+	return libkb.Usage{
+		API:       true,
+		KbKeyring: true,
+		Config:    true,
+	}
+}
@@ -105,6 +105,10 @@ func (n *nlistener) FSSyncStatusResponse(arg keybase1.FSSyncStatusArg)
 func (n *nlistener) FSSyncEvent(arg keybase1.FSPathSyncStatus)                          {}
 func (n *nlistener) BadgeState(badgeState keybase1.BadgeState)                          {}
 func (n *nlistener) ReachabilityChanged(r keybase1.Reachability)                        {}
+func (n *nlistener) GregorThrottled(throttled bool)                                     {}
+func (n *nlistener) GregorConnectFatal(reason string)                                   {}
+func (n *nlistener) GregorHandlerQuarantined(name string)                               {}
+func (n *nlistener) GenericGregorEvent(system string, body string)                      {}
 func (n *nlistener) ChatIdentifyUpdate(update keybase1.CanonicalTLFNameAndIDWithBreaks) {}
 func (n *nlistener) ChatTLFFinalize(uid keybase1.UID, convID chat1.ConversationID, info chat1.ConversationFinalizeInfo) {
 }
@@ -112,3 +116,10 @@ func (n *nlistener) ChatTLFResolve(uid keybase1.UID, convID chat1.ConversationID
 }
 func (n *nlistener) ChatInboxStale(uid keybase1.UID)                                {}
 func (n *nlistener) ChatThreadsStale(uid keybase1.UID, cids []chat1.ConversationID) {}
+func (n *nlistener) ChatTypingUpdate(uid keybase1.UID, convID chat1.ConversationID, typer keybase1.UID, typing bool) {
+}
+func (n *nlistener) ChatMembersUpdate(uid keybase1.UID, convID chat1.ConversationID, joined []keybase1.UID, left []keybase1.UID) {
+}
+func (n *nlistener) ChatMessageConflict(uid keybase1.UID, convID chat1.ConversationID, msgID chat1.MessageID) {
+}
+func (n *nlistener) ChatCompactionProgress(uid keybase1.UID, done int, total int) {}
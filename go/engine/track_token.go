@@ -10,6 +10,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol/keybase1"
 	jsonw "github.com/keybase/go-jsonw"
+	"golang.org/x/net/context"
 )
 
 // TrackToken is an engine.
@@ -136,7 +137,7 @@ func (e *TrackToken) Run(ctx *Context) (err error) {
 
 		// Dismiss any associated gregor item.
 		if outcome.ResponsibleGregorItem != nil {
-			err = e.G().GregorDismisser.DismissItem(outcome.ResponsibleGregorItem.Metadata().MsgID())
+			err = e.G().GregorDismisser.DismissItem(context.TODO(), outcome.ResponsibleGregorItem.Metadata().MsgID())
 		}
 	}
 
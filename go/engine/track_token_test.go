@@ -12,6 +12,7 @@ import (
 	gregor1 "github.com/keybase/client/go/protocol/gregor1"
 	keybase1 "github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/clockwork"
+	"golang.org/x/net/context"
 )
 
 func TestTrackTokenIdentify2(t *testing.T) {
@@ -419,7 +420,7 @@ type FakeGregorDismisser struct {
 
 var _ libkb.GregorDismisser = (*FakeGregorDismisser)(nil)
 
-func (d *FakeGregorDismisser) DismissItem(id gregor.MsgID) error {
+func (d *FakeGregorDismisser) DismissItem(ctx context.Context, id gregor.MsgID) error {
 	d.dismissedMsgID = id
 	return nil
 }
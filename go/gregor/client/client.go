@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/keybase/client/go/gregor"
@@ -25,6 +26,12 @@ type Client struct {
 	Log     rpc.LogOutput
 
 	SaveTimer <-chan time.Time
+
+	// stateLock serializes state machine mutations against snapshot reads,
+	// so a reader never observes a half-applied batch of messages.
+	// generation bumps on every mutation and tags snapshots.
+	stateLock  sync.Mutex
+	generation int64
 }
 
 func NewClient(user gregor.UID, device gregor.DeviceID, sm gregor.StateMachine,
@@ -40,9 +47,16 @@ func NewClient(user gregor.UID, device gregor.DeviceID, sm gregor.StateMachine,
 	return c
 }
 
+// LocalRestorer is implemented by state machines that manage their own
+// persistence but can still prime themselves from local storage on startup.
+type LocalRestorer interface {
+	Restore() error
+}
+
 func (c *Client) Save() error {
 	if !c.Sm.IsEphemeral() {
-		return errors.New("state machine is non-ephemeral")
+		// Non-ephemeral machines persist as they consume; nothing to do
+		return nil
 	}
 
 	state, err := c.Sm.State(c.User, c.Device, nil)
@@ -60,6 +74,9 @@ func (c *Client) Save() error {
 
 func (c *Client) Restore() error {
 	if !c.Sm.IsEphemeral() {
+		if r, ok := c.Sm.(LocalRestorer); ok {
+			return r.Restore()
+		}
 		return errors.New("state machine is non-ephemeral")
 	}
 
@@ -105,11 +122,9 @@ func (c *Client) SyncFromTime(cli gregor1.IncomingInterface, t *time.Time) (msgs
 	}
 
 	c.Log.Debug("syncFromTime consuming %d messages", len(res.Msgs))
-	for _, ibm := range res.Msgs {
-		m := gregor1.Message{Ibm_: &ibm}
+	c.consumeBatch(res.Msgs, func(ibm gregor1.InBandMessage) {
 		msgs = append(msgs, ibm)
-		c.Sm.ConsumeMessage(m)
-	}
+	})
 
 	// Check to make sure the server state is legit
 	state, err := c.Sm.State(c.User, c.Device, nil)
@@ -127,12 +142,82 @@ func (c *Client) SyncFromTime(cli gregor1.IncomingInterface, t *time.Time) (msgs
 	return msgs, nil
 }
 
+// SyncFromCheckpoint sends a digest of our local state along with the sync
+// request. On a digest match the server returns just the delta since ctime;
+// a mismatch means our state has diverged and the caller should run a full
+// sync.
+func (c *Client) SyncFromCheckpoint(cli gregor1.IncomingInterface, t *time.Time) (msgs []gregor.InBandMessage, err error) {
+	state, err := c.Sm.State(c.User, c.Device, nil)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := state.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), time.Second)
+	arg := gregor1.SyncCheckpointArg{
+		Uid:       gregor1.UID(c.User.Bytes()),
+		Deviceid:  gregor1.DeviceID(c.Device.Bytes()),
+		StateHash: hash,
+	}
+	if t != nil {
+		arg.Ctime = gregor1.ToTime(*t)
+	}
+
+	c.Log.Debug("syncFromCheckpoint from: %s", gregor1.FromTime(arg.Ctime))
+	res, err := cli.SyncCheckpoint(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+	if !res.HashMatch {
+		return nil, ErrHashMismatch{}
+	}
+
+	c.Log.Debug("syncFromCheckpoint consuming %d messages", len(res.Msgs))
+	c.consumeBatch(res.Msgs, func(ibm gregor1.InBandMessage) {
+		msgs = append(msgs, ibm)
+	})
+
+	// Make sure we ended up where the server says we should have
+	state, err = c.Sm.State(c.User, c.Device, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hash, err = state.Hash(); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(res.Hash, hash) {
+		return nil, ErrHashMismatch{}
+	}
+
+	return msgs, nil
+}
+
+// consumeBatch runs a batch of server messages into the state machine under
+// the snapshot lock, so concurrent snapshot readers see all of the batch or
+// none of it.
+func (c *Client) consumeBatch(ibms []gregor1.InBandMessage, each func(gregor1.InBandMessage)) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	for _, ibm := range ibms {
+		m := gregor1.Message{Ibm_: &ibm}
+		each(ibm)
+		c.Sm.ConsumeMessage(m)
+	}
+	if len(ibms) > 0 {
+		c.generation++
+	}
+}
+
 func (c *Client) freshSync(cli gregor1.IncomingInterface) ([]gregor.InBandMessage, error) {
 
 	var msgs []gregor.InBandMessage
 	var err error
 
-	c.Sm.Clear()
+	// Fetch the server state before touching ours, so readers never see the
+	// window between Clear and InitState
 	state, err := c.State(cli)
 	if err != nil {
 		return msgs, err
@@ -140,7 +225,7 @@ func (c *Client) freshSync(cli gregor1.IncomingInterface) ([]gregor.InBandMessag
 	if msgs, err = c.InBandMessagesFromState(state); err != nil {
 		return msgs, err
 	}
-	if err = c.Sm.InitState(state); err != nil {
+	if err = c.StateMachineInitState(state); err != nil {
 		return msgs, err
 	}
 
@@ -154,8 +239,19 @@ func (c *Client) Sync(cli gregor1.IncomingInterface) ([]gregor.InBandMessage, er
 		return c.freshSync(cli)
 	}
 
-	c.Log.Debug("Sync(): incremental server sync: using Sync()")
-	msgs, err := c.SyncFromTime(cli, latestCtime)
+	c.Log.Debug("Sync(): incremental server sync: using checkpoint")
+	msgs, err := c.SyncFromCheckpoint(cli, latestCtime)
+	if err == nil {
+		return msgs, nil
+	}
+	if _, ok := err.(ErrHashMismatch); ok {
+		c.Log.Info("Sync failure: %v\nResetting StateMachine and retrying", err)
+		return c.freshSync(cli)
+	}
+
+	// The server might not speak checkpoints yet
+	c.Log.Debug("Sync(): checkpoint sync failed (%v), using ctime sync", err)
+	msgs, err = c.SyncFromTime(cli, latestCtime)
 	if err != nil {
 		if _, ok := err.(ErrHashMismatch); ok {
 			c.Log.Info("Sync failure: %v\nResetting StateMachine and retrying", err)
@@ -195,10 +291,41 @@ func (c *Client) State(cli gregor1.IncomingInterface) (gregor.State, error) {
 	return res, nil
 }
 
+// StateMachineInitState replaces the state machine's contents with the given
+// state. The swap happens under the snapshot lock, so readers never observe
+// the window between the clear and the init.
+func (c *Client) StateMachineInitState(s gregor.State) error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.Sm.Clear()
+	if err := c.Sm.InitState(s); err != nil {
+		return err
+	}
+	c.generation++
+	return nil
+}
+
+// StateMachineSnapshot returns the current state together with the generation
+// number it corresponds to. Mutations are serialized against this call, so
+// the returned state never reflects a half-applied batch of messages.
+func (c *Client) StateMachineSnapshot(t gregor.TimeOrOffset) (gregor.State, int64, error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	state, err := c.Sm.State(c.User, c.Device, t)
+	if err != nil {
+		return nil, 0, err
+	}
+	return state, c.generation, nil
+}
+
 func (c *Client) StateMachineConsumeMessage(m gregor1.Message) error {
+	c.stateLock.Lock()
 	if _, err := c.Sm.ConsumeMessage(m); err != nil {
+		c.stateLock.Unlock()
 		return err
 	}
+	c.generation++
+	c.stateLock.Unlock()
 
 	// Check to see if we should save
 	select {
@@ -224,3 +351,19 @@ func (c *Client) StateMachineInBandMessagesSince(t time.Time) ([]gregor.InBandMe
 func (c *Client) StateMachineState(t gregor.TimeOrOffset) (gregor.State, error) {
 	return c.Sm.State(c.User, c.Device, t)
 }
+
+// StateMachineStateAt returns the state as it was at the given time,
+// replaying the engine's message log when it supports that and otherwise
+// filtering the current item set by time.
+func (c *Client) StateMachineStateAt(t time.Time) (gregor.State, error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if hs, ok := c.Sm.(gregor.HistoricStater); ok {
+		return hs.StateAt(c.User, c.Device, t)
+	}
+	return c.Sm.State(c.User, c.Device, gregor1.TimeOrOffset{Time_: gregor1.ToTime(t)})
+}
+
+func (c *Client) StateMachineStateByCategoryPrefix(t gregor.TimeOrOffset, cp gregor.Category) (gregor.State, error) {
+	return c.Sm.StateByCategoryPrefix(c.User, c.Device, t, cp)
+}
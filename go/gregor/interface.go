@@ -203,6 +203,46 @@ type StateMachine interface {
 	ReminderLockDuration() time.Duration
 }
 
+// DismissalRollbacker is an optional interface a StateMachine can implement
+// to locally reverse a dismissal that was applied optimistically but then
+// rejected by the server.
+// RetentionSetter is an optional interface for state machines that can
+// enforce per-category retention bounds locally.
+type RetentionSetter interface {
+	SetRetentionPolicy(category string, maxItems int, maxAge time.Duration)
+}
+
+// MetadataMerger is an optional interface for state machines that can merge
+// server-authoritative metadata into an item that was already consumed
+// locally (e.g. one we injected ourselves before the server echoed it back).
+type MetadataMerger interface {
+	MergeMetadata(u UID, it Item) (bool, error)
+}
+
+// HistoricStater is an optional interface for state machines that can
+// reconstruct the state as of an arbitrary past time by replaying their
+// message log.
+type HistoricStater interface {
+	StateAt(u UID, d DeviceID, t time.Time) (State, error)
+}
+
+// ItemSearcher is an optional interface for state machines that can search
+// live item bodies for a substring.
+type ItemSearcher interface {
+	SearchItems(u UID, query string) ([]Item, error)
+}
+
+// StateCompacter is an optional interface for state machines that can drop
+// items dismissed before the given time, along with their log entries, from
+// their internal storage.
+type StateCompacter interface {
+	Compact(u UID, before time.Time) (int, error)
+}
+
+type DismissalRollbacker interface {
+	RollbackDismissal(u UID, dismissalID MsgID, ids []MsgID) error
+}
+
 type ObjFactory interface {
 	MakeUID(b []byte) (UID, error)
 	MakeMsgID(b []byte) (MsgID, error)
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/gregor"
+	"github.com/keybase/clockwork"
+)
+
+// LocalStorage persists a marshaled state blob for a given user. It is
+// structurally identical to the client package's LocalStorageEngine, so the
+// same leveldb wrapper can back both.
+type LocalStorage interface {
+	Store(gregor.UID, []byte) error
+	Load(gregor.UID) ([]byte, error)
+}
+
+// DurableEngine wraps MemEngine and writes the full state through to local
+// storage after every consumed message. Unlike an ephemeral engine saved on
+// an interval, a crash loses nothing that was already consumed. Restore
+// primes the in-memory engine from the last flushed state.
+type DurableEngine struct {
+	*MemEngine
+	store  LocalStorage
+	user   gregor.UID
+	device gregor.DeviceID
+}
+
+// NewDurableEngine makes a DurableEngine for the given user and device that
+// flushes into store.
+func NewDurableEngine(f gregor.ObjFactory, cl clockwork.Clock, store LocalStorage,
+	user gregor.UID, device gregor.DeviceID) *DurableEngine {
+	return &DurableEngine{
+		MemEngine: NewMemEngine(f, cl),
+		store:     store,
+		user:      user,
+		device:    device,
+	}
+}
+
+var _ gregor.StateMachine = (*DurableEngine)(nil)
+
+// IsEphemeral is false: the engine persists itself, so callers shouldn't
+// also dump it on a timer.
+func (d *DurableEngine) IsEphemeral() bool {
+	return false
+}
+
+// ConsumeMessage updates the in-memory state and then flushes it to local
+// storage, so the message survives a crash.
+func (d *DurableEngine) ConsumeMessage(m gregor.Message) (time.Time, error) {
+	ctime, err := d.MemEngine.ConsumeMessage(m)
+	if err != nil {
+		return ctime, err
+	}
+	return ctime, d.flush()
+}
+
+// RollbackDismissal undoes a local dismissal and flushes the repaired state.
+func (d *DurableEngine) RollbackDismissal(uid gregor.UID, dismissalID gregor.MsgID,
+	ids []gregor.MsgID) error {
+	if err := d.MemEngine.RollbackDismissal(uid, dismissalID, ids); err != nil {
+		return err
+	}
+	return d.flush()
+}
+
+// MergeMetadata merges server metadata into an existing item and flushes the
+// result if anything changed.
+func (d *DurableEngine) MergeMetadata(uid gregor.UID, it gregor.Item) (bool, error) {
+	changed, err := d.MemEngine.MergeMetadata(uid, it)
+	if err != nil || !changed {
+		return changed, err
+	}
+	return changed, d.flush()
+}
+
+// Compact drops long-dismissed items and rewrites the persisted blob without
+// them if anything was removed.
+func (d *DurableEngine) Compact(uid gregor.UID, before time.Time) (int, error) {
+	n, err := d.MemEngine.Compact(uid, before)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	return n, d.flush()
+}
+
+// InitState replaces the in-memory state and flushes it, so imported state
+// is immediately durable.
+func (d *DurableEngine) InitState(s gregor.State) error {
+	if err := d.MemEngine.InitState(s); err != nil {
+		return err
+	}
+	return d.flush()
+}
+
+// Restore loads the last flushed state into the in-memory engine.
+func (d *DurableEngine) Restore() error {
+	b, err := d.store.Load(d.user)
+	if err != nil {
+		return err
+	}
+	state, err := d.ObjFactory().UnmarshalState(b)
+	if err != nil {
+		return err
+	}
+	return d.InitState(state)
+}
+
+func (d *DurableEngine) flush() error {
+	state, err := d.MemEngine.State(d.user, d.device, nil)
+	if err != nil {
+		return err
+	}
+	b, err := state.Marshal()
+	if err != nil {
+		return err
+	}
+	return d.store.Store(d.user, b)
+}
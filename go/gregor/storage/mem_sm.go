@@ -20,6 +20,14 @@ type MemEngine struct {
 	objFactory gregor.ObjFactory
 	clock      clockwork.Clock
 	users      map[string](*user)
+	retention  map[string]retentionPolicy
+}
+
+// retentionPolicy bounds how many items (and how old) we keep in a category.
+// A zero value means unlimited.
+type retentionPolicy struct {
+	maxItems int
+	maxAge   time.Duration
 }
 
 // NewMemEngine makes a new MemEngine with the given object factory and the
@@ -43,6 +51,10 @@ type item struct {
 	ctime time.Time
 	dtime *time.Time
 
+	// Cached lowercase rendering of the body, built on first search. Bodies
+	// are immutable so this never needs invalidating.
+	loweredBody *string
+
 	// If we received a message from the server that a message should be dimissed,
 	// do so immediately, so as not to introduce clock-skew bugs. We previously
 	// had a bug here --- a message would come in to dismiss a message M at server time T,
@@ -310,9 +322,56 @@ func (m *MemEngine) getUser(uid gregor.UID) *user {
 
 func (m *MemEngine) consumeCreation(u *user, now time.Time, i gregor.Item) (*item, error) {
 	newItem := u.addItem(now, i)
+	m.applyRetention(u, now, i.Category().String())
 	return newItem, nil
 }
 
+// SetRetentionPolicy bounds the named category to at most maxItems live
+// items no older than maxAge; zero means unlimited. Enforcement happens as
+// messages are consumed.
+func (m *MemEngine) SetRetentionPolicy(category string, maxItems int, maxAge time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if m.retention == nil {
+		m.retention = make(map[string]retentionPolicy)
+	}
+	m.retention[category] = retentionPolicy{maxItems: maxItems, maxAge: maxAge}
+}
+
+var _ gregor.RetentionSetter = (*MemEngine)(nil)
+
+// applyRetention dismisses the oldest items over the category's count bound
+// and anything past its age bound. Pruned items stay in the list as
+// dismissed, so replaying the same creation doesn't resurrect them.
+func (m *MemEngine) applyRetention(u *user, now time.Time, category string) {
+	p, ok := m.retention[category]
+	if !ok {
+		return
+	}
+	var live [](*item)
+	for _, i := range u.items {
+		if i.item.Category().String() != category || i.isDismissedAt(now) {
+			continue
+		}
+		if p.maxAge > 0 && now.Sub(i.ctime) > p.maxAge {
+			t := now
+			i.dtime = &t
+			i.dismissedImmediate = true
+			continue
+		}
+		live = append(live, i)
+	}
+	if p.maxItems > 0 && len(live) > p.maxItems {
+		// Items are kept in arrival order, so the front of the list is
+		// the oldest
+		for _, i := range live[:len(live)-p.maxItems] {
+			t := now
+			i.dtime = &t
+			i.dismissedImmediate = true
+		}
+	}
+}
+
 func (m *MemEngine) consumeDismissal(u *user, now time.Time, d gregor.Dismissal, ctime time.Time) error {
 	dtime := nowIfZero(now, ctime)
 	if ids := d.MsgIDsToDismiss(); ids != nil {
@@ -341,6 +400,108 @@ func (m *MemEngine) consumeStateUpdateMessage(u *user, now time.Time, msg gregor
 	return i, nil
 }
 
+// RollbackDismissal implements gregor.DismissalRollbacker. It clears the
+// dismissal markers on the given items and drops the dismissal message from
+// the log, so an optimistic dismissal the server rejected doesn't stick
+// around locally.
+func (m *MemEngine) RollbackDismissal(uid gregor.UID, dismissalID gregor.MsgID, ids []gregor.MsgID) error {
+	m.Lock()
+	defer m.Unlock()
+	u := m.getUser(uid)
+
+	set := make(map[string]bool)
+	for _, i := range ids {
+		set[msgIDtoString(i)] = true
+	}
+	for _, i := range u.items {
+		if set[msgIDtoString(i.item.Metadata().MsgID())] {
+			i.dtime = nil
+			i.dismissedImmediate = false
+		}
+	}
+
+	var log []loggedMsg
+	for _, l := range u.log {
+		if bytes.Equal(l.m.Metadata().MsgID().Bytes(), dismissalID.Bytes()) {
+			continue
+		}
+		log = append(log, l)
+	}
+	u.log = log
+	return nil
+}
+
+var _ gregor.DismissalRollbacker = (*MemEngine)(nil)
+
+// MergeMetadata merges server-authoritative metadata into an existing item
+// with the same MsgID: the server's ctime replaces the locally stamped one,
+// and a server-set dtime dismisses the item. Reports whether anything
+// actually changed.
+func (m *MemEngine) MergeMetadata(uid gregor.UID, it gregor.Item) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	u := m.getUser(uid)
+	msgID := it.Metadata().MsgID()
+	for _, existing := range u.items {
+		if !bytes.Equal(existing.item.Metadata().MsgID().Bytes(), msgID.Bytes()) {
+			continue
+		}
+		var changed bool
+		if ct := it.Metadata().CTime(); !ct.IsZero() && !ct.Equal(existing.ctime) {
+			existing.ctime = ct
+			changed = true
+		}
+		if dt := it.DTime(); dt != nil {
+			t := toTime(existing.ctime, dt)
+			if existing.dtime == nil || !existing.dtime.Equal(t) {
+				existing.dtime = &t
+				changed = true
+			}
+		}
+		return changed, nil
+	}
+	return false, nil
+}
+
+var _ gregor.MetadataMerger = (*MemEngine)(nil)
+
+// Compact drops items that were dismissed before the given time, along with
+// their log entries, and reports how many items went away. Live items and
+// recent dismissals are untouched, so rollback of a recent dismissal still
+// works.
+func (m *MemEngine) Compact(uid gregor.UID, before time.Time) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	u := m.getUser(uid)
+	dropped := make(map[string]bool)
+	var items [](*item)
+	for _, i := range u.items {
+		if i.dtime != nil && i.dtime.Before(before) {
+			dropped[msgIDtoString(i.item.Metadata().MsgID())] = true
+			continue
+		}
+		items = append(items, i)
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+	u.items = items
+
+	var log []loggedMsg
+	for _, l := range u.log {
+		if l.i != nil && dropped[msgIDtoString(l.i.item.Metadata().MsgID())] {
+			continue
+		}
+		log = append(log, l)
+	}
+	u.log = log
+	return len(dropped), nil
+}
+
+var _ gregor.StateCompacter = (*MemEngine)(nil)
+
 func (m *MemEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) (gregor.State, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -348,6 +509,30 @@ func (m *MemEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset
 	return user.state(m.clock.Now(), m.objFactory, d, t)
 }
 
+// StateAt reconstructs the state as of time t by replaying the logged
+// messages up to t into a scratch user. Unlike State with a time offset, the
+// answer doesn't depend on the current item set, so it stays correct for
+// items that were since compacted away.
+func (m *MemEngine) StateAt(uid gregor.UID, d gregor.DeviceID, t time.Time) (gregor.State, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	scratch := new(user)
+	for _, l := range m.getUser(uid).log {
+		if l.ctime.After(t) {
+			continue
+		}
+		if sum := l.m.ToStateUpdateMessage(); sum != nil {
+			if _, err := m.consumeStateUpdateMessage(scratch, l.ctime, sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return scratch.state(t, m.objFactory, d, timeOrOffset(t))
+}
+
+var _ gregor.HistoricStater = (*MemEngine)(nil)
+
 func (m *MemEngine) StateByCategoryPrefix(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, cp gregor.Category) (gregor.State, error) {
 	state, err := m.State(u, d, t)
 	if err != nil {
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/keybase/client/go/gregor"
+)
+
+// loweredBodyStr returns the item's body lowered for case-insensitive
+// matching, caching the result on the item.
+func (i *item) loweredBodyStr() string {
+	if i.loweredBody == nil {
+		var s string
+		if b := i.item.Body(); b != nil {
+			s = strings.ToLower(string(b.Bytes()))
+		}
+		i.loweredBody = &s
+	}
+	return *i.loweredBody
+}
+
+// SearchItems returns the user's live items whose body contains the given
+// substring, case-insensitively. Bodies are indexed (lowered) lazily on the
+// first search and reused afterwards.
+func (m *MemEngine) SearchItems(uid gregor.UID, query string) ([]gregor.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	u := m.getUser(uid)
+	now := m.clock.Now()
+	q := strings.ToLower(query)
+
+	var res []gregor.Item
+	for _, i := range u.items {
+		if i.isDismissedAt(now) {
+			continue
+		}
+		if !strings.Contains(i.loweredBodyStr(), q) {
+			continue
+		}
+		exported, err := i.export(m.objFactory)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, exported)
+	}
+	return res, nil
+}
+
+var _ gregor.ItemSearcher = (*MemEngine)(nil)
@@ -146,6 +146,22 @@ func (p CommandLine) GetGregorPingTimeout() (time.Duration, bool) {
 	}
 	return ret, true
 }
+func (p CommandLine) GetGregorReplayBudget() (time.Duration, bool) {
+	ret, err := p.GetGDuration("push-replay-budget")
+	if err != nil {
+		return 0, false
+	}
+	return ret, true
+}
+func (p CommandLine) GetGregorTLSCAFile() string {
+	return p.GetGString("push-tls-ca-file")
+}
+func (p CommandLine) GetGregorUseSystemCA() (bool, bool) {
+	return p.GetBool("push-use-system-ca", true)
+}
+func (p CommandLine) GetGregorPinnedSPKIHash() string {
+	return p.GetGString("push-spki-hash")
+}
 
 func (p CommandLine) GetChatDelivererInterval() (time.Duration, bool) {
 	ret, err := p.GetGDuration("chat-deliverer-interval")
@@ -155,6 +171,62 @@ func (p CommandLine) GetChatDelivererInterval() (time.Duration, bool) {
 	return ret, true
 }
 
+func (p CommandLine) GetChatCacheMaxBytes() (int, bool) {
+	ret := p.GetGInt("chat-cache-max-bytes")
+	if ret == 0 {
+		return 0, false
+	}
+	return ret, true
+}
+
+func (p CommandLine) GetChatConvCacheMaxBytes() (int, bool) {
+	ret := p.GetGInt("chat-conv-cache-max-bytes")
+	if ret == 0 {
+		return 0, false
+	}
+	return ret, true
+}
+
+func (p CommandLine) GetChatUnboxWorkers() (int, bool) {
+	ret := p.GetGInt("chat-unbox-workers")
+	if ret == 0 {
+		return 0, false
+	}
+	return ret, true
+}
+
+func (p CommandLine) GetChatFetchBatchSize() (int, bool) {
+	ret := p.GetGInt("chat-fetch-batch-size")
+	if ret == 0 {
+		return 0, false
+	}
+	return ret, true
+}
+
+func (p CommandLine) GetChatOutboxMaxAge() (time.Duration, bool) {
+	ret, err := p.GetGDuration("chat-outbox-max-age")
+	if err != nil {
+		return 0, false
+	}
+	return ret, true
+}
+
+func (p CommandLine) GetChatOutboxMaxAttempts() (int, bool) {
+	ret := p.GetGInt("chat-outbox-max-attempts")
+	if ret == 0 {
+		return 0, false
+	}
+	return ret, true
+}
+
+func (p CommandLine) GetChatPinnedBackfillDepth() (int, bool) {
+	ret := p.GetGInt("chat-pinned-backfill-depth")
+	if ret == 0 {
+		return 0, false
+	}
+	return ret, true
+}
+
 func (p CommandLine) GetRunMode() (libkb.RunMode, error) {
 	return libkb.StringToRunMode(p.GetGString("run-mode"))
 }
@@ -554,10 +554,56 @@ func (f JSONConfigFile) GetGregorPingTimeout() (time.Duration, bool) {
 	return f.GetDurationAtPath("push.ping_timeout")
 }
 
+func (f JSONConfigFile) GetGregorReplayBudget() (time.Duration, bool) {
+	return f.GetDurationAtPath("push.replay_budget")
+}
+
+func (f JSONConfigFile) GetGregorTLSCAFile() string {
+	res, _ := f.GetStringAtPath("push.tls_ca_file")
+	return res
+}
+
+func (f JSONConfigFile) GetGregorUseSystemCA() (bool, bool) {
+	return f.GetBoolAtPath("push.use_system_ca")
+}
+
+func (f JSONConfigFile) GetGregorPinnedSPKIHash() string {
+	res, _ := f.GetStringAtPath("push.spki_hash")
+	return res
+}
+
 func (f JSONConfigFile) GetChatDelivererInterval() (time.Duration, bool) {
 	return f.GetDurationAtPath("chat.deliverer_interval")
 }
 
+func (f JSONConfigFile) GetChatCacheMaxBytes() (int, bool) {
+	return f.jw.AtPathGetInt("chat.cache_max_bytes")
+}
+
+func (f JSONConfigFile) GetChatConvCacheMaxBytes() (int, bool) {
+	return f.jw.AtPathGetInt("chat.conv_cache_max_bytes")
+}
+
+func (f JSONConfigFile) GetChatUnboxWorkers() (int, bool) {
+	return f.jw.AtPathGetInt("chat.unbox_workers")
+}
+
+func (f JSONConfigFile) GetChatFetchBatchSize() (int, bool) {
+	return f.jw.AtPathGetInt("chat.fetch_batch_size")
+}
+
+func (f JSONConfigFile) GetChatOutboxMaxAge() (time.Duration, bool) {
+	return f.GetDurationAtPath("chat.outbox_max_age")
+}
+
+func (f JSONConfigFile) GetChatOutboxMaxAttempts() (int, bool) {
+	return f.jw.AtPathGetInt("chat.outbox_max_attempts")
+}
+
+func (f JSONConfigFile) GetChatPinnedBackfillDepth() (int, bool) {
+	return f.jw.AtPathGetInt("chat.pinned_backfill_depth")
+}
+
 func (f JSONConfigFile) getCacheSize(w string) (int, bool) {
 	return f.jw.AtPathGetInt(w)
 }
@@ -53,14 +53,18 @@ type ConnectionManager struct {
 	nxt    ConnectionID
 	lookup map[ConnectionID](*rpcConnection)
 
-	addConnectionCh      chan *addConnectionObj
-	lookupConnectionCh   chan *lookupConnectionObj
-	removeConnectionCh   chan ConnectionID
-	applyAllCh           chan ApplyFn
-	shutdownCh           chan struct{}
-	labelConnectionCh    chan labelConnectionObj
-	listAllCh            chan chan<- []keybase1.ClientDetails
-	lookupByClientTypeCh chan *lookupByClientTypeObj
+	addConnectionCh          chan *addConnectionObj
+	lookupConnectionCh       chan *lookupConnectionObj
+	removeConnectionCh       chan ConnectionID
+	applyAllCh               chan ApplyFn
+	shutdownCh               chan struct{}
+	labelConnectionCh        chan labelConnectionObj
+	listAllCh                chan chan<- []keybase1.ClientDetails
+	lookupByClientTypeCh     chan *lookupByClientTypeObj
+	registerDisconnectHookCh chan func(ConnectionID)
+
+	// Only the run() loop touches disconnectHooks
+	disconnectHooks []func(ConnectionID)
 }
 
 // AddConnection adds a new connection to the table of Connection object, with a
@@ -174,6 +178,12 @@ func (c *ConnectionManager) run() {
 			lookupConnectionObj.ch <- c.lookupTransporter(lookupConnectionObj.id)
 		case id := <-c.removeConnectionCh:
 			delete(c.lookup, id)
+			for _, f := range c.disconnectHooks {
+				// Hooks can block, so don't hold up the routing loop on them
+				go f(id)
+			}
+		case f := <-c.registerDisconnectHookCh:
+			c.disconnectHooks = append(c.disconnectHooks, f)
 		case labelConnectionObj := <-c.labelConnectionCh:
 			id := labelConnectionObj.id
 			var err error
@@ -204,6 +214,14 @@ func (c *ConnectionManager) run() {
 	}
 }
 
+// RegisterDisconnectHook registers f to be called with the ConnectionID of
+// every connection removed from the table, so interested parties hear about a
+// disconnect right away instead of discovering it lazily. Each hook runs in
+// its own goroutine.
+func (c *ConnectionManager) RegisterDisconnectHook(f func(ConnectionID)) {
+	c.registerDisconnectHookCh <- f
+}
+
 // ApplyAll applies the given function f to all connections in the table.
 // If you're going to do something blocking, please do it in a GoRoutine,
 // since we're holding the lock for all connections as we do this.
@@ -215,15 +233,16 @@ func (c *ConnectionManager) ApplyAll(f ApplyFn) {
 // routing loop running.
 func NewConnectionManager() *ConnectionManager {
 	ret := &ConnectionManager{
-		lookup:               make(map[ConnectionID](*rpcConnection)),
-		addConnectionCh:      make(chan *addConnectionObj),
-		lookupConnectionCh:   make(chan *lookupConnectionObj),
-		removeConnectionCh:   make(chan ConnectionID),
-		labelConnectionCh:    make(chan labelConnectionObj),
-		applyAllCh:           make(chan ApplyFn),
-		listAllCh:            make(chan chan<- []keybase1.ClientDetails),
-		shutdownCh:           make(chan struct{}),
-		lookupByClientTypeCh: make(chan *lookupByClientTypeObj),
+		lookup:                   make(map[ConnectionID](*rpcConnection)),
+		addConnectionCh:          make(chan *addConnectionObj),
+		lookupConnectionCh:       make(chan *lookupConnectionObj),
+		removeConnectionCh:       make(chan ConnectionID),
+		labelConnectionCh:        make(chan labelConnectionObj),
+		applyAllCh:               make(chan ApplyFn),
+		listAllCh:                make(chan chan<- []keybase1.ClientDetails),
+		shutdownCh:               make(chan struct{}),
+		lookupByClientTypeCh:     make(chan *lookupByClientTypeObj),
+		registerDisconnectHookCh: make(chan func(ConnectionID)),
 	}
 	go ret.run()
 	return ret
@@ -94,6 +94,14 @@ const (
 	LinkCacheSize               = 0x10000
 	LinkCacheCleanDur           = 1 * time.Minute
 
+	ChatCacheMaxBytes       = 300 * 1024 * 1024  // approximate budget for all locally cached conversations
+	ChatConvCacheMaxBytes   = 30 * 1024 * 1024   // approximate budget for a single conversation
+	ChatUnboxWorkers        = 8                  // how many messages we unbox in parallel
+	ChatFetchBatchSize      = 300                // how many messages we request from the server per call
+	ChatOutboxMaxAge        = 7 * 24 * time.Hour // how long an undelivered outbox record keeps retrying
+	ChatOutboxMaxAttempts   = 5                  // how many send attempts before an outbox record fails
+	ChatPinnedBackfillDepth = 1000               // how many messages we cache for a pinned conversation
+
 	SigShortIDBytes  = 27
 	LocalTrackMaxAge = 48 * time.Hour
 
@@ -480,7 +488,8 @@ const (
 )
 
 const (
-	EncryptionReasonChatLocalStorage EncryptionReason = "Keybase-Chat-Local-Storage-1"
+	EncryptionReasonChatLocalStorage   EncryptionReason = "Keybase-Chat-Local-Storage-1"
+	EncryptionReasonGregorLocalStorage EncryptionReason = "Keybase-Gregor-Local-Storage-1"
 )
 
 // FirstPRodMerkleSeqnoWithSkips is the first merkle root on production that
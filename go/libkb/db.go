@@ -95,6 +95,11 @@ func (j *JSONLocalDb) ForceOpen() error      { return j.engine.ForceOpen() }
 func (j *JSONLocalDb) Close() error          { return j.engine.Close() }
 func (j *JSONLocalDb) Nuke() (string, error) { return j.engine.Nuke() }
 
+func (j *JSONLocalDb) Compact(progress func(done, total int)) error {
+	return j.engine.Compact(progress)
+}
+func (j *JSONLocalDb) DiskUsage() (int64, error) { return j.engine.DiskUsage() }
+
 func (j *JSONLocalDb) PutRaw(id DbKey, b []byte) error       { return j.engine.Put(id, nil, b) }
 func (j *JSONLocalDb) GetRaw(id DbKey) ([]byte, bool, error) { return j.engine.Get(id) }
 func (j *JSONLocalDb) Delete(id DbKey) error                 { return j.engine.Delete(id) }
@@ -172,6 +177,7 @@ const (
 	DBSig                     = 0x0f
 	DBLink                    = 0xe0
 	DBLocalTrack              = 0xe1
+	DBChatQuarantine          = 0xe2
 	DBPGPKey                  = 0xe3
 	DBSigHints                = 0xe4
 	DBProofCheck              = 0xe5
@@ -191,6 +197,16 @@ const (
 	DBChatInbox               = 0xf9
 	DBIdentify                = 0xfa
 	DBResolveUsernameToUID    = 0xfb
+	DBChatIndex               = 0xfc
+	DBChatCacheTracker        = 0xfd
+	DBChatHoles               = 0xfe
+	DBChatDerived             = 0xff
+	DBChatDrafts              = 0xea
+	DBChatPins                = 0xeb
+	DBChatReadMarks           = 0xec
+	DBChatApplyJournal        = 0xed
+	DBChatConvPins            = 0xee
+	DBChatReceipts            = 0xef
 )
 
 const (
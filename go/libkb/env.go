@@ -76,7 +76,18 @@ func (n NullConfiguration) GetGregorURI() string
 func (n NullConfiguration) GetGregorSaveInterval() (time.Duration, bool)                   { return 0, false }
 func (n NullConfiguration) GetGregorPingInterval() (time.Duration, bool)                   { return 0, false }
 func (n NullConfiguration) GetGregorPingTimeout() (time.Duration, bool)                    { return 0, false }
+func (n NullConfiguration) GetGregorReplayBudget() (time.Duration, bool)                   { return 0, false }
+func (n NullConfiguration) GetGregorTLSCAFile() string                                     { return "" }
+func (n NullConfiguration) GetGregorUseSystemCA() (bool, bool)                             { return false, false }
+func (n NullConfiguration) GetGregorPinnedSPKIHash() string                                { return "" }
 func (n NullConfiguration) GetChatDelivererInterval() (time.Duration, bool)                { return 0, false }
+func (n NullConfiguration) GetChatCacheMaxBytes() (int, bool)                              { return 0, false }
+func (n NullConfiguration) GetChatConvCacheMaxBytes() (int, bool)                          { return 0, false }
+func (n NullConfiguration) GetChatUnboxWorkers() (int, bool)                               { return 0, false }
+func (n NullConfiguration) GetChatFetchBatchSize() (int, bool)                             { return 0, false }
+func (n NullConfiguration) GetChatOutboxMaxAge() (time.Duration, bool)                     { return 0, false }
+func (n NullConfiguration) GetChatOutboxMaxAttempts() (int, bool)                          { return 0, false }
+func (n NullConfiguration) GetChatPinnedBackfillDepth() (int, bool)                        { return 0, false }
 func (n NullConfiguration) IsAdmin() (bool, bool)                                          { return false, false }
 func (n NullConfiguration) GetGregorDisabled() (bool, bool)                                { return false, false }
 func (n NullConfiguration) GetMountDir() string                                            { return "" }
@@ -612,6 +623,47 @@ func (e *Env) GetGregorPingTimeout() time.Duration {
 	)
 }
 
+// GetGregorTLSCAFile returns the path of an alternate CA file to use when
+// connecting to a self-hosted gregord, overriding the bundled CA.
+func (e *Env) GetGregorTLSCAFile() string {
+	return e.GetString(
+		func() string { return os.Getenv("KEYBASE_PUSH_TLS_CA_FILE") },
+		func() string { return e.config.GetGregorTLSCAFile() },
+		func() string { return e.cmd.GetGregorTLSCAFile() },
+	)
+}
+
+// GetGregorUseSystemCA returns true if the gregord connection should verify
+// the server against the system cert pool rather than the bundled CA.
+func (e *Env) GetGregorUseSystemCA() bool {
+	return e.GetBool(false,
+		func() (bool, bool) { return e.cmd.GetGregorUseSystemCA() },
+		func() (bool, bool) { return getEnvBool("KEYBASE_PUSH_USE_SYSTEM_CA") },
+		func() (bool, bool) { return e.config.GetGregorUseSystemCA() },
+	)
+}
+
+// GetGregorPinnedSPKIHash returns a hex-encoded SHA-256 hash of the SPKI of
+// the gregord server certificate to pin to, replacing chain validation.
+func (e *Env) GetGregorPinnedSPKIHash() string {
+	return e.GetString(
+		func() string { return os.Getenv("KEYBASE_PUSH_SPKI_HASH") },
+		func() string { return e.config.GetGregorPinnedSPKIHash() },
+		func() string { return e.cmd.GetGregorPinnedSPKIHash() },
+	)
+}
+
+// GetGregorReplayBudget is the most wall-clock time a single replay of
+// in-band messages is allowed to take on reconnect; anything left over is
+// resumed on the next reconnect.
+func (e *Env) GetGregorReplayBudget() time.Duration {
+	return e.GetDuration(30*time.Second,
+		func() (time.Duration, bool) { return e.getEnvDuration("KEYBASE_PUSH_REPLAY_BUDGET") },
+		func() (time.Duration, bool) { return e.config.GetGregorReplayBudget() },
+		func() (time.Duration, bool) { return e.cmd.GetGregorReplayBudget() },
+	)
+}
+
 func (e *Env) GetChatDelivererInterval() time.Duration {
 	return e.GetDuration(30*time.Second,
 		func() (time.Duration, bool) { return e.getEnvDuration("KEYBASE_CHAT_DELIVERER_INTERVAL") },
@@ -620,6 +672,62 @@ func (e *Env) GetChatDelivererInterval() time.Duration {
 	)
 }
 
+func (e *Env) GetChatCacheMaxBytes() int {
+	return e.GetInt(ChatCacheMaxBytes,
+		func() (int, bool) { return e.getEnvInt("KEYBASE_CHAT_CACHE_MAX_BYTES") },
+		e.config.GetChatCacheMaxBytes,
+		e.cmd.GetChatCacheMaxBytes,
+	)
+}
+
+func (e *Env) GetChatConvCacheMaxBytes() int {
+	return e.GetInt(ChatConvCacheMaxBytes,
+		func() (int, bool) { return e.getEnvInt("KEYBASE_CHAT_CONV_CACHE_MAX_BYTES") },
+		e.config.GetChatConvCacheMaxBytes,
+		e.cmd.GetChatConvCacheMaxBytes,
+	)
+}
+
+func (e *Env) GetChatUnboxWorkers() int {
+	return e.GetInt(ChatUnboxWorkers,
+		func() (int, bool) { return e.getEnvInt("KEYBASE_CHAT_UNBOX_WORKERS") },
+		e.config.GetChatUnboxWorkers,
+		e.cmd.GetChatUnboxWorkers,
+	)
+}
+
+func (e *Env) GetChatFetchBatchSize() int {
+	return e.GetInt(ChatFetchBatchSize,
+		func() (int, bool) { return e.getEnvInt("KEYBASE_CHAT_FETCH_BATCH_SIZE") },
+		e.config.GetChatFetchBatchSize,
+		e.cmd.GetChatFetchBatchSize,
+	)
+}
+
+func (e *Env) GetChatOutboxMaxAge() time.Duration {
+	return e.GetDuration(ChatOutboxMaxAge,
+		func() (time.Duration, bool) { return e.getEnvDuration("KEYBASE_CHAT_OUTBOX_MAX_AGE") },
+		func() (time.Duration, bool) { return e.config.GetChatOutboxMaxAge() },
+		func() (time.Duration, bool) { return e.cmd.GetChatOutboxMaxAge() },
+	)
+}
+
+func (e *Env) GetChatOutboxMaxAttempts() int {
+	return e.GetInt(ChatOutboxMaxAttempts,
+		func() (int, bool) { return e.getEnvInt("KEYBASE_CHAT_OUTBOX_MAX_ATTEMPTS") },
+		e.config.GetChatOutboxMaxAttempts,
+		e.cmd.GetChatOutboxMaxAttempts,
+	)
+}
+
+func (e *Env) GetChatPinnedBackfillDepth() int {
+	return e.GetInt(ChatPinnedBackfillDepth,
+		func() (int, bool) { return e.getEnvInt("KEYBASE_CHAT_PINNED_BACKFILL_DEPTH") },
+		e.config.GetChatPinnedBackfillDepth,
+		e.cmd.GetChatPinnedBackfillDepth,
+	)
+}
+
 func (e *Env) GetPidFile() (ret string, err error) {
 	ret = e.GetString(
 		func() string { return e.cmd.GetPidFile() },
@@ -1778,3 +1778,16 @@ func (e DeviceNotFoundError) Error() string {
 }
 
 //=============================================================================
+
+// GregorRetryableError is returned by a GregorInBandMessageHandler that
+// failed transiently: the message was not durably handled and should be
+// redelivered to the handler later.
+type GregorRetryableError struct {
+	Inner error
+}
+
+func (e GregorRetryableError) Error() string {
+	return fmt.Sprintf("retryable gregor handler error: %s", e.Inner)
+}
+
+//=============================================================================
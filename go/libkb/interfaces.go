@@ -43,7 +43,11 @@ type configGetter interface {
 	GetBGIdentifierDisabled() (bool, bool)
 	GetGregorPingInterval() (time.Duration, bool)
 	GetGregorPingTimeout() (time.Duration, bool)
+	GetGregorReplayBudget() (time.Duration, bool)
 	GetGregorSaveInterval() (time.Duration, bool)
+	GetGregorTLSCAFile() string
+	GetGregorUseSystemCA() (bool, bool)
+	GetGregorPinnedSPKIHash() string
 	GetGregorURI() string
 	GetHome() string
 	GetLinkCacheSize() (int, bool)
@@ -72,6 +76,13 @@ type configGetter interface {
 	GetUserCacheMaxAge() (time.Duration, bool)
 	GetVDebugSetting() string
 	GetChatDelivererInterval() (time.Duration, bool)
+	GetChatCacheMaxBytes() (int, bool)
+	GetChatConvCacheMaxBytes() (int, bool)
+	GetChatUnboxWorkers() (int, bool)
+	GetChatFetchBatchSize() (int, bool)
+	GetChatOutboxMaxAge() (time.Duration, bool)
+	GetChatOutboxMaxAttempts() (int, bool)
+	GetChatPinnedBackfillDepth() (int, bool)
 	GetFeatureFlags() (FeatureFlags, error)
 }
 
@@ -117,6 +128,8 @@ type LocalDb interface {
 	ForceOpen() error
 	Close() error
 	Nuke() (string, error)
+	Compact(progress func(done, total int)) error
+	DiskUsage() (int64, error)
 	OpenTransaction() (LocalDbTransaction, error)
 }
 
@@ -427,7 +440,7 @@ type Clock interface {
 }
 
 type GregorDismisser interface {
-	DismissItem(id gregor.MsgID) error
+	DismissItem(ctx context.Context, id gregor.MsgID) error
 }
 
 type GregorInBandMessageHandler interface {
@@ -437,15 +450,55 @@ type GregorInBandMessageHandler interface {
 	Dismiss(ctx context.Context, cli gregor1.IncomingInterface, category string, ibm gregor.Item) (bool, error)
 }
 
+// GregorStateDeltaHandler is an optional interface a GregorFirehoseHandler
+// can implement to accept incremental state updates. PushStateDelta reports
+// whether the delta was applied; on false the caller falls back to a full
+// PushState.
+type GregorStateDeltaHandler interface {
+	PushStateDelta(d keybase1.GregorStateDelta, r keybase1.PushReason) bool
+}
+
+// GregorForceFullReplayer is an optional interface a
+// GregorInBandMessageHandler can implement to always get the full state
+// replayed when it attaches, instead of picking up from its replay watermark.
+type GregorForceFullReplayer interface {
+	ForceFullReplay() bool
+}
+
+// GregorMultiDeviceViewer is an optional interface a
+// GregorInBandMessageHandler can implement to also receive messages targeted
+// at other devices; by default a handler only sees untargeted messages and
+// ones for the local device.
+type GregorMultiDeviceViewer interface {
+	WantMultiDeviceView() bool
+}
+
+// GregorOOBMReplayer is an optional interface a GregorFirehoseHandler can
+// implement to have recently seen out-of-band messages replayed to it when it
+// attaches, rather than missing whatever arrived before it connected.
+type GregorOOBMReplayer interface {
+	ReplayOutOfBandMessages() bool
+}
+
 type GregorFirehoseHandler interface {
 	IsAlive() bool
 	PushState(gregor1.State, keybase1.PushReason)
 	PushOutOfBandMessages([]gregor1.OutOfBandMessage)
 }
 
+// GregorFirehoseSubscription narrows what a firehose handler receives: state
+// pushes are filtered to items whose category matches one of the prefixes,
+// and out-of-band messages to the listed systems. An empty slice means no
+// filtering on that axis.
+type GregorFirehoseSubscription struct {
+	CategoryPrefixes []string
+	OOBMSystems      []string
+}
+
 type GregorListener interface {
 	PushHandler(handler GregorInBandMessageHandler)
 	PushFirehoseHandler(handler GregorFirehoseHandler)
+	PushFirehoseHandlerWithSubscription(handler GregorFirehoseHandler, sub GregorFirehoseSubscription)
 }
 
 type LogContext interface {
@@ -541,13 +594,35 @@ type ConversationSource interface {
 		msg chat1.MessageBoxed) (chat1.MessageUnboxed, bool, error)
 	Pull(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID, query *chat1.GetThreadQuery,
 		pagination *chat1.Pagination) (chat1.ThreadView, []*chat1.RateLimit, error)
+	PullStream(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+		query *chat1.GetThreadQuery, pagination *chat1.Pagination,
+		deliver func(thread chat1.ThreadView, final bool)) ([]*chat1.RateLimit, error)
 	PullLocalOnly(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
 		query *chat1.GetThreadQuery, p *chat1.Pagination) (chat1.ThreadView, error)
+	PreloadConversations(ctx context.Context, uid gregor1.UID, convIDs []chat1.ConversationID,
+		depth int) ([]*chat1.RateLimit, error)
 	GetMessages(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID, msgIDs []chat1.MessageID, finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error)
 	GetMessagesWithRemotes(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
 		msgs []chat1.MessageBoxed, finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error)
 	Clear(convID chat1.ConversationID, uid gregor1.UID) error
+	ClearCache(ctx context.Context, uid gregor1.UID, opts chat1.ClearCacheLocalOpts) (chat1.ClearCacheLocalRes, error)
+	CacheStats() chat1.CacheStatsLocalRes
+	InvalidateTLFCryptKeys(tlfName string)
 	TransformSupersedes(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID, msgs []chat1.MessageUnboxed, finalizeInfo *chat1.ConversationFinalizeInfo) ([]chat1.MessageUnboxed, error)
+	Search(ctx context.Context, uid gregor1.UID, query string, opts chat1.SearchLocalOptions) ([]chat1.SearchLocalHit, error)
+	AttachmentPreviewCached(ctx context.Context, convID chat1.ConversationID,
+		msgID chat1.MessageID) ([]byte, chat1.Asset, bool)
+	CacheAttachmentPreview(ctx context.Context, convID chat1.ConversationID,
+		msgID chat1.MessageID, asset chat1.Asset, data []byte)
+	Pin(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+		msgID chat1.MessageID) error
+	Unpin(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+		msgID chat1.MessageID) error
+	ListPinned(ctx context.Context, convID chat1.ConversationID,
+		uid gregor1.UID) ([]chat1.MessageUnboxed, error)
+	SetConvPinned(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID,
+		pinned bool) error
+	ListPinnedConvs(ctx context.Context, uid gregor1.UID) []chat1.ConversationID
 }
 
 type MessageDeliverer interface {
@@ -581,6 +656,10 @@ type InboxSource interface {
 		msgID chat1.MessageID) (*chat1.ConversationLocal, error)
 	SetStatus(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers, convID chat1.ConversationID,
 		status chat1.ConversationStatus) (*chat1.ConversationLocal, error)
+	MembersUpdate(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers, convID chat1.ConversationID,
+		joined []gregor1.UID, left []gregor1.UID) (*chat1.ConversationLocal, error)
+	UpdateConversation(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
+		conv chat1.Conversation) (*chat1.ConversationLocal, error)
 	TlfFinalize(ctx context.Context, uid gregor1.UID, vers chat1.InboxVers,
 		convIDs []chat1.ConversationID, finalizeInfo chat1.ConversationFinalizeInfo) ([]chat1.ConversationLocal, error)
 }
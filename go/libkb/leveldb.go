@@ -6,12 +6,14 @@ package libkb
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	errors "github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // table names
@@ -239,6 +241,54 @@ func (l *LevelDb) nukeIfCorrupt(err error) bool {
 	return false
 }
 
+// Compact rewrites the underlying table files to reclaim space left behind
+// by deleted and overwritten records. It works one key range at a time so
+// the caller can report progress; if non-nil, progress is invoked after each
+// range with how many of the total ranges are done.
+func (l *LevelDb) Compact(progress func(done, total int)) error {
+	return l.doWhileOpenAndNukeIfCorrupted(func() error {
+		// One range for the lookup alias table, plus one per key type in
+		// the main table. ';' is the next byte after ':', so it bounds each
+		// prefix.
+		total := 0x100 + 1
+		if err := l.db.CompactRange(util.Range{
+			Start: []byte(levelDbTableLo + ":"),
+			Limit: []byte(levelDbTableLo + ";"),
+		}); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(1, total)
+		}
+		for typ := 0; typ <= 0xff; typ++ {
+			if err := l.db.CompactRange(util.Range{
+				Start: []byte(fmt.Sprintf("%s:%02x:", levelDbTableKv, typ)),
+				Limit: []byte(fmt.Sprintf("%s:%02x;", levelDbTableKv, typ)),
+			}); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(typ+2, total)
+			}
+		}
+		return nil
+	})
+}
+
+// DiskUsage reports the total size in bytes of the database files on disk.
+func (l *LevelDb) DiskUsage() (total int64, err error) {
+	err = filepath.Walk(l.GetFilename(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
 func (l *LevelDb) Put(id DbKey, aliases []DbKey, value []byte) error {
 	return l.doWhileOpenAndNukeIfCorrupted(func() error {
 		return levelDbPut(l.db, id, aliases, value)
@@ -116,6 +116,42 @@ func TestLevelDb(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "compact", testBody: func(t *testing.T) {
+				tc := SetupTest(t, "LevelDb-compact", 0)
+				db, err := createTempLevelDbForTest(&tc, &td)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				key, err := testLevelDbPut(db)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+
+				var last, total int
+				if err = db.Compact(func(done, n int) {
+					last = done
+					total = n
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if total == 0 || last != total {
+					t.Fatalf("compaction progress ended at %d/%d", last, total)
+				}
+
+				size, err := db.DiskUsage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size <= 0 {
+					t.Fatalf("expected nonzero disk usage, got %d", size)
+				}
+			},
+		},
 		{
 			name: "concurrent", testBody: func(t *testing.T) {
 				tc := SetupTest(t, "LevelDb-concurrent", 0)
@@ -48,9 +48,17 @@ type NotifyListener interface {
 		resolveInfo chat1.ConversationResolveInfo)
 	ChatInboxStale(uid keybase1.UID)
 	ChatThreadsStale(uid keybase1.UID, cids []chat1.ConversationID)
+	ChatTypingUpdate(uid keybase1.UID, convID chat1.ConversationID, typer keybase1.UID, typing bool)
+	ChatMembersUpdate(uid keybase1.UID, convID chat1.ConversationID, joined []keybase1.UID, left []keybase1.UID)
+	ChatMessageConflict(uid keybase1.UID, convID chat1.ConversationID, msgID chat1.MessageID)
+	ChatCompactionProgress(uid keybase1.UID, done int, total int)
 	PGPKeyInSecretStoreFile()
 	BadgeState(badgeState keybase1.BadgeState)
 	ReachabilityChanged(r keybase1.Reachability)
+	GregorThrottled(throttled bool)
+	GregorConnectFatal(reason string)
+	GregorHandlerQuarantined(name string)
+	GenericGregorEvent(system string, body string)
 }
 
 // NotifyRouter routes notifications to the various active RPC
@@ -299,6 +307,109 @@ func (n *NotifyRouter) HandleBadgeState(badgeState keybase1.BadgeState) {
 	}
 }
 
+// HandleGregorThrottled is called when gregord starts or stops rate-limiting
+// our calls, so UIs can tell the user the client is being throttled.
+func (n *NotifyRouter) HandleGregorThrottled(throttled bool) {
+	if n == nil {
+		return
+	}
+	n.G().Log.Debug("Sending GregorThrottled notification (throttled: %v)", throttled)
+	// For all connections we currently have open...
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		// If the connection wants the `Gregor` notification type
+		if n.getNotificationChannels(id).Gregor {
+			// In the background do...
+			go func() {
+				(keybase1.NotifyGregorClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).GregorThrottled(context.Background(), throttled)
+			}()
+		}
+		return true
+	})
+	if n.listener != nil {
+		n.listener.GregorThrottled(throttled)
+	}
+}
+
+// HandleGregorConnectFatal is called when a gregor connection attempt fails
+// with an error that retrying won't fix, so UIs can surface it to the user.
+func (n *NotifyRouter) HandleGregorConnectFatal(reason string) {
+	if n == nil {
+		return
+	}
+	n.G().Log.Debug("Sending GregorConnectFatal notification (reason: %s)", reason)
+	// For all connections we currently have open...
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		// If the connection wants the `Gregor` notification type
+		if n.getNotificationChannels(id).Gregor {
+			// In the background do...
+			go func() {
+				(keybase1.NotifyGregorClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).GregorConnectFatal(context.Background(), reason)
+			}()
+		}
+		return true
+	})
+	if n.listener != nil {
+		n.listener.GregorConnectFatal(reason)
+	}
+}
+
+// HandleGregorHandlerQuarantined is called when a gregor message handler is
+// quarantined after repeated panics, so the UI owning it can re-register.
+func (n *NotifyRouter) HandleGregorHandlerQuarantined(name string) {
+	if n == nil {
+		return
+	}
+	n.G().Log.Debug("Sending GregorHandlerQuarantined notification (handler: %s)", name)
+	// For all connections we currently have open...
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		// If the connection wants the `Gregor` notification type
+		if n.getNotificationChannels(id).Gregor {
+			// In the background do...
+			go func() {
+				(keybase1.NotifyGregorClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).GregorHandlerQuarantined(context.Background(), name)
+			}()
+		}
+		return true
+	})
+	if n.listener != nil {
+		n.listener.GregorHandlerQuarantined(name)
+	}
+}
+
+// HandleGenericGregorEvent is called for allowlisted gregor systems with no
+// dedicated handler, forwarding their JSON bodies straight to the UIs.
+func (n *NotifyRouter) HandleGenericGregorEvent(system string, body string) {
+	if n == nil {
+		return
+	}
+	n.G().Log.Debug("Sending GenericGregorEvent notification (system: %s)", system)
+	// For all connections we currently have open...
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		// If the connection wants the `Gregor` notification type
+		if n.getNotificationChannels(id).Gregor {
+			// In the background do...
+			go func() {
+				(keybase1.NotifyGregorClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).GenericGregorEvent(context.Background(), keybase1.GenericGregorEventArg{
+					System: system,
+					Body:   body,
+				})
+			}()
+		}
+		return true
+	})
+	if n.listener != nil {
+		n.listener.GenericGregorEvent(system, body)
+	}
+}
+
 // HandleFSActivity is called for any KBFS notification. It will broadcast the messages
 // to all curious listeners.
 func (n *NotifyRouter) HandleFSActivity(activity keybase1.FSNotification) {
@@ -643,6 +754,131 @@ func (n *NotifyRouter) HandleChatThreadsStale(ctx context.Context, uid keybase1.
 	n.G().Log.Debug("- Sent ChatThreadsStale notification")
 }
 
+func (n *NotifyRouter) HandleChatTypingUpdate(ctx context.Context, uid keybase1.UID,
+	convID chat1.ConversationID, typer keybase1.UID, typing bool) {
+	if n == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	n.G().Log.Debug("+ Sending ChatTypingUpdate notification")
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		if n.getNotificationChannels(id).Chat {
+			wg.Add(1)
+			go func() {
+				(chat1.NotifyChatClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).ChatTypingUpdate(context.Background(), chat1.ChatTypingUpdateArg{
+					Uid:    uid,
+					ConvID: convID,
+					Typer:  typer,
+					Typing: typing,
+				})
+				wg.Done()
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+	if n.listener != nil {
+		n.listener.ChatTypingUpdate(uid, convID, typer, typing)
+	}
+	n.G().Log.Debug("- Sent ChatTypingUpdate notification")
+}
+
+func (n *NotifyRouter) HandleChatMembersUpdate(ctx context.Context, uid keybase1.UID,
+	convID chat1.ConversationID, joined []keybase1.UID, left []keybase1.UID) {
+	if n == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	n.G().Log.Debug("+ Sending ChatMembersUpdate notification")
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		if n.getNotificationChannels(id).Chat {
+			wg.Add(1)
+			go func() {
+				(chat1.NotifyChatClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).ChatMembersUpdate(context.Background(), chat1.ChatMembersUpdateArg{
+					Uid:    uid,
+					ConvID: convID,
+					Joined: joined,
+					Left:   left,
+				})
+				wg.Done()
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+	if n.listener != nil {
+		n.listener.ChatMembersUpdate(uid, convID, joined, left)
+	}
+	n.G().Log.Debug("- Sent ChatMembersUpdate notification")
+}
+
+// HandleChatMessageConflict is called when chat storage refuses to overwrite
+// an existing message with conflicting contents for the same ID. It is a
+// security warning: servers should never reuse message IDs.
+func (n *NotifyRouter) HandleChatMessageConflict(ctx context.Context, uid keybase1.UID,
+	convID chat1.ConversationID, msgID chat1.MessageID) {
+	if n == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	n.G().Log.Debug("+ Sending ChatMessageConflict notification")
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		if n.getNotificationChannels(id).Chat {
+			wg.Add(1)
+			go func() {
+				(chat1.NotifyChatClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).ChatMessageConflict(context.Background(), chat1.ChatMessageConflictArg{
+					Uid:    uid,
+					ConvID: convID,
+					MsgID:  msgID,
+				})
+				wg.Done()
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+	if n.listener != nil {
+		n.listener.ChatMessageConflict(uid, convID, msgID)
+	}
+	n.G().Log.Debug("- Sent ChatMessageConflict notification")
+}
+
+// HandleChatCompactionProgress is called as storage compaction works through
+// the local chat database, so UIs can show how far along it is.
+func (n *NotifyRouter) HandleChatCompactionProgress(ctx context.Context, uid keybase1.UID,
+	done int, total int) {
+	if n == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	n.cm.ApplyAll(func(id ConnectionID, xp rpc.Transporter) bool {
+		if n.getNotificationChannels(id).Chat {
+			wg.Add(1)
+			go func() {
+				(chat1.NotifyChatClient{
+					Cli: rpc.NewClient(xp, ErrorUnwrapper{}),
+				}).ChatCompactionProgress(context.Background(), chat1.ChatCompactionProgressArg{
+					Uid:   uid,
+					Done:  done,
+					Total: total,
+				})
+				wg.Done()
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+	if n.listener != nil {
+		n.listener.ChatCompactionProgress(uid, done, total)
+	}
+}
+
 // HandlePaperKeyCached is called whenever a paper key is cached
 // in response to a rekey harassment.
 func (n *NotifyRouter) HandlePaperKeyCached(uid keybase1.UID, encKID keybase1.KID, sigKID keybase1.KID) {
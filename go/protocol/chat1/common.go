@@ -29,6 +29,7 @@ const (
 	MessageType_TLFNAME            MessageType = 6
 	MessageType_HEADLINE           MessageType = 7
 	MessageType_ATTACHMENTUPLOADED MessageType = 8
+	MessageType_REACTION           MessageType = 9
 )
 
 var MessageTypeMap = map[string]MessageType{
@@ -41,6 +42,7 @@ var MessageTypeMap = map[string]MessageType{
 	"TLFNAME":            6,
 	"HEADLINE":           7,
 	"ATTACHMENTUPLOADED": 8,
+	"REACTION":           9,
 }
 
 var MessageTypeRevMap = map[MessageType]string{
@@ -53,6 +55,7 @@ var MessageTypeRevMap = map[MessageType]string{
 	6: "TLFNAME",
 	7: "HEADLINE",
 	8: "ATTACHMENTUPLOADED",
+	9: "REACTION",
 }
 
 type TopicType int
@@ -232,6 +235,7 @@ type MessageClientHeader struct {
 	MerkleRoot   *MerkleRoot              `codec:"merkleRoot,omitempty" json:"merkleRoot,omitempty"`
 	OutboxID     *OutboxID                `codec:"outboxID,omitempty" json:"outboxID,omitempty"`
 	OutboxInfo   *OutboxInfo              `codec:"outboxInfo,omitempty" json:"outboxInfo,omitempty"`
+	Etime        *gregor1.Time            `codec:"etime,omitempty" json:"etime,omitempty"`
 }
 
 type EncryptedData struct {
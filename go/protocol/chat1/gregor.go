@@ -4,6 +4,7 @@
 package chat1
 
 import (
+	gregor1 "github.com/keybase/client/go/protocol/gregor1"
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 )
 
@@ -42,6 +43,21 @@ type SetStatusPayload struct {
 	UnreadUpdate *UnreadUpdate      `codec:"unreadUpdate,omitempty" json:"unreadUpdate,omitempty"`
 }
 
+type UpdateConversationPayload struct {
+	Action       string         `codec:"Action" json:"Action"`
+	ConvID       ConversationID `codec:"convID" json:"convID"`
+	InboxVers    InboxVers      `codec:"inboxVers" json:"inboxVers"`
+	UnreadUpdate *UnreadUpdate  `codec:"unreadUpdate,omitempty" json:"unreadUpdate,omitempty"`
+}
+
+type MembersUpdatePayload struct {
+	Action    string         `codec:"Action" json:"Action"`
+	ConvID    ConversationID `codec:"convID" json:"convID"`
+	InboxVers InboxVers      `codec:"inboxVers" json:"inboxVers"`
+	Joined    []gregor1.UID  `codec:"joined" json:"joined"`
+	Left      []gregor1.UID  `codec:"left" json:"left"`
+}
+
 type UnreadUpdate struct {
 	ConvID         ConversationID `codec:"convID" json:"convID"`
 	UnreadMessages int            `codec:"UnreadMessages" json:"UnreadMessages"`
@@ -58,6 +74,12 @@ type TLFResolveUpdate struct {
 	InboxVers InboxVers      `codec:"inboxVers" json:"inboxVers"`
 }
 
+type TypingUpdate struct {
+	ConvID ConversationID `codec:"convID" json:"convID"`
+	Uid    gregor1.UID    `codec:"uid" json:"uid"`
+	Typing bool           `codec:"typing" json:"typing"`
+}
+
 type GregorInterface interface {
 }
 
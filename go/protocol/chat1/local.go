@@ -28,6 +28,11 @@ type MessageDelete struct {
 	MessageIDs []MessageID `codec:"messageIDs" json:"messageIDs"`
 }
 
+type MessageReaction struct {
+	MessageID MessageID `codec:"messageID" json:"messageID"`
+	Body      string    `codec:"body" json:"body"`
+}
+
 type MessageHeadline struct {
 	Headline string `codec:"headline" json:"headline"`
 }
@@ -204,6 +209,7 @@ type MessageBody struct {
 	Metadata__           *MessageConversationMetadata `codec:"metadata,omitempty" json:"metadata,omitempty"`
 	Headline__           *MessageHeadline             `codec:"headline,omitempty" json:"headline,omitempty"`
 	Attachmentuploaded__ *MessageAttachmentUploaded   `codec:"attachmentuploaded,omitempty" json:"attachmentuploaded,omitempty"`
+	Reaction__           *MessageReaction             `codec:"reaction,omitempty" json:"reaction,omitempty"`
 }
 
 func (o *MessageBody) MessageType() (ret MessageType, err error) {
@@ -243,6 +249,11 @@ func (o *MessageBody) MessageType() (ret MessageType, err error) {
 			err = errors.New("unexpected nil value for Attachmentuploaded__")
 			return ret, err
 		}
+	case MessageType_REACTION:
+		if o.Reaction__ == nil {
+			err = errors.New("unexpected nil value for Reaction__")
+			return ret, err
+		}
 	}
 	return o.MessageType__, nil
 }
@@ -317,6 +328,16 @@ func (o MessageBody) Attachmentuploaded() MessageAttachmentUploaded {
 	return *o.Attachmentuploaded__
 }
 
+func (o MessageBody) Reaction() MessageReaction {
+	if o.MessageType__ != MessageType_REACTION {
+		panic("wrong case accessed")
+	}
+	if o.Reaction__ == nil {
+		return MessageReaction{}
+	}
+	return *o.Reaction__
+}
+
 func NewMessageBodyWithText(v MessageText) MessageBody {
 	return MessageBody{
 		MessageType__: MessageType_TEXT,
@@ -366,21 +387,31 @@ func NewMessageBodyWithAttachmentuploaded(v MessageAttachmentUploaded) MessageBo
 	}
 }
 
+func NewMessageBodyWithReaction(v MessageReaction) MessageBody {
+	return MessageBody{
+		MessageType__: MessageType_REACTION,
+		Reaction__:    &v,
+	}
+}
+
 type OutboxStateType int
 
 const (
 	OutboxStateType_SENDING OutboxStateType = 0
 	OutboxStateType_ERROR   OutboxStateType = 1
+	OutboxStateType_FAILED  OutboxStateType = 2
 )
 
 var OutboxStateTypeMap = map[string]OutboxStateType{
 	"SENDING": 0,
 	"ERROR":   1,
+	"FAILED":  2,
 }
 
 var OutboxStateTypeRevMap = map[OutboxStateType]string{
 	0: "SENDING",
 	1: "ERROR",
+	2: "FAILED",
 }
 
 func (e OutboxStateType) String() string {
@@ -429,6 +460,7 @@ type OutboxState struct {
 	State__   OutboxStateType   `codec:"state" json:"state"`
 	Sending__ *int              `codec:"sending,omitempty" json:"sending,omitempty"`
 	Error__   *OutboxStateError `codec:"error,omitempty" json:"error,omitempty"`
+	Failed__  *OutboxStateError `codec:"failed,omitempty" json:"failed,omitempty"`
 }
 
 func (o *OutboxState) State() (ret OutboxStateType, err error) {
@@ -443,6 +475,11 @@ func (o *OutboxState) State() (ret OutboxStateType, err error) {
 			err = errors.New("unexpected nil value for Error__")
 			return ret, err
 		}
+	case OutboxStateType_FAILED:
+		if o.Failed__ == nil {
+			err = errors.New("unexpected nil value for Failed__")
+			return ret, err
+		}
 	}
 	return o.State__, nil
 }
@@ -467,6 +504,16 @@ func (o OutboxState) Error() OutboxStateError {
 	return *o.Error__
 }
 
+func (o OutboxState) Failed() OutboxStateError {
+	if o.State__ != OutboxStateType_FAILED {
+		panic("wrong case accessed")
+	}
+	if o.Failed__ == nil {
+		return OutboxStateError{}
+	}
+	return *o.Failed__
+}
+
 func NewOutboxStateWithSending(v int) OutboxState {
 	return OutboxState{
 		State__:   OutboxStateType_SENDING,
@@ -481,6 +528,13 @@ func NewOutboxStateWithError(v OutboxStateError) OutboxState {
 	}
 }
 
+func NewOutboxStateWithFailed(v OutboxStateError) OutboxState {
+	return OutboxState{
+		State__:  OutboxStateType_FAILED,
+		Failed__: &v,
+	}
+}
+
 type OutboxRecord struct {
 	State            OutboxState                  `codec:"state" json:"state"`
 	OutboxID         OutboxID                     `codec:"outboxID" json:"outboxID"`
@@ -1115,21 +1169,24 @@ type MessagePlaintext struct {
 type MessageUnboxedState int
 
 const (
-	MessageUnboxedState_VALID  MessageUnboxedState = 1
-	MessageUnboxedState_ERROR  MessageUnboxedState = 2
-	MessageUnboxedState_OUTBOX MessageUnboxedState = 3
+	MessageUnboxedState_VALID       MessageUnboxedState = 1
+	MessageUnboxedState_ERROR       MessageUnboxedState = 2
+	MessageUnboxedState_OUTBOX      MessageUnboxedState = 3
+	MessageUnboxedState_PLACEHOLDER MessageUnboxedState = 4
 )
 
 var MessageUnboxedStateMap = map[string]MessageUnboxedState{
-	"VALID":  1,
-	"ERROR":  2,
-	"OUTBOX": 3,
+	"VALID":       1,
+	"ERROR":       2,
+	"OUTBOX":      3,
+	"PLACEHOLDER": 4,
 }
 
 var MessageUnboxedStateRevMap = map[MessageUnboxedState]string{
 	1: "VALID",
 	2: "ERROR",
 	3: "OUTBOX",
+	4: "PLACEHOLDER",
 }
 
 func (e MessageUnboxedState) String() string {
@@ -1139,16 +1196,41 @@ func (e MessageUnboxedState) String() string {
 	return ""
 }
 
+type MessageDeliveryStatus int
+
+const (
+	MessageDeliveryStatus_NONE      MessageDeliveryStatus = 0
+	MessageDeliveryStatus_SENT      MessageDeliveryStatus = 1
+	MessageDeliveryStatus_DELIVERED MessageDeliveryStatus = 2
+	MessageDeliveryStatus_READ      MessageDeliveryStatus = 3
+)
+
+var MessageDeliveryStatusMap = map[string]MessageDeliveryStatus{
+	"NONE":      0,
+	"SENT":      1,
+	"DELIVERED": 2,
+	"READ":      3,
+}
+
+var MessageDeliveryStatusRevMap = map[MessageDeliveryStatus]string{
+	0: "NONE",
+	1: "SENT",
+	2: "DELIVERED",
+	3: "READ",
+}
+
 type MessageUnboxedValid struct {
-	ClientHeader          MessageClientHeader `codec:"clientHeader" json:"clientHeader"`
-	ServerHeader          MessageServerHeader `codec:"serverHeader" json:"serverHeader"`
-	MessageBody           MessageBody         `codec:"messageBody" json:"messageBody"`
-	SenderUsername        string              `codec:"senderUsername" json:"senderUsername"`
-	SenderDeviceName      string              `codec:"senderDeviceName" json:"senderDeviceName"`
-	SenderDeviceType      string              `codec:"senderDeviceType" json:"senderDeviceType"`
-	HeaderHash            Hash                `codec:"headerHash" json:"headerHash"`
-	HeaderSignature       *SignatureInfo      `codec:"headerSignature,omitempty" json:"headerSignature,omitempty"`
-	SenderDeviceRevokedAt *gregor1.Time       `codec:"senderDeviceRevokedAt,omitempty" json:"senderDeviceRevokedAt,omitempty"`
+	ClientHeader          MessageClientHeader   `codec:"clientHeader" json:"clientHeader"`
+	ServerHeader          MessageServerHeader   `codec:"serverHeader" json:"serverHeader"`
+	MessageBody           MessageBody           `codec:"messageBody" json:"messageBody"`
+	SenderUsername        string                `codec:"senderUsername" json:"senderUsername"`
+	SenderDeviceName      string                `codec:"senderDeviceName" json:"senderDeviceName"`
+	SenderDeviceType      string                `codec:"senderDeviceType" json:"senderDeviceType"`
+	HeaderHash            Hash                  `codec:"headerHash" json:"headerHash"`
+	HeaderSignature       *SignatureInfo        `codec:"headerSignature,omitempty" json:"headerSignature,omitempty"`
+	SenderDeviceRevokedAt *gregor1.Time         `codec:"senderDeviceRevokedAt,omitempty" json:"senderDeviceRevokedAt,omitempty"`
+	Reactions             map[string][]string   `codec:"reactions" json:"reactions"`
+	DeliveryStatus        MessageDeliveryStatus `codec:"deliveryStatus" json:"deliveryStatus"`
 }
 
 type MessageUnboxedErrorType int
@@ -1189,11 +1271,16 @@ type MessageUnboxedError struct {
 	Ctime       gregor1.Time            `codec:"ctime" json:"ctime"`
 }
 
+type MessageUnboxedPlaceholder struct {
+	MessageID MessageID `codec:"messageID" json:"messageID"`
+}
+
 type MessageUnboxed struct {
-	State__  MessageUnboxedState  `codec:"state" json:"state"`
-	Valid__  *MessageUnboxedValid `codec:"valid,omitempty" json:"valid,omitempty"`
-	Error__  *MessageUnboxedError `codec:"error,omitempty" json:"error,omitempty"`
-	Outbox__ *OutboxRecord        `codec:"outbox,omitempty" json:"outbox,omitempty"`
+	State__       MessageUnboxedState        `codec:"state" json:"state"`
+	Valid__       *MessageUnboxedValid       `codec:"valid,omitempty" json:"valid,omitempty"`
+	Error__       *MessageUnboxedError       `codec:"error,omitempty" json:"error,omitempty"`
+	Outbox__      *OutboxRecord              `codec:"outbox,omitempty" json:"outbox,omitempty"`
+	Placeholder__ *MessageUnboxedPlaceholder `codec:"placeholder,omitempty" json:"placeholder,omitempty"`
 }
 
 func (o *MessageUnboxed) State() (ret MessageUnboxedState, err error) {
@@ -1213,6 +1300,11 @@ func (o *MessageUnboxed) State() (ret MessageUnboxedState, err error) {
 			err = errors.New("unexpected nil value for Outbox__")
 			return ret, err
 		}
+	case MessageUnboxedState_PLACEHOLDER:
+		if o.Placeholder__ == nil {
+			err = errors.New("unexpected nil value for Placeholder__")
+			return ret, err
+		}
 	}
 	return o.State__, nil
 }
@@ -1247,6 +1339,16 @@ func (o MessageUnboxed) Outbox() OutboxRecord {
 	return *o.Outbox__
 }
 
+func (o MessageUnboxed) Placeholder() MessageUnboxedPlaceholder {
+	if o.State__ != MessageUnboxedState_PLACEHOLDER {
+		panic("wrong case accessed")
+	}
+	if o.Placeholder__ == nil {
+		return MessageUnboxedPlaceholder{}
+	}
+	return *o.Placeholder__
+}
+
 func NewMessageUnboxedWithValid(v MessageUnboxedValid) MessageUnboxed {
 	return MessageUnboxed{
 		State__: MessageUnboxedState_VALID,
@@ -1268,6 +1370,13 @@ func NewMessageUnboxedWithOutbox(v OutboxRecord) MessageUnboxed {
 	}
 }
 
+func NewMessageUnboxedWithPlaceholder(v MessageUnboxedPlaceholder) MessageUnboxed {
+	return MessageUnboxed{
+		State__:       MessageUnboxedState_PLACEHOLDER,
+		Placeholder__: &v,
+	}
+}
+
 type UnreadFirstNumLimit struct {
 	NumRead int `codec:"NumRead" json:"NumRead"`
 	AtLeast int `codec:"AtLeast" json:"AtLeast"`
@@ -1351,14 +1460,16 @@ type ConversationLocal struct {
 }
 
 type ThreadView struct {
-	Messages   []MessageUnboxed `codec:"messages" json:"messages"`
-	Pagination *Pagination      `codec:"pagination,omitempty" json:"pagination,omitempty"`
+	Messages       []MessageUnboxed `codec:"messages" json:"messages"`
+	Pagination     *Pagination      `codec:"pagination,omitempty" json:"pagination,omitempty"`
+	PinnedMessages []MessageID      `codec:"pinnedMessages" json:"pinnedMessages"`
 }
 
 type GetThreadQuery struct {
 	MarkAsRead               bool          `codec:"markAsRead" json:"markAsRead"`
 	MessageTypes             []MessageType `codec:"messageTypes" json:"messageTypes"`
 	DisableResolveSupersedes bool          `codec:"disableResolveSupersedes" json:"disableResolveSupersedes"`
+	NoCache                  bool          `codec:"noCache" json:"noCache"`
 	Before                   *gregor1.Time `codec:"before,omitempty" json:"before,omitempty"`
 	After                    *gregor1.Time `codec:"after,omitempty" json:"after,omitempty"`
 }
@@ -1420,6 +1531,67 @@ type SetConversationStatusLocalRes struct {
 	IdentifyFailures []keybase1.TLFIdentifyFailure `codec:"identifyFailures" json:"identifyFailures"`
 }
 
+type SearchLocalOptions struct {
+	ConvID  *ConversationID `codec:"convID,omitempty" json:"convID,omitempty"`
+	MaxHits int             `codec:"maxHits" json:"maxHits"`
+}
+
+type SearchLocalHit struct {
+	ConvID ConversationID `codec:"convID" json:"convID"`
+	Msg    MessageUnboxed `codec:"msg" json:"msg"`
+}
+
+type SearchLocalRes struct {
+	Hits             []SearchLocalHit              `codec:"hits" json:"hits"`
+	IdentifyFailures []keybase1.TLFIdentifyFailure `codec:"identifyFailures" json:"identifyFailures"`
+}
+
+type ClearCacheLocalOpts struct {
+	ConvID           *ConversationID `codec:"convID,omitempty" json:"convID,omitempty"`
+	TlfName          string          `codec:"tlfName" json:"tlfName"`
+	OlderThanSeconds int64           `codec:"olderThanSeconds" json:"olderThanSeconds"`
+}
+
+type ClearCacheLocalRes struct {
+	BytesReclaimed int64 `codec:"bytesReclaimed" json:"bytesReclaimed"`
+	ConvsCleared   int   `codec:"convsCleared" json:"convsCleared"`
+}
+
+type CacheStatsLocalRes struct {
+	PullCacheHits       int64 `codec:"pullCacheHits" json:"pullCacheHits"`
+	PullCachePartials   int64 `codec:"pullCachePartials" json:"pullCachePartials"`
+	PullCacheMisses     int64 `codec:"pullCacheMisses" json:"pullCacheMisses"`
+	MergeBatches        int64 `codec:"mergeBatches" json:"mergeBatches"`
+	MergedMessages      int64 `codec:"mergedMessages" json:"mergedMessages"`
+	UnboxBatches        int64 `codec:"unboxBatches" json:"unboxBatches"`
+	UnboxedMessages     int64 `codec:"unboxedMessages" json:"unboxedMessages"`
+	UnboxLatencyTotalMs int64 `codec:"unboxLatencyTotalMs" json:"unboxLatencyTotalMs"`
+	MergeConflicts      int64 `codec:"mergeConflicts" json:"mergeConflicts"`
+}
+
+type PurgeFailedOutboxLocalRes struct {
+	Purged int `codec:"purged" json:"purged"`
+}
+
+type PreloadConversationsLocalRes struct {
+	RateLimits []RateLimit `codec:"rateLimits" json:"rateLimits"`
+}
+
+type CompactChatStorageLocalRes struct {
+	BytesBefore int64 `codec:"bytesBefore" json:"bytesBefore"`
+	BytesAfter  int64 `codec:"bytesAfter" json:"bytesAfter"`
+}
+
+type DraftInfo struct {
+	Text            string       `codec:"text" json:"text"`
+	AttachmentPaths []string     `codec:"attachmentPaths" json:"attachmentPaths"`
+	Mtime           gregor1.Time `codec:"mtime" json:"mtime"`
+}
+
+type GetDraftLocalRes struct {
+	Draft *DraftInfo `codec:"draft,omitempty" json:"draft,omitempty"`
+}
+
 type NewConversationLocalRes struct {
 	Conv             ConversationLocal             `codec:"conv" json:"conv"`
 	RateLimits       []RateLimit                   `codec:"rateLimits" json:"rateLimits"`
@@ -1553,6 +1725,51 @@ type SetConversationStatusLocalArg struct {
 	IdentifyBehavior keybase1.TLFIdentifyBehavior `codec:"identifyBehavior" json:"identifyBehavior"`
 }
 
+type SearchLocalArg struct {
+	Query            string                       `codec:"query" json:"query"`
+	Opts             SearchLocalOptions           `codec:"opts" json:"opts"`
+	IdentifyBehavior keybase1.TLFIdentifyBehavior `codec:"identifyBehavior" json:"identifyBehavior"`
+}
+
+type ClearCacheLocalArg struct {
+	Opts ClearCacheLocalOpts `codec:"opts" json:"opts"`
+}
+
+type GetCacheStatsLocalArg struct {
+}
+
+type PurgeFailedOutboxLocalArg struct {
+}
+
+type SetConvPinnedLocalArg struct {
+	ConversationID ConversationID `codec:"conversationID" json:"conversationID"`
+	Pinned         bool           `codec:"pinned" json:"pinned"`
+}
+
+type ListPinnedConvsLocalArg struct {
+}
+
+type PreloadConversationsLocalArg struct {
+	ConversationIDs []ConversationID `codec:"conversationIDs" json:"conversationIDs"`
+	Depth           int              `codec:"depth" json:"depth"`
+}
+
+type CompactChatStorageLocalArg struct {
+}
+
+type SaveDraftLocalArg struct {
+	ConversationID ConversationID `codec:"conversationID" json:"conversationID"`
+	Draft          DraftInfo      `codec:"draft" json:"draft"`
+}
+
+type GetDraftLocalArg struct {
+	ConversationID ConversationID `codec:"conversationID" json:"conversationID"`
+}
+
+type ClearDraftLocalArg struct {
+	ConversationID ConversationID `codec:"conversationID" json:"conversationID"`
+}
+
 type NewConversationLocalArg struct {
 	TlfName          string                       `codec:"tlfName" json:"tlfName"`
 	TopicType        TopicType                    `codec:"topicType" json:"topicType"`
@@ -1649,6 +1866,17 @@ type LocalInterface interface {
 	PostDeleteNonblock(context.Context, PostDeleteNonblockArg) (PostLocalNonblockRes, error)
 	PostEditNonblock(context.Context, PostEditNonblockArg) (PostLocalNonblockRes, error)
 	SetConversationStatusLocal(context.Context, SetConversationStatusLocalArg) (SetConversationStatusLocalRes, error)
+	SearchLocal(context.Context, SearchLocalArg) (SearchLocalRes, error)
+	ClearCacheLocal(context.Context, ClearCacheLocalOpts) (ClearCacheLocalRes, error)
+	GetCacheStatsLocal(context.Context) (CacheStatsLocalRes, error)
+	PurgeFailedOutboxLocal(context.Context) (PurgeFailedOutboxLocalRes, error)
+	SetConvPinnedLocal(context.Context, SetConvPinnedLocalArg) error
+	ListPinnedConvsLocal(context.Context) ([]ConversationID, error)
+	PreloadConversationsLocal(context.Context, PreloadConversationsLocalArg) (PreloadConversationsLocalRes, error)
+	CompactChatStorageLocal(context.Context) (CompactChatStorageLocalRes, error)
+	SaveDraftLocal(context.Context, SaveDraftLocalArg) error
+	GetDraftLocal(context.Context, ConversationID) (GetDraftLocalRes, error)
+	ClearDraftLocal(context.Context, ConversationID) error
 	NewConversationLocal(context.Context, NewConversationLocalArg) (NewConversationLocalRes, error)
 	GetInboxSummaryForCLILocal(context.Context, GetInboxSummaryForCLILocalQuery) (GetInboxSummaryForCLILocalRes, error)
 	GetConversationForCLILocal(context.Context, GetConversationForCLILocalQuery) (GetConversationForCLILocalRes, error)
@@ -1811,6 +2039,162 @@ func LocalProtocol(i LocalInterface) rpc.Protocol {
 				},
 				MethodType: rpc.MethodCall,
 			},
+			"searchLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]SearchLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]SearchLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]SearchLocalArg)(nil), args)
+						return
+					}
+					ret, err = i.SearchLocal(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"clearCacheLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]ClearCacheLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ClearCacheLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ClearCacheLocalArg)(nil), args)
+						return
+					}
+					ret, err = i.ClearCacheLocal(ctx, (*typedArgs)[0].Opts)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getCacheStatsLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]GetCacheStatsLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.GetCacheStatsLocal(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"purgeFailedOutboxLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]PurgeFailedOutboxLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.PurgeFailedOutboxLocal(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"setConvPinnedLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]SetConvPinnedLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]SetConvPinnedLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]SetConvPinnedLocalArg)(nil), args)
+						return
+					}
+					err = i.SetConvPinnedLocal(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"listPinnedConvsLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]ListPinnedConvsLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.ListPinnedConvsLocal(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"preloadConversationsLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]PreloadConversationsLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]PreloadConversationsLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]PreloadConversationsLocalArg)(nil), args)
+						return
+					}
+					ret, err = i.PreloadConversationsLocal(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"compactChatStorageLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]CompactChatStorageLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.CompactChatStorageLocal(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"saveDraftLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]SaveDraftLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]SaveDraftLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]SaveDraftLocalArg)(nil), args)
+						return
+					}
+					err = i.SaveDraftLocal(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getDraftLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]GetDraftLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GetDraftLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GetDraftLocalArg)(nil), args)
+						return
+					}
+					ret, err = i.GetDraftLocal(ctx, (*typedArgs)[0].ConversationID)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"clearDraftLocal": {
+				MakeArg: func() interface{} {
+					ret := make([]ClearDraftLocalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ClearDraftLocalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ClearDraftLocalArg)(nil), args)
+						return
+					}
+					err = i.ClearDraftLocal(ctx, (*typedArgs)[0].ConversationID)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
 			"newConversationLocal": {
 				MakeArg: func() interface{} {
 					ret := make([]NewConversationLocalArg, 1)
@@ -2056,6 +2440,64 @@ func (c LocalClient) SetConversationStatusLocal(ctx context.Context, __arg SetCo
 	return
 }
 
+func (c LocalClient) SearchLocal(ctx context.Context, __arg SearchLocalArg) (res SearchLocalRes, err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.searchLocal", []interface{}{__arg}, &res)
+	return
+}
+
+func (c LocalClient) ClearCacheLocal(ctx context.Context, opts ClearCacheLocalOpts) (res ClearCacheLocalRes, err error) {
+	__arg := ClearCacheLocalArg{Opts: opts}
+	err = c.Cli.Call(ctx, "chat.1.local.clearCacheLocal", []interface{}{__arg}, &res)
+	return
+}
+
+func (c LocalClient) GetCacheStatsLocal(ctx context.Context) (res CacheStatsLocalRes, err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.getCacheStatsLocal", []interface{}{GetCacheStatsLocalArg{}}, &res)
+	return
+}
+
+func (c LocalClient) PurgeFailedOutboxLocal(ctx context.Context) (res PurgeFailedOutboxLocalRes, err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.purgeFailedOutboxLocal", []interface{}{PurgeFailedOutboxLocalArg{}}, &res)
+	return
+}
+
+func (c LocalClient) SetConvPinnedLocal(ctx context.Context, __arg SetConvPinnedLocalArg) (err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.setConvPinnedLocal", []interface{}{__arg}, nil)
+	return
+}
+
+func (c LocalClient) ListPinnedConvsLocal(ctx context.Context) (res []ConversationID, err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.listPinnedConvsLocal", []interface{}{ListPinnedConvsLocalArg{}}, &res)
+	return
+}
+
+func (c LocalClient) PreloadConversationsLocal(ctx context.Context, __arg PreloadConversationsLocalArg) (res PreloadConversationsLocalRes, err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.preloadConversationsLocal", []interface{}{__arg}, &res)
+	return
+}
+
+func (c LocalClient) CompactChatStorageLocal(ctx context.Context) (res CompactChatStorageLocalRes, err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.compactChatStorageLocal", []interface{}{CompactChatStorageLocalArg{}}, &res)
+	return
+}
+
+func (c LocalClient) SaveDraftLocal(ctx context.Context, __arg SaveDraftLocalArg) (err error) {
+	err = c.Cli.Call(ctx, "chat.1.local.saveDraftLocal", []interface{}{__arg}, nil)
+	return
+}
+
+func (c LocalClient) GetDraftLocal(ctx context.Context, conversationID ConversationID) (res GetDraftLocalRes, err error) {
+	__arg := GetDraftLocalArg{ConversationID: conversationID}
+	err = c.Cli.Call(ctx, "chat.1.local.getDraftLocal", []interface{}{__arg}, &res)
+	return
+}
+
+func (c LocalClient) ClearDraftLocal(ctx context.Context, conversationID ConversationID) (err error) {
+	__arg := ClearDraftLocalArg{ConversationID: conversationID}
+	err = c.Cli.Call(ctx, "chat.1.local.clearDraftLocal", []interface{}{__arg}, nil)
+	return
+}
+
 func (c LocalClient) NewConversationLocal(ctx context.Context, __arg NewConversationLocalArg) (res NewConversationLocalRes, err error) {
 	err = c.Cli.Call(ctx, "chat.1.local.newConversationLocal", []interface{}{__arg}, &res)
 	return
@@ -13,21 +13,25 @@ import (
 type ChatActivityType int
 
 const (
-	ChatActivityType_RESERVED         ChatActivityType = 0
-	ChatActivityType_INCOMING_MESSAGE ChatActivityType = 1
-	ChatActivityType_READ_MESSAGE     ChatActivityType = 2
-	ChatActivityType_NEW_CONVERSATION ChatActivityType = 3
-	ChatActivityType_SET_STATUS       ChatActivityType = 4
-	ChatActivityType_FAILED_MESSAGE   ChatActivityType = 5
+	ChatActivityType_RESERVED            ChatActivityType = 0
+	ChatActivityType_INCOMING_MESSAGE    ChatActivityType = 1
+	ChatActivityType_READ_MESSAGE        ChatActivityType = 2
+	ChatActivityType_NEW_CONVERSATION    ChatActivityType = 3
+	ChatActivityType_SET_STATUS          ChatActivityType = 4
+	ChatActivityType_FAILED_MESSAGE      ChatActivityType = 5
+	ChatActivityType_UPDATE_CONVERSATION ChatActivityType = 6
+	ChatActivityType_DELIVERY_STATUS     ChatActivityType = 7
 )
 
 var ChatActivityTypeMap = map[string]ChatActivityType{
-	"RESERVED":         0,
-	"INCOMING_MESSAGE": 1,
-	"READ_MESSAGE":     2,
-	"NEW_CONVERSATION": 3,
-	"SET_STATUS":       4,
-	"FAILED_MESSAGE":   5,
+	"RESERVED":            0,
+	"INCOMING_MESSAGE":    1,
+	"READ_MESSAGE":        2,
+	"NEW_CONVERSATION":    3,
+	"SET_STATUS":          4,
+	"FAILED_MESSAGE":      5,
+	"UPDATE_CONVERSATION": 6,
+	"DELIVERY_STATUS":     7,
 }
 
 var ChatActivityTypeRevMap = map[ChatActivityType]string{
@@ -37,6 +41,8 @@ var ChatActivityTypeRevMap = map[ChatActivityType]string{
 	3: "NEW_CONVERSATION",
 	4: "SET_STATUS",
 	5: "FAILED_MESSAGE",
+	6: "UPDATE_CONVERSATION",
+	7: "DELIVERY_STATUS",
 }
 
 func (e ChatActivityType) String() string {
@@ -73,13 +79,24 @@ type FailedMessageInfo struct {
 	OutboxRecords []OutboxRecord `codec:"outboxRecords" json:"outboxRecords"`
 }
 
+type DeliveryStatusInfo struct {
+	OutboxRecords []OutboxRecord `codec:"outboxRecords" json:"outboxRecords"`
+}
+
+type UpdateConversationInfo struct {
+	ConvID ConversationID     `codec:"convID" json:"convID"`
+	Conv   *ConversationLocal `codec:"conv,omitempty" json:"conv,omitempty"`
+}
+
 type ChatActivity struct {
-	ActivityType__    ChatActivityType     `codec:"activityType" json:"activityType"`
-	IncomingMessage__ *IncomingMessage     `codec:"incomingMessage,omitempty" json:"incomingMessage,omitempty"`
-	ReadMessage__     *ReadMessageInfo     `codec:"readMessage,omitempty" json:"readMessage,omitempty"`
-	NewConversation__ *NewConversationInfo `codec:"newConversation,omitempty" json:"newConversation,omitempty"`
-	SetStatus__       *SetStatusInfo       `codec:"setStatus,omitempty" json:"setStatus,omitempty"`
-	FailedMessage__   *FailedMessageInfo   `codec:"failedMessage,omitempty" json:"failedMessage,omitempty"`
+	ActivityType__       ChatActivityType        `codec:"activityType" json:"activityType"`
+	IncomingMessage__    *IncomingMessage        `codec:"incomingMessage,omitempty" json:"incomingMessage,omitempty"`
+	ReadMessage__        *ReadMessageInfo        `codec:"readMessage,omitempty" json:"readMessage,omitempty"`
+	NewConversation__    *NewConversationInfo    `codec:"newConversation,omitempty" json:"newConversation,omitempty"`
+	SetStatus__          *SetStatusInfo          `codec:"setStatus,omitempty" json:"setStatus,omitempty"`
+	FailedMessage__      *FailedMessageInfo      `codec:"failedMessage,omitempty" json:"failedMessage,omitempty"`
+	UpdateConversation__ *UpdateConversationInfo `codec:"updateConversation,omitempty" json:"updateConversation,omitempty"`
+	DeliveryStatus__     *DeliveryStatusInfo     `codec:"deliveryStatus,omitempty" json:"deliveryStatus,omitempty"`
 }
 
 func (o *ChatActivity) ActivityType() (ret ChatActivityType, err error) {
@@ -109,6 +126,16 @@ func (o *ChatActivity) ActivityType() (ret ChatActivityType, err error) {
 			err = errors.New("unexpected nil value for FailedMessage__")
 			return ret, err
 		}
+	case ChatActivityType_UPDATE_CONVERSATION:
+		if o.UpdateConversation__ == nil {
+			err = errors.New("unexpected nil value for UpdateConversation__")
+			return ret, err
+		}
+	case ChatActivityType_DELIVERY_STATUS:
+		if o.DeliveryStatus__ == nil {
+			err = errors.New("unexpected nil value for DeliveryStatus__")
+			return ret, err
+		}
 	}
 	return o.ActivityType__, nil
 }
@@ -163,6 +190,26 @@ func (o ChatActivity) FailedMessage() FailedMessageInfo {
 	return *o.FailedMessage__
 }
 
+func (o ChatActivity) UpdateConversation() UpdateConversationInfo {
+	if o.ActivityType__ != ChatActivityType_UPDATE_CONVERSATION {
+		panic("wrong case accessed")
+	}
+	if o.UpdateConversation__ == nil {
+		return UpdateConversationInfo{}
+	}
+	return *o.UpdateConversation__
+}
+
+func (o ChatActivity) DeliveryStatus() DeliveryStatusInfo {
+	if o.ActivityType__ != ChatActivityType_DELIVERY_STATUS {
+		panic("wrong case accessed")
+	}
+	if o.DeliveryStatus__ == nil {
+		return DeliveryStatusInfo{}
+	}
+	return *o.DeliveryStatus__
+}
+
 func NewChatActivityWithIncomingMessage(v IncomingMessage) ChatActivity {
 	return ChatActivity{
 		ActivityType__:    ChatActivityType_INCOMING_MESSAGE,
@@ -198,6 +245,20 @@ func NewChatActivityWithFailedMessage(v FailedMessageInfo) ChatActivity {
 	}
 }
 
+func NewChatActivityWithUpdateConversation(v UpdateConversationInfo) ChatActivity {
+	return ChatActivity{
+		ActivityType__:       ChatActivityType_UPDATE_CONVERSATION,
+		UpdateConversation__: &v,
+	}
+}
+
+func NewChatActivityWithDeliveryStatus(v DeliveryStatusInfo) ChatActivity {
+	return ChatActivity{
+		ActivityType__:   ChatActivityType_DELIVERY_STATUS,
+		DeliveryStatus__: &v,
+	}
+}
+
 type NewChatActivityArg struct {
 	Uid      keybase1.UID `codec:"uid" json:"uid"`
 	Activity ChatActivity `codec:"activity" json:"activity"`
@@ -229,6 +290,32 @@ type ChatThreadsStaleArg struct {
 	ConvIDs []ConversationID `codec:"convIDs" json:"convIDs"`
 }
 
+type ChatTypingUpdateArg struct {
+	Uid    keybase1.UID   `codec:"uid" json:"uid"`
+	ConvID ConversationID `codec:"convID" json:"convID"`
+	Typer  keybase1.UID   `codec:"typer" json:"typer"`
+	Typing bool           `codec:"typing" json:"typing"`
+}
+
+type ChatMembersUpdateArg struct {
+	Uid    keybase1.UID   `codec:"uid" json:"uid"`
+	ConvID ConversationID `codec:"convID" json:"convID"`
+	Joined []keybase1.UID `codec:"joined" json:"joined"`
+	Left   []keybase1.UID `codec:"left" json:"left"`
+}
+
+type ChatMessageConflictArg struct {
+	Uid    keybase1.UID   `codec:"uid" json:"uid"`
+	ConvID ConversationID `codec:"convID" json:"convID"`
+	MsgID  MessageID      `codec:"msgID" json:"msgID"`
+}
+
+type ChatCompactionProgressArg struct {
+	Uid   keybase1.UID `codec:"uid" json:"uid"`
+	Done  int          `codec:"done" json:"done"`
+	Total int          `codec:"total" json:"total"`
+}
+
 type NotifyChatInterface interface {
 	NewChatActivity(context.Context, NewChatActivityArg) error
 	ChatIdentifyUpdate(context.Context, keybase1.CanonicalTLFNameAndIDWithBreaks) error
@@ -236,6 +323,10 @@ type NotifyChatInterface interface {
 	ChatTLFResolve(context.Context, ChatTLFResolveArg) error
 	ChatInboxStale(context.Context, keybase1.UID) error
 	ChatThreadsStale(context.Context, ChatThreadsStaleArg) error
+	ChatTypingUpdate(context.Context, ChatTypingUpdateArg) error
+	ChatMembersUpdate(context.Context, ChatMembersUpdateArg) error
+	ChatMessageConflict(context.Context, ChatMessageConflictArg) error
+	ChatCompactionProgress(context.Context, ChatCompactionProgressArg) error
 }
 
 func NotifyChatProtocol(i NotifyChatInterface) rpc.Protocol {
@@ -338,6 +429,70 @@ func NotifyChatProtocol(i NotifyChatInterface) rpc.Protocol {
 				},
 				MethodType: rpc.MethodNotify,
 			},
+			"ChatTypingUpdate": {
+				MakeArg: func() interface{} {
+					ret := make([]ChatTypingUpdateArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ChatTypingUpdateArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ChatTypingUpdateArg)(nil), args)
+						return
+					}
+					err = i.ChatTypingUpdate(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+			"ChatMembersUpdate": {
+				MakeArg: func() interface{} {
+					ret := make([]ChatMembersUpdateArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ChatMembersUpdateArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ChatMembersUpdateArg)(nil), args)
+						return
+					}
+					err = i.ChatMembersUpdate(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+			"ChatMessageConflict": {
+				MakeArg: func() interface{} {
+					ret := make([]ChatMessageConflictArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ChatMessageConflictArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ChatMessageConflictArg)(nil), args)
+						return
+					}
+					err = i.ChatMessageConflict(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+			"ChatCompactionProgress": {
+				MakeArg: func() interface{} {
+					ret := make([]ChatCompactionProgressArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ChatCompactionProgressArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ChatCompactionProgressArg)(nil), args)
+						return
+					}
+					err = i.ChatCompactionProgress(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
 		},
 	}
 }
@@ -377,3 +532,23 @@ func (c NotifyChatClient) ChatThreadsStale(ctx context.Context, __arg ChatThread
 	err = c.Cli.Notify(ctx, "chat.1.NotifyChat.ChatThreadsStale", []interface{}{__arg})
 	return
 }
+
+func (c NotifyChatClient) ChatTypingUpdate(ctx context.Context, __arg ChatTypingUpdateArg) (err error) {
+	err = c.Cli.Notify(ctx, "chat.1.NotifyChat.ChatTypingUpdate", []interface{}{__arg})
+	return
+}
+
+func (c NotifyChatClient) ChatMembersUpdate(ctx context.Context, __arg ChatMembersUpdateArg) (err error) {
+	err = c.Cli.Notify(ctx, "chat.1.NotifyChat.ChatMembersUpdate", []interface{}{__arg})
+	return
+}
+
+func (c NotifyChatClient) ChatMessageConflict(ctx context.Context, __arg ChatMessageConflictArg) (err error) {
+	err = c.Cli.Notify(ctx, "chat.1.NotifyChat.ChatMessageConflict", []interface{}{__arg})
+	return
+}
+
+func (c NotifyChatClient) ChatCompactionProgress(ctx context.Context, __arg ChatCompactionProgressArg) (err error) {
+	err = c.Cli.Notify(ctx, "chat.1.NotifyChat.ChatCompactionProgress", []interface{}{__arg})
+	return
+}
@@ -30,9 +30,10 @@ type State struct {
 }
 
 type StateUpdateMessage struct {
-	Md_        Metadata   `codec:"md" json:"md"`
-	Creation_  *Item      `codec:"creation,omitempty" json:"creation,omitempty"`
-	Dismissal_ *Dismissal `codec:"dismissal,omitempty" json:"dismissal,omitempty"`
+	Md_        Metadata          `codec:"md" json:"md"`
+	Creation_  *Item             `codec:"creation,omitempty" json:"creation,omitempty"`
+	Creations_ []ItemAndMetadata `codec:"creations" json:"creations"`
+	Dismissal_ *Dismissal        `codec:"dismissal,omitempty" json:"dismissal,omitempty"`
 }
 
 type StateSyncMessage struct {
@@ -19,6 +19,19 @@ type SyncArg struct {
 	Ctime    Time     `codec:"ctime" json:"ctime"`
 }
 
+type SyncCheckpointResult struct {
+	HashMatch bool            `codec:"hashMatch" json:"hashMatch"`
+	Msgs      []InBandMessage `codec:"msgs" json:"msgs"`
+	Hash      []byte          `codec:"hash" json:"hash"`
+}
+
+type SyncCheckpointArg struct {
+	Uid       UID      `codec:"uid" json:"uid"`
+	Deviceid  DeviceID `codec:"deviceid" json:"deviceid"`
+	Ctime     Time     `codec:"ctime" json:"ctime"`
+	StateHash []byte   `codec:"stateHash" json:"stateHash"`
+}
+
 type ConsumeMessageArg struct {
 	M Message `codec:"m" json:"m"`
 }
@@ -49,6 +62,11 @@ type StateByCategoryPrefixArg struct {
 
 type IncomingInterface interface {
 	Sync(context.Context, SyncArg) (SyncResult, error)
+	// syncCheckpoint is like sync, but the client also sends a digest of its
+	// local state. If the digest matches the server's state at ctime, the
+	// server only returns messages since then; on mismatch the client should
+	// fall back to a full sync.
+	SyncCheckpoint(context.Context, SyncCheckpointArg) (SyncCheckpointResult, error)
 	ConsumeMessage(context.Context, Message) error
 	ConsumePublishMessage(context.Context, Message) error
 	Ping(context.Context) (string, error)
@@ -79,6 +97,22 @@ func IncomingProtocol(i IncomingInterface) rpc.Protocol {
 				},
 				MethodType: rpc.MethodCall,
 			},
+			"syncCheckpoint": {
+				MakeArg: func() interface{} {
+					ret := make([]SyncCheckpointArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]SyncCheckpointArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]SyncCheckpointArg)(nil), args)
+						return
+					}
+					ret, err = i.SyncCheckpoint(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
 			"consumeMessage": {
 				MakeArg: func() interface{} {
 					ret := make([]ConsumeMessageArg, 1)
@@ -183,6 +217,15 @@ func (c IncomingClient) Sync(ctx context.Context, __arg SyncArg) (res SyncResult
 	return
 }
 
+// syncCheckpoint is like sync, but the client also sends a digest of its
+// local state. If the digest matches the server's state at ctime, the
+// server only returns messages since then; on mismatch the client should
+// fall back to a full sync.
+func (c IncomingClient) SyncCheckpoint(ctx context.Context, __arg SyncCheckpointArg) (res SyncCheckpointResult, err error) {
+	err = c.Cli.Call(ctx, "gregor.1.incoming.syncCheckpoint", []interface{}{__arg}, &res)
+	return
+}
+
 func (c IncomingClient) ConsumeMessage(ctx context.Context, m Message) (err error) {
 	__arg := ConsumeMessageArg{M: m}
 	err = c.Cli.Call(ctx, "gregor.1.incoming.consumeMessage", []interface{}{__arg}, nil)
@@ -23,12 +23,17 @@ type RegisterRekeyUIArg struct {
 type RegisterGregorFirehoseArg struct {
 }
 
+type RegisterOOBMTapArg struct {
+	SystemPrefixes []string `codec:"systemPrefixes" json:"systemPrefixes"`
+}
+
 type DelegateUiCtlInterface interface {
 	RegisterIdentifyUI(context.Context) error
 	RegisterSecretUI(context.Context) error
 	RegisterUpdateUI(context.Context) error
 	RegisterRekeyUI(context.Context) error
 	RegisterGregorFirehose(context.Context) error
+	RegisterOOBMTap(context.Context, []string) error
 }
 
 func DelegateUiCtlProtocol(i DelegateUiCtlInterface) rpc.Protocol {
@@ -90,6 +95,22 @@ func DelegateUiCtlProtocol(i DelegateUiCtlInterface) rpc.Protocol {
 				},
 				MethodType: rpc.MethodCall,
 			},
+			"registerOOBMTap": {
+				MakeArg: func() interface{} {
+					ret := make([]RegisterOOBMTapArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]RegisterOOBMTapArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]RegisterOOBMTapArg)(nil), args)
+						return
+					}
+					err = i.RegisterOOBMTap(ctx, (*typedArgs)[0].SystemPrefixes)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
 		},
 	}
 }
@@ -122,3 +143,9 @@ func (c DelegateUiCtlClient) RegisterGregorFirehose(ctx context.Context) (err er
 	err = c.Cli.Call(ctx, "keybase.1.delegateUiCtl.registerGregorFirehose", []interface{}{RegisterGregorFirehoseArg{}}, nil)
 	return
 }
+
+func (c DelegateUiCtlClient) RegisterOOBMTap(ctx context.Context, systemPrefixes []string) (err error) {
+	__arg := RegisterOOBMTapArg{SystemPrefixes: systemPrefixes}
+	err = c.Cli.Call(ctx, "keybase.1.delegateUiCtl.registerOOBMTap", []interface{}{__arg}, nil)
+	return
+}
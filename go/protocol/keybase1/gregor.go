@@ -9,11 +9,157 @@ import (
 	context "golang.org/x/net/context"
 )
 
+type GregorAuditEntry struct {
+	Ctime    Time        `codec:"ctime" json:"ctime"`
+	MsgID    string      `codec:"msgID" json:"msgID"`
+	Category string      `codec:"category" json:"category"`
+	Handler  string      `codec:"handler" json:"handler"`
+	Op       string      `codec:"op" json:"op"`
+	Handled  bool        `codec:"handled" json:"handled"`
+	Err      string      `codec:"err" json:"err"`
+	Latency  DurationSec `codec:"latency" json:"latency"`
+}
+
+type QuarantinedOOBM struct {
+	System  string `codec:"system" json:"system"`
+	Body    []byte `codec:"body" json:"body"`
+	Ctime   Time   `codec:"ctime" json:"ctime"`
+	Version string `codec:"version" json:"version"`
+	Err     string `codec:"err" json:"err"`
+}
+
+type ConnectionQuality struct {
+	AvgRtt      DurationSec `codec:"avgRtt" json:"avgRtt"`
+	MinRtt      DurationSec `codec:"minRtt" json:"minRtt"`
+	MaxRtt      DurationSec `codec:"maxRtt" json:"maxRtt"`
+	LossCount   int         `codec:"lossCount" json:"lossCount"`
+	LastSuccess Time        `codec:"lastSuccess" json:"lastSuccess"`
+}
+
+type PushStateFilter struct {
+	Name    string `codec:"name" json:"name"`
+	Enabled bool   `codec:"enabled" json:"enabled"`
+}
+
+type GregorHandlerStats struct {
+	Name      string      `codec:"name" json:"name"`
+	Creates   int64       `codec:"creates" json:"creates"`
+	Dismisses int64       `codec:"dismisses" json:"dismisses"`
+	Errors    int64       `codec:"errors" json:"errors"`
+	P50       DurationSec `codec:"p50" json:"p50"`
+	P95       DurationSec `codec:"p95" json:"p95"`
+}
+
+type GregorOOBMStats struct {
+	System   string `codec:"system" json:"system"`
+	Received int64  `codec:"received" json:"received"`
+	Handled  int64  `codec:"handled" json:"handled"`
+	Errored  int64  `codec:"errored" json:"errored"`
+	Dropped  int64  `codec:"dropped" json:"dropped"`
+}
+
+type GregorStats struct {
+	Reconnects         int64                `codec:"reconnects" json:"reconnects"`
+	AuthFailures       int64                `codec:"authFailures" json:"authFailures"`
+	BroadcastsReceived int64                `codec:"broadcastsReceived" json:"broadcastsReceived"`
+	Replays            int64                `codec:"replays" json:"replays"`
+	HandlerErrors      int64                `codec:"handlerErrors" json:"handlerErrors"`
+	PingTimeouts       int64                `codec:"pingTimeouts" json:"pingTimeouts"`
+	RestoreFailures    int64                `codec:"restoreFailures" json:"restoreFailures"`
+	ClockSkewMsec      int64                `codec:"clockSkewMsec" json:"clockSkewMsec"`
+	HandlerStats       []GregorHandlerStats `codec:"handlerStats" json:"handlerStats"`
+	OobmStats          []GregorOOBMStats    `codec:"oobmStats" json:"oobmStats"`
+}
+
+type UnhandledMessage struct {
+	Category string        `codec:"category" json:"category"`
+	MsgID    gregor1.MsgID `codec:"msgID" json:"msgID"`
+	Ctime    Time          `codec:"ctime" json:"ctime"`
+}
+
+type LocalGregorState struct {
+	State      gregor1.State `codec:"state" json:"state"`
+	Generation int64         `codec:"generation" json:"generation"`
+	Stale      bool          `codec:"stale" json:"stale"`
+}
+
+type GregorStateDump struct {
+	State        []byte `codec:"state" json:"state"`
+	ReplayCursor Time   `codec:"replayCursor" json:"replayCursor"`
+}
+
 type GetStateArg struct {
 }
 
+type GetStateByCategoryPrefixArg struct {
+	CategoryPrefix string `codec:"categoryPrefix" json:"categoryPrefix"`
+}
+
+type GetStateAtTimeArg struct {
+	AtTime Time `codec:"atTime" json:"atTime"`
+}
+
+type ExportLocalStateArg struct {
+}
+
+type ImportLocalStateArg struct {
+	Dump GregorStateDump `codec:"dump" json:"dump"`
+}
+
+type CompactLocalStateArg struct {
+}
+
+type SearchItemsArg struct {
+	Query string `codec:"query" json:"query"`
+}
+
+type ListUnhandledArg struct {
+}
+
+type GetLocalStateArg struct {
+}
+
+type GetAuditLogArg struct {
+	MaxEntries int `codec:"maxEntries" json:"maxEntries"`
+}
+
+type ListOOBMQuarantineArg struct {
+}
+
+type PurgeOOBMQuarantineArg struct {
+}
+
+type GetConnectionQualityArg struct {
+}
+
+type ListPushStateFiltersArg struct {
+}
+
+type TogglePushStateFilterArg struct {
+	Name    string `codec:"name" json:"name"`
+	Enabled bool   `codec:"enabled" json:"enabled"`
+}
+
+type GetStatsArg struct {
+}
+
 type GregorInterface interface {
 	GetState(context.Context) (gregor1.State, error)
+	GetStateByCategoryPrefix(context.Context, string) (gregor1.State, error)
+	GetStateAtTime(context.Context, Time) (gregor1.State, error)
+	GetLocalState(context.Context) (LocalGregorState, error)
+	ExportLocalState(context.Context) (GregorStateDump, error)
+	ImportLocalState(context.Context, GregorStateDump) error
+	CompactLocalState(context.Context) (int, error)
+	SearchItems(context.Context, string) ([]gregor1.ItemAndMetadata, error)
+	ListUnhandled(context.Context) ([]UnhandledMessage, error)
+	GetAuditLog(context.Context, int) ([]GregorAuditEntry, error)
+	ListOOBMQuarantine(context.Context) ([]QuarantinedOOBM, error)
+	PurgeOOBMQuarantine(context.Context) error
+	GetConnectionQuality(context.Context) (ConnectionQuality, error)
+	ListPushStateFilters(context.Context) ([]PushStateFilter, error)
+	TogglePushStateFilter(context.Context, TogglePushStateFilterArg) error
+	GetStats(context.Context) (GregorStats, error)
 }
 
 func GregorProtocol(i GregorInterface) rpc.Protocol {
@@ -31,6 +177,201 @@ func GregorProtocol(i GregorInterface) rpc.Protocol {
 				},
 				MethodType: rpc.MethodCall,
 			},
+			"getStateByCategoryPrefix": {
+				MakeArg: func() interface{} {
+					ret := make([]GetStateByCategoryPrefixArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GetStateByCategoryPrefixArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GetStateByCategoryPrefixArg)(nil), args)
+						return
+					}
+					ret, err = i.GetStateByCategoryPrefix(ctx, (*typedArgs)[0].CategoryPrefix)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getStateAtTime": {
+				MakeArg: func() interface{} {
+					ret := make([]GetStateAtTimeArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GetStateAtTimeArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GetStateAtTimeArg)(nil), args)
+						return
+					}
+					ret, err = i.GetStateAtTime(ctx, (*typedArgs)[0].AtTime)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getLocalState": {
+				MakeArg: func() interface{} {
+					ret := make([]GetLocalStateArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.GetLocalState(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"exportLocalState": {
+				MakeArg: func() interface{} {
+					ret := make([]ExportLocalStateArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.ExportLocalState(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"importLocalState": {
+				MakeArg: func() interface{} {
+					ret := make([]ImportLocalStateArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]ImportLocalStateArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]ImportLocalStateArg)(nil), args)
+						return
+					}
+					err = i.ImportLocalState(ctx, (*typedArgs)[0].Dump)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"compactLocalState": {
+				MakeArg: func() interface{} {
+					ret := make([]CompactLocalStateArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.CompactLocalState(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"searchItems": {
+				MakeArg: func() interface{} {
+					ret := make([]SearchItemsArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]SearchItemsArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]SearchItemsArg)(nil), args)
+						return
+					}
+					ret, err = i.SearchItems(ctx, (*typedArgs)[0].Query)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"listUnhandled": {
+				MakeArg: func() interface{} {
+					ret := make([]ListUnhandledArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.ListUnhandled(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getAuditLog": {
+				MakeArg: func() interface{} {
+					ret := make([]GetAuditLogArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GetAuditLogArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GetAuditLogArg)(nil), args)
+						return
+					}
+					ret, err = i.GetAuditLog(ctx, (*typedArgs)[0].MaxEntries)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"listOOBMQuarantine": {
+				MakeArg: func() interface{} {
+					ret := make([]ListOOBMQuarantineArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.ListOOBMQuarantine(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"purgeOOBMQuarantine": {
+				MakeArg: func() interface{} {
+					ret := make([]PurgeOOBMQuarantineArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					err = i.PurgeOOBMQuarantine(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getConnectionQuality": {
+				MakeArg: func() interface{} {
+					ret := make([]GetConnectionQualityArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.GetConnectionQuality(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"listPushStateFilters": {
+				MakeArg: func() interface{} {
+					ret := make([]ListPushStateFiltersArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.ListPushStateFilters(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"togglePushStateFilter": {
+				MakeArg: func() interface{} {
+					ret := make([]TogglePushStateFilterArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]TogglePushStateFilterArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]TogglePushStateFilterArg)(nil), args)
+						return
+					}
+					err = i.TogglePushStateFilter(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"getStats": {
+				MakeArg: func() interface{} {
+					ret := make([]GetStatsArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					ret, err = i.GetStats(ctx)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
 		},
 	}
 }
@@ -43,3 +384,83 @@ func (c GregorClient) GetState(ctx context.Context) (res gregor1.State, err erro
 	err = c.Cli.Call(ctx, "keybase.1.gregor.getState", []interface{}{GetStateArg{}}, &res)
 	return
 }
+
+func (c GregorClient) GetStateByCategoryPrefix(ctx context.Context, categoryPrefix string) (res gregor1.State, err error) {
+	__arg := GetStateByCategoryPrefixArg{CategoryPrefix: categoryPrefix}
+	err = c.Cli.Call(ctx, "keybase.1.gregor.getStateByCategoryPrefix", []interface{}{__arg}, &res)
+	return
+}
+
+func (c GregorClient) GetStateAtTime(ctx context.Context, atTime Time) (res gregor1.State, err error) {
+	__arg := GetStateAtTimeArg{AtTime: atTime}
+	err = c.Cli.Call(ctx, "keybase.1.gregor.getStateAtTime", []interface{}{__arg}, &res)
+	return
+}
+
+func (c GregorClient) GetLocalState(ctx context.Context) (res LocalGregorState, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.getLocalState", []interface{}{GetLocalStateArg{}}, &res)
+	return
+}
+
+func (c GregorClient) ExportLocalState(ctx context.Context) (res GregorStateDump, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.exportLocalState", []interface{}{ExportLocalStateArg{}}, &res)
+	return
+}
+
+func (c GregorClient) ImportLocalState(ctx context.Context, dump GregorStateDump) (err error) {
+	__arg := ImportLocalStateArg{Dump: dump}
+	err = c.Cli.Call(ctx, "keybase.1.gregor.importLocalState", []interface{}{__arg}, nil)
+	return
+}
+
+func (c GregorClient) CompactLocalState(ctx context.Context) (res int, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.compactLocalState", []interface{}{CompactLocalStateArg{}}, &res)
+	return
+}
+
+func (c GregorClient) SearchItems(ctx context.Context, query string) (res []gregor1.ItemAndMetadata, err error) {
+	__arg := SearchItemsArg{Query: query}
+	err = c.Cli.Call(ctx, "keybase.1.gregor.searchItems", []interface{}{__arg}, &res)
+	return
+}
+
+func (c GregorClient) ListUnhandled(ctx context.Context) (res []UnhandledMessage, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.listUnhandled", []interface{}{ListUnhandledArg{}}, &res)
+	return
+}
+
+func (c GregorClient) GetAuditLog(ctx context.Context, maxEntries int) (res []GregorAuditEntry, err error) {
+	__arg := GetAuditLogArg{MaxEntries: maxEntries}
+	err = c.Cli.Call(ctx, "keybase.1.gregor.getAuditLog", []interface{}{__arg}, &res)
+	return
+}
+
+func (c GregorClient) ListOOBMQuarantine(ctx context.Context) (res []QuarantinedOOBM, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.listOOBMQuarantine", []interface{}{ListOOBMQuarantineArg{}}, &res)
+	return
+}
+
+func (c GregorClient) PurgeOOBMQuarantine(ctx context.Context) (err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.purgeOOBMQuarantine", []interface{}{PurgeOOBMQuarantineArg{}}, nil)
+	return
+}
+
+func (c GregorClient) GetConnectionQuality(ctx context.Context) (res ConnectionQuality, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.getConnectionQuality", []interface{}{GetConnectionQualityArg{}}, &res)
+	return
+}
+
+func (c GregorClient) ListPushStateFilters(ctx context.Context) (res []PushStateFilter, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.listPushStateFilters", []interface{}{ListPushStateFiltersArg{}}, &res)
+	return
+}
+
+func (c GregorClient) TogglePushStateFilter(ctx context.Context, __arg TogglePushStateFilterArg) (err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.togglePushStateFilter", []interface{}{__arg}, nil)
+	return
+}
+
+func (c GregorClient) GetStats(ctx context.Context) (res GregorStats, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregor.getStats", []interface{}{GetStatsArg{}}, &res)
+	return
+}
@@ -45,9 +45,22 @@ type PushOutOfBandMessagesArg struct {
 	Oobm []gregor1.OutOfBandMessage `codec:"oobm" json:"oobm"`
 }
 
+type GregorStateDelta struct {
+	BaseHash     []byte                    `codec:"baseHash" json:"baseHash"`
+	NewHash      []byte                    `codec:"newHash" json:"newHash"`
+	NewItems     []gregor1.ItemAndMetadata `codec:"newItems" json:"newItems"`
+	DismissedIDs []gregor1.MsgID           `codec:"dismissedIDs" json:"dismissedIDs"`
+}
+
+type PushStateDeltaArg struct {
+	Delta  GregorStateDelta `codec:"delta" json:"delta"`
+	Reason PushReason       `codec:"reason" json:"reason"`
+}
+
 type GregorUIInterface interface {
 	PushState(context.Context, PushStateArg) error
 	PushOutOfBandMessages(context.Context, []gregor1.OutOfBandMessage) error
+	PushStateDelta(context.Context, PushStateDeltaArg) error
 }
 
 func GregorUIProtocol(i GregorUIInterface) rpc.Protocol {
@@ -86,6 +99,22 @@ func GregorUIProtocol(i GregorUIInterface) rpc.Protocol {
 				},
 				MethodType: rpc.MethodCall,
 			},
+			"pushStateDelta": {
+				MakeArg: func() interface{} {
+					ret := make([]PushStateDeltaArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]PushStateDeltaArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]PushStateDeltaArg)(nil), args)
+						return
+					}
+					err = i.PushStateDelta(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
 		},
 	}
 }
@@ -104,3 +133,8 @@ func (c GregorUIClient) PushOutOfBandMessages(ctx context.Context, oobm []gregor
 	err = c.Cli.Call(ctx, "keybase.1.gregorUI.pushOutOfBandMessages", []interface{}{__arg}, nil)
 	return
 }
+
+func (c GregorUIClient) PushStateDelta(ctx context.Context, __arg PushStateDeltaArg) (err error) {
+	err = c.Cli.Call(ctx, "keybase.1.gregorUI.pushStateDelta", []interface{}{__arg}, nil)
+	return
+}
@@ -23,6 +23,7 @@ type NotificationChannels struct {
 	Kbfsrequest  bool `codec:"kbfsrequest" json:"kbfsrequest"`
 	Badges       bool `codec:"badges" json:"badges"`
 	Reachability bool `codec:"reachability" json:"reachability"`
+	Gregor       bool `codec:"gregor" json:"gregor"`
 }
 
 type SetNotificationsArg struct {
@@ -0,0 +1,132 @@
+// Auto-generated by avdl-compiler v1.3.11 (https://github.com/keybase/node-avdl-compiler)
+//   Input file: avdl/keybase1/notify_gregor.avdl
+
+package keybase1
+
+import (
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	context "golang.org/x/net/context"
+)
+
+type GregorThrottledArg struct {
+	Throttled bool `codec:"throttled" json:"throttled"`
+}
+
+type GregorConnectFatalArg struct {
+	Reason string `codec:"reason" json:"reason"`
+}
+
+type GregorHandlerQuarantinedArg struct {
+	Name string `codec:"name" json:"name"`
+}
+
+type GenericGregorEventArg struct {
+	System string `codec:"system" json:"system"`
+	Body   string `codec:"body" json:"body"`
+}
+
+type NotifyGregorInterface interface {
+	GregorThrottled(context.Context, bool) error
+	GregorConnectFatal(context.Context, string) error
+	GregorHandlerQuarantined(context.Context, string) error
+	GenericGregorEvent(context.Context, GenericGregorEventArg) error
+}
+
+func NotifyGregorProtocol(i NotifyGregorInterface) rpc.Protocol {
+	return rpc.Protocol{
+		Name: "keybase.1.NotifyGregor",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"gregorThrottled": {
+				MakeArg: func() interface{} {
+					ret := make([]GregorThrottledArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GregorThrottledArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GregorThrottledArg)(nil), args)
+						return
+					}
+					err = i.GregorThrottled(ctx, (*typedArgs)[0].Throttled)
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+			"gregorConnectFatal": {
+				MakeArg: func() interface{} {
+					ret := make([]GregorConnectFatalArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GregorConnectFatalArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GregorConnectFatalArg)(nil), args)
+						return
+					}
+					err = i.GregorConnectFatal(ctx, (*typedArgs)[0].Reason)
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+			"gregorHandlerQuarantined": {
+				MakeArg: func() interface{} {
+					ret := make([]GregorHandlerQuarantinedArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GregorHandlerQuarantinedArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GregorHandlerQuarantinedArg)(nil), args)
+						return
+					}
+					err = i.GregorHandlerQuarantined(ctx, (*typedArgs)[0].Name)
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+			"genericGregorEvent": {
+				MakeArg: func() interface{} {
+					ret := make([]GenericGregorEventArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GenericGregorEventArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GenericGregorEventArg)(nil), args)
+						return
+					}
+					err = i.GenericGregorEvent(ctx, (*typedArgs)[0])
+					return
+				},
+				MethodType: rpc.MethodNotify,
+			},
+		},
+	}
+}
+
+type NotifyGregorClient struct {
+	Cli rpc.GenericClient
+}
+
+func (c NotifyGregorClient) GregorThrottled(ctx context.Context, throttled bool) (err error) {
+	__arg := GregorThrottledArg{Throttled: throttled}
+	err = c.Cli.Notify(ctx, "keybase.1.NotifyGregor.gregorThrottled", []interface{}{__arg})
+	return
+}
+
+func (c NotifyGregorClient) GregorConnectFatal(ctx context.Context, reason string) (err error) {
+	__arg := GregorConnectFatalArg{Reason: reason}
+	err = c.Cli.Notify(ctx, "keybase.1.NotifyGregor.gregorConnectFatal", []interface{}{__arg})
+	return
+}
+
+func (c NotifyGregorClient) GregorHandlerQuarantined(ctx context.Context, name string) (err error) {
+	__arg := GregorHandlerQuarantinedArg{Name: name}
+	err = c.Cli.Notify(ctx, "keybase.1.NotifyGregor.gregorHandlerQuarantined", []interface{}{__arg})
+	return
+}
+
+func (c NotifyGregorClient) GenericGregorEvent(ctx context.Context, __arg GenericGregorEventArg) (err error) {
+	err = c.Cli.Notify(ctx, "keybase.1.NotifyGregor.genericGregorEvent", []interface{}{__arg})
+	return
+}
@@ -4,6 +4,7 @@
 package service
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -151,6 +152,33 @@ func (h *chatLocalHandler) MarkAsReadLocal(ctx context.Context, arg chat1.MarkAs
 	})
 }
 
+// convSourceRetries is how many times a retriable ConversationSource error
+// is retried before it is returned to the caller
+const convSourceRetries = 3
+
+// retryConvSourceCall runs f, retrying when it fails with an error the chat
+// source marks as retriable, honoring any retry-after the server handed back.
+func (h *chatLocalHandler) retryConvSourceCall(ctx context.Context, name string, f func() error) (err error) {
+	for i := 0; i < convSourceRetries; i++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		serr, ok := err.(chat.ConvSourceError)
+		if !ok || !serr.IsRetriable() {
+			return err
+		}
+		h.Debug(ctx, "%s: retriable chat source error: attempt: %d err: %s", name, i+1, err.Error())
+		if wait := serr.RetryAfter(); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return err
+}
+
 // GetInboxAndUnboxLocal implements keybase.chatLocal.getInboxAndUnboxLocal protocol.
 func (h *chatLocalHandler) GetInboxAndUnboxLocal(ctx context.Context, arg chat1.GetInboxAndUnboxLocalArg) (res chat1.GetInboxAndUnboxLocalRes, err error) {
 	defer h.Trace(ctx, func() error { return err }, "GetInboxAndUnboxLocal")()
@@ -199,9 +227,13 @@ func (h *chatLocalHandler) GetThreadLocal(ctx context.Context, arg chat1.GetThre
 	}
 	var identBreaks []keybase1.TLFIdentifyFailure
 	ctx = chat.Context(ctx, arg.IdentifyBehavior, &identBreaks, h.identNotifier)
-	thread, rl, err := h.G().ConvSource.Pull(ctx, arg.ConversationID,
-		gregor1.UID(uid.ToBytes()), arg.Query, arg.Pagination)
-	if err != nil {
+	var thread chat1.ThreadView
+	var rl []*chat1.RateLimit
+	if err = h.retryConvSourceCall(ctx, "GetThreadLocal", func() (perr error) {
+		thread, rl, perr = h.G().ConvSource.Pull(ctx, arg.ConversationID,
+			gregor1.UID(uid.ToBytes()), arg.Query, arg.Pagination)
+		return perr
+	}); err != nil {
 		return chat1.GetThreadLocalRes{}, err
 	}
 
@@ -212,6 +244,171 @@ func (h *chatLocalHandler) GetThreadLocal(ctx context.Context, arg chat1.GetThre
 	}, nil
 }
 
+// SearchLocal implements keybase.chatLocal.searchLocal protocol.
+func (h *chatLocalHandler) SearchLocal(ctx context.Context, arg chat1.SearchLocalArg) (res chat1.SearchLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "SearchLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return chat1.SearchLocalRes{}, err
+	}
+
+	uid := h.G().Env.GetUID()
+	if uid.IsNil() {
+		err = libkb.LoginRequiredError{}
+		return chat1.SearchLocalRes{}, err
+	}
+	var identBreaks []keybase1.TLFIdentifyFailure
+	ctx = chat.Context(ctx, arg.IdentifyBehavior, &identBreaks, h.identNotifier)
+	hits, err := h.G().ConvSource.Search(ctx, gregor1.UID(uid.ToBytes()), arg.Query, arg.Opts)
+	if err != nil {
+		return chat1.SearchLocalRes{}, err
+	}
+
+	return chat1.SearchLocalRes{
+		Hits:             hits,
+		IdentifyFailures: identBreaks,
+	}, nil
+}
+
+// ClearCacheLocal implements keybase.chatLocal.clearCacheLocal protocol.
+func (h *chatLocalHandler) ClearCacheLocal(ctx context.Context, opts chat1.ClearCacheLocalOpts) (res chat1.ClearCacheLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "ClearCacheLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return chat1.ClearCacheLocalRes{}, err
+	}
+
+	uid := h.G().Env.GetUID()
+	if uid.IsNil() {
+		err = libkb.LoginRequiredError{}
+		return chat1.ClearCacheLocalRes{}, err
+	}
+	return h.G().ConvSource.ClearCache(ctx, gregor1.UID(uid.ToBytes()), opts)
+}
+
+// GetCacheStatsLocal implements keybase.chatLocal.getCacheStatsLocal protocol.
+func (h *chatLocalHandler) GetCacheStatsLocal(ctx context.Context) (res chat1.CacheStatsLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "GetCacheStatsLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return chat1.CacheStatsLocalRes{}, err
+	}
+	return h.G().ConvSource.CacheStats(), nil
+}
+
+func (h *chatLocalHandler) PurgeFailedOutboxLocal(ctx context.Context) (res chat1.PurgeFailedOutboxLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "PurgeFailedOutboxLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return res, err
+	}
+
+	uid := h.G().Env.GetUID()
+	outbox := storage.NewOutbox(h.G(), uid.ToBytes(), h.getSecretUI)
+	purged, perr := outbox.PurgeFailed(ctx)
+	if perr != nil {
+		return res, perr
+	}
+	return chat1.PurgeFailedOutboxLocalRes{Purged: purged}, nil
+}
+
+// SetConvPinnedLocal implements keybase.chatLocal.setConvPinnedLocal protocol.
+func (h *chatLocalHandler) SetConvPinnedLocal(ctx context.Context, arg chat1.SetConvPinnedLocalArg) (err error) {
+	defer h.Trace(ctx, func() error { return err }, "SetConvPinnedLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return err
+	}
+	uid := h.G().Env.GetUID()
+	return h.G().ConvSource.SetConvPinned(ctx, arg.ConversationID, gregor1.UID(uid.ToBytes()),
+		arg.Pinned)
+}
+
+// PreloadConversationsLocal implements keybase.chatLocal.preloadConversationsLocal protocol.
+func (h *chatLocalHandler) PreloadConversationsLocal(ctx context.Context, arg chat1.PreloadConversationsLocalArg) (res chat1.PreloadConversationsLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "PreloadConversationsLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return res, err
+	}
+	uid := h.G().Env.GetUID()
+	rl, err := h.G().ConvSource.PreloadConversations(ctx, gregor1.UID(uid.ToBytes()),
+		arg.ConversationIDs, arg.Depth)
+	if err != nil {
+		return res, err
+	}
+	return chat1.PreloadConversationsLocalRes{
+		RateLimits: utils.AggRateLimitsP(rl),
+	}, nil
+}
+
+// ListPinnedConvsLocal implements keybase.chatLocal.listPinnedConvsLocal protocol.
+func (h *chatLocalHandler) ListPinnedConvsLocal(ctx context.Context) (res []chat1.ConversationID, err error) {
+	defer h.Trace(ctx, func() error { return err }, "ListPinnedConvsLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return nil, err
+	}
+	uid := h.G().Env.GetUID()
+	return h.G().ConvSource.ListPinnedConvs(ctx, gregor1.UID(uid.ToBytes())), nil
+}
+
+// CompactChatStorageLocal implements keybase.chatLocal.compactChatStorageLocal protocol.
+func (h *chatLocalHandler) CompactChatStorageLocal(ctx context.Context) (res chat1.CompactChatStorageLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "CompactChatStorageLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return res, err
+	}
+	uid := h.G().Env.GetUID()
+	before, err := h.G().LocalChatDb.DiskUsage()
+	if err != nil {
+		return res, err
+	}
+	if err = h.G().LocalChatDb.Compact(func(done, total int) {
+		h.G().NotifyRouter.HandleChatCompactionProgress(ctx, uid, done, total)
+	}); err != nil {
+		return res, err
+	}
+	after, err := h.G().LocalChatDb.DiskUsage()
+	if err != nil {
+		return res, err
+	}
+	return chat1.CompactChatStorageLocalRes{
+		BytesBefore: before,
+		BytesAfter:  after,
+	}, nil
+}
+
+func (h *chatLocalHandler) SaveDraftLocal(ctx context.Context, arg chat1.SaveDraftLocalArg) (err error) {
+	defer h.Trace(ctx, func() error { return err }, "SaveDraftLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return err
+	}
+
+	uid := h.G().Env.GetUID()
+	drafts := storage.NewDrafts(h.G(), uid.ToBytes(), h.getSecretUI)
+	return drafts.Save(ctx, arg.ConversationID, arg.Draft)
+}
+
+func (h *chatLocalHandler) GetDraftLocal(ctx context.Context, convID chat1.ConversationID) (res chat1.GetDraftLocalRes, err error) {
+	defer h.Trace(ctx, func() error { return err }, "GetDraftLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return chat1.GetDraftLocalRes{}, err
+	}
+
+	uid := h.G().Env.GetUID()
+	drafts := storage.NewDrafts(h.G(), uid.ToBytes(), h.getSecretUI)
+	draft, derr := drafts.Get(ctx, convID)
+	if derr != nil {
+		return chat1.GetDraftLocalRes{}, derr
+	}
+	return chat1.GetDraftLocalRes{Draft: draft}, nil
+}
+
+func (h *chatLocalHandler) ClearDraftLocal(ctx context.Context, convID chat1.ConversationID) (err error) {
+	defer h.Trace(ctx, func() error { return err }, "ClearDraftLocal")()
+	if err = h.assertLoggedIn(ctx); err != nil {
+		return err
+	}
+
+	uid := h.G().Env.GetUID()
+	drafts := storage.NewDrafts(h.G(), uid.ToBytes(), h.getSecretUI)
+	return drafts.Clear(ctx, convID)
+}
+
 // NewConversationLocal implements keybase.chatLocal.newConversationLocal protocol.
 // Create a new conversation. Or in the case of CHAT, create-or-get a conversation.
 func (h *chatLocalHandler) NewConversationLocal(ctx context.Context, arg chat1.NewConversationLocalArg) (res chat1.NewConversationLocalRes, reserr error) {
@@ -539,8 +736,12 @@ func (h *chatLocalHandler) GetMessagesLocal(ctx context.Context, arg chat1.GetMe
 	}
 
 	// use ConvSource to get the messages, to try the cache first
-	messages, err := h.G().ConvSource.GetMessages(ctx, arg.ConversationID, uid.ToBytes(), arg.MessageIDs, conv.Metadata.FinalizeInfo)
-	if err != nil {
+	var messages []chat1.MessageUnboxed
+	if err = h.retryConvSourceCall(ctx, "GetMessagesLocal", func() (perr error) {
+		messages, perr = h.G().ConvSource.GetMessages(ctx, arg.ConversationID, uid.ToBytes(),
+			arg.MessageIDs, conv.Metadata.FinalizeInfo)
+		return perr
+	}); err != nil {
 		return deflt, err
 	}
 
@@ -1117,6 +1318,26 @@ func (h *chatLocalHandler) downloadAttachmentLocal(ctx context.Context, arg down
 		chatUI.ChatAttachmentDownloadProgress(ctx, parg)
 	}
 
+	// serve previews straight out of the cache when we can, skipping S3
+	if arg.Preview {
+		if data, asset, ok := h.G().ConvSource.AttachmentPreviewCached(ctx, arg.ConversationID,
+			arg.MessageID); ok {
+			h.G().Log.Debug("preview cache hit: %s (%d bytes)", asset.MimeType, len(data))
+			chatUI.ChatAttachmentDownloadStart(ctx)
+			if _, err := arg.Sink.Write(data); err != nil {
+				arg.Sink.Close()
+				return chat1.DownloadAttachmentLocalRes{}, err
+			}
+			if err := arg.Sink.Close(); err != nil {
+				return chat1.DownloadAttachmentLocalRes{}, err
+			}
+			chatUI.ChatAttachmentDownloadDone(ctx)
+			return chat1.DownloadAttachmentLocalRes{
+				IdentifyFailures: identBreaks,
+			}, nil
+		}
+	}
+
 	// get s3 params from server
 	params, err := h.remoteClient().GetS3Params(ctx, arg.ConversationID)
 	if err != nil {
@@ -1136,8 +1357,15 @@ func (h *chatLocalHandler) downloadAttachmentLocal(ctx context.Context, arg down
 		}
 		h.G().Log.Debug("downloading preview attachment asset")
 	}
+
+	// tee preview downloads so the bytes land in the cache for next time
+	var previewBuf bytes.Buffer
+	var sink io.Writer = arg.Sink
+	if arg.Preview {
+		sink = io.MultiWriter(arg.Sink, &previewBuf)
+	}
 	chatUI.ChatAttachmentDownloadStart(ctx)
-	if err := h.store.DownloadAsset(ctx, params, obj, arg.Sink, h, progress); err != nil {
+	if err := h.store.DownloadAsset(ctx, params, obj, sink, h, progress); err != nil {
 		arg.Sink.Close()
 		return chat1.DownloadAttachmentLocalRes{}, err
 	}
@@ -1145,6 +1373,10 @@ func (h *chatLocalHandler) downloadAttachmentLocal(ctx context.Context, arg down
 	if err := arg.Sink.Close(); err != nil {
 		return chat1.DownloadAttachmentLocalRes{}, err
 	}
+	if arg.Preview {
+		h.G().ConvSource.CacheAttachmentPreview(ctx, arg.ConversationID, arg.MessageID, obj,
+			previewBuf.Bytes())
+	}
 
 	chatUI.ChatAttachmentDownloadDone(ctx)
 
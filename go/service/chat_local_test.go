@@ -901,6 +901,10 @@ func (n *chatListener) KeyfamilyChanged(uid keybase1.UID)
 func (n *chatListener) PGPKeyInSecretStoreFile()                                           {}
 func (n *chatListener) BadgeState(badgeState keybase1.BadgeState)                          {}
 func (n *chatListener) ReachabilityChanged(r keybase1.Reachability)                        {}
+func (n *chatListener) GregorThrottled(throttled bool)                                     {}
+func (n *chatListener) GregorConnectFatal(reason string)                                   {}
+func (n *chatListener) GregorHandlerQuarantined(name string)                               {}
+func (n *chatListener) GenericGregorEvent(system string, body string)                      {}
 func (n *chatListener) ChatIdentifyUpdate(update keybase1.CanonicalTLFNameAndIDWithBreaks) {}
 func (n *chatListener) ChatTLFFinalize(uid keybase1.UID, convID chat1.ConversationID, info chat1.ConversationFinalizeInfo) {
 }
@@ -908,6 +912,13 @@ func (n *chatListener) ChatTLFResolve(uid keybase1.UID, convID chat1.Conversatio
 }
 func (n *chatListener) ChatInboxStale(uid keybase1.UID)                                {}
 func (n *chatListener) ChatThreadsStale(uid keybase1.UID, cids []chat1.ConversationID) {}
+func (n *chatListener) ChatTypingUpdate(uid keybase1.UID, convID chat1.ConversationID, typer keybase1.UID, typing bool) {
+}
+func (n *chatListener) ChatMembersUpdate(uid keybase1.UID, convID chat1.ConversationID, joined []keybase1.UID, left []keybase1.UID) {
+}
+func (n *chatListener) ChatMessageConflict(uid keybase1.UID, convID chat1.ConversationID, msgID chat1.MessageID) {
+}
+func (n *chatListener) ChatCompactionProgress(uid keybase1.UID, done int, total int) {}
 func (n *chatListener) NewChatActivity(uid keybase1.UID, activity chat1.ChatActivity) {
 	typ, _ := activity.ActivityType()
 	if typ == chat1.ChatActivityType_INCOMING_MESSAGE {
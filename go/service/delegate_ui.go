@@ -60,6 +60,19 @@ func (d *DelegateUICtlHandler) RegisterGregorFirehose(_ context.Context) error {
 	return nil
 }
 
+// RegisterOOBMTap streams raw out-of-band messages for the given system
+// prefixes to this connection, replaying recently buffered ones on attach. An
+// empty prefix list taps every system.
+func (d *DelegateUICtlHandler) RegisterOOBMTap(_ context.Context, systemPrefixes []string) error {
+	if d.G().GregorListener != nil {
+		d.G().Log.Debug("Registering OOBM tap on connection %d: prefixes: %v", d.id, systemPrefixes)
+		d.G().GregorListener.PushFirehoseHandler(newOOBMTapHandler(d.G(), d.id, d.xp, systemPrefixes))
+	} else {
+		d.G().Log.Info("Failed to register OOBM tap on connection %d", d.id)
+	}
+	return nil
+}
+
 func (d *DelegateUICtlHandler) RegisterRekeyUI(_ context.Context) error {
 	d.G().UIRouter.SetUI(d.id, libkb.RekeyUIKind)
 	if d.rekeyMaster != nil {
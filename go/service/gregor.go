@@ -2,12 +2,25 @@ package service
 
 import (
 	"bytes"
+	stdcontext "context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/net/context"
 
 	"github.com/cenkalti/backoff"
@@ -32,6 +45,199 @@ var ErrGregorTimeout = errors.New("Network request timed out.")
 
 const GregorConnectionRetryInterval time.Duration = 2 * time.Second
 
+// How long we wait between resends of messages that gregord has rate limited,
+// and how many of them we are willing to hold on to
+const GregorRetryThrottleInterval time.Duration = 2 * time.Second
+const gregorRetryQueueSize = 100
+
+// How many messages we replay before yielding the processor
+const replayChunkSize = 100
+
+// How many consecutive ping timeouts we absorb with transport-level
+// reconnects before giving up and doing a full Shutdown/Connect
+const gregorPingReconnectLimit = 3
+
+// How many out-of-band messages we buffer per system for replay to firehose
+// handlers that attach late
+const oobmReplayLimit = 32
+
+// How often we re-evaluate item dtimes against the clock, so expired items
+// disappear locally even if the server never tells us about them
+const gregorItemSweepInterval = time.Minute
+
+// How many panics a handler gets before it's quarantined
+const gregorHandlerPanicLimit = 3
+
+// How many handlers run concurrently for a dispatched message
+const gregorDispatchWorkers = 4
+
+// How many unhandled messages we keep for later replay before dropping the
+// oldest
+const gregorDeadLetterLimit = 100
+
+// How often the scheduled GC compacts long-dismissed items out of the
+// persisted state, and how long a dismissal sticks around before it is
+// eligible
+const gregorGCInterval = time.Hour
+const gregorGCDismissedAge = 7 * 24 * time.Hour
+
+// How many recently seen broadcast MsgIDs we persist for dedup across
+// restarts
+const gregorSeenMsgIDLimit = 100
+
+// How many ping round-trip times we keep around for connection quality
+// reporting
+const pingRTTBufferSize = 32
+
+// pingRTTTracker is a fixed size ring buffer of ping round-trip times, plus
+// counters describing how the ping loop has been faring. All methods are safe
+// for concurrent use.
+type pingRTTTracker struct {
+	sync.Mutex
+	rtts        []time.Duration
+	next        int
+	lossCount   int
+	lastSuccess time.Time
+}
+
+func newPingRTTTracker() *pingRTTTracker {
+	return &pingRTTTracker{}
+}
+
+func (p *pingRTTTracker) recordSuccess(rtt time.Duration, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.rtts) < pingRTTBufferSize {
+		p.rtts = append(p.rtts, rtt)
+	} else {
+		p.rtts[p.next] = rtt
+	}
+	p.next = (p.next + 1) % pingRTTBufferSize
+	p.lastSuccess = now
+}
+
+func (p *pingRTTTracker) recordLoss() {
+	p.Lock()
+	defer p.Unlock()
+	p.lossCount++
+}
+
+func (p *pingRTTTracker) connectionQuality() (res keybase1.ConnectionQuality) {
+	p.Lock()
+	defer p.Unlock()
+
+	res.LossCount = p.lossCount
+	if !p.lastSuccess.IsZero() {
+		res.LastSuccess = keybase1.ToTime(p.lastSuccess)
+	}
+	if len(p.rtts) == 0 {
+		return res
+	}
+
+	var total time.Duration
+	min, max := p.rtts[0], p.rtts[0]
+	for _, rtt := range p.rtts {
+		total += rtt
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+	}
+	avg := total / time.Duration(len(p.rtts))
+	res.AvgRtt = keybase1.DurationSec(avg.Seconds())
+	res.MinRtt = keybase1.DurationSec(min.Seconds())
+	res.MaxRtt = keybase1.DurationSec(max.Seconds())
+	return res
+}
+
+// How many clock skew samples we keep around
+const clockSkewBufferSize = 32
+
+// clockSkewTracker estimates the offset between our clock and gregord's by
+// sampling (local receipt time - server ctime) on live broadcasts. A broadcast
+// arrives right after the server stamps it, so each sample is the skew plus a
+// little network latency. All methods are safe for concurrent use.
+type clockSkewTracker struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newClockSkewTracker() *clockSkewTracker {
+	return &clockSkewTracker{}
+}
+
+func (c *clockSkewTracker) sample(serverCtime, localNow time.Time) {
+	if serverCtime.IsZero() {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	d := localNow.Sub(serverCtime)
+	if len(c.samples) < clockSkewBufferSize {
+		c.samples = append(c.samples, d)
+	} else {
+		c.samples[c.next] = d
+	}
+	c.next = (c.next + 1) % clockSkewBufferSize
+}
+
+// estimate returns the current skew estimate. Latency only ever inflates a
+// sample, so the minimum is the sample least polluted by the network.
+func (c *clockSkewTracker) estimate() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.samples) == 0 {
+		return 0
+	}
+	min := c.samples[0]
+	for _, d := range c.samples {
+		if d < min {
+			min = d
+		}
+	}
+	return min
+}
+
+// serverWatermark is the incremental replay high-water mark, advanced only
+// with ctimes gregord stamped on messages it delivered to us. The state
+// machine's latest ctime also reflects locally injected items, which we stamp
+// with our own wall clock; resuming from that can skip server messages when
+// the two clocks disagree.
+type serverWatermark struct {
+	sync.Mutex
+	ctime time.Time
+	msgID gregor.MsgID
+}
+
+func newServerWatermark() *serverWatermark {
+	return &serverWatermark{}
+}
+
+func (w *serverWatermark) advance(msgID gregor.MsgID, ctime time.Time) {
+	if ctime.IsZero() {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if ctime.After(w.ctime) {
+		w.ctime = ctime
+		w.msgID = msgID
+	}
+}
+
+func (w *serverWatermark) time() *time.Time {
+	w.Lock()
+	defer w.Unlock()
+	if w.ctime.IsZero() {
+		return nil
+	}
+	t := w.ctime
+	return &t
+}
+
 type IdentifyUIHandler struct {
 	libkb.Contextified
 	connID      libkb.ConnectionID
@@ -56,6 +262,10 @@ func (h IdentifyUIHandler) Name() string {
 	return "IdentifyUIHandler"
 }
 
+func (h IdentifyUIHandler) HandlerConnectionID() libkb.ConnectionID {
+	return h.connID
+}
+
 func (h *IdentifyUIHandler) toggleAlwaysAlive(alive bool) {
 	h.alwaysAlive = alive
 }
@@ -78,6 +288,10 @@ func (h *gregorFirehoseHandler) IsAlive() bool {
 	return h.G().ConnectionManager.LookupConnection(h.connID) != nil
 }
 
+func (h *gregorFirehoseHandler) HandlerConnectionID() libkb.ConnectionID {
+	return h.connID
+}
+
 func (h *gregorFirehoseHandler) PushState(s gregor1.State, r keybase1.PushReason) {
 	err := h.cli.PushState(context.Background(), keybase1.PushStateArg{State: s, Reason: r})
 	if err != nil {
@@ -92,6 +306,305 @@ func (h *gregorFirehoseHandler) PushOutOfBandMessages(m []gregor1.OutOfBandMessa
 	}
 }
 
+// Electron typically connects well after the service starts, so catch it up
+// on any out-of-band messages it missed
+func (h *gregorFirehoseHandler) ReplayOutOfBandMessages() bool {
+	return true
+}
+
+func (h *gregorFirehoseHandler) PushStateDelta(d keybase1.GregorStateDelta, r keybase1.PushReason) bool {
+	err := h.cli.PushStateDelta(context.Background(), keybase1.PushStateDeltaArg{Delta: d, Reason: r})
+	if err != nil {
+		h.G().Log.Debug("firehose push state delta not applied, falling back to full push: %s", err)
+		return false
+	}
+	return true
+}
+
+// oobmTapHandler is a narrow firehose consumer that only wants raw
+// out-of-band messages for a set of system prefixes; bot and automation
+// frontends attach one via registerOOBMTap. State pushes are dropped on the
+// floor.
+type oobmTapHandler struct {
+	libkb.Contextified
+	connID   libkb.ConnectionID
+	cli      keybase1.GregorUIClient
+	prefixes []string
+}
+
+func newOOBMTapHandler(g *libkb.GlobalContext, connID libkb.ConnectionID, xp rpc.Transporter,
+	prefixes []string) *oobmTapHandler {
+	return &oobmTapHandler{
+		Contextified: libkb.NewContextified(g),
+		connID:       connID,
+		cli:          keybase1.GregorUIClient{Cli: rpc.NewClient(xp, libkb.ErrorUnwrapper{})},
+		prefixes:     prefixes,
+	}
+}
+
+func (h *oobmTapHandler) IsAlive() bool {
+	return h.G().ConnectionManager.LookupConnection(h.connID) != nil
+}
+
+func (h *oobmTapHandler) HandlerConnectionID() libkb.ConnectionID {
+	return h.connID
+}
+
+// PushState is a no-op; taps only care about out-of-band messages.
+func (h *oobmTapHandler) PushState(s gregor1.State, r keybase1.PushReason) {}
+
+// Catch a freshly attached tap up on messages it just missed
+func (h *oobmTapHandler) ReplayOutOfBandMessages() bool {
+	return true
+}
+
+func (h *oobmTapHandler) PushOutOfBandMessages(m []gregor1.OutOfBandMessage) {
+	var res []gregor1.OutOfBandMessage
+	for _, msg := range m {
+		if h.wantSystem(msg.System_.String()) {
+			res = append(res, msg)
+		}
+	}
+	if len(res) == 0 {
+		return
+	}
+	if err := h.cli.PushOutOfBandMessages(context.Background(), res); err != nil {
+		h.G().Log.Error(fmt.Sprintf("Error in OOBM tap push: %s", err))
+	}
+}
+
+// wantSystem says whether the tap subscribed to the system; no prefixes means
+// everything.
+func (h *oobmTapHandler) wantSystem(system string) bool {
+	if len(h.prefixes) == 0 {
+		return true
+	}
+	for _, p := range h.prefixes {
+		if strings.HasPrefix(system, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// oobmReplayBuffer holds the last few out-of-band messages per system so
+// firehose handlers that attach late can be caught up. Within a system,
+// messages come back in arrival order; across systems the order is
+// unspecified.
+type oobmReplayBuffer struct {
+	sync.Mutex
+	limit    int
+	bySystem map[string][]gregor1.OutOfBandMessage
+}
+
+func newOOBMReplayBuffer(limit int) *oobmReplayBuffer {
+	return &oobmReplayBuffer{
+		limit:    limit,
+		bySystem: make(map[string][]gregor1.OutOfBandMessage),
+	}
+}
+
+func (b *oobmReplayBuffer) add(msgs []gregor1.OutOfBandMessage) {
+	b.Lock()
+	defer b.Unlock()
+	for _, m := range msgs {
+		key := m.System().String()
+		q := append(b.bySystem[key], m)
+		if len(q) > b.limit {
+			q = q[len(q)-b.limit:]
+		}
+		b.bySystem[key] = q
+	}
+}
+
+func (b *oobmReplayBuffer) recent() (res []gregor1.OutOfBandMessage) {
+	b.Lock()
+	defer b.Unlock()
+	for _, q := range b.bySystem {
+		res = append(res, q...)
+	}
+	return res
+}
+
+// gregorStats is a set of counters describing the health of our connection
+// to gregord. Counters only ever go up, and reset when the service restarts.
+type gregorStats struct {
+	sync.Mutex
+	reconnects         int64
+	authFailures       int64
+	broadcastsReceived int64
+	replays            int64
+	handlerErrors      int64
+	pingTimeouts       int64
+	restoreFailures    int64
+}
+
+func (s *gregorStats) incr(p *int64) {
+	s.Lock()
+	defer s.Unlock()
+	*p++
+}
+
+func (s *gregorStats) export() keybase1.GregorStats {
+	s.Lock()
+	defer s.Unlock()
+	return keybase1.GregorStats{
+		Reconnects:         s.reconnects,
+		AuthFailures:       s.authFailures,
+		BroadcastsReceived: s.broadcastsReceived,
+		Replays:            s.replays,
+		HandlerErrors:      s.handlerErrors,
+		PingTimeouts:       s.pingTimeouts,
+		RestoreFailures:    s.restoreFailures,
+	}
+}
+
+// How many latency samples we keep per handler for the percentile estimates
+const handlerLatencySamples = 64
+
+// handlerMetrics tracks per-handler dispatch counts and latencies, so the
+// stats RPC can point at the handler slowing broadcast processing down. All
+// methods are safe for concurrent use.
+type handlerMetrics struct {
+	sync.Mutex
+	byName map[string]*handlerMetric
+}
+
+type handlerMetric struct {
+	creates   int64
+	dismisses int64
+	errors    int64
+	latencies []time.Duration
+	next      int
+}
+
+func newHandlerMetrics() *handlerMetrics {
+	return &handlerMetrics{byName: make(map[string]*handlerMetric)}
+}
+
+// recordCreate notes a Create call on the named handler and how long it took.
+func (m *handlerMetrics) recordCreate(name string, d time.Duration, err error) {
+	m.record(name, d, err, true)
+}
+
+// recordDismiss is recordCreate for Dismiss calls.
+func (m *handlerMetrics) recordDismiss(name string, d time.Duration, err error) {
+	m.record(name, d, err, false)
+}
+
+func (m *handlerMetrics) record(name string, d time.Duration, err error, create bool) {
+	m.Lock()
+	defer m.Unlock()
+	hm := m.byName[name]
+	if hm == nil {
+		hm = &handlerMetric{}
+		m.byName[name] = hm
+	}
+	if create {
+		hm.creates++
+	} else {
+		hm.dismisses++
+	}
+	if err != nil {
+		hm.errors++
+	}
+	if len(hm.latencies) < handlerLatencySamples {
+		hm.latencies = append(hm.latencies, d)
+	} else {
+		hm.latencies[hm.next] = d
+	}
+	hm.next = (hm.next + 1) % handlerLatencySamples
+}
+
+type byDuration []time.Duration
+
+func (a byDuration) Len() int           { return len(a) }
+func (a byDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDuration) Less(i, j int) bool { return a[i] < a[j] }
+
+// latencyPercentile returns the pth percentile of the sorted samples, or zero
+// if there are none.
+func latencyPercentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// export dumps the per-handler stats, sorted by handler name so the output
+// is stable.
+func (m *handlerMetrics) export() (res []keybase1.GregorHandlerStats) {
+	m.Lock()
+	defer m.Unlock()
+	var names []string
+	for name := range m.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hm := m.byName[name]
+		sorted := make(byDuration, len(hm.latencies))
+		copy(sorted, hm.latencies)
+		sort.Sort(sorted)
+		res = append(res, keybase1.GregorHandlerStats{
+			Name:      name,
+			Creates:   hm.creates,
+			Dismisses: hm.dismisses,
+			Errors:    hm.errors,
+			P50:       keybase1.DurationSec(latencyPercentile(sorted, 50).Seconds()),
+			P95:       keybase1.DurationSec(latencyPercentile(sorted, 95).Seconds()),
+		})
+	}
+	return res
+}
+
+// How many per-message audit records we keep for the getAuditLog RPC
+const gregorAuditLogLimit = 256
+
+// handlerAuditLog is a bounded ring of per-message processing records: which
+// handler saw which message, the outcome, and how long it took. Support can
+// pull it over the getAuditLog RPC when debugging a stuck notification. All
+// methods are safe for concurrent use.
+type handlerAuditLog struct {
+	sync.Mutex
+	entries []keybase1.GregorAuditEntry
+	next    int
+}
+
+func (a *handlerAuditLog) record(e keybase1.GregorAuditEntry) {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.entries) < gregorAuditLogLimit {
+		a.entries = append(a.entries, e)
+	} else {
+		a.entries[a.next] = e
+	}
+	a.next = (a.next + 1) % gregorAuditLogLimit
+}
+
+// dump returns up to max entries, oldest first; max <= 0 means everything.
+func (a *handlerAuditLog) dump(max int) (res []keybase1.GregorAuditEntry) {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.entries) < gregorAuditLogLimit {
+		res = append(res, a.entries...)
+	} else {
+		res = append(res, a.entries[a.next:]...)
+		res = append(res, a.entries[:a.next]...)
+	}
+	if max > 0 && len(res) > max {
+		res = res[len(res)-max:]
+	}
+	return res
+}
+
+func auditErrString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 type testingEvents struct {
 	broadcastSentCh chan error
 }
@@ -110,10 +623,51 @@ type gregorHandler struct {
 	sync.Mutex
 	ibmHandlers      []libkb.GregorInBandMessageHandler
 	gregorCli        *grclient.Client
-	firehoseHandlers []libkb.GregorFirehoseHandler
-	badger           *badges.Badger
-	chatHandler      *chat.PushHandler
-	chatSync         *chat.Syncer
+	firehoseHandlers []firehoseRegistration
+	oobmReplay       *oobmReplayBuffer
+	sweepItems       map[string]bool
+
+	// Per-handler replay watermarks, keyed by handler name. A handler that
+	// reattaches only gets messages newer than what it already processed.
+	replayWatermarks map[string]time.Time
+
+	// Dispatch declarations from RegisterHandler, keyed by handler name.
+	// Handlers attached via plain PushHandler have no entry and keep the
+	// historical behavior: priority 0, every category.
+	ibmRegistrations map[string]ibmHandlerRegistration
+
+	// Panic counts per handler, and the handlers quarantined for panicking
+	// repeatedly. A quarantined handler is skipped until it re-registers.
+	// panicLock protects both maps, since panics are noted from dispatch
+	// workers running outside the main lock.
+	panicLock           sync.Mutex
+	handlerPanics       map[string]int
+	quarantinedHandlers map[string]bool
+
+	// Messages no handler claimed, kept around so a handler that registers
+	// their category later can still see them. Bounded to
+	// gregorDeadLetterLimit; the oldest entries fall off first.
+	deadLetters []deadLetter
+
+	seenMsgIDs *seenMsgIDTracker
+
+	// Nacked messages awaiting redelivery for the current user
+	redelivery *redeliveryQueue
+
+	// Out-of-band messages no handler could decode, kept for a retry after
+	// the next client upgrade
+	oobmQuarantine *oobmQuarantine
+
+	// MsgIDs of items we created locally that the server hasn't echoed back
+	// yet, pending metadata reconciliation on the next sync
+	injectedItems map[string]bool
+
+	// The last state we pushed to firehose handlers, for computing deltas
+	lastPushedState *gregor1.State
+	lastPushedHash  []byte
+	badger          *badges.Badger
+	chatHandler     *chat.PushHandler
+	chatSync        *chat.Syncer
 
 	// This mutex protects the con object
 	connMutex     sync.Mutex
@@ -121,19 +675,79 @@ type gregorHandler struct {
 	uri           *rpc.FMPURI
 	startPingLoop sync.Once
 
-	cli              rpc.GenericClient
-	pingCli          rpc.GenericClient
-	sessionID        gregor1.SessionID
-	skipRetryConnect bool
-	freshReplay      bool
+	cli         rpc.GenericClient
+	pingCli     rpc.GenericClient
+	sessionID   gregor1.SessionID
+	freshReplay bool
+
+	// Tracks ping round-trip times for connection quality reporting
+	rttTracker *pingRTTTracker
+
+	// Server-clock replay cursor and our skew estimate against gregord
+	watermark *serverWatermark
+	clockSkew *clockSkewTracker
 
-	// Function for determining if a new BroadcastMessage should trigger
-	// a pushState call to firehose handlers
-	pushStateFilter func(m gregor.Message) bool
+	// Counters for the getStats RPC
+	stats gregorStats
+
+	// Per-system out-of-band message throughput, also for getStats
+	oobmThroughput *oobmThroughput
+
+	// Per-handler dispatch counts and latencies, also for getStats
+	metrics *handlerMetrics
+
+	// Ring of per-message processing records for the getAuditLog RPC
+	audit *handlerAuditLog
+
+	// Routes out-of-band messages to handlers registered by system prefix
+	oobmRouter *oobmDispatcher
+
+	// Fires user-configured local automation for selected categories/systems
+	hooks *gregorHookRunner
+
+	// System prefixes whose OOBMs are forwarded to the UI as generic JSON
+	// events when nothing else handles them
+	passthroughSystems []string
+
+	// Orders live broadcasts that race a reconnect replay
+	sequencer *replaySequencer
+
+	// Coalescing state for firehose pushes: one NEW_DATA state push and one
+	// OOBM batch per window, however big the burst
+	pushCoalescePending bool
+	pushCoalesceDirty   bool
+	oobmCoalescePending bool
+	pendingOOBMs        []gregor1.OutOfBandMessage
+
+	// Warm per-UID sessions for fast user switching
+	sessions *gregorSessionRegistry
+
+	// Named predicates for determining if a new BroadcastMessage should
+	// trigger a pushState call to firehose handlers. All enabled filters must
+	// agree (AND semantics). Protected by the main lock.
+	pushStateFilters []*pushStateFilterEntry
+
+	// Reconnect broadcast bookkeeping: how many times this process has
+	// reconnected, when the last server sync finished, and whether the
+	// current connection is still up (for flap suppression)
+	reconnectMu    sync.Mutex
+	reconnectSeqno int
+	lastSyncTime   time.Time
+	connGen        int
+	connUp         bool
 
 	shutdownCh  chan struct{}
 	broadcastCh chan gregor1.Message
 
+	// Local state updates (e.g. optimistic dismissals) queued to the
+	// broadcast loop so they never take the handler lock on the caller's
+	// goroutine
+	localOpCh chan func()
+
+	// Bounded queue of messages gregord rate limited that we retry on a
+	// spaced schedule
+	retryCh chan gregor1.Message
+
 	// Testing
 	testingEvents       *testingEvents
 	transportForTesting *connTransport
@@ -142,95 +756,686 @@ type gregorHandler struct {
 var _ libkb.GregorDismisser = (*gregorHandler)(nil)
 var _ libkb.GregorListener = (*gregorHandler)(nil)
 
+// gregorSession is the per-UID state the handler keeps across account
+// switches: the local state machine (inside the client) and the replay
+// cursor.
+type gregorSession struct {
+	gcli        *grclient.Client
+	freshReplay bool
+}
+
+// gregorSessionRegistry holds a gregorSession per UID, so fast user switching
+// can pick an account's state machine back up warm instead of rebuilding it
+// from local storage.
+type gregorSessionRegistry struct {
+	sync.Mutex
+	sessions map[string]*gregorSession
+}
+
+func newGregorSessionRegistry() *gregorSessionRegistry {
+	return &gregorSessionRegistry{
+		sessions: make(map[string]*gregorSession),
+	}
+}
+
+func (r *gregorSessionRegistry) get(uid gregor.UID) *gregorSession {
+	r.Lock()
+	defer r.Unlock()
+	return r.sessions[hex.EncodeToString(uid.Bytes())]
+}
+
+func (r *gregorSessionRegistry) put(uid gregor.UID, s *gregorSession) {
+	r.Lock()
+	defer r.Unlock()
+	r.sessions[hex.EncodeToString(uid.Bytes())] = s
+}
+
 type gregorLocalDb struct {
+	g  *libkb.GlobalContext
 	db *libkb.JSONLocalDb
 }
 
 func newLocalDB(g *libkb.GlobalContext) *gregorLocalDb {
-	return &gregorLocalDb{db: g.LocalDb}
+	return &gregorLocalDb{g: g, db: g.LocalDb}
 }
 
 func dbKey(u gregor.UID) libkb.DbKey {
 	return libkb.DbKey{Typ: libkb.DBGregor, Key: hex.EncodeToString(u.Bytes())}
 }
 
-func (db *gregorLocalDb) Store(u gregor.UID, b []byte) error {
-	return db.db.PutRaw(dbKey(u), b)
+func quarantineKey(u gregor.UID) libkb.DbKey {
+	return libkb.DbKey{Typ: libkb.DBGregor, Key: "quarantine:" + hex.EncodeToString(u.Bytes())}
 }
 
-func (db *gregorLocalDb) Load(u gregor.UID) (res []byte, e error) {
-	res, _, err := db.db.GetRaw(dbKey(u))
-	return res, err
+// Stored blobs carry a magic prefix and a sha256 checksum so we can tell
+// corruption from legacy (unchecksummed) data.
+var gregorDbMagic = []byte("GRGRDB1")
+
+var errCorruptDbBlob = errors.New("corrupt gregor local db blob: checksum mismatch")
+
+func sealDbBlob(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	out := make([]byte, 0, len(gregorDbMagic)+len(sum)+len(b))
+	out = append(out, gregorDbMagic...)
+	out = append(out, sum[:]...)
+	return append(out, b...)
 }
 
-func newGregorHandler(g *libkb.GlobalContext) (*gregorHandler, error) {
-	gh := &gregorHandler{
-		Contextified:    libkb.NewContextified(g),
-		freshReplay:     true,
-		pushStateFilter: func(m gregor.Message) bool { return true },
-		badger:          nil,
-		chatSync:        chat.NewSyncer(g),
-		chatHandler:     chat.NewPushHandler(g),
-		broadcastCh:     make(chan gregor1.Message, 10000),
+func openDbBlob(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, gregorDbMagic) {
+		// Legacy blob from before checksumming; take it as is
+		return b, nil
 	}
-
-	// Attempt to create a gregor client initially, if we are not logged in
-	// or don't have user/device info in G, then this won't work
-	if err := gh.resetGregorClient(); err != nil {
-		g.Log.Warning("unable to create push service client: %s", err)
+	rest := b[len(gregorDbMagic):]
+	if len(rest) < sha256.Size {
+		return nil, errCorruptDbBlob
 	}
-
-	// Start broadcast handler goroutine
-	go gh.broadcastMessageHandler()
-
-	return gh, nil
+	sum := sha256.Sum256(rest[sha256.Size:])
+	if !bytes.Equal(rest[:sha256.Size], sum[:]) {
+		return nil, errCorruptDbBlob
+	}
+	return rest[sha256.Size:], nil
 }
 
-func (g *gregorHandler) resetGregorClient() (err error) {
-	defer g.G().Trace("gregorHandler#newGregorClient", func() error { return err })()
-	of := gregor1.ObjFactory{}
-	sm := storage.NewMemEngine(of, clockwork.NewRealClock())
-
-	var guid gregor.UID
-	var gdid gregor.DeviceID
-	var b []byte
+// Encrypted blobs (v2) are a secretbox over the checksummed v1 payload,
+// keyed off the device encryption key the same way chat local storage is.
+var gregorDbMagicV2 = []byte("GRGRDB2")
 
-	uid := g.G().Env.GetUID()
-	if !uid.Exists() {
-		err = errors.New("no UID; probably not logged in")
-		return err
+func (db *gregorLocalDb) secretBoxKey() (fkey [32]byte, err error) {
+	encKey, err := engine.GetMySecretKey(db.g,
+		func() libkb.SecretUI { return chat.DelivererSecretUI{} },
+		libkb.DeviceEncryptionKeyType, "encrypt gregor local storage")
+	if err != nil {
+		return fkey, err
 	}
-	if b = uid.ToBytes(); b == nil {
-		err = errors.New("Can't convert UID to byte array")
-		return err
+	kp, ok := encKey.(libkb.NaclDHKeyPair)
+	if !ok || kp.Private == nil {
+		return fkey, libkb.KeyCannotDecryptError{}
 	}
-	if guid, err = of.MakeUID(b); err != nil {
-		return err
+	skey, err := encKey.SecretSymmetricKey(libkb.EncryptionReasonGregorLocalStorage)
+	if err != nil {
+		return fkey, err
 	}
+	copy(fkey[:], skey)
+	return fkey, nil
+}
 
-	did := g.G().Env.GetDeviceID()
-	if !did.Exists() {
-		err = errors.New("no device ID; probably not logged in")
-		return err
-	}
-	if b, err = hex.DecodeString(did.String()); err != nil {
-		return err
+func (db *gregorLocalDb) encryptDbBlob(b []byte) ([]byte, error) {
+	key, err := db.secretBoxKey()
+	if err != nil {
+		return nil, err
 	}
-	if gdid, err = of.MakeDeviceID(b); err != nil {
-		return err
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
 	}
+	out := make([]byte, 0, len(gregorDbMagicV2)+len(nonce)+len(b)+secretbox.Overhead)
+	out = append(out, gregorDbMagicV2...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, b, &nonce, &key), nil
+}
 
-	// Create client object
-	gcli := grclient.NewClient(guid, gdid, sm, newLocalDB(g.G()), g.G().Env.GetGregorSaveInterval(), g.G().Log)
-
-	// Bring up local state
-	g.Debug("restoring state from leveldb")
-	if err = gcli.Restore(); err != nil {
-		// If this fails, we'll keep trying since the server can bail us out
+func (db *gregorLocalDb) decryptDbBlob(b []byte) ([]byte, error) {
+	rest := b[len(gregorDbMagicV2):]
+	if len(rest) < 24 {
+		return nil, errCorruptDbBlob
+	}
+	key, err := db.secretBoxKey()
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], rest[:24])
+	res, ok := secretbox.Open(nil, rest[24:], &nonce, &key)
+	if !ok {
+		return nil, errCorruptDbBlob
+	}
+	return res, nil
+}
+
+func (db *gregorLocalDb) Store(u gregor.UID, b []byte) error {
+	enc, err := db.encryptDbBlob(sealDbBlob(b))
+	if err != nil {
+		// Device key unavailable (e.g. locked); store checksummed plaintext
+		// rather than dropping the state on the floor
+		db.g.Log.Debug("gregorLocalDb: storing unencrypted: %s", err)
+		return db.db.PutRaw(dbKey(u), sealDbBlob(b))
+	}
+	return db.db.PutRaw(dbKey(u), enc)
+}
+
+func (db *gregorLocalDb) Load(u gregor.UID) (res []byte, e error) {
+	raw, _, err := db.db.GetRaw(dbKey(u))
+	if err != nil {
+		return nil, err
+	}
+	payload := raw
+	if bytes.HasPrefix(raw, gregorDbMagicV2) {
+		if payload, err = db.decryptDbBlob(raw); err != nil && err != errCorruptDbBlob {
+			return nil, err
+		}
+	}
+	if err == nil {
+		// Legacy plaintext blobs (both checksummed and not) pass through here,
+		// so a pre-encryption DB migrates transparently on the next Store
+		res, err = openDbBlob(payload)
+	}
+	if err == errCorruptDbBlob {
+		// Quarantine the corrupt blob for post-mortem and clear the slot so
+		// the next save starts clean; replaying from the server rebuilds the
+		// state we lost
+		if qerr := db.db.PutRaw(quarantineKey(u), raw); qerr != nil {
+			return nil, qerr
+		}
+		if derr := db.db.Delete(dbKey(u)); derr != nil {
+			return nil, derr
+		}
+	}
+	return res, err
+}
+
+func seenMsgIDKey(u gregor.UID) libkb.DbKey {
+	return libkb.DbKey{Typ: libkb.DBGregor, Key: "seen:" + hex.EncodeToString(u.Bytes())}
+}
+
+func (db *gregorLocalDb) StoreSeenMsgIDs(u gregor.UID, b []byte) error {
+	return db.db.PutRaw(seenMsgIDKey(u), b)
+}
+
+func (db *gregorLocalDb) LoadSeenMsgIDs(u gregor.UID) (res []byte, e error) {
+	res, _, err := db.db.GetRaw(seenMsgIDKey(u))
+	return res, err
+}
+
+func unackedKey(u gregor.UID) libkb.DbKey {
+	return libkb.DbKey{Typ: libkb.DBGregor, Key: "unacked:" + hex.EncodeToString(u.Bytes())}
+}
+
+func (db *gregorLocalDb) StoreUnacked(u gregor.UID, b []byte) error {
+	return db.db.PutRaw(unackedKey(u), b)
+}
+
+func (db *gregorLocalDb) LoadUnacked(u gregor.UID) (res []byte, e error) {
+	res, _, err := db.db.GetRaw(unackedKey(u))
+	return res, err
+}
+
+func oobmQuarantineKey(u gregor.UID) libkb.DbKey {
+	return libkb.DbKey{Typ: libkb.DBGregor, Key: "oobmquar:" + hex.EncodeToString(u.Bytes())}
+}
+
+func (db *gregorLocalDb) StoreOOBMQuarantine(u gregor.UID, b []byte) error {
+	return db.db.PutRaw(oobmQuarantineKey(u), b)
+}
+
+func (db *gregorLocalDb) LoadOOBMQuarantine(u gregor.UID) (res []byte, e error) {
+	res, _, err := db.db.GetRaw(oobmQuarantineKey(u))
+	return res, err
+}
+
+func tlfHintKey(u gregor.UID) libkb.DbKey {
+	return libkb.DbKey{Typ: libkb.DBGregor, Key: "tlfhint:" + hex.EncodeToString(u.Bytes())}
+}
+
+func (db *gregorLocalDb) StoreTlfHints(u gregor.UID, b []byte) error {
+	return db.db.PutRaw(tlfHintKey(u), b)
+}
+
+func (db *gregorLocalDb) LoadTlfHints(u gregor.UID) (res []byte, e error) {
+	res, _, err := db.db.GetRaw(tlfHintKey(u))
+	return res, err
+}
+
+// Redelivery schedule for messages a handler nacked with
+// libkb.GregorRetryableError
+const gregorRedeliverInterval = 10 * time.Second
+const gregorRedeliverInitialBackoff = 10 * time.Second
+const gregorRedeliverMaxBackoff = 5 * time.Minute
+const gregorRedeliverMaxAge = time.Hour
+
+// unackedEntry is one nacked message awaiting redelivery to one handler.
+type unackedEntry struct {
+	handler     string
+	msg         gregor1.InBandMessage
+	firstTried  time.Time
+	nextAttempt time.Time
+	backoff     time.Duration
+}
+
+// storedUnacked is the persisted form of an unackedEntry; the schedule resets
+// on restart, which just means one early redelivery.
+type storedUnacked struct {
+	Handler    string                `json:"handler"`
+	Msg        gregor1.InBandMessage `json:"msg"`
+	FirstTried time.Time             `json:"firstTried"`
+}
+
+// redeliveryQueue holds messages handlers nacked, and schedules them for
+// redelivery with exponential backoff until acked or expired. It is persisted
+// per UID so a nacked message survives a service restart. All methods are
+// safe for concurrent use.
+type redeliveryQueue struct {
+	sync.Mutex
+	db      *gregorLocalDb
+	uid     gregor.UID
+	entries []*unackedEntry
+}
+
+func newRedeliveryQueue(db *gregorLocalDb, uid gregor.UID, now time.Time) *redeliveryQueue {
+	q := &redeliveryQueue{db: db, uid: uid}
+	if b, err := db.LoadUnacked(uid); err == nil && len(b) > 0 {
+		var stored []storedUnacked
+		if err := json.Unmarshal(b, &stored); err == nil {
+			for _, s := range stored {
+				q.entries = append(q.entries, &unackedEntry{
+					handler:     s.Handler,
+					msg:         s.Msg,
+					firstTried:  s.FirstTried,
+					nextAttempt: now,
+					backoff:     gregorRedeliverInitialBackoff,
+				})
+			}
+		}
+	}
+	return q
+}
+
+// persist writes the queue out; call with the lock held.
+func (q *redeliveryQueue) persist() {
+	stored := make([]storedUnacked, 0, len(q.entries))
+	for _, e := range q.entries {
+		stored = append(stored, storedUnacked{
+			Handler:    e.handler,
+			Msg:        e.msg,
+			FirstTried: e.firstTried,
+		})
+	}
+	if b, err := json.Marshal(stored); err == nil {
+		q.db.StoreUnacked(q.uid, b)
+	}
+}
+
+// nack records a message the named handler failed transiently on.
+func (q *redeliveryQueue) nack(handler string, msg gregor1.InBandMessage, now time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	for _, e := range q.entries {
+		if e.handler == handler && e.msg.Metadata().MsgID().String() == msg.Metadata().MsgID().String() {
+			// Already queued; leave its schedule alone
+			return
+		}
+	}
+	q.entries = append(q.entries, &unackedEntry{
+		handler:     handler,
+		msg:         msg,
+		firstTried:  now,
+		nextAttempt: now.Add(gregorRedeliverInitialBackoff),
+		backoff:     gregorRedeliverInitialBackoff,
+	})
+	q.persist()
+}
+
+// due returns the entries whose next attempt has come.
+func (q *redeliveryQueue) due(now time.Time) (res []*unackedEntry) {
+	q.Lock()
+	defer q.Unlock()
+	for _, e := range q.entries {
+		if !e.nextAttempt.After(now) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// ack drops an entry for good, whether it succeeded or expired.
+func (q *redeliveryQueue) ack(entry *unackedEntry) {
+	q.Lock()
+	defer q.Unlock()
+	for i, e := range q.entries {
+		if e == entry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	q.persist()
+}
+
+// reschedule backs an entry off after another failed attempt.
+func (q *redeliveryQueue) reschedule(entry *unackedEntry, now time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	entry.backoff *= 2
+	if entry.backoff > gregorRedeliverMaxBackoff {
+		entry.backoff = gregorRedeliverMaxBackoff
+	}
+	entry.nextAttempt = now.Add(entry.backoff)
+}
+
+const gregorOOBMQuarantineLimit = 50
+
+// oobmQuarantine parks out-of-band messages whose handlers choked on them,
+// raw bytes and all, instead of dropping them. Each entry is tagged with the
+// client version that failed; a later version gets one shot at redecoding.
+// Persisted per UID. All methods are safe for concurrent use.
+type oobmQuarantine struct {
+	sync.Mutex
+	db      *gregorLocalDb
+	uid     gregor.UID
+	entries []keybase1.QuarantinedOOBM
+}
+
+func newOOBMQuarantine(db *gregorLocalDb, uid gregor.UID) *oobmQuarantine {
+	q := &oobmQuarantine{db: db, uid: uid}
+	if b, err := db.LoadOOBMQuarantine(uid); err == nil && len(b) > 0 {
+		json.Unmarshal(b, &q.entries)
+	}
+	return q
+}
+
+// persist writes the quarantine out; call with the lock held.
+func (q *oobmQuarantine) persist() {
+	if b, err := json.Marshal(q.entries); err == nil {
+		q.db.StoreOOBMQuarantine(q.uid, b)
+	}
+}
+
+// add records a message a handler failed on, dropping the oldest entry if the
+// quarantine is full.
+func (q *oobmQuarantine) add(obm gregor.OutOfBandMessage, herr error, now time.Time) {
+	if obm.System() == nil || obm.Body() == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	body := obm.Body().Bytes()
+	for _, e := range q.entries {
+		if e.System == obm.System().String() && bytes.Equal(e.Body, body) {
+			// Same message requarantined (e.g. a server replay); keep the
+			// original entry
+			return
+		}
+	}
+	q.entries = append(q.entries, keybase1.QuarantinedOOBM{
+		System:  obm.System().String(),
+		Body:    body,
+		Ctime:   keybase1.ToTime(now),
+		Version: libkb.VersionString(),
+		Err:     herr.Error(),
+	})
+	if len(q.entries) > gregorOOBMQuarantineLimit {
+		q.entries = q.entries[len(q.entries)-gregorOOBMQuarantineLimit:]
+	}
+	q.persist()
+}
+
+func (q *oobmQuarantine) list() (res []keybase1.QuarantinedOOBM) {
+	q.Lock()
+	defer q.Unlock()
+	return append(res, q.entries...)
+}
+
+func (q *oobmQuarantine) purge() {
+	q.Lock()
+	defer q.Unlock()
+	q.entries = nil
+	q.persist()
+}
+
+// retryUpgraded redispatches entries quarantined by an older client version.
+// Successes leave the quarantine; failures are restamped with the current
+// version so they wait for the next upgrade.
+func (q *oobmQuarantine) retryUpgraded(ctx context.Context,
+	dispatch func(ctx context.Context, obm gregor.OutOfBandMessage) error) {
+	vers := libkb.VersionString()
+	q.Lock()
+	pending := append([]keybase1.QuarantinedOOBM{}, q.entries...)
+	q.Unlock()
+
+	var keep []keybase1.QuarantinedOOBM
+	changed := false
+	for _, e := range pending {
+		if e.Version == vers {
+			keep = append(keep, e)
+			continue
+		}
+		changed = true
+		obm := gregor1.OutOfBandMessage{
+			Uid_:    gregor1.UID(q.uid.Bytes()),
+			System_: gregor1.System(e.System),
+			Body_:   gregor1.Body(e.Body),
+		}
+		if err := dispatch(ctx, obm); err != nil {
+			e.Version = vers
+			e.Err = err.Error()
+			keep = append(keep, e)
+		}
+	}
+	if changed {
+		q.Lock()
+		q.entries = keep
+		q.persist()
+		q.Unlock()
+	}
+}
+
+// seenMsgIDTracker is a small LRU of recently processed broadcast MsgIDs,
+// persisted to the local DB. The state machine dedups on its own once it's
+// populated, but right after a restart (before restore completes) the same
+// broadcast can be processed twice; this cache covers that window.
+type seenMsgIDTracker struct {
+	sync.Mutex
+	db  *gregorLocalDb
+	uid gregor.UID
+	ids []string
+	set map[string]bool
+}
+
+func newSeenMsgIDTracker(db *gregorLocalDb, uid gregor.UID) *seenMsgIDTracker {
+	t := &seenMsgIDTracker{db: db, uid: uid, set: make(map[string]bool)}
+	if b, err := db.LoadSeenMsgIDs(uid); err == nil && len(b) > 0 {
+		var ids []string
+		if err := json.Unmarshal(b, &ids); err == nil {
+			t.ids = ids
+			for _, id := range ids {
+				t.set[id] = true
+			}
+		}
+	}
+	return t
+}
+
+func (t *seenMsgIDTracker) seen(id gregor.MsgID) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.set[id.String()]
+}
+
+func (t *seenMsgIDTracker) note(id gregor.MsgID) error {
+	t.Lock()
+	defer t.Unlock()
+
+	key := id.String()
+	if t.set[key] {
+		return nil
+	}
+	t.set[key] = true
+	t.ids = append(t.ids, key)
+	if len(t.ids) > gregorSeenMsgIDLimit {
+		for _, evicted := range t.ids[:len(t.ids)-gregorSeenMsgIDLimit] {
+			delete(t.set, evicted)
+		}
+		t.ids = t.ids[len(t.ids)-gregorSeenMsgIDLimit:]
+	}
+
+	b, err := json.Marshal(t.ids)
+	if err != nil {
+		return err
+	}
+	return t.db.StoreSeenMsgIDs(t.uid, b)
+}
+
+func newGregorHandler(g *libkb.GlobalContext) (*gregorHandler, error) {
+	gh := &gregorHandler{
+		Contextified:        libkb.NewContextified(g),
+		freshReplay:         true,
+		badger:              nil,
+		chatSync:            chat.NewSyncer(g),
+		chatHandler:         chat.NewPushHandler(g),
+		broadcastCh:         make(chan gregor1.Message, 10000),
+		localOpCh:           make(chan func(), 1000),
+		retryCh:             make(chan gregor1.Message, gregorRetryQueueSize),
+		rttTracker:          newPingRTTTracker(),
+		watermark:           newServerWatermark(),
+		clockSkew:           newClockSkewTracker(),
+		metrics:             newHandlerMetrics(),
+		audit:               &handlerAuditLog{},
+		sequencer:           &replaySequencer{},
+		sessions:            newGregorSessionRegistry(),
+		oobmReplay:          newOOBMReplayBuffer(oobmReplayLimit),
+		replayWatermarks:    make(map[string]time.Time),
+		ibmRegistrations:    make(map[string]ibmHandlerRegistration),
+		handlerPanics:       make(map[string]int),
+		quarantinedHandlers: make(map[string]bool),
+		injectedItems:       make(map[string]bool),
+		hooks:               newGregorHookRunner(g),
+		oobmThroughput:      newOOBMThroughput(),
+	}
+
+	// Route out-of-band messages by system prefix; each subsystem registers
+	// its own systems
+	gh.oobmRouter = newOOBMDispatcher()
+	gh.oobmRouter.register("kbfs.favorites", gh.kbfsFavorites)
+	gh.oobmRouter.register("kbfs.tlfUpdate", gh.kbfsTlfUpdate)
+	gh.oobmRouter.register("device.", gh.deviceUpdate)
+	gh.passthroughSystems = loadPassthroughSystems(g)
+	gh.oobmRouter.setDefault(gh.passthroughOOBM)
+	gh.chatHandler.RegisterOOBMHandlers(
+		func(system string, f func(ctx stdcontext.Context, obm gregor.OutOfBandMessage) error) {
+			gh.oobmRouter.register(system, func(ctx context.Context, obm gregor.OutOfBandMessage) error {
+				return f(ctx, obm)
+			})
+		},
+		func() *badges.Badger { return gh.badger })
+	gh.oobmRouter.register("internal.reconnect",
+		func(ctx context.Context, obm gregor.OutOfBandMessage) error {
+			if obm.Body() != nil {
+				var body reconnectOobmBody
+				if err := json.Unmarshal(obm.Body().Bytes(), &body); err == nil {
+					gh.G().Log.Debug("reconnected to push server: device %s seqno %d",
+						body.DeviceID, body.Seqno)
+					return nil
+				}
+			}
+			gh.G().Log.Debug("reconnected to push server")
+			return nil
+		})
+
+	// Attempt to create a gregor client initially, if we are not logged in
+	// or don't have user/device info in G, then this won't work
+	if err := gh.resetGregorClient(); err != nil {
+		g.Log.Warning("unable to create push service client: %s", err)
+	}
+
+	// Start broadcast handler goroutine
+	go gh.broadcastMessageHandler()
+
+	// Start resender for rate-limited messages
+	go gh.retryLoop()
+
+	// Start expiry sweeper for items with dtimes
+	go gh.itemSweepLoop()
+	go gh.gcLoop()
+
+	// Redeliver messages handlers nacked
+	go gh.redeliverLoop()
+
+	return gh, nil
+}
+
+func (g *gregorHandler) resetGregorClient() (err error) {
+	defer g.G().Trace("gregorHandler#newGregorClient", func() error { return err })()
+	of := gregor1.ObjFactory{}
+
+	var guid gregor.UID
+	var gdid gregor.DeviceID
+	var b []byte
+
+	uid := g.G().Env.GetUID()
+	if !uid.Exists() {
+		err = errors.New("no UID; probably not logged in")
+		return err
+	}
+	if b = uid.ToBytes(); b == nil {
+		err = errors.New("Can't convert UID to byte array")
+		return err
+	}
+	if guid, err = of.MakeUID(b); err != nil {
+		return err
+	}
+
+	did := g.G().Env.GetDeviceID()
+	if !did.Exists() {
+		err = errors.New("no device ID; probably not logged in")
+		return err
+	}
+	if b, err = hex.DecodeString(did.String()); err != nil {
+		return err
+	}
+	if gdid, err = of.MakeDeviceID(b); err != nil {
+		return err
+	}
+
+	// Stash the session we are leaving so switching back to that account
+	// picks its state machine and replay cursor up warm
+	if g.gregorCli != nil {
+		g.sessions.put(g.gregorCli.User, &gregorSession{
+			gcli:        g.gregorCli,
+			freshReplay: g.freshReplay,
+		})
+	}
+
+	// Bring up the persisted dedup cache for this user before we can receive
+	// any broadcasts
+	g.seenMsgIDs = newSeenMsgIDTracker(newLocalDB(g.G()), guid)
+
+	// Likewise any messages handlers nacked before the last shutdown
+	g.redelivery = newRedeliveryQueue(newLocalDB(g.G()), guid, g.G().Clock().Now())
+
+	// And any out-of-band messages quarantined as undecodable; if the client
+	// has been upgraded since, give them another chance to decode
+	g.oobmQuarantine = newOOBMQuarantine(newLocalDB(g.G()), guid)
+	g.oobmQuarantine.retryUpgraded(context.Background(), g.oobmRouter.dispatch)
+
+	// If we have seen this UID before, resume its session rather than
+	// rebuilding from local storage
+	if sess := g.sessions.get(guid); sess != nil {
+		g.Debug("resuming warm gregor session for %s", guid)
+		g.gregorCli = sess.gcli
+		g.freshReplay = sess.freshReplay
+		return nil
+	}
+
+	// Create client object, backed by storage that writes each consumed
+	// message through to leveldb rather than trusting the periodic save
+	db := newLocalDB(g.G())
+	sm := storage.NewDurableEngine(of, clockwork.NewRealClock(), db, guid, gdid)
+	gcli := grclient.NewClient(guid, gdid, sm, db, g.G().Env.GetGregorSaveInterval(), g.G().Log)
+
+	// Bring up local state
+	g.Debug("restoring state from leveldb")
+	if err = gcli.Restore(); err != nil {
+		// If this fails, we'll keep trying since the server can bail us out
 		g.Debug("restore local state failed: %s", err)
+		if err == errCorruptDbBlob {
+			// The blob was quarantined; the fresh replay below resyncs us
+			g.Warning("local gregor state was corrupt; forcing a full resync")
+			g.stats.incr(&g.stats.restoreFailures)
+		}
 	}
 
 	g.gregorCli = gcli
+	g.freshReplay = true
+	g.sessions.put(guid, &gregorSession{gcli: gcli, freshReplay: true})
 	return nil
 }
 
@@ -257,8 +1462,72 @@ func (g *gregorHandler) Errorf(s string, args ...interface{}) {
 	g.G().Log.Errorf("PushHandler: "+s, args...)
 }
 
+type pushStateFilterEntry struct {
+	name    string
+	enabled bool
+	f       func(m gregor.Message) bool
+}
+
+// RegisterPushStateFilter adds a named predicate to the push state filter
+// chain, replacing any existing filter with the same name. A message only
+// triggers a pushState to firehose handlers if every enabled filter says yes.
+func (g *gregorHandler) RegisterPushStateFilter(name string, f func(m gregor.Message) bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, e := range g.pushStateFilters {
+		if e.name == name {
+			e.f = f
+			e.enabled = true
+			return
+		}
+	}
+	g.pushStateFilters = append(g.pushStateFilters, &pushStateFilterEntry{
+		name:    name,
+		enabled: true,
+		f:       f,
+	})
+}
+
+// SetPushStateFilter registers f as the "default" push state filter. It
+// predates RegisterPushStateFilter and is kept for callers that only care
+// about a single global filter.
 func (g *gregorHandler) SetPushStateFilter(f func(m gregor.Message) bool) {
-	g.pushStateFilter = f
+	g.RegisterPushStateFilter("default", f)
+}
+
+// pushStateFilterAllows evaluates the filter chain for m. The gregorHandler
+// lock must be held.
+func (g *gregorHandler) pushStateFilterAllows(m gregor.Message) bool {
+	for _, e := range g.pushStateFilters {
+		if e.enabled && !e.f(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *gregorHandler) listPushStateFilters() (res []keybase1.PushStateFilter) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, e := range g.pushStateFilters {
+		res = append(res, keybase1.PushStateFilter{Name: e.name, Enabled: e.enabled})
+	}
+	return res
+}
+
+func (g *gregorHandler) togglePushStateFilter(name string, enabled bool) error {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, e := range g.pushStateFilters {
+		if e.name == name {
+			e.enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("no push state filter named %q", name)
 }
 
 func (g *gregorHandler) Connect(uri *rpc.FMPURI) (err error) {
@@ -282,90 +1551,594 @@ func (g *gregorHandler) Connect(uri *rpc.FMPURI) (err error) {
 		err = g.connectNoTLS()
 	}
 
-	return err
+	return err
+}
+
+func (g *gregorHandler) HandlerName() string {
+	return "keybase service"
+}
+
+// PushHandler adds a new ibm handler to our list. This is usually triggered
+// when an external entity (like Electron) connects to the service, and we can
+// safely send Gregor information to it
+// ibmHandlerRegistration records how a handler asked to be dispatched:
+// higher priority runs first, and a handler that declared category prefixes
+// only sees creations in those categories.
+type ibmHandlerRegistration struct {
+	priority   int
+	categories []string
+}
+
+// RegisterHandler attaches handler like PushHandler does, additionally
+// declaring the category prefixes it owns and its dispatch precedence.
+func (g *gregorHandler) RegisterHandler(handler libkb.GregorInBandMessageHandler, priority int,
+	categories []string) {
+	g.Lock()
+	g.ibmRegistrations[handler.Name()] = ibmHandlerRegistration{
+		priority:   priority,
+		categories: categories,
+	}
+	g.Unlock()
+	g.PushHandler(handler)
+}
+
+func (g *gregorHandler) PushHandler(handler libkb.GregorInBandMessageHandler) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.G().Log.Debug("pushing inband handler %s to position %d", handler.Name(), len(g.ibmHandlers))
+
+	// A re-registering handler gets a clean slate
+	g.panicLock.Lock()
+	delete(g.handlerPanics, handler.Name())
+	delete(g.quarantinedHandlers, handler.Name())
+	g.panicLock.Unlock()
+
+	g.ibmHandlers = append(g.ibmHandlers, handler)
+
+	// Replay for the new handler if we have any state to replay from. We
+	// don't need a server connection for this: in standalone or offline mode
+	// the restored local state machine serves the replay, just possibly stale.
+	if g.IsConnected() || g.gregorCli != nil {
+		// A handler we have seen before picks up from its replay watermark,
+		// unless it explicitly wants the whole state again
+		var since time.Time
+		if f, ok := handler.(libkb.GregorForceFullReplayer); ok && f.ForceFullReplay() {
+			g.Debug("handler %s forced a full replay", handler.Name())
+		} else {
+			since = g.replayWatermarks[handler.Name()]
+		}
+		if _, err := g.replayInBandMessages(context.TODO(), gregor1.IncomingClient{Cli: g.cli},
+			since, handler); err != nil {
+			g.Errorf("replayInBandMessages on PushHandler failed: %s", err)
+		} else {
+			g.markHandlerReplayed(handler.Name())
+		}
+
+		// Offer any dead letters in the new handler's categories
+		g.replayDeadLetters(handler)
+
+		if g.badger != nil {
+			s, err := g.getState()
+			if err != nil {
+				g.Warning("Cannot get state in PushHandler: %s", err)
+				return
+			}
+			g.badger.PushState(s)
+		}
+	}
+}
+
+// categoryCallbackHandler adapts a pair of plain callbacks into a full
+// in-band handler, so internal subsystems can hook a category without
+// writing a handler type of their own. It lives until the process does.
+type categoryCallbackHandler struct {
+	prefix  string
+	create  func(ctx context.Context, item gregor.Item) error
+	dismiss func(ctx context.Context, item gregor.Item) error
+}
+
+var _ libkb.GregorInBandMessageHandler = (*categoryCallbackHandler)(nil)
+
+func (h *categoryCallbackHandler) IsAlive() bool {
+	return true
+}
+
+func (h *categoryCallbackHandler) Name() string {
+	return "categoryCallbackHandler:" + h.prefix
+}
+
+func (h *categoryCallbackHandler) Create(ctx context.Context, cli gregor1.IncomingInterface,
+	category string, item gregor.Item) (bool, error) {
+	if !strings.HasPrefix(category, h.prefix) {
+		return false, nil
+	}
+	if h.create == nil {
+		return false, nil
+	}
+	return true, h.create(ctx, item)
+}
+
+func (h *categoryCallbackHandler) Dismiss(ctx context.Context, cli gregor1.IncomingInterface,
+	category string, item gregor.Item) (bool, error) {
+	if !strings.HasPrefix(category, h.prefix) {
+		return false, nil
+	}
+	if h.dismiss == nil {
+		return false, nil
+	}
+	return true, h.dismiss(ctx, item)
+}
+
+// HandleCategory registers create and dismiss callbacks for items in the
+// given category prefix. Either callback may be nil. This is the cheap way
+// for Go code inside the service to react to server-driven state without
+// implementing libkb.GregorInBandMessageHandler itself.
+func (g *gregorHandler) HandleCategory(prefix string,
+	create, dismiss func(ctx context.Context, item gregor.Item) error) {
+	g.RegisterHandler(&categoryCallbackHandler{
+		prefix:  prefix,
+		create:  create,
+		dismiss: dismiss,
+	}, 0, []string{prefix})
+}
+
+// connectionBoundHandler is implemented by handlers tied to an RPC
+// connection, so they can be dropped as soon as that connection dies.
+type connectionBoundHandler interface {
+	HandlerConnectionID() libkb.ConnectionID
+}
+
+// RemoveHandler immediately drops the in-band handlers bound to the given
+// connection instead of waiting for IsAlive to notice it died, and cleans up
+// their bookkeeping.
+func (g *gregorHandler) RemoveHandler(id libkb.ConnectionID) {
+	g.Lock()
+	defer g.Unlock()
+	var kept []libkb.GregorInBandMessageHandler
+	for _, handler := range g.ibmHandlers {
+		if cb, ok := handler.(connectionBoundHandler); ok && cb.HandlerConnectionID() == id {
+			g.Debug("removing handler %s for dead connection %d", handler.Name(), id)
+			g.forgetHandler(handler.Name())
+			continue
+		}
+		kept = append(kept, handler)
+	}
+	g.ibmHandlers = kept
+}
+
+// RemoveFirehoseHandler is RemoveHandler for firehose handlers.
+func (g *gregorHandler) RemoveFirehoseHandler(id libkb.ConnectionID) {
+	g.Lock()
+	defer g.Unlock()
+	var kept []firehoseRegistration
+	for _, reg := range g.firehoseHandlers {
+		if cb, ok := reg.handler.(connectionBoundHandler); ok && cb.HandlerConnectionID() == id {
+			g.Debug("removing firehose handler for dead connection %d", id)
+			continue
+		}
+		kept = append(kept, reg)
+	}
+	g.firehoseHandlers = kept
+}
+
+// forgetHandler clears the bookkeeping of a handler that's gone for good.
+// gregorHandler needs to be locked when calling this function.
+func (g *gregorHandler) forgetHandler(name string) {
+	delete(g.replayWatermarks, name)
+	delete(g.ibmRegistrations, name)
+	g.panicLock.Lock()
+	delete(g.handlerPanics, name)
+	delete(g.quarantinedHandlers, name)
+	g.panicLock.Unlock()
+}
+
+// firehoseRegistration pairs a firehose handler with its subscription; a nil
+// subscription means the full firehose.
+type firehoseRegistration struct {
+	handler libkb.GregorFirehoseHandler
+	sub     *libkb.GregorFirehoseSubscription
+}
+
+// filterStateForSubscription returns a copy of s containing only the items
+// whose category matches one of the subscription's prefixes.
+func filterStateForSubscription(s gregor1.State, sub *libkb.GregorFirehoseSubscription) gregor1.State {
+	if sub == nil || len(sub.CategoryPrefixes) == 0 {
+		return s
+	}
+	var res gregor1.State
+	for _, it := range s.Items_ {
+		if it.Item_ == nil {
+			continue
+		}
+		cat := it.Item_.Category_.String()
+		for _, p := range sub.CategoryPrefixes {
+			if strings.HasPrefix(cat, p) {
+				res.Items_ = append(res.Items_, it)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// filterOOBMsForSubscription returns the messages belonging to one of the
+// subscription's systems.
+func filterOOBMsForSubscription(msgs []gregor1.OutOfBandMessage,
+	sub *libkb.GregorFirehoseSubscription) []gregor1.OutOfBandMessage {
+	if sub == nil || len(sub.OOBMSystems) == 0 {
+		return msgs
+	}
+	var res []gregor1.OutOfBandMessage
+	for _, m := range msgs {
+		sys := m.System_.String()
+		for _, s := range sub.OOBMSystems {
+			if sys == s {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// PushFirehoseHandler pushes a new firehose handler onto the list of currently
+// active firehose handles. We can have several of these active at once. All
+// get the "firehose" of gregor events. They're removed lazily as their underlying
+// connections die.
+func (g *gregorHandler) PushFirehoseHandler(handler libkb.GregorFirehoseHandler) {
+	g.pushFirehoseHandler(handler, nil)
+}
+
+// PushFirehoseHandlerWithSubscription is PushFirehoseHandler for handlers
+// that only care about part of the state: pushes are filtered to the
+// subscription's category prefixes and OOBM systems, saving serialization
+// for narrow consumers.
+func (g *gregorHandler) PushFirehoseHandlerWithSubscription(handler libkb.GregorFirehoseHandler,
+	sub libkb.GregorFirehoseSubscription) {
+	g.pushFirehoseHandler(handler, &sub)
+}
+
+func (g *gregorHandler) pushFirehoseHandler(handler libkb.GregorFirehoseHandler,
+	sub *libkb.GregorFirehoseSubscription) {
+	g.Lock()
+	defer g.Unlock()
+	g.firehoseHandlers = append(g.firehoseHandlers, firehoseRegistration{handler: handler, sub: sub})
+
+	s, err := g.getState()
+	if err != nil {
+		g.Warning("Cannot push state in firehose handler: %s", err)
+		return
+	}
+	handler.PushState(filterStateForSubscription(s, sub), keybase1.PushReason_RECONNECTED)
+
+	// Catch the new handler up on out-of-band messages it missed, if it
+	// wants them
+	if r, ok := handler.(libkb.GregorOOBMReplayer); ok && r.ReplayOutOfBandMessages() {
+		if msgs := filterOOBMsForSubscription(g.oobmReplay.recent(), sub); len(msgs) > 0 {
+			g.Debug("replaying %d out-of-band messages to new firehose handler", len(msgs))
+			handler.PushOutOfBandMessages(msgs)
+		}
+	}
+}
+
+// iterateOverFirehoseHandlers applies the function f to all live fireshose handlers
+// and then resets the list to only include the live ones.
+func (g *gregorHandler) iterateOverFirehoseHandlers(f func(h libkb.GregorFirehoseHandler, sub *libkb.GregorFirehoseSubscription)) {
+	var freshHandlers []firehoseRegistration
+	for _, reg := range g.firehoseHandlers {
+		if reg.handler.IsAlive() {
+			f(reg.handler, reg.sub)
+			freshHandlers = append(freshHandlers, reg)
+		}
+	}
+	g.firehoseHandlers = freshHandlers
+	return
+}
+
+// How long we wait to coalesce back-to-back state pushes into a single one
+const gregorPushCoalesceWindow = 250 * time.Millisecond
+
+// pushState sends the current state to the firehose handlers. Routine
+// NEW_DATA pushes are coalesced: a burst of broadcasts inside the window
+// produces one push of the latest state instead of one per message. Other
+// reasons (reconnects and the like) bypass the window and push right away.
+// gregorHandler must be locked when calling this function.
+func (g *gregorHandler) pushState(r keybase1.PushReason) {
+	if r == keybase1.PushReason_NEW_DATA {
+		g.pushCoalesceDirty = true
+		if g.pushCoalescePending {
+			return
+		}
+		g.pushCoalescePending = true
+		go func() {
+			<-g.G().Clock().After(gregorPushCoalesceWindow)
+			g.Lock()
+			defer g.Unlock()
+			g.pushCoalescePending = false
+			if g.pushCoalesceDirty {
+				g.pushStateNow(keybase1.PushReason_NEW_DATA)
+			}
+		}()
+		return
+	}
+	// A full push covers whatever a pending coalesced push would have sent
+	g.pushStateNow(r)
+}
+
+// pushStateNow pushes the current state to the firehose handlers without any
+// coalescing. gregorHandler must be locked when calling this function.
+func (g *gregorHandler) pushStateNow(r keybase1.PushReason) {
+	g.pushCoalesceDirty = false
+	s, err := g.getState()
+	if err != nil {
+		g.Warning("Cannot push state in firehose handler: %s", err)
+		return
+	}
+
+	// Handlers that understand deltas get just what changed since the last
+	// push, which is O(delta) instead of O(state) per message. Everyone else,
+	// reconnects, and deltas that fail to apply get the full state.
+	var delta keybase1.GregorStateDelta
+	haveDelta := false
+	newHash, err := s.Hash()
+	if err != nil {
+		g.Debug("pushState: unable to hash state: %s", err)
+	} else if r == keybase1.PushReason_NEW_DATA && g.lastPushedState != nil {
+		delta = computeStateDelta(*g.lastPushedState, g.lastPushedHash, s, newHash)
+		haveDelta = true
+	}
+
+	g.iterateOverFirehoseHandlers(func(h libkb.GregorFirehoseHandler, sub *libkb.GregorFirehoseSubscription) {
+		if sub != nil {
+			// Subscribed handlers always get a (filtered) full state; deltas
+			// are computed against the unfiltered state and don't apply
+			h.PushState(filterStateForSubscription(s, sub), r)
+			return
+		}
+		if haveDelta {
+			if dh, ok := h.(libkb.GregorStateDeltaHandler); ok && dh.PushStateDelta(delta, r) {
+				return
+			}
+		}
+		h.PushState(s, r)
+	})
+
+	if newHash != nil {
+		g.lastPushedState = &s
+		g.lastPushedHash = newHash
+	}
+
+	// Keep the expiry sweeper's baseline in step with what handlers have seen
+	g.noteVisibleItems(s)
+
+	if g.badger != nil {
+		g.badger.PushState(s)
+	}
+}
+
+// computeStateDelta diffs two exported states into the new items and
+// dismissed IDs that take oldState to newState.
+func computeStateDelta(oldState gregor1.State, oldHash []byte, newState gregor1.State,
+	newHash []byte) keybase1.GregorStateDelta {
+	oldSet := visibleItemSet(oldState)
+	newSet := visibleItemSet(newState)
+	delta := keybase1.GregorStateDelta{
+		BaseHash: oldHash,
+		NewHash:  newHash,
+	}
+	for _, it := range newState.Items_ {
+		if it.Md_ != nil && !oldSet[it.Md_.MsgID_.String()] {
+			delta.NewItems = append(delta.NewItems, it)
+		}
+	}
+	for _, it := range oldState.Items_ {
+		if it.Md_ != nil && !newSet[it.Md_.MsgID_.String()] {
+			delta.DismissedIDs = append(delta.DismissedIDs, it.Md_.MsgID_)
+		}
+	}
+	return delta
+}
+
+func visibleItemSet(s gregor1.State) map[string]bool {
+	visible := make(map[string]bool)
+	for _, it := range s.Items_ {
+		if it.Md_ != nil {
+			visible[it.Md_.MsgID_.String()] = true
+		}
+	}
+	return visible
 }
 
-func (g *gregorHandler) HandlerName() string {
-	return "keybase service"
+func (g *gregorHandler) noteVisibleItems(s gregor1.State) {
+	g.sweepItems = visibleItemSet(s)
 }
 
-// PushHandler adds a new ibm handler to our list. This is usually triggered
-// when an external entity (like Electron) connects to the service, and we can
-// safely send Gregor information to it
-func (g *gregorHandler) PushHandler(handler libkb.GregorInBandMessageHandler) {
+// itemSweepLoop periodically re-evaluates item dtimes against the clock. The
+// state machine already excludes expired items from State(), but if the
+// server's expunge message never arrives (we might be offline), nothing
+// pushes that change out to firehose handlers. Notice the visible item set
+// shrinking and push the updated state when it does.
+func (g *gregorHandler) itemSweepLoop() {
+	for {
+		<-g.G().Clock().After(gregorItemSweepInterval)
+		g.sweepExpiredItems()
+	}
+}
+
+func (g *gregorHandler) sweepExpiredItems() {
 	g.Lock()
 	defer g.Unlock()
 
-	g.G().Log.Debug("pushing inband handler %s to position %d", handler.Name(), len(g.ibmHandlers))
-
-	g.ibmHandlers = append(g.ibmHandlers, handler)
-
-	// Only try replaying if we are logged in, it's possible that a handler can
-	// attach before that is true (like if we start the service logged out and
-	// Electron connects)
-	if g.IsConnected() {
-		if _, err := g.replayInBandMessages(context.TODO(), gregor1.IncomingClient{Cli: g.cli},
-			time.Time{}, handler); err != nil {
-			g.Errorf("replayInBandMessages on PushHandler failed: %s", err)
+	if g.sweepItems == nil {
+		// We haven't pushed a state yet, so no one is holding anything stale
+		return
+	}
+	s, err := g.getState()
+	if err != nil {
+		return
+	}
+	visible := visibleItemSet(s)
+	var expired int
+	for id := range g.sweepItems {
+		if !visible[id] {
+			expired++
 		}
+	}
+	if expired > 0 {
+		g.Debug("sweep: %d items expired locally, pushing state", expired)
+		g.pushState(keybase1.PushReason_NEW_DATA)
+	}
+}
 
-		if g.badger != nil {
-			s, err := g.getState()
-			if err != nil {
-				g.Warning("Cannot get state in PushHandler: %s", err)
-				return
-			}
-			g.badger.PushState(s)
+// gcLoop periodically compacts long-dismissed items out of the state machine
+// and its persisted blob, which otherwise grow without bound on long-lived
+// installs.
+func (g *gregorHandler) gcLoop() {
+	for {
+		<-g.G().Clock().After(gregorGCInterval)
+		if n, err := g.compactLocalState(gregorGCDismissedAge); err != nil {
+			g.Debug("gc: compact failed: %s", err)
+		} else if n > 0 {
+			g.Debug("gc: compacted %d dismissed items", n)
 		}
 	}
 }
 
-// PushFirehoseHandler pushes a new firehose handler onto the list of currently
-// active firehose handles. We can have several of these active at once. All
-// get the "firehose" of gregor events. They're removed lazily as their underlying
-// connections die.
-func (g *gregorHandler) PushFirehoseHandler(handler libkb.GregorFirehoseHandler) {
+// redeliverLoop periodically retries messages handlers nacked.
+func (g *gregorHandler) redeliverLoop() {
+	for {
+		<-g.G().Clock().After(gregorRedeliverInterval)
+		g.redeliverNacked()
+	}
+}
+
+// redeliverNacked runs every due nacked message against its handler again,
+// backing off on another nack and dropping entries once they expire.
+func (g *gregorHandler) redeliverNacked() {
 	g.Lock()
 	defer g.Unlock()
-	g.firehoseHandlers = append(g.firehoseHandlers, handler)
-
-	s, err := g.getState()
-	if err != nil {
-		g.Warning("Cannot push state in firehose handler: %s", err)
+	if g.redelivery == nil {
 		return
 	}
-	handler.PushState(s, keybase1.PushReason_RECONNECTED)
+	now := g.G().Clock().Now()
+	for _, e := range g.redelivery.due(now) {
+		if now.Sub(e.firstTried) > gregorRedeliverMaxAge {
+			g.Debug("redeliver: dropping expired message %s for handler %s",
+				e.msg.Metadata().MsgID(), e.handler)
+			g.redelivery.ack(e)
+			continue
+		}
+		handler := g.findHandler(e.handler)
+		if handler == nil {
+			// The handler is gone for good; there's no one to redeliver to
+			g.Debug("redeliver: handler %s no longer attached, dropping message %s",
+				e.handler, e.msg.Metadata().MsgID())
+			g.redelivery.ack(e)
+			continue
+		}
+		_, err := g.handleInBandMessageWithHandler(context.Background(),
+			gregor1.IncomingClient{Cli: g.cli}, e.msg, handler)
+		if _, retry := err.(libkb.GregorRetryableError); retry {
+			g.Debug("redeliver: handler %s nacked %s again, backing off",
+				e.handler, e.msg.Metadata().MsgID())
+			g.redelivery.reschedule(e, now)
+			continue
+		}
+		if err != nil {
+			g.Errorf("redeliver: handler %s failed hard on %s: %s",
+				e.handler, e.msg.Metadata().MsgID(), err)
+		}
+		g.redelivery.ack(e)
+	}
 }
 
-// iterateOverFirehoseHandlers applies the function f to all live fireshose handlers
-// and then resets the list to only include the live ones.
-func (g *gregorHandler) iterateOverFirehoseHandlers(f func(h libkb.GregorFirehoseHandler)) {
-	var freshHandlers []libkb.GregorFirehoseHandler
-	for _, h := range g.firehoseHandlers {
-		if h.IsAlive() {
-			f(h)
-			freshHandlers = append(freshHandlers, h)
+// findHandler returns the live attached handler with the given name, or nil.
+// gregorHandler needs to be locked when calling this function.
+func (g *gregorHandler) findHandler(name string) libkb.GregorInBandMessageHandler {
+	for _, h := range g.ibmHandlers {
+		if h.Name() == name && h.IsAlive() {
+			return h
 		}
 	}
-	g.firehoseHandlers = freshHandlers
-	return
+	return nil
 }
 
-func (g *gregorHandler) pushState(r keybase1.PushReason) {
-	s, err := g.getState()
+// compactLocalState drops items dismissed more than maxAge ago from the state
+// machine and saves the result, returning how many items were removed.
+func (g *gregorHandler) compactLocalState(maxAge time.Duration) (int, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	gcli, err := g.getGregorCli()
 	if err != nil {
-		g.Warning("Cannot push state in firehose handler: %s", err)
+		return 0, err
+	}
+	compacter, ok := gcli.Sm.(gregor.StateCompacter)
+	if !ok {
+		return 0, nil
+	}
+	n, err := compacter.Compact(gcli.User, g.G().Clock().Now().Add(-maxAge))
+	if err != nil || n == 0 {
+		return n, err
+	}
+	// For engines that don't persist on their own
+	if err := gcli.Save(); err != nil {
+		g.Debug("compactLocalState: unable to save: %s", err)
+	}
+	return n, nil
+}
+
+// pushOutOfBandMessages forwards OOBMs to the firehose handlers. Bursts are
+// accumulated and flushed as one batch per coalescing window; messages from
+// internal systems skip the window since handlers act on them promptly (e.g.
+// the reconnect marker). gregorHandler must be locked when calling this
+// function.
+func (g *gregorHandler) pushOutOfBandMessages(m []gregor1.OutOfBandMessage) {
+	g.oobmReplay.add(m)
+
+	urgent := false
+	for _, msg := range m {
+		if strings.HasPrefix(msg.System_.String(), "internal.") {
+			urgent = true
+			break
+		}
+	}
+	if urgent {
+		// Flush anything batched first so ordering holds
+		batch := append(g.pendingOOBMs, m...)
+		g.pendingOOBMs = nil
+		g.pushOutOfBandMessagesNow(batch)
 		return
 	}
-	g.iterateOverFirehoseHandlers(func(h libkb.GregorFirehoseHandler) { h.PushState(s, r) })
 
-	if g.badger != nil {
-		g.badger.PushState(s)
+	g.pendingOOBMs = append(g.pendingOOBMs, m...)
+	if g.oobmCoalescePending {
+		return
 	}
+	g.oobmCoalescePending = true
+	go func() {
+		<-g.G().Clock().After(gregorPushCoalesceWindow)
+		g.Lock()
+		defer g.Unlock()
+		g.oobmCoalescePending = false
+		batch := g.pendingOOBMs
+		g.pendingOOBMs = nil
+		if len(batch) > 0 {
+			g.pushOutOfBandMessagesNow(batch)
+		}
+	}()
 }
 
-func (g *gregorHandler) pushOutOfBandMessages(m []gregor1.OutOfBandMessage) {
-	g.iterateOverFirehoseHandlers(func(h libkb.GregorFirehoseHandler) { h.PushOutOfBandMessages(m) })
+// pushOutOfBandMessagesNow sends a batch of OOBMs to the firehose handlers
+// without coalescing. gregorHandler must be locked when calling this
+// function.
+func (g *gregorHandler) pushOutOfBandMessagesNow(m []gregor1.OutOfBandMessage) {
+	g.iterateOverFirehoseHandlers(func(h libkb.GregorFirehoseHandler, sub *libkb.GregorFirehoseSubscription) {
+		if msgs := filterOOBMsForSubscription(m, sub); len(msgs) > 0 {
+			h.PushOutOfBandMessages(msgs)
+		}
+	})
 }
 
 // replayInBandMessages will replay all the messages in the current state from
@@ -378,6 +2151,7 @@ func (g *gregorHandler) replayInBandMessages(ctx context.Context, cli gregor1.In
 	var msgs []gregor.InBandMessage
 	var err error
 
+	g.stats.incr(&g.stats.replays)
 	gcli, err := g.getGregorCli()
 	if err != nil {
 		return nil, err
@@ -402,8 +2176,28 @@ func (g *gregorHandler) replayInBandMessages(ctx context.Context, cli gregor1.In
 		}
 	}
 
-	g.Debug("replaying %d messages", len(msgs))
-	for _, msg := range msgs {
+	budget := g.G().Env.GetGregorReplayBudget()
+	start := g.G().Clock().Now()
+
+	g.Debug("replaying %d messages (budget: %v)", len(msgs), budget)
+	for i, msg := range msgs {
+		// Check for cancellation and our time budget periodically; whatever
+		// we don't get through is picked up on the next reconnect.
+		select {
+		case <-ctx.Done():
+			g.Debug("replay canceled after %d messages: %s", i, ctx.Err())
+			return msgs[:i], ctx.Err()
+		default:
+		}
+		if budget > 0 && g.G().Clock().Now().Sub(start) > budget {
+			g.Debug("replay budget exhausted after %d messages, resuming on next reconnect", i)
+			return msgs[:i], nil
+		}
+		// Yield between chunks so a huge replay doesn't starve everyone else
+		if i > 0 && i%replayChunkSize == 0 {
+			runtime.Gosched()
+		}
+
 		// If we have a handler, just run it on that, otherwise run it against
 		// all of the handlers we know about
 		if handler == nil {
@@ -423,6 +2217,57 @@ func (g *gregorHandler) replayInBandMessages(ctx context.Context, cli gregor1.In
 	return msgs, nil
 }
 
+// noteInjectedItem records a locally created item for reconciliation when
+// the server echoes it back in a sync.
+func (g *gregorHandler) noteInjectedItem(id gregor.MsgID) {
+	g.Lock()
+	defer g.Unlock()
+	g.injectedItems[id.String()] = true
+}
+
+// reconcileInjectedItems merges server-authoritative metadata into items we
+// created locally once the server echoes them back. The state machine keeps
+// the first copy of an item it sees, so without this the locally stamped
+// ctime (and any server-set dtime) would never be corrected. gregorHandler
+// needs to be locked when calling this function.
+func (g *gregorHandler) reconcileInjectedItems(msgs []gregor.InBandMessage) {
+	if len(g.injectedItems) == 0 {
+		return
+	}
+	gcli, err := g.getGregorCli()
+	if err != nil {
+		return
+	}
+	merger, canMerge := gcli.Sm.(gregor.MetadataMerger)
+	for _, msg := range msgs {
+		update := msg.ToStateUpdateMessage()
+		if update == nil {
+			continue
+		}
+		item := update.Creation()
+		if item == nil {
+			continue
+		}
+		id := item.Metadata().MsgID().String()
+		if !g.injectedItems[id] {
+			continue
+		}
+		delete(g.injectedItems, id)
+		if !canMerge {
+			g.Debug("reconcile: state machine can't merge metadata for %s", id)
+			continue
+		}
+		changed, err := merger.MergeMetadata(gcli.User, item)
+		if err != nil {
+			g.Debug("reconcile: error merging metadata for %s: %s", id, err)
+			continue
+		}
+		if changed {
+			g.Debug("reconcile: server metadata differed for locally injected item %s, merged", id)
+		}
+	}
+}
+
 func (g *gregorHandler) IsConnected() bool {
 	return g.conn != nil && g.conn.IsConnected()
 }
@@ -441,8 +2286,7 @@ func (g *gregorHandler) serverSync(ctx context.Context,
 	// Get time of the last message we synced (unless this is our first time syncing)
 	var t time.Time
 	if !g.freshReplay {
-		pt := gcli.StateMachineLatestCTime()
-		if pt != nil {
+		if pt := g.replayStartTime(gcli); pt != nil {
 			t = *pt
 		}
 		g.Debug("starting replay from: %s", t)
@@ -457,6 +2301,15 @@ func (g *gregorHandler) serverSync(ctx context.Context,
 		return nil, nil, err
 	}
 
+	// Everything the sync handed us is server-stamped, so it can advance the
+	// replay cursor
+	for _, m := range consumedMsgs {
+		g.watermark.advance(m.Metadata().MsgID(), m.Metadata().CTime())
+	}
+
+	// Merge server-authoritative metadata into items we created locally
+	g.reconcileInjectedItems(consumedMsgs)
+
 	// Replay in-band messages
 	replayedMsgs, err := g.replayInBandMessages(ctx, cli, t, nil)
 	if err != nil {
@@ -472,12 +2325,101 @@ func (g *gregorHandler) serverSync(ctx context.Context,
 	return replayedMsgs, consumedMsgs, nil
 }
 
+// replaySequencer buffers live broadcasts that arrive while a reconnect
+// replay is in flight, releasing them in CTime/MsgID order once the replay
+// finishes. Handlers then never see a live message jump ahead of an older
+// replayed one. All methods are safe for concurrent use.
+type replaySequencer struct {
+	sync.Mutex
+	buffering bool
+	buffer    []gregor1.Message
+}
+
+// hold captures the message for later if we are buffering, and returns
+// whether it did; false means the caller should process the message now.
+func (r *replaySequencer) hold(m gregor1.Message) bool {
+	r.Lock()
+	defer r.Unlock()
+	if !r.buffering {
+		return false
+	}
+	r.buffer = append(r.buffer, m)
+	return true
+}
+
+func (r *replaySequencer) start() {
+	r.Lock()
+	defer r.Unlock()
+	r.buffering = true
+	r.buffer = nil
+}
+
+// release stops buffering and returns everything held, oldest first. OOBMs
+// have no ctime and keep their arrival order at the front.
+func (r *replaySequencer) release() []gregor1.Message {
+	r.Lock()
+	defer r.Unlock()
+	r.buffering = false
+	res := r.buffer
+	r.buffer = nil
+	sort.Stable(byBroadcastOrder(res))
+	return res
+}
+
+type byBroadcastOrder []gregor1.Message
+
+func (a byBroadcastOrder) Len() int      { return len(a) }
+func (a byBroadcastOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byBroadcastOrder) Less(i, j int) bool {
+	mi, mj := a[i].ToInBandMessage(), a[j].ToInBandMessage()
+	if mi == nil || mj == nil {
+		return false
+	}
+	ti, tj := mi.Metadata().CTime(), mj.Metadata().CTime()
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	return mi.Metadata().MsgID().String() < mj.Metadata().MsgID().String()
+}
+
+// gregorReconnectFlapWindow is how long a new connection has to stay up
+// before we announce it with an internal.reconnect broadcast. A connection
+// that drops again inside the window was a flap nobody needs to hear about.
+const gregorReconnectFlapWindow = 2 * time.Second
+
+// reconnectOobmBody is the metadata carried by an internal.reconnect
+// broadcast: which device reconnected, how many times it has in this process
+// lifetime, and when it last finished a server sync.
+type reconnectOobmBody struct {
+	DeviceID string        `json:"device_id"`
+	Seqno    int           `json:"seqno"`
+	LastSync keybase1.Time `json:"last_sync"`
+}
+
 func (g *gregorHandler) makeReconnectOobm() gregor1.Message {
-	return gregor1.Message{
-		Oobm_: &gregor1.OutOfBandMessage{
-			System_: "internal.reconnect",
-		},
+	g.reconnectMu.Lock()
+	g.reconnectSeqno++
+	body := reconnectOobmBody{
+		DeviceID: g.G().Env.GetDeviceID().String(),
+		Seqno:    g.reconnectSeqno,
+	}
+	if !g.lastSyncTime.IsZero() {
+		body.LastSync = keybase1.ToTime(g.lastSyncTime)
+	}
+	g.reconnectMu.Unlock()
+
+	obm := gregor1.OutOfBandMessage{
+		System_: "internal.reconnect",
+	}
+	if gcli, err := g.getGregorCli(); err == nil {
+		if uid, ok := gcli.User.(gregor1.UID); ok {
+			obm.Uid_ = uid
+		}
 	}
+	if b, err := json.Marshal(body); err == nil {
+		obm.Body_ = gregor1.Body(b)
+	}
+	return gregor1.Message{Oobm_: &obm}
 }
 
 // OnConnect is called by the rpc library to indicate we have connected to
@@ -487,6 +2429,7 @@ func (g *gregorHandler) OnConnect(ctx context.Context, conn *rpc.Connection,
 	g.Lock()
 	defer g.Unlock()
 
+	g.stats.incr(&g.stats.reconnects)
 	timeoutCli := WrapGenericClientWithTimeout(cli, GregorRequestTimeout, ErrGregorTimeout)
 
 	g.Debug("connected")
@@ -501,13 +2444,23 @@ func (g *gregorHandler) OnConnect(ctx context.Context, conn *rpc.Connection,
 		return err
 	}
 
-	// Sync down events since we have been dead
+	// Sync down events since we have been dead. Any live broadcasts arriving
+	// meanwhile get buffered and sequenced in afterwards
+	g.sequencer.start()
 	replayedMsgs, consumedMsgs, err := g.serverSync(ctx, gregor1.IncomingClient{Cli: timeoutCli})
 	if err != nil {
 		g.Errorf("sync failure: %s", err)
 	} else {
 		g.Debug("sync success: replayed: %d consumed: %d",
 			len(replayedMsgs), len(consumedMsgs))
+		g.reconnectMu.Lock()
+		g.lastSyncTime = g.G().Clock().Now()
+		g.reconnectMu.Unlock()
+	}
+	for _, bm := range g.sequencer.release() {
+		if berr := g.broadcastMessageLocked(ctx, bm); berr != nil {
+			g.Debug("buffered broadcast failed: %s", berr)
+		}
 	}
 
 	// Sync chat data using a Syncer object
@@ -518,6 +2471,8 @@ func (g *gregorHandler) OnConnect(ctx context.Context, conn *rpc.Connection,
 		if err := g.chatSync.Connected(ctx, chatCli, uid); err != nil {
 			return err
 		}
+		// Replay any newMessage applies a crash cut short
+		g.chatHandler.ReplayPendingApplies(ctx, uid)
 	}
 
 	// Sync badge state in the background
@@ -528,14 +2483,62 @@ func (g *gregorHandler) OnConnect(ctx context.Context, conn *rpc.Connection,
 	}
 
 	// Broadcast reconnect oobm. Spawn this off into a goroutine so that we don't delay
-	// reconnection any longer than we have to.
-	go func(m gregor1.Message) {
+	// reconnection any longer than we have to. It waits out the flap window
+	// first; if the connection has already dropped again by then, nothing is
+	// sent.
+	g.reconnectMu.Lock()
+	g.connGen++
+	g.connUp = true
+	gen := g.connGen
+	g.reconnectMu.Unlock()
+	go func(m gregor1.Message, gen int) {
+		time.Sleep(gregorReconnectFlapWindow)
+		g.reconnectMu.Lock()
+		flapped := !g.connUp || g.connGen != gen
+		g.reconnectMu.Unlock()
+		if flapped {
+			g.Debug("suppressing reconnect broadcast: connection flapped")
+			return
+		}
 		g.BroadcastMessage(context.Background(), m)
-	}(g.makeReconnectOobm())
+	}(g.makeReconnectOobm(), gen)
 
 	return nil
 }
 
+// fatalConnectError marks connect-time failures that retrying won't fix.
+// ShouldRetryOnConnect gives up when it sees one, instead of relying on a
+// mutable flag set deep inside auth().
+type fatalConnectError interface {
+	error
+	FatalConnectError()
+}
+
+// BadSessionError is returned when we can't get a session token to present
+// to gregor, typically because the user is logged out.
+type BadSessionError struct {
+	wrapped error
+}
+
+func (e BadSessionError) Error() string {
+	return fmt.Sprintf("bad session: %s", e.wrapped)
+}
+
+func (e BadSessionError) FatalConnectError() {}
+
+// AuthMismatchError is returned when gregor authenticates us as a different
+// UID than the one our session claims.
+type AuthMismatchError struct {
+	AuthUID    gregor1.UID
+	SessionUID keybase1.UID
+}
+
+func (e AuthMismatchError) Error() string {
+	return fmt.Sprintf("auth result uid %x doesn't match session uid %q", e.AuthUID, e.SessionUID)
+}
+
+func (e AuthMismatchError) FatalConnectError() {}
+
 func (g *gregorHandler) OnConnectError(err error, reconnectThrottleDuration time.Duration) {
 	g.Debug("connect error %s, reconnect throttle duration: %s", err, reconnectThrottleDuration)
 }
@@ -543,6 +2546,10 @@ func (g *gregorHandler) OnConnectError(err error, reconnectThrottleDuration time
 func (g *gregorHandler) OnDisconnected(ctx context.Context, status rpc.DisconnectStatus) {
 	g.Debug("disconnected: %v", status)
 
+	g.reconnectMu.Lock()
+	g.connUp = false
+	g.reconnectMu.Unlock()
+
 	// Alert chat syncer that we are now disconnected
 	g.chatSync.Disconnected(ctx)
 }
@@ -562,9 +2569,9 @@ func (g *gregorHandler) ShouldRetryOnConnect(err error) bool {
 	}
 
 	g.Debug("should retry on connect, err %v", err)
-	if g.skipRetryConnect {
-		g.Debug("should retry on connect, skip retry flag set, returning false")
-		g.skipRetryConnect = false
+	if _, ok := err.(fatalConnectError); ok {
+		g.Debug("should retry on connect, fatal error, returning false")
+		g.G().NotifyRouter.HandleGregorConnectFatal(err.Error())
 		return false
 	}
 
@@ -572,9 +2579,21 @@ func (g *gregorHandler) ShouldRetryOnConnect(err error) bool {
 }
 
 func (g *gregorHandler) broadcastMessageOnce(ctx context.Context, m gregor1.Message) error {
+	// A broadcast racing a reconnect replay waits its turn instead of
+	// blocking on the lock and interleaving with replayed messages
+	if g.sequencer.hold(m) {
+		g.Debug("broadcast buffered while replay is in flight")
+		return nil
+	}
+
 	g.Lock()
 	defer g.Unlock()
+	return g.broadcastMessageLocked(ctx, m)
+}
 
+// broadcastMessageLocked handles a single broadcast. gregorHandler must be
+// locked when calling this function.
+func (g *gregorHandler) broadcastMessageLocked(ctx context.Context, m gregor1.Message) error {
 	// Handle the message
 	var obm gregor.OutOfBandMessage
 	ibm := m.ToInBandMessage()
@@ -595,15 +2614,31 @@ func (g *gregorHandler) broadcastMessageOnce(ctx context.Context, m gregor1.Mess
 			g.Debug("BroadcastMessage: msgID: %s already in state, ignoring", msgID)
 			return errors.New("ignored repeat message")
 		}
+		// The state check misses messages consumed right before a restart if
+		// restore hasn't finished; the persisted cache covers that window
+		if g.seenMsgIDs != nil && g.seenMsgIDs.seen(msgID) {
+			g.Debug("BroadcastMessage: msgID: %s in recently-seen cache, ignoring", msgID)
+			return errors.New("ignored repeat message")
+		}
 
 		g.Debug("broadcast: in-band message: msgID: %s Ctime: %s", msgID, ibm.Metadata().CTime())
 		err = g.handleInBandMessage(ctx, gregor1.IncomingClient{Cli: g.cli}, ibm)
 
+		// A live broadcast carries the server's clock; advance the replay
+		// cursor and feed the skew estimator
+		g.watermark.advance(msgID, ibm.Metadata().CTime())
+		g.clockSkew.sample(ibm.Metadata().CTime(), g.G().Clock().Now())
+
 		// Send message to local state machine
 		gcli.StateMachineConsumeMessage(m)
+		if g.seenMsgIDs != nil {
+			if err := g.seenMsgIDs.note(msgID); err != nil {
+				g.Debug("BroadcastMessage: unable to persist seen msgID: %s", err)
+			}
+		}
 
 		// Forward to electron or whichever UI is listening for the new gregor state
-		if g.pushStateFilter(m) {
+		if g.pushStateFilterAllows(m) {
 			g.pushState(keybase1.PushReason_NEW_DATA)
 		}
 
@@ -628,58 +2663,336 @@ func (g *gregorHandler) broadcastMessageOnce(ctx context.Context, m gregor1.Mess
 func (g *gregorHandler) broadcastMessageHandler() {
 	ctx := context.Background()
 	for {
-		m := <-g.broadcastCh
-		err := g.broadcastMessageOnce(ctx, m)
+		select {
+		case f := <-g.localOpCh:
+			f()
+		case m := <-g.broadcastCh:
+			err := g.broadcastMessageOnce(ctx, m)
+
+			// Testing alerts
+			if g.testingEvents != nil {
+				g.testingEvents.broadcastSentCh <- err
+			}
+		}
+	}
+}
+
+// BroadcastMessage is called when we receive a new messages from gregord. Grabs
+// the lock protect the state machine and handleInBandMessage
+func (g *gregorHandler) BroadcastMessage(ctx context.Context, m gregor1.Message) error {
+	g.stats.incr(&g.stats.broadcastsReceived)
+	// Send the message on a channel so we can return to Gregor as fast as possible. Note
+	// that this can block, but broadcastCh has a large buffer to try and mitigate
+	g.broadcastCh <- m
+	return nil
+}
+
+// handleInBandMessage runs a message on all the alive handlers. gregorHandler
+// must be locked when calling this function.
+func (g *gregorHandler) handleInBandMessage(ctx context.Context, cli gregor1.IncomingInterface,
+	ibm gregor.InBandMessage) (err error) {
+
+	defer g.G().Trace(fmt.Sprintf("gregorHandler#handleInBandMessage with %d handlers", len(g.ibmHandlers)), func() error { return err })()
+
+	// Fire any configured automation hooks for new items
+	if sum := ibm.ToStateUpdateMessage(); sum != nil {
+		if crt := sum.Creation(); crt != nil && crt.Category() != nil {
+			var body []byte
+			if crt.Body() != nil {
+				body = crt.Body().Bytes()
+			}
+			g.hooks.fire(crt.Category().String(), body)
+		}
+	}
+
+	// Prune anyone who died since last time
+	var freshHandlers []libkb.GregorInBandMessageHandler
+	for _, handler := range g.ibmHandlers {
+		if handler.IsAlive() {
+			freshHandlers = append(freshHandlers, handler)
+		} else {
+			g.Debug("skipping handler as it's marked dead: %s", handler.Name())
+			g.forgetHandler(handler.Name())
+		}
+	}
+	if len(g.ibmHandlers) != len(freshHandlers) {
+		g.Debug("Change # of live handlers from %d to %d", len(g.ibmHandlers), len(freshHandlers))
+		g.ibmHandlers = freshHandlers
+	}
+
+	// Run the message against the handlers that own its category. Handlers
+	// of equal priority run concurrently through a bounded worker pool, so a
+	// slow handler only delays its own priority wave; higher priority waves
+	// still complete before lower ones start. Each handler sees messages in
+	// arrival order because dispatch as a whole is serialized per message.
+	ordered, prios := g.dispatchOrder(ibm)
+	sem := make(chan struct{}, gregorDispatchWorkers)
+	var handledMu sync.Mutex
+	anyHandled := false
+	rq := g.redelivery
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && prios[end] == prios[start] {
+			end++
+		}
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			handler := ordered[i]
+			g.Debug("trying handler %s at position %d", handler.Name(), i)
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(handler libkb.GregorInBandMessageHandler) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				handled, err := g.handleInBandMessageWithHandler(ctx, cli, ibm, handler)
+				if handled {
+					handledMu.Lock()
+					anyHandled = true
+					handledMu.Unlock()
+				}
+				if err != nil {
+					g.stats.incr(&g.stats.handlerErrors)
+					if _, retry := err.(libkb.GregorRetryableError); retry && rq != nil {
+						if msg, ok := ibm.(gregor1.InBandMessage); ok {
+							g.Debug("handler %s nacked %s, queueing for redelivery",
+								handler.Name(), ibm.Metadata().MsgID())
+							rq.nack(handler.Name(), msg, g.G().Clock().Now())
+						}
+					}
+					if handled {
+						// Don't stop handling errors on a first failure.
+						g.Errorf("failed to run %s handler: %s", handler.Name(), err)
+					} else {
+						g.Debug("handleInBandMessage() failed to run %s handler: %s", handler.Name(), err)
+					}
+				}
+			}(handler)
+		}
+		wg.Wait()
+		start = end
+	}
+	if !anyHandled {
+		g.noteDeadLetter(ibm)
+	}
+
+	// Everyone still alive has now seen everything up to the latest ctime
+	for _, handler := range g.ibmHandlers {
+		g.markHandlerReplayed(handler.Name())
+	}
+	return nil
+}
+
+// deadLetter is a message no handler claimed, remembered in case one that
+// owns its category attaches later.
+type deadLetter struct {
+	category string
+	msgID    gregor.MsgID
+	ctime    time.Time
+	ibm      gregor.InBandMessage
+}
+
+// noteDeadLetter records a creation nobody handled. gregorHandler needs to be
+// locked when calling this function.
+func (g *gregorHandler) noteDeadLetter(ibm gregor.InBandMessage) {
+	category := ibmCategory(ibm)
+	if category == "" {
+		return
+	}
+	g.Debug("no handler took message %s (category %s), dead-lettering",
+		ibm.Metadata().MsgID(), category)
+	g.deadLetters = append(g.deadLetters, deadLetter{
+		category: category,
+		msgID:    ibm.Metadata().MsgID(),
+		ctime:    ibm.Metadata().CTime(),
+		ibm:      ibm,
+	})
+	if len(g.deadLetters) > gregorDeadLetterLimit {
+		g.deadLetters = g.deadLetters[len(g.deadLetters)-gregorDeadLetterLimit:]
+	}
+}
+
+// replayDeadLetters runs stored unhandled messages through a newly attached
+// handler and drops the ones it claims. gregorHandler needs to be locked when
+// calling this function.
+func (g *gregorHandler) replayDeadLetters(handler libkb.GregorInBandMessageHandler) {
+	if len(g.deadLetters) == 0 {
+		return
+	}
+	var remaining []deadLetter
+	for _, dl := range g.deadLetters {
+		if !g.handlerCoversCategory(handler, dl.category) {
+			remaining = append(remaining, dl)
+			continue
+		}
+		handled, err := g.handleInBandMessageWithHandler(context.TODO(),
+			gregor1.IncomingClient{Cli: g.cli}, dl.ibm, handler)
+		if err != nil {
+			g.Debug("dead letter %s replay on %s failed: %s", dl.msgID, handler.Name(), err)
+		}
+		if handled {
+			g.Debug("dead letter %s (category %s) taken by %s", dl.msgID, dl.category, handler.Name())
+			continue
+		}
+		remaining = append(remaining, dl)
+	}
+	g.deadLetters = remaining
+}
+
+// listUnhandled describes the current dead letters for the listUnhandled RPC.
+func (g *gregorHandler) listUnhandled() (res []keybase1.UnhandledMessage) {
+	g.Lock()
+	defer g.Unlock()
+	for _, dl := range g.deadLetters {
+		res = append(res, keybase1.UnhandledMessage{
+			Category: dl.category,
+			MsgID:    gregor1.MsgID(dl.msgID.Bytes()),
+			Ctime:    keybase1.ToTime(dl.ctime),
+		})
+	}
+	return res
+}
+
+// ibmCategory pulls the category out of a creation message. Dismissals and
+// other updates have none and go to every handler.
+func ibmCategory(ibm gregor.InBandMessage) string {
+	if sum := ibm.ToStateUpdateMessage(); sum != nil {
+		if crt := sum.Creation(); crt != nil {
+			return crt.Category().String()
+		}
+	}
+	return ""
+}
+
+// byHandlerPriority stably orders handlers by descending declared priority,
+// so equal priorities keep attach order.
+type byHandlerPriority struct {
+	handlers []libkb.GregorInBandMessageHandler
+	prio     []int
+}
 
-		// Testing alerts
-		if g.testingEvents != nil {
-			g.testingEvents.broadcastSentCh <- err
+func (b byHandlerPriority) Len() int           { return len(b.handlers) }
+func (b byHandlerPriority) Less(i, j int) bool { return b.prio[i] > b.prio[j] }
+func (b byHandlerPriority) Swap(i, j int) {
+	b.handlers[i], b.handlers[j] = b.handlers[j], b.handlers[i]
+	b.prio[i], b.prio[j] = b.prio[j], b.prio[i]
+}
+
+// dispatchOrder returns the handlers that should see the message and their
+// priorities, highest priority first. A handler that declared category
+// prefixes is skipped for creations outside of them. gregorHandler needs to
+// be locked when calling this function.
+func (g *gregorHandler) dispatchOrder(ibm gregor.InBandMessage) ([]libkb.GregorInBandMessageHandler, []int) {
+	category := ibmCategory(ibm)
+	ordered := byHandlerPriority{}
+	for _, handler := range g.ibmHandlers {
+		g.panicLock.Lock()
+		quarantined := g.quarantinedHandlers[handler.Name()]
+		g.panicLock.Unlock()
+		if quarantined {
+			continue
+		}
+		if category != "" && !g.handlerCoversCategory(handler, category) {
+			continue
+		}
+		ordered.handlers = append(ordered.handlers, handler)
+		ordered.prio = append(ordered.prio, g.ibmRegistrations[handler.Name()].priority)
+	}
+	sort.Stable(ordered)
+	return ordered.handlers, ordered.prio
+}
+
+// handlerCoversCategory returns whether the handler should see creations in
+// the given category: true unless it registered category prefixes that all
+// miss. gregorHandler needs to be locked when calling this function.
+func (g *gregorHandler) handlerCoversCategory(handler libkb.GregorInBandMessageHandler, category string) bool {
+	reg, ok := g.ibmRegistrations[handler.Name()]
+	if !ok || len(reg.categories) == 0 {
+		return true
+	}
+	for _, c := range reg.categories {
+		if strings.HasPrefix(category, c) {
+			return true
 		}
 	}
+	return false
 }
 
-// BroadcastMessage is called when we receive a new messages from gregord. Grabs
-// the lock protect the state machine and handleInBandMessage
-func (g *gregorHandler) BroadcastMessage(ctx context.Context, m gregor1.Message) error {
-	// Send the message on a channel so we can return to Gregor as fast as possible. Note
-	// that this can block, but broadcastCh has a large buffer to try and mitigate
-	g.broadcastCh <- m
-	return nil
+// replayStartTime returns where incremental replay should resume: the server
+// watermark when we have one, otherwise the state machine's latest ctime.
+func (g *gregorHandler) replayStartTime(gcli *grclient.Client) *time.Time {
+	if t := g.watermark.time(); t != nil {
+		return t
+	}
+	return gcli.StateMachineLatestCTime()
 }
 
-// handleInBandMessage runs a message on all the alive handlers. gregorHandler
-// must be locked when calling this function.
-func (g *gregorHandler) handleInBandMessage(ctx context.Context, cli gregor1.IncomingInterface,
-	ibm gregor.InBandMessage) (err error) {
+// markHandlerReplayed advances the named handler's replay watermark to the
+// server replay cursor. gregorHandler needs to be locked when calling this
+// function.
+func (g *gregorHandler) markHandlerReplayed(name string) {
+	gcli, err := g.getGregorCli()
+	if err != nil {
+		return
+	}
+	pt := g.replayStartTime(gcli)
+	if pt == nil {
+		return
+	}
+	if cur, ok := g.replayWatermarks[name]; !ok || pt.After(cur) {
+		g.replayWatermarks[name] = *pt
+	}
+}
 
-	defer g.G().Trace(fmt.Sprintf("gregorHandler#handleInBandMessage with %d handlers", len(g.ibmHandlers)), func() error { return err })()
+// noteHandlerPanic counts panics per handler and quarantines one that keeps
+// panicking: it stops receiving messages until it re-registers, and UIs are
+// notified so the owner can do so.
+func (g *gregorHandler) noteHandlerPanic(name string) {
+	g.panicLock.Lock()
+	defer g.panicLock.Unlock()
+	g.handlerPanics[name]++
+	if g.handlerPanics[name] < gregorHandlerPanicLimit || g.quarantinedHandlers[name] {
+		return
+	}
+	g.Errorf("quarantining handler %s after %d panics", name, g.handlerPanics[name])
+	g.quarantinedHandlers[name] = true
+	g.G().NotifyRouter.HandleGregorHandlerQuarantined(name)
+}
 
-	var freshHandlers []libkb.GregorInBandMessageHandler
+// safeCreate runs handler.Create, converting a panic in the handler into an
+// error so one bad handler can't take down the whole service.
+func (g *gregorHandler) safeCreate(ctx context.Context, cli gregor1.IncomingInterface,
+	handler libkb.GregorInBandMessageHandler, category string, item gregor.Item) (handled bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			handled = true
+			err = fmt.Errorf("handler %s panicked in Create: %v", handler.Name(), r)
+			g.noteHandlerPanic(handler.Name())
+		}
+	}()
+	return handler.Create(ctx, cli, category, item)
+}
 
-	// Loop over all handlers and run the messages against any that are alive
-	// If the handler is not alive, we prune it from our list
-	for i, handler := range g.ibmHandlers {
-		g.Debug("trying handler %s at position %d", handler.Name(), i)
-		if handler.IsAlive() {
-			if handled, err := g.handleInBandMessageWithHandler(ctx, cli, ibm, handler); err != nil {
-				if handled {
-					// Don't stop handling errors on a first failure.
-					g.Errorf("failed to run %s handler: %s", handler.Name(), err)
-				} else {
-					g.Debug("handleInBandMessage() failed to run %s handler: %s", handler.Name(), err)
-				}
-			}
-			freshHandlers = append(freshHandlers, handler)
-		} else {
-			g.Debug("skipping handler as it's marked dead: %s", handler.Name())
+// safeDismiss is safeCreate for handler.Dismiss.
+func (g *gregorHandler) safeDismiss(ctx context.Context, cli gregor1.IncomingInterface,
+	handler libkb.GregorInBandMessageHandler, category string, item gregor.Item) (handled bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			handled = true
+			err = fmt.Errorf("handler %s panicked in Dismiss: %v", handler.Name(), r)
+			g.noteHandlerPanic(handler.Name())
 		}
-	}
+	}()
+	return handler.Dismiss(ctx, cli, category, item)
+}
 
-	if len(g.ibmHandlers) != len(freshHandlers) {
-		g.Debug("Change # of live handlers from %d to %d", len(g.ibmHandlers), len(freshHandlers))
-		g.ibmHandlers = freshHandlers
+// messageTargetsThisDevice returns true if the message is addressed to every
+// device or specifically to ours.
+func (g *gregorHandler) messageTargetsThisDevice(gcli *grclient.Client, ibm gregor.InBandMessage) bool {
+	did := ibm.Metadata().DeviceID()
+	if did == nil || gcli.Device == nil {
+		return true
 	}
-	return nil
+	return bytes.Equal(did.Bytes(), gcli.Device.Bytes())
 }
 
 // handleInBandMessageWithHandler runs a message against the specified handler
@@ -691,6 +3004,17 @@ func (g *gregorHandler) handleInBandMessageWithHandler(ctx context.Context, cli
 	if err != nil {
 		return false, err
 	}
+
+	// Items can be targeted at one device; don't run another device's
+	// messages against a handler unless it asked for the full multi-device
+	// view
+	if !g.messageTargetsThisDevice(gcli, ibm) {
+		if mdv, ok := handler.(libkb.GregorMultiDeviceViewer); !ok || !mdv.WantMultiDeviceView() {
+			g.Debug("skipping message targeted at device %s for handler %s",
+				ibm.Metadata().DeviceID(), handler.Name())
+			return false, nil
+		}
+	}
 	state, err := gcli.StateMachineState(nil)
 	if err != nil {
 		return false, err
@@ -706,6 +3030,10 @@ func (g *gregorHandler) handleInBandMessageWithHandler(ctx context.Context, cli
 	if update != nil {
 		g.Debug("state update message")
 
+		// Whether this handler actually claimed any part of the message; the
+		// caller uses it to decide if the message was handled at all
+		var anyHandled bool
+
 		item := update.Creation()
 		if item != nil {
 			id := item.Metadata().MsgID().String()
@@ -718,9 +3046,24 @@ func (g *gregorHandler) handleInBandMessageWithHandler(ctx context.Context, cli
 				g.Debug("item %s has category %s", id, category)
 			}
 
-			if handled, err := handler.Create(ctx, cli, category, item); err != nil {
+			start := g.G().Clock().Now()
+			handled, err := g.safeCreate(ctx, cli, handler, category, item)
+			took := g.G().Clock().Now().Sub(start)
+			g.metrics.recordCreate(handler.Name(), took, err)
+			g.audit.record(keybase1.GregorAuditEntry{
+				Ctime:    keybase1.ToTime(start),
+				MsgID:    id,
+				Category: category,
+				Handler:  handler.Name(),
+				Op:       "create",
+				Handled:  handled,
+				Err:      auditErrString(err),
+				Latency:  keybase1.DurationSec(took.Seconds()),
+			})
+			if err != nil {
 				return handled, err
 			}
+			anyHandled = anyHandled || handled
 		}
 
 		dismissal := update.Dismissal()
@@ -740,16 +3083,31 @@ func (g *gregorHandler) handleInBandMessageWithHandler(ctx context.Context, cli
 					g.Debug("dismissal %s has category %s", id, category)
 				}
 
-				if handled, err := handler.Dismiss(ctx, cli, category, item); handled && err != nil {
+				start := g.G().Clock().Now()
+				handled, err := g.safeDismiss(ctx, cli, handler, category, item)
+				took := g.G().Clock().Now().Sub(start)
+				g.metrics.recordDismiss(handler.Name(), took, err)
+				g.audit.record(keybase1.GregorAuditEntry{
+					Ctime:    keybase1.ToTime(start),
+					MsgID:    id.String(),
+					Category: category,
+					Handler:  handler.Name(),
+					Op:       "dismiss",
+					Handled:  handled,
+					Err:      auditErrString(err),
+					Latency:  keybase1.DurationSec(took.Seconds()),
+				})
+				if handled && err != nil {
 					return handled, err
 				}
+				anyHandled = anyHandled || handled
 			}
 			if len(dismissal.RangesToDismiss()) > 0 {
 				g.Debug("message range dismissing not implemented")
 			}
 		}
 
-		return true, nil
+		return anyHandled, nil
 	}
 
 	return false, nil
@@ -879,32 +3237,326 @@ func (h IdentifyUIHandler) handleShowTrackerPopupDismiss(ctx context.Context, cl
 	return nil
 }
 
+// oobmHandlerFn handles one out-of-band message.
+type oobmHandlerFn func(ctx context.Context, obm gregor.OutOfBandMessage) error
+
+// gregorHookTimeout bounds how long one hook invocation may run.
+const gregorHookTimeout = 10 * time.Second
+
+// gregorHook is one user-configured automation target from the push.hooks
+// config array. Items and out-of-band messages whose category or system
+// matches Prefix get their body handed to Exec (run with the category as its
+// argument and the body on stdin) or posted to URL.
+type gregorHook struct {
+	Prefix string `json:"prefix"`
+	Exec   string `json:"exec"`
+	URL    string `json:"url"`
+}
+
+// gregorHookRunner fires local automation for selected gregor traffic. It is
+// opt-in: with no push.hooks config entry it does nothing.
+type gregorHookRunner struct {
+	libkb.Contextified
+	hooks []gregorHook
+}
+
+func newGregorHookRunner(g *libkb.GlobalContext) *gregorHookRunner {
+	r := &gregorHookRunner{Contextified: libkb.NewContextified(g)}
+	r.load()
+	return r
+}
+
+func (r *gregorHookRunner) load() {
+	conf := r.G().Env.GetConfig()
+	if conf == nil {
+		return
+	}
+	i, err := conf.GetInterfaceAtPath("push.hooks")
+	if err != nil || i == nil {
+		return
+	}
+	// Round-trip through JSON rather than hand-walking the interface tree
+	b, err := json.Marshal(i)
+	if err != nil {
+		return
+	}
+	var hooks []gregorHook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		r.G().Log.Warning("push.hooks config malformed: %s", err)
+		return
+	}
+	for _, h := range hooks {
+		if h.Prefix == "" || (h.Exec == "" && h.URL == "") {
+			r.G().Log.Warning("push.hooks entry ignored: needs prefix and one of exec, url")
+			continue
+		}
+		r.hooks = append(r.hooks, h)
+	}
+	if len(r.hooks) > 0 {
+		r.G().Log.Debug("gregor hooks: %d configured", len(r.hooks))
+	}
+}
+
+// fire launches every hook whose prefix matches the category or system. The
+// hooks run in the background so a slow consumer can't stall dispatch.
+func (r *gregorHookRunner) fire(category string, body []byte) {
+	for _, h := range r.hooks {
+		if !strings.HasPrefix(category, h.Prefix) {
+			continue
+		}
+		go r.run(h, category, body)
+	}
+}
+
+func (r *gregorHookRunner) run(h gregorHook, category string, body []byte) {
+	if h.Exec != "" {
+		cmd := exec.Command(h.Exec, category)
+		cmd.Stdin = bytes.NewReader(body)
+		if err := cmd.Start(); err != nil {
+			r.G().Log.Warning("gregor hook %q: exec %s: %s", h.Prefix, h.Exec, err)
+			return
+		}
+		t := time.AfterFunc(gregorHookTimeout, func() { cmd.Process.Kill() })
+		err := cmd.Wait()
+		t.Stop()
+		if err != nil {
+			r.G().Log.Warning("gregor hook %q: exec %s: %s", h.Prefix, h.Exec, err)
+		}
+		return
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		r.G().Log.Warning("gregor hook %q: post %s: %s", h.Prefix, h.URL, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Keybase-Category", category)
+	cli := &http.Client{Timeout: gregorHookTimeout}
+	resp, err := cli.Do(req)
+	if err != nil {
+		r.G().Log.Warning("gregor hook %q: post %s: %s", h.Prefix, h.URL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		r.G().Log.Warning("gregor hook %q: post %s: %s", h.Prefix, h.URL, resp.Status)
+	}
+}
+
+// loadPassthroughSystems reads the push.passthrough_systems config array:
+// system prefixes whose out-of-band messages are forwarded to the UI rather
+// than rejected as unhandled.
+func loadPassthroughSystems(g *libkb.GlobalContext) (res []string) {
+	conf := g.Env.GetConfig()
+	if conf == nil {
+		return nil
+	}
+	i, err := conf.GetInterfaceAtPath("push.passthrough_systems")
+	if err != nil || i == nil {
+		return nil
+	}
+	entries, ok := i.([]interface{})
+	if !ok {
+		g.Log.Warning("push.passthrough_systems config malformed: expected array of strings")
+		return nil
+	}
+	for _, e := range entries {
+		if s, ok := e.(string); ok && s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// passthroughOOBM is the dispatcher's fallback: systems on the passthrough
+// allowlist get their JSON bodies forwarded to the UI as a generic event, so
+// simple new server systems don't need a client release to reach the UI.
+// Anything else is still an unhandled system.
+func (g *gregorHandler) passthroughOOBM(ctx context.Context, obm gregor.OutOfBandMessage) error {
+	system := obm.System().String()
+	allowed := false
+	for _, p := range g.passthroughSystems {
+		if strings.HasPrefix(system, p) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return unhandledSystemError{system: system}
+	}
+	if obm.Body() == nil {
+		return fmt.Errorf("gregor handler for %s: nil message body", system)
+	}
+	// Make sure the body really is JSON before handing it to UIs
+	var decoded interface{}
+	if err := json.Unmarshal(obm.Body().Bytes(), &decoded); err != nil {
+		return fmt.Errorf("passthrough for %s: body is not JSON: %s", system, err)
+	}
+	g.Debug("passthrough: forwarding %s to UI", system)
+	g.G().NotifyRouter.HandleGenericGregorEvent(system, string(obm.Body().Bytes()))
+	return nil
+}
+
+// unhandledSystemError marks an out-of-band message nothing claimed, so the
+// throughput counters can tell a drop from a handler failure.
+type unhandledSystemError struct {
+	system string
+}
+
+func (e unhandledSystemError) Error() string {
+	return fmt.Sprintf("unhandled system: %s", e.system)
+}
+
+// oobmThroughput tracks per-system counts of out-of-band messages: how many
+// arrived, how many a handler applied, how many a handler failed on, and how
+// many nothing claimed. The stats RPC exports it so a deploy that breaks e.g.
+// chat.activity handling shows up as a climbing errored count.
+type oobmThroughput struct {
+	sync.Mutex
+	bySystem map[string]*oobmThroughputEntry
+}
+
+type oobmThroughputEntry struct {
+	received int64
+	handled  int64
+	errored  int64
+	dropped  int64
+}
+
+func newOOBMThroughput() *oobmThroughput {
+	return &oobmThroughput{bySystem: make(map[string]*oobmThroughputEntry)}
+}
+
+func (t *oobmThroughput) get(system string) *oobmThroughputEntry {
+	e, ok := t.bySystem[system]
+	if !ok {
+		e = &oobmThroughputEntry{}
+		t.bySystem[system] = e
+	}
+	return e
+}
+
+func (t *oobmThroughput) recordReceived(system string) {
+	t.Lock()
+	defer t.Unlock()
+	t.get(system).received++
+}
+
+// recordOutcome classifies the result of a dispatch: no error means handled,
+// an unhandledSystemError means dropped, anything else is a handler error.
+func (t *oobmThroughput) recordOutcome(system string, err error) {
+	t.Lock()
+	defer t.Unlock()
+	e := t.get(system)
+	switch err.(type) {
+	case nil:
+		e.handled++
+	case unhandledSystemError:
+		e.dropped++
+	default:
+		e.errored++
+	}
+}
+
+func (t *oobmThroughput) export() (res []keybase1.GregorOOBMStats) {
+	t.Lock()
+	defer t.Unlock()
+	var systems []string
+	for system := range t.bySystem {
+		systems = append(systems, system)
+	}
+	sort.Strings(systems)
+	for _, system := range systems {
+		e := t.bySystem[system]
+		res = append(res, keybase1.GregorOOBMStats{
+			System:   system,
+			Received: e.received,
+			Handled:  e.handled,
+			Errored:  e.errored,
+			Dropped:  e.dropped,
+		})
+	}
+	return res
+}
+
+// oobmDispatcher routes out-of-band messages to handlers registered by
+// system name or prefix (e.g. "chat."), replacing the old hardcoded switch.
+// The longest matching prefix wins; systems nothing registered for go to the
+// default handler. All methods are safe for concurrent use.
+type oobmDispatcher struct {
+	sync.Mutex
+	handlers map[string]oobmHandlerFn
+	def      oobmHandlerFn
+}
+
+func newOOBMDispatcher() *oobmDispatcher {
+	return &oobmDispatcher{handlers: make(map[string]oobmHandlerFn)}
+}
+
+// register wires f to every system matching the given prefix; an exact
+// system name works too.
+func (d *oobmDispatcher) register(prefix string, f oobmHandlerFn) {
+	d.Lock()
+	defer d.Unlock()
+	d.handlers[prefix] = f
+}
+
+// setDefault routes systems no handler registered for.
+func (d *oobmDispatcher) setDefault(f oobmHandlerFn) {
+	d.Lock()
+	defer d.Unlock()
+	d.def = f
+}
+
+// dispatch runs the registered handler with the longest prefix matching the
+// message's system.
+func (d *oobmDispatcher) dispatch(ctx context.Context, obm gregor.OutOfBandMessage) error {
+	system := obm.System().String()
+	d.Lock()
+	var best string
+	var f oobmHandlerFn
+	for p, h := range d.handlers {
+		if strings.HasPrefix(system, p) && len(p) >= len(best) {
+			best, f = p, h
+		}
+	}
+	if f == nil {
+		f = d.def
+	}
+	d.Unlock()
+	if f == nil {
+		return unhandledSystemError{system: system}
+	}
+	return f(ctx, obm)
+}
+
 func (g *gregorHandler) handleOutOfBandMessage(ctx context.Context, obm gregor.OutOfBandMessage) error {
 	if obm.System() == nil {
 		return errors.New("nil system in out of band message")
 	}
 
+	// Fire any configured automation hooks for this system
+	if obm.Body() != nil {
+		g.hooks.fire(obm.System().String(), obm.Body().Bytes())
+	}
+
 	if tmp, ok := obm.(gregor1.OutOfBandMessage); ok {
 		g.pushOutOfBandMessages([]gregor1.OutOfBandMessage{tmp})
 	} else {
 		g.G().Log.Warning("Got non-exportable out-of-band message")
 	}
 
-	switch obm.System().String() {
-	case "kbfs.favorites":
-		return g.kbfsFavorites(ctx, obm)
-	case "chat.activity":
-		return g.chatHandler.Activity(ctx, obm, g.badger)
-	case "chat.tlffinalize":
-		return g.chatHandler.TlfFinalize(ctx, obm)
-	case "chat.tlfresolve":
-		return g.chatHandler.TlfResolve(ctx, obm)
-	case "internal.reconnect":
-		g.G().Log.Debug("reconnected to push server")
-		return nil
-	default:
-		return fmt.Errorf("unhandled system: %s", obm.System())
+	system := obm.System().String()
+	g.oobmThroughput.recordReceived(system)
+	err := g.oobmRouter.dispatch(ctx, obm)
+	g.oobmThroughput.recordOutcome(system, err)
+	if err != nil && g.oobmQuarantine != nil {
+		// Don't lose the message just because this version of the client
+		// couldn't make sense of it
+		g.oobmQuarantine.add(obm, err, g.G().Clock().Now())
 	}
+	return err
 }
 
 func (g *gregorHandler) Shutdown() {
@@ -915,6 +3567,16 @@ func (g *gregorHandler) Shutdown() {
 	if g.conn == nil {
 		return
 	}
+
+	// Flush the state machine to local storage, so a clean shutdown doesn't
+	// lose whatever we consumed since the last save interval tick (and force
+	// a fresh replay on the next start).
+	if gcli, err := g.getGregorCli(); err == nil {
+		if err := gcli.Save(); err != nil {
+			g.Debug("shutdown: failed to save gregor state: %s", err)
+		}
+	}
+
 	close(g.shutdownCh)
 	g.conn.Shutdown()
 	g.conn = nil
@@ -925,6 +3587,19 @@ func (g *gregorHandler) Reset() error {
 	return g.resetGregorClient()
 }
 
+// NetworkChanged is called (by the mobile bindings, mainly) when the device
+// switches networks, say from WiFi to cellular. The old TCP connection is
+// likely dead but won't fail until a ping times out, so tear it down right
+// away and reconnect; the resulting OnConnect does an incremental sync.
+func (g *gregorHandler) NetworkChanged() error {
+	g.Debug("network changed: resetting connection")
+	if g.uri == nil {
+		return errors.New("no gregor URI; not previously connected")
+	}
+	g.Shutdown()
+	return g.Connect(g.uri)
+}
+
 func (g *gregorHandler) kbfsFavorites(ctx context.Context, m gregor.OutOfBandMessage) error {
 	if m.Body() == nil {
 		return errors.New("gregor handler for kbfs.favorites: nil message body")
@@ -947,6 +3622,129 @@ func (g *gregorHandler) kbfsFavorites(ctx context.Context, m gregor.OutOfBandMes
 	}
 }
 
+// tlfUpdateHint is the last rekey/upgrade hint the server pushed for a TLF,
+// persisted per user so KBFS can ask for it after a restart.
+type tlfUpdateHint struct {
+	Tlf    string        `json:"tlf"`
+	Public bool          `json:"public"`
+	Action string        `json:"action"`
+	Ctime  keybase1.Time `json:"ctime"`
+}
+
+func (g *gregorHandler) kbfsTlfUpdate(ctx context.Context, m gregor.OutOfBandMessage) error {
+	if m.Body() == nil {
+		return errors.New("gregor handler for kbfs.tlfUpdate: nil message body")
+	}
+	body, err := jsonw.Unmarshal(m.Body().Bytes())
+	if err != nil {
+		return err
+	}
+
+	tlf, err := body.AtPath("tlf").GetString()
+	if err != nil {
+		return err
+	}
+	action, err := body.AtPath("action").GetString()
+	if err != nil {
+		return err
+	}
+	public, _ := body.AtPath("public").GetBool()
+
+	switch action {
+	case "rekey", "upgrade":
+	default:
+		return fmt.Errorf("unhandled kbfs.tlfUpdate action %q", action)
+	}
+
+	hint := tlfUpdateHint{
+		Tlf:    tlf,
+		Public: public,
+		Action: action,
+		Ctime:  keybase1.ToTime(g.G().Clock().Now()),
+	}
+	if err := g.storeTlfUpdateHint(m.UID(), hint); err != nil {
+		g.Debug("kbfs.tlfUpdate: unable to persist hint for %s: %s", tlf, err)
+	}
+
+	// KBFS already listens for FS activity, so reuse that channel to tell it
+	// to refresh the folder
+	g.G().NotifyRouter.HandleFSActivity(keybase1.FSNotification{
+		PublicTopLevelFolder: public,
+		Filename:             tlf,
+		Status:               action,
+		NotificationType:     keybase1.FSNotificationType_REKEYING,
+		LocalTime:            hint.Ctime,
+	})
+	return nil
+}
+
+// storeTlfUpdateHint merges the hint into the user's persisted hint map,
+// keyed by TLF name so only the latest hint per folder survives.
+func (g *gregorHandler) storeTlfUpdateHint(uid gregor.UID, hint tlfUpdateHint) error {
+	db := newLocalDB(g.G())
+	hints := make(map[string]tlfUpdateHint)
+	if raw, err := db.LoadTlfHints(uid); err == nil && raw != nil {
+		if err := json.Unmarshal(raw, &hints); err != nil {
+			// Unreadable hint cache; start over rather than fail the update
+			hints = make(map[string]tlfUpdateHint)
+		}
+	}
+	hints[hint.Tlf] = hint
+	b, err := json.Marshal(hints)
+	if err != nil {
+		return err
+	}
+	return db.StoreTlfHints(uid, b)
+}
+
+// deviceUpdate handles a device.* out-of-band message. For "device.revoked"
+// naming this device, lock secrets right away and take the gregor connection
+// down for good; the revocation makes any retry pointless. For other devices,
+// just refresh cached device info.
+func (g *gregorHandler) deviceUpdate(ctx context.Context, m gregor.OutOfBandMessage) error {
+	system := m.System().String()
+	if system != "device.revoked" {
+		return fmt.Errorf("unhandled device system %q", system)
+	}
+	if m.Body() == nil {
+		return errors.New("gregor handler for device.revoked: nil message body")
+	}
+	body, err := jsonw.Unmarshal(m.Body().Bytes())
+	if err != nil {
+		return err
+	}
+
+	deviceIDStr, err := body.AtPath("device_id").GetString()
+	if err != nil {
+		return err
+	}
+	deviceID, err := keybase1.DeviceIDFromString(deviceIDStr)
+	if err != nil {
+		return err
+	}
+
+	if deviceID.Eq(g.G().Env.GetDeviceID()) {
+		g.Debug("device.revoked: this device was revoked; logging out")
+		// Logout locks secrets and broadcasts the logout to the UIs
+		if err := g.G().Logout(); err != nil {
+			g.Debug("device.revoked: logout error: %s", err)
+		}
+		// Our session is dead, so reconnecting would just fail auth over
+		// and over. Shutdown rather than Reset so nothing retries.
+		go g.Shutdown()
+		return nil
+	}
+
+	g.Debug("device.revoked: device %s revoked; refreshing cached devices", deviceID)
+	kbUID, err := keybase1.UIDFromString(hex.EncodeToString(m.UID().Bytes()))
+	if err != nil {
+		return err
+	}
+	g.G().GetUPAKLoader().Invalidate(ctx, kbUID)
+	g.G().NotifyRouter.HandleKeyfamilyChanged(kbUID)
+	return nil
+}
+
 func (g *gregorHandler) notifyFavoritesChanged(ctx context.Context, uid gregor.UID) error {
 	kbUID, err := keybase1.UIDFromString(hex.EncodeToString(uid.Bytes()))
 	if err != nil {
@@ -979,8 +3777,7 @@ func (g *gregorHandler) auth(ctx context.Context, cli rpc.GenericClient) (err er
 		return errors.New("blank session token would have been sent to gregor")
 	}
 	if aerr != nil {
-		g.skipRetryConnect = true
-		return aerr
+		return BadSessionError{wrapped: aerr}
 	}
 	g.Debug("have session token")
 
@@ -989,19 +3786,127 @@ func (g *gregorHandler) auth(ctx context.Context, cli rpc.GenericClient) (err er
 	auth, err := ac.AuthenticateSessionToken(ctx, gregor1.SessionToken(token))
 	if err != nil {
 		g.Debug("auth error: %s", err)
+		g.stats.incr(&g.stats.authFailures)
 		return err
 	}
 
 	g.Debug("auth result: %+v", auth)
 	if !bytes.Equal(auth.Uid, uid.ToBytes()) {
-		g.skipRetryConnect = true
-		return fmt.Errorf("auth result uid %x doesn't match session uid %q", auth.Uid, uid)
+		g.stats.incr(&g.stats.authFailures)
+		return AuthMismatchError{AuthUID: auth.Uid, SessionUID: uid}
 	}
 	g.sessionID = auth.Sid
 
 	return nil
 }
 
+// isRateLimitError returns true if the given error from gregord is telling us
+// to slow down.
+func (g *gregorHandler) isRateLimitError(err error) bool {
+	if err, ok := err.(libkb.AppStatusError); ok {
+		return err.Code == int(keybase1.StatusCode_SCThrottleControl)
+	}
+	return false
+}
+
+// queueRetry enqueues a rate-limited message for a spaced retry and tells the
+// UI we are being throttled. Returns false if the queue is full, in which
+// case the message is dropped and the original error stands.
+func (g *gregorHandler) queueRetry(m gregor1.Message) bool {
+	select {
+	case g.retryCh <- m:
+		g.G().NotifyRouter.HandleGregorThrottled(true)
+		return true
+	default:
+		g.Debug("queueRetry: retry queue full, dropping message")
+		return false
+	}
+}
+
+// retryLoop re-sends messages that gregord rate limited, spacing the sends
+// out so we don't make the throttling any worse. Once the queue drains, the
+// UI is told we are no longer being throttled.
+func (g *gregorHandler) retryLoop() {
+	for m := range g.retryCh {
+		<-g.G().Clock().After(GregorRetryThrottleInterval)
+
+		incomingClient := gregor1.IncomingClient{Cli: g.cli}
+		if err := incomingClient.ConsumeMessage(context.Background(), m); err != nil {
+			if g.isRateLimitError(err) {
+				// Still throttled: put the message back and go around again
+				select {
+				case g.retryCh <- m:
+				default:
+					g.Debug("retryLoop: retry queue full, dropping message")
+				}
+				continue
+			}
+			g.Debug("retryLoop: error retrying message: %s", err)
+		}
+		if len(g.retryCh) == 0 {
+			g.G().NotifyRouter.HandleGregorThrottled(false)
+		}
+	}
+}
+
+// isAuthError returns true if the given error from gregord means our session
+// token is no longer any good, as opposed to a connectivity problem.
+func (g *gregorHandler) isAuthError(err error) bool {
+	switch err := err.(type) {
+	case libkb.AppStatusError:
+		switch err.Code {
+		case int(keybase1.StatusCode_SCLoginRequired), int(keybase1.StatusCode_SCBadSession):
+			return true
+		}
+	}
+	return false
+}
+
+// reAuthenticate re-runs authentication on the live connection after gregord
+// has rejected our session token.
+func (g *gregorHandler) reAuthenticate(ctx context.Context) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if !g.IsConnected() {
+		return errors.New("not connected to gregord")
+	}
+	return g.auth(ctx, g.cli)
+}
+
+// checkAuthError inspects an error that came back from a gregord RPC. If it
+// indicates an expired session token, we try re-running auth on the live
+// connection, and only tear the connection down for a full reconnect (and the
+// state sync that comes with it) if the re-auth fails.
+func (g *gregorHandler) checkAuthError(ctx context.Context, err error) {
+	if !g.isAuthError(err) {
+		return
+	}
+	g.Debug("auth error from gregord: %s; attempting re-auth on live connection", err)
+	if rerr := g.reAuthenticate(ctx); rerr != nil {
+		g.Debug("re-auth failed: %s; falling back to full reconnect", rerr)
+		g.Shutdown()
+		if cerr := g.Connect(g.uri); cerr != nil {
+			g.Debug("error reconnecting after failed re-auth: %s", cerr)
+		}
+		return
+	}
+	g.Debug("re-auth success, connection preserved")
+}
+
+// forceReconnect kicks the reconnect machinery of the existing
+// rpc.Connection, keeping our handlers, the state machine, and freshReplay
+// intact. OnConnect runs as usual once the new transport is up.
+func (g *gregorHandler) forceReconnect(ctx context.Context) error {
+	g.connMutex.Lock()
+	conn := g.conn
+	g.connMutex.Unlock()
+	if conn == nil {
+		return errors.New("no connection to reconnect")
+	}
+	return conn.ForceReconnect(ctx)
+}
+
 func (g *gregorHandler) pingLoop() {
 
 	duration := g.G().Env.GetGregorPingInterval()
@@ -1009,11 +3914,13 @@ func (g *gregorHandler) pingLoop() {
 	g.Debug("ping loop: starting up: duration: %v timeout: %v", duration, timeout)
 	defer g.Debug("ping loop: terminating")
 
+	consecutiveTimeouts := 0
 	for {
 		select {
 		case <-g.G().Clock().After(duration):
 			var err error
 			ctx := context.Background()
+			start := g.G().Clock().Now()
 			if g.IsConnected() {
 				// If we are connected, subject the ping call to a fairly
 				// aggressive timeout so our chat stuff can be responsive
@@ -1030,14 +3937,39 @@ func (g *gregorHandler) pingLoop() {
 				_, err = gregor1.IncomingClient{Cli: g.pingCli}.Ping(ctx)
 			}
 
+			// Record the outcome so connection quality queries have something
+			// to report
+			if err == nil {
+				now := g.G().Clock().Now()
+				g.rttTracker.recordSuccess(now.Sub(start), now)
+				consecutiveTimeouts = 0
+			} else {
+				g.rttTracker.recordLoss()
+			}
+
 			if err != nil {
 				g.Debug("ping loop: error: %s", err.Error())
+				g.checkAuthError(ctx, err)
 				if err == context.DeadlineExceeded {
-					g.Debug("ping loop: timeout: terminating connection")
-					g.Shutdown()
-
-					if err := g.Connect(g.uri); err != nil {
-						g.Debug("ping loop: error connecting: %s", err.Error())
+					g.stats.incr(&g.stats.pingTimeouts)
+					consecutiveTimeouts++
+					if consecutiveTimeouts < gregorPingReconnectLimit {
+						// Bounce just the transport so we keep the gregor
+						// client and get an incremental replay, rather than
+						// rebuilding the world with a full Connect
+						g.Debug("ping loop: timeout: forcing reconnect")
+						if err := g.forceReconnect(context.Background()); err != nil {
+							g.Debug("ping loop: error force reconnecting: %s", err.Error())
+						}
+					} else {
+						g.Debug("ping loop: timeout: %d consecutive, terminating connection",
+							consecutiveTimeouts)
+						consecutiveTimeouts = 0
+						g.Shutdown()
+
+						if err := g.Connect(g.uri); err != nil {
+							g.Debug("ping loop: error connecting: %s", err.Error())
+						}
 					}
 				}
 			}
@@ -1046,22 +3978,82 @@ func (g *gregorHandler) pingLoop() {
 
 }
 
+// gregorTLSConfig builds a tls.Config honoring the Env options for talking
+// to a self-hosted gregord: an alternate CA file, the system cert pool, or a
+// pinned SPKI hash. It returns nil if the default bundled-CA behavior should
+// be used.
+func (g *gregorHandler) gregorTLSConfig() (*tls.Config, error) {
+	if pin := g.G().Env.GetGregorPinnedSPKIHash(); pin != "" {
+		want, err := hex.DecodeString(pin)
+		if err != nil {
+			return nil, fmt.Errorf("bad gregor SPKI pin: %s", err)
+		}
+		return &tls.Config{
+			// Chain validation is replaced by the SPKI pin check below
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errors.New("no peer certificate for SPKI pin check")
+				}
+				cert, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if !bytes.Equal(sum[:], want) {
+					return errors.New("gregor server SPKI hash doesn't match pin")
+				}
+				return nil
+			},
+		}, nil
+	}
+	if caFile := g.G().Env.GetGregorTLSCAFile(); caFile != "" {
+		rawCA, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rawCA) {
+			return nil, fmt.Errorf("no CA certs found in %s", caFile)
+		}
+		return &tls.Config{RootCAs: pool}, nil
+	}
+	if g.G().Env.GetGregorUseSystemCA() {
+		// A nil RootCAs means the system cert pool
+		return &tls.Config{}, nil
+	}
+	return nil, nil
+}
+
 func (g *gregorHandler) connectTLS() error {
 	uri := g.uri
 	g.Debug("connecting to gregord via TLS at %s", uri)
-	rawCA := g.G().Env.GetBundledCA(uri.Host)
-	if len(rawCA) == 0 {
-		return fmt.Errorf("No bundled CA for %s", uri.Host)
+
+	tlsConfig, err := g.gregorTLSConfig()
+	if err != nil {
+		return err
 	}
-	g.Debug("Using CA for gregor: %s", libkb.ShortCA(rawCA))
 
-	g.connMutex.Lock()
 	opts := rpc.ConnectionOpts{
 		WrapErrorFunc:    libkb.WrapError,
 		ReconnectBackoff: backoff.NewConstantBackOff(GregorConnectionRetryInterval),
 	}
-	g.conn = rpc.NewTLSConnection(uri.HostPort, []byte(rawCA), libkb.ErrorUnwrapper{}, g, libkb.NewRPCLogFactory(g.G()), g.G().Log, opts)
-	g.connMutex.Unlock()
+	if tlsConfig != nil {
+		g.Debug("using custom TLS config for gregor")
+		g.connMutex.Lock()
+		g.conn = rpc.NewTLSConnectionWithTLSConfig(uri.HostPort, tlsConfig, libkb.ErrorUnwrapper{}, g, libkb.NewRPCLogFactory(g.G()), g.G().Log, opts)
+		g.connMutex.Unlock()
+	} else {
+		rawCA := g.G().Env.GetBundledCA(uri.Host)
+		if len(rawCA) == 0 {
+			return fmt.Errorf("No bundled CA for %s", uri.Host)
+		}
+		g.Debug("Using CA for gregor: %s", libkb.ShortCA(rawCA))
+
+		g.connMutex.Lock()
+		g.conn = rpc.NewTLSConnection(uri.HostPort, []byte(rawCA), libkb.ErrorUnwrapper{}, g, libkb.NewRPCLogFactory(g.G()), g.G().Log, opts)
+		g.connMutex.Unlock()
+	}
 
 	// The client we get here will reconnect to gregord on disconnect if necessary.
 	// We should grab it here instead of in OnConnect, since the connection is not
@@ -1132,7 +4124,7 @@ func (g *gregorHandler) templateMessage() (*gregor1.Message, error) {
 	}, nil
 }
 
-func (g *gregorHandler) DismissItem(id gregor.MsgID) error {
+func (g *gregorHandler) DismissItem(ctx context.Context, id gregor.MsgID) error {
 	if id == nil {
 		return nil
 	}
@@ -1150,13 +4142,82 @@ func (g *gregorHandler) DismissItem(id gregor.MsgID) error {
 		MsgIDs_: []gregor1.MsgID{gregor1.MsgID(id.Bytes())},
 	}
 
+	// Apply the dismissal to the local state machine right away, so the badge
+	// clears without waiting on the server round trip.
+	g.applyLocalDismissal(*dismissal)
+
 	incomingClient := gregor1.IncomingClient{Cli: g.cli}
-	// TODO: Should the interface take a context from the caller?
-	err = incomingClient.ConsumeMessage(context.TODO(), *dismissal)
+	err = incomingClient.ConsumeMessage(ctx, *dismissal)
+	if err != nil {
+		g.checkAuthError(ctx, err)
+		// If we're being throttled, the dismissal stays applied locally and
+		// gets resent in the background, so don't roll back or surface the
+		// error.
+		if g.isRateLimitError(err) && g.queueRetry(*dismissal) {
+			return nil
+		}
+		// A timeout is not definitive: the server may well have applied the
+		// dismissal, and the next sync will reconcile us either way. Any
+		// other failure means the dismissal didn't happen, so put the item
+		// back.
+		if err != ErrGregorTimeout {
+			g.rollbackLocalDismissal(*dismissal, id)
+		}
+	}
 	return err
 }
 
-func (g *gregorHandler) InjectItem(cat string, body []byte) (gregor.MsgID, error) {
+// applyLocalDismissal optimistically runs a dismissal against the local state
+// machine and pushes the resulting state out to firehose handlers and the
+// badger. The work is queued to the broadcast loop rather than done inline:
+// DismissItem gets called from in-band handler dispatch, which runs with the
+// handler lock held, so taking the lock on the caller's goroutine would
+// deadlock.
+func (g *gregorHandler) applyLocalDismissal(m gregor1.Message) {
+	g.localOpCh <- func() {
+		g.Lock()
+		defer g.Unlock()
+
+		gcli, err := g.getGregorCli()
+		if err != nil {
+			return
+		}
+		if err := gcli.StateMachineConsumeMessage(m); err != nil {
+			g.Debug("applyLocalDismissal: failed to consume dismissal: %s", err)
+			return
+		}
+		g.pushState(keybase1.PushReason_NEW_DATA)
+	}
+}
+
+// rollbackLocalDismissal reverses an optimistic dismissal after the server
+// definitively rejected it, reinstating the dismissed item in local state.
+// It queues to the same loop as applyLocalDismissal, both to stay safe from
+// handler dispatch and so the rollback always runs after the apply it
+// reverses.
+func (g *gregorHandler) rollbackLocalDismissal(m gregor1.Message, id gregor.MsgID) {
+	g.localOpCh <- func() {
+		g.Lock()
+		defer g.Unlock()
+
+		gcli, err := g.getGregorCli()
+		if err != nil {
+			return
+		}
+		rb, ok := gcli.Sm.(gregor.DismissalRollbacker)
+		if !ok {
+			g.Debug("rollbackLocalDismissal: state machine can't roll back dismissals")
+			return
+		}
+		if err := rb.RollbackDismissal(gcli.User, m.Ibm_.StateUpdate_.Md_.MsgID_, []gregor.MsgID{id}); err != nil {
+			g.Debug("rollbackLocalDismissal: %s", err)
+			return
+		}
+		g.pushState(keybase1.PushReason_NEW_DATA)
+	}
+}
+
+func (g *gregorHandler) InjectItem(ctx context.Context, cat string, body []byte) (gregor.MsgID, error) {
 	var err error
 	defer g.G().Trace(fmt.Sprintf("gregorHandler.InjectItem(%s)", cat),
 		func() error { return err },
@@ -1172,12 +4233,75 @@ func (g *gregorHandler) InjectItem(cat string, body []byte) (gregor.MsgID, error
 	}
 
 	incomingClient := gregor1.IncomingClient{Cli: g.cli}
-	// TODO: Should the interface take a context from the caller?
-	err = incomingClient.ConsumeMessage(context.TODO(), *creation)
+	err = incomingClient.ConsumeMessage(ctx, *creation)
+	if err != nil {
+		g.checkAuthError(ctx, err)
+		// If we're being throttled, the creation gets resent in the
+		// background and the caller can treat the injection as queued.
+		if g.isRateLimitError(err) && g.queueRetry(*creation) {
+			err = nil
+		}
+	}
+	if err == nil {
+		g.noteInjectedItem(creation.Ibm_.StateUpdate_.Md_.MsgID_)
+	}
 	return creation.Ibm_.StateUpdate_.Md_.MsgID_, err
 }
 
-func (g *gregorHandler) InjectOutOfBandMessage(system string, body []byte) error {
+// ItemSpec describes a single item to be created by InjectItems.
+type ItemSpec struct {
+	Category string
+	Body     []byte
+}
+
+// InjectItems creates several gregor items with a single ConsumeMessage RPC.
+// The items ride along in the creations list of one state update message,
+// each with its own message ID.
+func (g *gregorHandler) InjectItems(ctx context.Context, specs []ItemSpec) (res []gregor.MsgID, err error) {
+	defer g.G().Trace(fmt.Sprintf("gregorHandler.InjectItems(%d items)", len(specs)),
+		func() error { return err },
+	)()
+
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	creation, err := g.templateMessage()
+	if err != nil {
+		return nil, err
+	}
+	uid := creation.Ibm_.StateUpdate_.Md_.Uid_
+	for _, spec := range specs {
+		msgID, err := NewGregorMsgID()
+		if err != nil {
+			return nil, err
+		}
+		creation.Ibm_.StateUpdate_.Creations_ = append(creation.Ibm_.StateUpdate_.Creations_,
+			gregor1.ItemAndMetadata{
+				Md_: &gregor1.Metadata{
+					Uid_:   uid,
+					MsgID_: msgID,
+				},
+				Item_: &gregor1.Item{
+					Category_: gregor1.Category(spec.Category),
+					Body_:     gregor1.Body(spec.Body),
+				},
+			})
+		res = append(res, msgID)
+	}
+
+	incomingClient := gregor1.IncomingClient{Cli: g.cli}
+	if err = incomingClient.ConsumeMessage(ctx, *creation); err != nil {
+		g.checkAuthError(ctx, err)
+		return nil, err
+	}
+	for _, msgID := range res {
+		g.noteInjectedItem(msgID)
+	}
+	return res, nil
+}
+
+func (g *gregorHandler) InjectOutOfBandMessage(ctx context.Context, system string, body []byte) error {
 	var err error
 	defer g.G().Trace(fmt.Sprintf("gregorHandler.InjectOutOfBandMessage(%s)", system),
 		func() error { return err },
@@ -1199,8 +4323,10 @@ func (g *gregorHandler) InjectOutOfBandMessage(system string, body []byte) error
 	}
 
 	incomingClient := gregor1.IncomingClient{Cli: g.cli}
-	// TODO: Should the interface take a context from the caller?
-	err = incomingClient.ConsumeMessage(context.TODO(), msg)
+	err = incomingClient.ConsumeMessage(ctx, msg)
+	if err != nil {
+		g.checkAuthError(ctx, err)
+	}
 	return err
 }
 
@@ -1223,14 +4349,82 @@ func newGregorRPCHandler(xp rpc.Transporter, g *libkb.GlobalContext, gh *gregorH
 	}
 }
 
+// stateIsStale reports whether the local state machine might be behind the
+// server: either we've never synced since restoring from disk, or we're
+// currently disconnected.
+func (g *gregorHandler) stateIsStale() bool {
+	return g.freshReplay || !g.IsConnected()
+}
+
+// ensureGregorClient returns the local gregor client, building one from
+// local storage if we don't have one yet. It works without a server
+// connection (standalone mode included); all it needs is a logged-in user
+// and device.
+func (g *gregorHandler) ensureGregorClient() (*grclient.Client, error) {
+	if g == nil {
+		return nil, errors.New("gregor service not available (are you in standalone?)")
+	}
+	if g.gregorCli == nil {
+		if err := g.resetGregorClient(); err != nil {
+			return nil, err
+		}
+	}
+	return g.gregorCli, nil
+}
+
 func (g *gregorHandler) getState() (res gregor1.State, err error) {
-	var s gregor.State
+	res, _, err = g.getStateSnapshot()
+	return res, err
+}
 
-	if g == nil || g.gregorCli == nil {
-		return res, errors.New("gregor service not available (are you in standalone?)")
+// getStateSnapshot returns a consistent snapshot of the local state along
+// with its generation number, so concurrent broadcasts can't be observed
+// half-applied.
+func (g *gregorHandler) getStateSnapshot() (res gregor1.State, gen int64, err error) {
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return res, gen, err
+	}
+
+	s, gen, err := gcli.StateMachineSnapshot(nil)
+	if err != nil {
+		return res, gen, err
+	}
+
+	ps, err := s.Export()
+	if err != nil {
+		return res, gen, err
+	}
+
+	var ok bool
+	if res, ok = ps.(gregor1.State); !ok {
+		return res, gen, errors.New("failed to convert state to exportable format")
+	}
+
+	return res, gen, nil
+}
+
+func (g *gregorRPCHandler) GetState(_ context.Context) (res gregor1.State, err error) {
+	return g.gh.getState()
+}
+
+func (g *gregorRPCHandler) GetLocalState(_ context.Context) (res keybase1.LocalGregorState, err error) {
+	if res.State, res.Generation, err = g.gh.getStateSnapshot(); err != nil {
+		return res, err
+	}
+	res.Stale = g.gh.stateIsStale()
+	return res, nil
+}
+
+// getStateAtTime reconstructs the local state as of the given time, for
+// debugging why an item or badge was visible.
+func (g *gregorHandler) getStateAtTime(t time.Time) (res gregor1.State, err error) {
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return res, err
 	}
 
-	s, err = g.gregorCli.StateMachineState(nil)
+	s, err := gcli.StateMachineStateAt(t)
 	if err != nil {
 		return res, err
 	}
@@ -1248,8 +4442,242 @@ func (g *gregorHandler) getState() (res gregor1.State, err error) {
 	return res, nil
 }
 
-func (g *gregorRPCHandler) GetState(_ context.Context) (res gregor1.State, err error) {
-	return g.gh.getState()
+// searchItems finds live items whose JSON body contains the given substring,
+// case-insensitively. Meant for support tooling digging for a UID or
+// conversation ID.
+func (g *gregorHandler) searchItems(query string) (res []gregor1.ItemAndMetadata, err error) {
+	g.Lock()
+	defer g.Unlock()
+
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return nil, err
+	}
+	searcher, ok := gcli.Sm.(gregor.ItemSearcher)
+	if !ok {
+		return nil, errors.New("state machine cannot search item bodies")
+	}
+	items, err := searcher.SearchItems(gcli.User, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		iam, ok := it.(gregor1.ItemAndMetadata)
+		if !ok {
+			return nil, errors.New("failed to convert item to exportable format")
+		}
+		res = append(res, iam)
+	}
+	return res, nil
+}
+
+// SetCategoryRetention bounds how many items (and how old) the local state
+// machine keeps for a category; zero means unlimited. Pruning happens as
+// messages are consumed.
+func (g *gregorHandler) SetCategoryRetention(category string, maxItems int, maxAge time.Duration) error {
+	g.Lock()
+	defer g.Unlock()
+
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return err
+	}
+	rs, ok := gcli.Sm.(gregor.RetentionSetter)
+	if !ok {
+		return errors.New("state machine doesn't support retention policies")
+	}
+	rs.SetRetentionPolicy(category, maxItems, maxAge)
+	return nil
+}
+
+// ListItems enumerates the current items in the given category (all
+// categories if empty) in state order, without exporting the entire state.
+// For pagination, pass the MsgID of the last item of the previous page as
+// offsetMsgID to resume after it; a limit of 0 means no limit.
+func (g *gregorHandler) ListItems(ctx context.Context, category string, limit int,
+	offsetMsgID gregor.MsgID) ([]gregor.Item, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return nil, err
+	}
+	state, err := gcli.StateMachineState(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []gregor.Item
+	if category != "" {
+		cat, err := gcli.Sm.ObjFactory().MakeCategory(category)
+		if err != nil {
+			return nil, err
+		}
+		if items, err = state.ItemsInCategory(cat); err != nil {
+			return nil, err
+		}
+	} else if items, err = state.Items(); err != nil {
+		return nil, err
+	}
+
+	// Resume after the offset item if one was given
+	if offsetMsgID != nil {
+		for i, it := range items {
+			if bytes.Equal(it.Metadata().MsgID().Bytes(), offsetMsgID.Bytes()) {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+// getStateByCategoryPrefix filters the state down to items whose category
+// starts with the given prefix, so UIs don't have to ship the whole state
+// over IPC just to pick out a few items.
+func (g *gregorHandler) getStateByCategoryPrefix(prefix string) (res gregor1.State, err error) {
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return res, err
+	}
+	cp, err := gcli.Sm.ObjFactory().MakeCategory(prefix)
+	if err != nil {
+		return res, err
+	}
+	s, err := gcli.StateMachineStateByCategoryPrefix(nil, cp)
+	if err != nil {
+		return res, err
+	}
+	ps, err := s.Export()
+	if err != nil {
+		return res, err
+	}
+	var ok bool
+	if res, ok = ps.(gregor1.State); !ok {
+		return res, errors.New("failed to convert state to exportable format")
+	}
+	return res, nil
+}
+
+// exportLocalState dumps the local state machine -- items, dismissals, and
+// the replay cursor -- so support can capture repro cases and users can move
+// state between devices.
+func (g *gregorHandler) exportLocalState() (res keybase1.GregorStateDump, err error) {
+	g.Lock()
+	defer g.Unlock()
+
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return res, err
+	}
+	s, err := gcli.StateMachineState(nil)
+	if err != nil {
+		return res, err
+	}
+	if res.State, err = s.Marshal(); err != nil {
+		return res, err
+	}
+	if pt := g.replayStartTime(gcli); pt != nil {
+		res.ReplayCursor = keybase1.ToTime(*pt)
+	}
+	return res, nil
+}
+
+// importLocalState replaces the local state machine with a previously
+// exported dump and pushes the new state out to anyone listening.
+func (g *gregorHandler) importLocalState(dump keybase1.GregorStateDump) error {
+	g.Lock()
+	defer g.Unlock()
+
+	gcli, err := g.ensureGregorClient()
+	if err != nil {
+		return err
+	}
+	state, err := gcli.Sm.ObjFactory().UnmarshalState(dump.State)
+	if err != nil {
+		return err
+	}
+	if err := gcli.StateMachineInitState(state); err != nil {
+		return err
+	}
+	// For engines that don't persist on their own
+	if err := gcli.Save(); err != nil {
+		g.Debug("importLocalState: unable to save: %s", err)
+	}
+	g.pushState(keybase1.PushReason_NEW_DATA)
+	return nil
+}
+
+func (g *gregorRPCHandler) GetStateByCategoryPrefix(_ context.Context, categoryPrefix string) (res gregor1.State, err error) {
+	return g.gh.getStateByCategoryPrefix(categoryPrefix)
+}
+
+func (g *gregorRPCHandler) ExportLocalState(_ context.Context) (res keybase1.GregorStateDump, err error) {
+	return g.gh.exportLocalState()
+}
+
+func (g *gregorRPCHandler) ImportLocalState(_ context.Context, dump keybase1.GregorStateDump) error {
+	return g.gh.importLocalState(dump)
+}
+
+func (g *gregorRPCHandler) GetStateAtTime(_ context.Context, atTime keybase1.Time) (res gregor1.State, err error) {
+	return g.gh.getStateAtTime(keybase1.FromTime(atTime))
+}
+
+func (g *gregorRPCHandler) SearchItems(_ context.Context, query string) (res []gregor1.ItemAndMetadata, err error) {
+	return g.gh.searchItems(query)
+}
+
+func (g *gregorRPCHandler) ListUnhandled(_ context.Context) (res []keybase1.UnhandledMessage, err error) {
+	return g.gh.listUnhandled(), nil
+}
+
+func (g *gregorRPCHandler) GetAuditLog(_ context.Context, maxEntries int) (res []keybase1.GregorAuditEntry, err error) {
+	return g.gh.audit.dump(maxEntries), nil
+}
+
+func (g *gregorRPCHandler) ListOOBMQuarantine(_ context.Context) (res []keybase1.QuarantinedOOBM, err error) {
+	if g.gh.oobmQuarantine == nil {
+		return nil, nil
+	}
+	return g.gh.oobmQuarantine.list(), nil
+}
+
+func (g *gregorRPCHandler) PurgeOOBMQuarantine(_ context.Context) error {
+	if g.gh.oobmQuarantine == nil {
+		return nil
+	}
+	g.gh.oobmQuarantine.purge()
+	return nil
+}
+
+func (g *gregorRPCHandler) CompactLocalState(_ context.Context) (res int, err error) {
+	// A manual compaction takes every dismissed item, not just old ones
+	return g.gh.compactLocalState(0)
+}
+
+func (g *gregorRPCHandler) GetConnectionQuality(_ context.Context) (res keybase1.ConnectionQuality, err error) {
+	return g.gh.rttTracker.connectionQuality(), nil
+}
+
+func (g *gregorRPCHandler) ListPushStateFilters(_ context.Context) (res []keybase1.PushStateFilter, err error) {
+	return g.gh.listPushStateFilters(), nil
+}
+
+func (g *gregorRPCHandler) TogglePushStateFilter(_ context.Context, arg keybase1.TogglePushStateFilterArg) error {
+	return g.gh.togglePushStateFilter(arg.Name, arg.Enabled)
+}
+
+func (g *gregorRPCHandler) GetStats(_ context.Context) (res keybase1.GregorStats, err error) {
+	res = g.gh.stats.export()
+	res.ClockSkewMsec = int64(g.gh.clockSkew.estimate() / time.Millisecond)
+	res.HandlerStats = g.gh.metrics.export()
+	res.OobmStats = g.gh.oobmThroughput.export()
+	return res, nil
 }
 
 func WrapGenericClientWithTimeout(client rpc.GenericClient, timeout time.Duration, timeoutErr error) rpc.GenericClient {
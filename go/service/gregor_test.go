@@ -106,11 +106,22 @@ func (n *nlistener) PGPKeyInSecretStoreFile()
 func (n *nlistener) FSSyncStatusResponse(arg keybase1.FSSyncStatusArg)                  {}
 func (n *nlistener) FSSyncEvent(arg keybase1.FSPathSyncStatus)                          {}
 func (n *nlistener) ReachabilityChanged(r keybase1.Reachability)                        {}
+func (n *nlistener) GregorThrottled(throttled bool)                                     {}
+func (n *nlistener) GregorConnectFatal(reason string)                                   {}
+func (n *nlistener) GregorHandlerQuarantined(name string)                               {}
+func (n *nlistener) GenericGregorEvent(system string, body string)                      {}
 func (n *nlistener) ChatTLFFinalize(uid keybase1.UID, convID chat1.ConversationID, info chat1.ConversationFinalizeInfo) {
 }
 func (n *nlistener) ChatTLFResolve(uid keybase1.UID, convID chat1.ConversationID, info chat1.ConversationResolveInfo) {
 }
 func (n *nlistener) ChatInboxStale(uid keybase1.UID) {}
+func (n *nlistener) ChatTypingUpdate(uid keybase1.UID, convID chat1.ConversationID, typer keybase1.UID, typing bool) {
+}
+func (n *nlistener) ChatMembersUpdate(uid keybase1.UID, convID chat1.ConversationID, joined []keybase1.UID, left []keybase1.UID) {
+}
+func (n *nlistener) ChatMessageConflict(uid keybase1.UID, convID chat1.ConversationID, msgID chat1.MessageID) {
+}
+func (n *nlistener) ChatCompactionProgress(uid keybase1.UID, done int, total int) {}
 func (n *nlistener) ChatThreadsStale(uid keybase1.UID, cids []chat1.ConversationID) {
 	select {
 	case n.threadStale <- cids:
@@ -263,6 +274,18 @@ func (m mockGregord) Sync(_ context.Context, arg gregor1.SyncArg) (gregor1.SyncR
 	return res, nil
 }
 
+func (m mockGregord) SyncCheckpoint(ctx context.Context, arg gregor1.SyncCheckpointArg) (gregor1.SyncCheckpointResult, error) {
+	var res gregor1.SyncCheckpointResult
+	sres, err := m.Sync(ctx, gregor1.SyncArg{Uid: arg.Uid, Deviceid: arg.Deviceid, Ctime: arg.Ctime})
+	if err != nil {
+		return res, err
+	}
+	res.HashMatch = true
+	res.Msgs = sres.Msgs
+	res.Hash = sres.Hash
+	return res, nil
+}
+
 func (m mockGregord) ConsumeMessage(_ context.Context, msg gregor1.Message) error {
 	m.log.Debug("mockGregord: ConsumeMessage: msgID: %s Ctime: %s", msg.ToInBandMessage().Metadata().MsgID(),
 		msg.ToInBandMessage().Metadata().CTime())
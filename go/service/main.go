@@ -281,6 +281,10 @@ func (d *Service) createChatSources() {
 	d.G().AddUserChangedHandler(chat.NewIdentifyChangedHandler(d.G(), func() keybase1.TlfInterface {
 		return tlf
 	}))
+
+	// The boxer caches sender key revocation checks, bust that cache on
+	// sigchain changes
+	d.G().AddUserChangedHandler(boxer)
 }
 
 func (d *Service) configureRekey(uir *UIRouter) {
@@ -321,6 +325,11 @@ func (d *Service) startupGregor() {
 		d.G().GregorDismisser = d.gregor
 		d.G().GregorListener = d.gregor
 
+		// Prune a connection's handlers the moment it goes away, rather than
+		// lazily on the next broadcast
+		d.G().ConnectionManager.RegisterDisconnectHook(d.gregor.RemoveHandler)
+		d.G().ConnectionManager.RegisterDisconnectHook(d.gregor.RemoveFirehoseHandler)
+
 		// Add default handlers
 		d.gregor.PushHandler(newUserHandler(d.G()))
 		// TODO -- get rid of this?
@@ -679,21 +688,28 @@ func (d *Service) GregorDismiss(id gregor.MsgID) error {
 	if d.gregor == nil {
 		return errors.New("can't gregor dismiss without a gregor")
 	}
-	return d.gregor.DismissItem(id)
+	return d.gregor.DismissItem(context.Background(), id)
 }
 
 func (d *Service) GregorInject(cat string, body []byte) (gregor.MsgID, error) {
 	if d.gregor == nil {
 		return nil, errors.New("can't gregor inject without a gregor")
 	}
-	return d.gregor.InjectItem(cat, body)
+	return d.gregor.InjectItem(context.Background(), cat, body)
 }
 
 func (d *Service) GregorInjectOutOfBandMessage(sys string, body []byte) error {
 	if d.gregor == nil {
 		return errors.New("can't gregor inject without a gregor")
 	}
-	return d.gregor.InjectOutOfBandMessage(sys, body)
+	return d.gregor.InjectOutOfBandMessage(context.Background(), sys, body)
+}
+
+func (d *Service) GregorNetworkChanged() error {
+	if d.gregor == nil {
+		return errors.New("can't notify network change without a gregor")
+	}
+	return d.gregor.NetworkChanged()
 }
 
 func (d *Service) HasGregor() bool {
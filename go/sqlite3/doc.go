@@ -0,0 +1,11 @@
+// Copyright 2017 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+// Package sqlite3 is a minimal database/sql driver backed by the system
+// SQLite library. It exists so the chat SQL storage engine has a driver to
+// link against; it is only compiled into builds with the chatsqlite tag, so
+// regular builds carry no cgo dependency on SQLite. The driver registers
+// itself under the name "sqlite3" and covers the subset of database/sql the
+// chat engine uses: prepared statements with string, integer and blob
+// arguments, multi-statement scripts with no arguments, and transactions.
+package sqlite3
@@ -0,0 +1,295 @@
+// Copyright 2017 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+// +build chatsqlite
+
+package sqlite3
+
+/*
+#cgo LDFLAGS: -lsqlite3
+#include <sqlite3.h>
+#include <stdlib.h>
+
+// SQLITE_TRANSIENT is a macro expanding to a function pointer constant, which
+// cgo cannot reference directly.
+static int kb_bind_text(sqlite3_stmt *s, int n, const char *p, int np) {
+	return sqlite3_bind_text(s, n, p, np, SQLITE_TRANSIENT);
+}
+static int kb_bind_blob(sqlite3_stmt *s, int n, const void *p, int np) {
+	return sqlite3_bind_blob(s, n, p, np, SQLITE_TRANSIENT);
+}
+*/
+import "C"
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	sql.Register("sqlite3", &Driver{})
+}
+
+// Driver implements database/sql/driver.Driver over the system SQLite
+// library.
+type Driver struct{}
+
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	var db *C.sqlite3
+	rc := C.sqlite3_open_v2(cname, &db,
+		C.SQLITE_OPEN_READWRITE|C.SQLITE_OPEN_CREATE|C.SQLITE_OPEN_FULLMUTEX, nil)
+	if rc != C.SQLITE_OK {
+		if db != nil {
+			err := fmt.Errorf("sqlite3: open %s: %s", name, C.GoString(C.sqlite3_errmsg(db)))
+			C.sqlite3_close_v2(db)
+			return nil, err
+		}
+		return nil, fmt.Errorf("sqlite3: open %s: error code %d", name, int(rc))
+	}
+	// Wait out writers on other connections rather than failing with
+	// SQLITE_BUSY right away
+	C.sqlite3_busy_timeout(db, 5000)
+	return &conn{db: db}, nil
+}
+
+type conn struct {
+	db *C.sqlite3
+}
+
+func (c *conn) lastError() error {
+	return fmt.Errorf("sqlite3: %s", C.GoString(C.sqlite3_errmsg(c.db)))
+}
+
+// Prepare readies the first statement in query. The chat engine only ever
+// prepares single statements; multi-statement scripts go through Exec.
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	cquery := C.CString(query)
+	defer C.free(unsafe.Pointer(cquery))
+
+	var s *C.sqlite3_stmt
+	if rc := C.sqlite3_prepare_v2(c.db, cquery, -1, &s, nil); rc != C.SQLITE_OK {
+		return nil, c.lastError()
+	}
+	if s == nil {
+		return nil, fmt.Errorf("sqlite3: empty query")
+	}
+	return &stmt{c: c, s: s}, nil
+}
+
+// Exec runs every statement in an argument-free script, which is how the chat
+// engine applies its schema. Anything with arguments falls back to the
+// prepared statement path.
+func (c *conn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if len(args) > 0 {
+		return nil, driver.ErrSkip
+	}
+	cquery := C.CString(query)
+	defer C.free(unsafe.Pointer(cquery))
+
+	tail := cquery
+	for {
+		var s *C.sqlite3_stmt
+		var next *C.char
+		if rc := C.sqlite3_prepare_v2(c.db, tail, -1, &s, &next); rc != C.SQLITE_OK {
+			return nil, c.lastError()
+		}
+		if s != nil {
+			rc := C.sqlite3_step(s)
+			C.sqlite3_finalize(s)
+			if rc != C.SQLITE_DONE && rc != C.SQLITE_ROW {
+				return nil, c.lastError()
+			}
+		}
+		if next == nil || *next == 0 {
+			break
+		}
+		tail = next
+	}
+	return c.result(), nil
+}
+
+func (c *conn) result() driver.Result {
+	return &result{
+		lastID:  int64(C.sqlite3_last_insert_rowid(c.db)),
+		changes: int64(C.sqlite3_changes(c.db)),
+	}
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if _, err := c.Exec("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &tx{c: c}, nil
+}
+
+func (c *conn) Close() error {
+	if rc := C.sqlite3_close_v2(c.db); rc != C.SQLITE_OK {
+		return c.lastError()
+	}
+	c.db = nil
+	return nil
+}
+
+type tx struct {
+	c *conn
+}
+
+func (t *tx) Commit() error {
+	_, err := t.c.Exec("COMMIT", nil)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	_, err := t.c.Exec("ROLLBACK", nil)
+	return err
+}
+
+type result struct {
+	lastID  int64
+	changes int64
+}
+
+func (r *result) LastInsertId() (int64, error) {
+	return r.lastID, nil
+}
+
+func (r *result) RowsAffected() (int64, error) {
+	return r.changes, nil
+}
+
+type stmt struct {
+	c *conn
+	s *C.sqlite3_stmt
+}
+
+func (s *stmt) NumInput() int {
+	return int(C.sqlite3_bind_parameter_count(s.s))
+}
+
+func (s *stmt) bind(args []driver.Value) error {
+	C.sqlite3_reset(s.s)
+	C.sqlite3_clear_bindings(s.s)
+	for i, arg := range args {
+		n := C.int(i + 1)
+		var rc C.int
+		switch v := arg.(type) {
+		case nil:
+			rc = C.sqlite3_bind_null(s.s, n)
+		case int64:
+			rc = C.sqlite3_bind_int64(s.s, n, C.sqlite3_int64(v))
+		case bool:
+			var b int64
+			if v {
+				b = 1
+			}
+			rc = C.sqlite3_bind_int64(s.s, n, C.sqlite3_int64(b))
+		case float64:
+			rc = C.sqlite3_bind_double(s.s, n, C.double(v))
+		case string:
+			cv := C.CString(v)
+			rc = C.kb_bind_text(s.s, n, cv, C.int(len(v)))
+			C.free(unsafe.Pointer(cv))
+		case []byte:
+			if len(v) == 0 {
+				rc = C.sqlite3_bind_zeroblob(s.s, n, 0)
+			} else {
+				rc = C.kb_bind_blob(s.s, n, unsafe.Pointer(&v[0]), C.int(len(v)))
+			}
+		case time.Time:
+			formatted := v.Format(time.RFC3339Nano)
+			cv := C.CString(formatted)
+			rc = C.kb_bind_text(s.s, n, cv, C.int(len(formatted)))
+			C.free(unsafe.Pointer(cv))
+		default:
+			return fmt.Errorf("sqlite3: unsupported bind type %T", arg)
+		}
+		if rc != C.SQLITE_OK {
+			return s.c.lastError()
+		}
+	}
+	return nil
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.bind(args); err != nil {
+		return nil, err
+	}
+	rc := C.sqlite3_step(s.s)
+	C.sqlite3_reset(s.s)
+	if rc != C.SQLITE_DONE && rc != C.SQLITE_ROW {
+		return nil, s.c.lastError()
+	}
+	return s.c.result(), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.bind(args); err != nil {
+		return nil, err
+	}
+	return &rows{s: s}, nil
+}
+
+func (s *stmt) Close() error {
+	if rc := C.sqlite3_finalize(s.s); rc != C.SQLITE_OK {
+		return s.c.lastError()
+	}
+	s.s = nil
+	return nil
+}
+
+type rows struct {
+	s *stmt
+}
+
+func (r *rows) Columns() []string {
+	count := int(C.sqlite3_column_count(r.s.s))
+	res := make([]string, count)
+	for i := 0; i < count; i++ {
+		res[i] = C.GoString(C.sqlite3_column_name(r.s.s, C.int(i)))
+	}
+	return res
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	rc := C.sqlite3_step(r.s.s)
+	if rc == C.SQLITE_DONE {
+		return io.EOF
+	}
+	if rc != C.SQLITE_ROW {
+		return r.s.c.lastError()
+	}
+	for i := range dest {
+		n := C.int(i)
+		switch C.sqlite3_column_type(r.s.s, n) {
+		case C.SQLITE_NULL:
+			dest[i] = nil
+		case C.SQLITE_INTEGER:
+			dest[i] = int64(C.sqlite3_column_int64(r.s.s, n))
+		case C.SQLITE_FLOAT:
+			dest[i] = float64(C.sqlite3_column_double(r.s.s, n))
+		case C.SQLITE_TEXT:
+			dest[i] = C.GoStringN((*C.char)(unsafe.Pointer(C.sqlite3_column_text(r.s.s, n))),
+				C.sqlite3_column_bytes(r.s.s, n))
+		case C.SQLITE_BLOB:
+			dest[i] = C.GoBytes(unsafe.Pointer(C.sqlite3_column_blob(r.s.s, n)),
+				C.sqlite3_column_bytes(r.s.s, n))
+		default:
+			return fmt.Errorf("sqlite3: unsupported column type")
+		}
+	}
+	return nil
+}
+
+// Close resets the statement rather than finalizing it; the statement is
+// owned by stmt and may be queried again.
+func (r *rows) Close() error {
+	C.sqlite3_reset(r.s.s)
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+// +build chatsqlite
+
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) (*sql.DB, string) {
+	dir, err := ioutil.TempDir("", "sqlite3_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+func TestDriverBasic(t *testing.T) {
+	db, path := openTestDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+
+	// Multi-statement schema script, as the chat engine applies it
+	schema := `
+	CREATE TABLE IF NOT EXISTS kv (
+		k TEXT NOT NULL,
+		n INTEGER NOT NULL,
+		v BLOB NOT NULL,
+		PRIMARY KEY (k, n)
+	);
+	CREATE INDEX IF NOT EXISTS kv_n ON kv (n);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := []byte{0x00, 0x01, 0xfe, 0xff}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO kv (k, n, v) VALUES (?, ?, ?)`,
+			"conv", int64(i), blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM kv WHERE k = ?`, "conv").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Fatalf("wrong count: %d", count)
+	}
+
+	rows, err := db.Query(`SELECT n, v FROM kv WHERE k = ? AND n <= ? ORDER BY n DESC`, "conv", int64(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	expected := int64(5)
+	for rows.Next() {
+		var n int64
+		var v []byte
+		if err := rows.Scan(&n, &v); err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("wrong row order: expected %d got %d", expected, n)
+		}
+		if !bytes.Equal(blob, v) {
+			t.Fatalf("blob did not roundtrip: %x", v)
+		}
+		expected--
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if expected != 0 {
+		t.Fatalf("missing rows: stopped at %d", expected)
+	}
+}
+
+func TestDriverRollback(t *testing.T) {
+	db, path := openTestDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE t (n INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO t (n) VALUES (?)`, int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("rollback did not discard the insert: count %d", count)
+	}
+}
+
+func TestDriverPersistence(t *testing.T) {
+	db, path := openTestDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := db.Exec(`CREATE TABLE t (s TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO t (s) VALUES (?)`, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var s string
+	if err := db.QueryRow(`SELECT s FROM t`).Scan(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello" {
+		t.Fatalf("wrong value after reopen: %q", s)
+	}
+}
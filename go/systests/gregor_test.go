@@ -33,6 +33,11 @@ func (e *electronMock) PushState(ctx context.Context, a keybase1.PushStateArg) (
 	return nil
 }
 
+func (e *electronMock) PushStateDelta(ctx context.Context, a keybase1.PushStateDeltaArg) error {
+	e.G().Log.Debug("electronMock::PushStateDelta: %#v\n", a)
+	return nil
+}
+
 func (e *electronMock) PushOutOfBandMessages(_ context.Context, msgs []gregor1.OutOfBandMessage) error {
 	for _, m := range msgs {
 		e.oobmCh <- m